@@ -38,7 +38,8 @@ fn rocket() -> _ {
                 get_sensors,
                 put_location,
                 put_sensor,
-                put_data
+                put_data,
+                put_data_batch
             ],
         )
 }
@@ -165,6 +166,46 @@ async fn put_data(
         .map_err(|_| Status::InternalServerError)
 }
 
+/// Creates several data samples at once, all or nothing. Devices aggregating
+/// their readings send a whole window's worth of them like this, instead of
+/// one request per value.
+#[put("/data_batch", data = "<input>")]
+async fn put_data_batch(
+    mut db: Connection<EnvServerDb>,
+    input: Json<Vec<CreateDataInput>>,
+) -> Result<String, Status> {
+    // Look up all the IDs first: the transaction below holds on to the
+    // connection.
+    let mut rows = Vec::with_capacity(input.len());
+    for sample in input.iter() {
+        let location_id = id_from_location(&mut db, &sample.location)
+            .await
+            .ok_or(Status::BadRequest)?;
+        let sensor_id = id_from_sensor(&mut db, &sample.sensor)
+            .await
+            .ok_or(Status::BadRequest)?;
+        rows.push((sample.unix_timestamp, location_id, sensor_id, sample.value));
+    }
+
+    let mut tx = sqlx::Connection::begin(&mut **db)
+        .await
+        .map_err(|_| Status::InternalServerError)?;
+    for (timestamp, location_id, sensor_id, value) in rows {
+        sqlx::query(INSERT_DATA_SQL)
+            .bind(timestamp)
+            .bind(location_id)
+            .bind(sensor_id)
+            .bind(value)
+            .execute(&mut *tx)
+            .await
+            .map_err(|_| Status::InternalServerError)?;
+    }
+    tx.commit()
+        .await
+        .map(|_| "Ok".to_string())
+        .map_err(|_| Status::InternalServerError)
+}
+
 /// Input data needed to query data.
 #[derive(Deserialize)]
 #[serde(crate = "rocket::serde")]
@@ -264,3 +305,153 @@ async fn id_from_sensor(db: &mut Connection<EnvServerDb>, sensor: &str) -> Optio
 
     return Some(row.0);
 }
+
+//
+// Tests
+//
+
+#[cfg(test)]
+mod tests {
+    use super::rocket;
+    use rocket::http::{ContentType, Status, StatusClass};
+    use rocket::local::blocking::Client;
+    use std::path::PathBuf;
+
+    /// An env-server with a database of its own, which is deleted when done.
+    struct TestServer {
+        client: Client,
+        db_path: PathBuf,
+    }
+
+    impl TestServer {
+        /// Starts an env-server with a fresh database, knowing the "Attic"
+        /// location and the "temperature" and "humidity" sensors. The name
+        /// keeps the databases of tests running in parallel apart.
+        fn new(name: &str) -> TestServer {
+            let db_path = std::env::temp_dir().join(format!(
+                "env-server-test-{}-{}.sqlite",
+                std::process::id(),
+                name
+            ));
+            let _ = std::fs::remove_file(&db_path);
+            let figment = rocket::Config::figment()
+                .merge(("databases.env_server_db.url", db_path.to_str().unwrap()));
+            let client = Client::tracked(rocket().configure(figment)).expect("valid rocket");
+            let server = TestServer { client, db_path };
+
+            assert_eq!(
+                server.put("/location", r#"{"location":"Attic"}"#),
+                Status::Ok
+            );
+            assert_eq!(
+                server.put("/sensor", r#"{"sensor":"temperature"}"#),
+                Status::Ok
+            );
+            assert_eq!(
+                server.put("/sensor", r#"{"sensor":"humidity"}"#),
+                Status::Ok
+            );
+            server
+        }
+
+        /// PUTs the JSON body to path, under the API, returning the status.
+        fn put(&self, path: &str, body: &str) -> Status {
+            self.client
+                .put(format!("/api/v0{}", path))
+                .header(ContentType::JSON)
+                .body(body)
+                .dispatch()
+                .status()
+        }
+
+        /// Returns the JSON with the Attic data for sensor, in the hour
+        /// from 1700000000.
+        fn data(&self, sensor: &str) -> String {
+            let body = format!(
+                r#"{{"unix_timestamp_from":1700000000,"unix_timestamp_to":1700003600,"location":"Attic","sensor":"{}"}}"#,
+                sensor
+            );
+            let response = self
+                .client
+                .post("/api/v0/get_data")
+                .header(ContentType::JSON)
+                .body(body)
+                .dispatch();
+            assert_eq!(response.status(), Status::Ok);
+            response.into_string().unwrap()
+        }
+    }
+
+    impl Drop for TestServer {
+        fn drop(&mut self) {
+            let _ = std::fs::remove_file(&self.db_path);
+        }
+    }
+
+    #[test]
+    fn put_data_batch_stores_all_samples() {
+        let server = TestServer::new("stores-all");
+        let batch = r#"[
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"temperature","value":20.5},
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"humidity","value":50},
+            {"unix_timestamp":1700000300,"location":"Attic","sensor":"temperature","value":21.25}
+        ]"#;
+        assert_eq!(server.put("/data_batch", batch), Status::Ok);
+
+        assert_eq!(
+            server.data("temperature"),
+            r#"[{"ts":"2023-11-14T22:13:20Z","value":20.5},{"ts":"2023-11-14T22:18:20Z","value":21.25}]"#
+        );
+        assert_eq!(
+            server.data("humidity"),
+            r#"[{"ts":"2023-11-14T22:13:20Z","value":50.0}]"#
+        );
+    }
+
+    #[test]
+    fn put_data_batch_is_all_or_nothing() {
+        let server = TestServer::new("all-or-nothing");
+        let batch = r#"[
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"temperature","value":20.5},
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"pressure","value":1013},
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"humidity","value":50}
+        ]"#;
+        assert_eq!(server.put("/data_batch", batch), Status::BadRequest);
+
+        let batch = r#"[
+            {"unix_timestamp":1700000000,"location":"Attic","sensor":"temperature","value":20.5},
+            {"unix_timestamp":1700000000,"location":"Cellar","sensor":"temperature","value":12}
+        ]"#;
+        assert_eq!(server.put("/data_batch", batch), Status::BadRequest);
+
+        assert_eq!(server.data("temperature"), "[]");
+        assert_eq!(server.data("humidity"), "[]");
+    }
+
+    #[test]
+    fn put_data_batch_takes_empty_batches() {
+        let server = TestServer::new("empty");
+        assert_eq!(server.put("/data_batch", "[]"), Status::Ok);
+        assert_eq!(server.data("temperature"), "[]");
+    }
+
+    #[test]
+    fn put_data_batch_rejects_malformed_input() {
+        let server = TestServer::new("malformed");
+        for body in [
+            "",
+            "[",
+            r#"{"unix_timestamp":1700000000,"location":"Attic","sensor":"temperature","value":20.5}"#,
+            r#"[{"unix_timestamp":1700000000,"location":"Attic","sensor":"temperature"}]"#,
+            r#"[{"unix_timestamp":"now","location":"Attic","sensor":"temperature","value":20.5}]"#,
+        ] {
+            assert_eq!(
+                server.put("/data_batch", body).class(),
+                StatusClass::ClientError,
+                "{}",
+                body
+            );
+        }
+        assert_eq!(server.data("temperature"), "[]");
+    }
+}
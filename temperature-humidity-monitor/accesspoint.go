@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/eth/dhcp"
+	"github.com/soypat/seqs/stacks"
+)
+
+//
+// Access point mode. Instead of joining an existing WiFi network, the Pico W
+// creates its own, and hands out addresses to whoever connects to it. This is
+// what we use for provisioning: a fresh device doesn't know any network to
+// join, so we need some way to talk to it before it does.
+//
+
+// AccessPointConfig is the configuration of the WiFi network created by a
+// PicoNet in access point mode.
+type AccessPointConfig struct {
+	// SSID is the name of the network.
+	SSID string
+
+	// Password is the WPA2 password of the network, between 8 and 63
+	// characters long. If empty, the network is open.
+	Password string
+
+	// Channel is the WiFi channel to use. Defaults to channel 1.
+	Channel uint8
+}
+
+const (
+	// defaultAPChannel is the default for AccessPointConfig.Channel.
+	defaultAPChannel = 1
+)
+
+// apAddr is our own address (and subnet) in access point mode.
+//
+// The DHCP server we have is quite rudimentary: it gives everyone the address
+// 192.168.1.2 (unless the client asks for something else), and doesn't even
+// tell clients the subnet mask. So we don't really get a choice here: we must
+// be on the same subnet, and clients will assume it is a /24, as usual for
+// 192.168.x.x addresses. This also means that only one client at a time can
+// reliably connect to us, but that's all we need for provisioning.
+var apAddr = netip.MustParsePrefix("192.168.1.1/24")
+
+// startAP creates our own WiFi network. This replaces connectToWifi in access
+// point mode.
+func (pn *PicoNet) startAP() error {
+	cfg := pn.config.AccessPoint
+	if cfg.Password != "" && (len(cfg.Password) < 8 || len(cfg.Password) > 63) {
+		return fmt.Errorf("invalid access point password: must have between 8 and 63 characters, got %d", len(cfg.Password))
+	}
+
+	pn.mutex.Lock()
+	pn.ssid = ""
+	pn.mutex.Unlock()
+
+	startTime := time.Now()
+	pn.logger.Info("Starting access point",
+		slog.String("ssid", cfg.SSID),
+		slog.Bool("open", cfg.Password == ""),
+		slog.Int("channel", int(cfg.Channel)),
+	)
+	err := pn.device.StartAP(cfg.SSID, cfg.Password, cfg.Channel)
+	if err != nil {
+		return fmt.Errorf("starting access point %q: %w", cfg.SSID, err)
+	}
+
+	pn.mutex.Lock()
+	pn.ssid = cfg.SSID
+	pn.mutex.Unlock()
+
+	pn.logger.Info("Successfully started access point", slog.String("ssid", cfg.SSID), slogTook(startTime))
+	return nil
+}
+
+// startDHCPServer starts handing out addresses to the clients connecting to our
+// access point.
+func (pn *PicoNet) startDHCPServer() error {
+	if pn.dhcpServer != nil {
+		return nil
+	}
+
+	startTime := time.Now()
+	pn.logger.Info("Starting DHCP server")
+	server := stacks.NewDHCPServer(pn.stack, apAddr.Addr(), dhcp.DefaultServerPort)
+	err := server.Start()
+	if err != nil {
+		return fmt.Errorf("starting DHCP server: %w", err)
+	}
+	pn.dhcpServer = server
+
+	pn.logger.Info("Successfully started DHCP server", slogTook(startTime))
+	return nil
+}
+
+// apClientAddr is the address our DHCP server gives to clients.
+var apClientAddr = netip.AddrFrom4([4]byte{192, 168, 1, 2})
+
+// fixDHCPRequest returns frame, if it is a broadcast to a DHCP server, fixed so
+// that the server in the stack can handle it; anything else is returned as is.
+// Two things need fixing:
+//
+//   - Clients without an address can only broadcast, but the stack drops
+//     anything not sent to its own address, which it has before the DHCP
+//     server starts. So the request is readdressed to addr.
+//   - The server panics on a DISCOVER not asking for a specific address. So we
+//     make it ask for apClientAddr, which is what the server would give anyway.
+//
+// The lengths and checksums are fixed to match.
+func fixDHCPRequest(frame []byte, addr netip.Addr) []byte {
+	if len(frame) < udpHeadersSize || binary.BigEndian.Uint16(frame[12:]) != uint16(eth.EtherTypeIPv4) {
+		return frame
+	}
+	ipHeader, ipHeaderLen := eth.DecodeIPv4Header(frame[eth.SizeEthernetHeader:])
+	if ipHeader.Protocol != 17 || ipHeaderLen != eth.SizeIPv4Header || ipHeader.Destination != [4]byte{255, 255, 255, 255} {
+		return frame
+	}
+	const udpOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header
+	const dhcpOffset = udpOffset + eth.SizeUDPHeader
+	udpHeader := eth.DecodeUDPHeader(frame[udpOffset:])
+	end := udpOffset + int(udpHeader.Length)
+	if udpHeader.DestinationPort != dhcp.DefaultServerPort || end < dhcpOffset+dhcp.OptionsOffset || end > len(frame) {
+		return frame
+	}
+
+	// Look for the message type and requested address, and for where the
+	// options end.
+	var msgType dhcp.MessageType
+	requested := false
+	optionsEnd := -1
+	options := frame[dhcpOffset+dhcp.OptionsOffset : end]
+	for i := 0; i < len(options); {
+		switch dhcp.OptNum(options[i]) {
+		case 0:
+			i++
+			continue
+		case 0xff:
+			optionsEnd = i
+		case dhcp.OptMessageType:
+			if i+2 < len(options) && options[i+1] == 1 {
+				msgType = dhcp.MessageType(options[i+2])
+			}
+		case dhcp.OptRequestedIPaddress:
+			requested = true
+		}
+		if optionsEnd >= 0 || i+1 >= len(options) {
+			break
+		}
+		i += 2 + int(options[i+1])
+	}
+
+	if msgType == dhcp.MsgDiscover && !requested && optionsEnd >= 0 {
+		// There's no telling if there's room after the frame, so this goes
+		// into a new one. Discovers are rare enough for that not to matter.
+		cut := dhcpOffset + dhcp.OptionsOffset + optionsEnd
+		option := []byte{byte(dhcp.OptRequestedIPaddress), 4}
+		option = append(option, apClientAddr.AsSlice()...)
+		fixed := make([]byte, 0, end+len(option))
+		fixed = append(fixed, frame[:cut]...)
+		fixed = append(fixed, option...)
+		fixed = append(fixed, frame[cut:end]...)
+		frame = fixed
+		end += len(option)
+		udpHeader.Length += uint16(len(option))
+		ipHeader.TotalLength = uint16(end - eth.SizeEthernetHeader)
+	}
+
+	ipHeader.Destination = addr.As4()
+	ipHeader.Checksum = ipHeader.CalculateChecksum()
+	ipHeader.Put(frame[eth.SizeEthernetHeader:])
+	if udpHeader.Checksum != 0 {
+		udpHeader.Checksum = udpHeader.CalculateChecksumIPv4(&ipHeader, frame[dhcpOffset:end])
+	}
+	udpHeader.Put(frame[udpOffset:])
+	return frame
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"github.com/soypat/seqs/eth/dhcp"
+	"github.com/soypat/seqs/stacks"
+)
+
+// A client going through DISCOVER, OFFER, REQUEST and ACK with our DHCP
+// server, with the frames passed by hand between the two stacks. Our address
+// is set before the server starts, as in configureStaticIP.
+func TestStartDHCPServer(t *testing.T) {
+	pn := &PicoNet{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config: PicoNetConfig{AccessPoint: &AccessPointConfig{SSID: provisioningSSID}},
+	}
+	pn.stack = stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             [6]byte{0x28, 0xcd, 0xc1, 0, 0, 1},
+		MaxOpenPortsUDP: 1,
+		MTU:             1500,
+	})
+	pn.stack.SetAddr(apAddr.Addr())
+	if err := pn.startDHCPServer(); err != nil {
+		t.Fatal(err)
+	}
+	server := pn.dhcpServer
+	if err := pn.startDHCPServer(); err != nil || pn.dhcpServer != server {
+		t.Fatalf("starting again: %v, same server: %v", err, pn.dhcpServer == server)
+	}
+
+	phone := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             [6]byte{0x02, 0, 0, 0, 0, 2},
+		MaxOpenPortsUDP: 1,
+		MTU:             1500,
+	})
+	client := stacks.NewDHCPClient(phone, dhcp.DefaultClientPort)
+	if err := client.BeginRequest(stacks.DHCPRequestConfig{Xid: 0x1234}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	for i := 0; i < 10 && client.State() != dhcp.StateBound; i++ {
+		if n, _ := phone.HandleEth(buf); n > 0 {
+			pn.recvEth(buf[:n])
+		}
+		if n, _ := pn.stack.HandleEth(buf); n > 0 {
+			phone.RecvEth(buf[:n])
+		}
+	}
+	if client.State() != dhcp.StateBound {
+		t.Fatalf("client stuck in state %v", client.State())
+	}
+	if got, want := client.Offer(), netip.MustParseAddr("192.168.1.2"); got != want {
+		t.Errorf("offered %v, want %v", got, want)
+	}
+	if got := client.DHCPServer(); got != apAddr.Addr() {
+		t.Errorf("server %v, want %v", got, apAddr.Addr())
+	}
+	if !apAddr.Contains(client.Offer()) {
+		t.Errorf("offered %v, outside of our subnet %v", client.Offer(), apAddr)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// The HTTP API. Lets scripts on the local network poll the device directly,
+// which comes in handy when the env-server is down (or when we just want to
+// know what's going on with a specific device). Everything is read-only, and
+// served as JSON -- except for the metrics, which are served in the format
+// Prometheus likes, and /api/senml, which serves the latest reading as SenML,
+// in JSON or, if the request accepts it, CBOR.
+//
+
+const (
+	// apiPort is the TCP port on which the API is served.
+	apiPort = 80
+
+	// defaultHistoryLimit is the number of history samples returned when the
+	// request doesn't say how many it wants. The whole history makes for a
+	// rather large response, which we have to build in memory.
+	defaultHistoryLimit = 60
+)
+
+// apiServer serves the HTTP API.
+type apiServer struct {
+	// pn is the network, which we report the status of.
+	pn *PicoNet
+
+	// readings are the sensor readings we serve.
+	readings *sensorReadings
+
+	// telemetry is the reading pipeline, which we report the sinks of.
+	telemetry *telemetry
+
+	// bootTime is when the device booted, according to the local clock.
+	bootTime time.Time
+}
+
+// runAPIServer serves the HTTP API on pn, once it is ready. Meant to run in its
+// own goroutine; returns only if something goes wrong.
+func runAPIServer(logger *slog.Logger, pn *PicoNet, readings *sensorReadings, telemetry *telemetry, bootTime time.Time) {
+	for pn.Status() != StatusReadyToGo {
+		time.Sleep(time.Second)
+	}
+
+	// The listener survives the network going down and coming back, so we
+	// only need to do this once.
+	l, err := pn.Listen(apiPort)
+	if err != nil {
+		logger.Error("Listening for API requests", slogError(err))
+		return
+	}
+
+	api := &apiServer{pn: pn, readings: readings, telemetry: telemetry, bootTime: bootTime}
+	err = serveHTTP(l, logger, api.handle)
+	logger.Error("API server stopped", slogError(err))
+}
+
+// handle handles a request to the API.
+func (a *apiServer) handle(req *httpwire.Request) *serverResponse {
+	var handler func(req *httpwire.Request, now time.Time) []byte
+	contentType := "application/json"
+	switch req.URL.Path {
+	case "/api/readings":
+		handler = a.readingsJSON
+	case "/api/status":
+		handler = a.statusJSON
+	case "/api/history":
+		handler = a.historyJSON
+	case "/api/senml":
+		handler = a.readingsSenMLJSON
+		contentType = senmlJSONContentType
+		if strings.Contains(req.Header.Get("Accept"), senmlCBORContentType) {
+			handler = a.readingsSenMLCBOR
+			contentType = senmlCBORContentType
+		}
+	case "/metrics":
+		handler = a.metrics
+		contentType = metricsContentType
+	default:
+		return textResponse(404, "Not found")
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		res := textResponse(405, "Method not allowed")
+		res.Header.Set("Allow", "GET, HEAD")
+		return res
+	}
+
+	res := &serverResponse{
+		StatusCode: 200,
+		Header:     httpwire.Header{},
+		Body:       handler(req, time.Now()),
+	}
+	res.Header.Set("Content-Type", contentType)
+	res.Header.Set("Cache-Control", "no-store")
+	return res
+}
+
+// readingsJSON returns the latest reading, what we derive from it, and how
+// much it can be trusted.
+func (a *apiServer) readingsJSON(req *httpwire.Request, now time.Time) []byte {
+	r := a.readings.Latest(now)
+	clock := a.newWallClock(now)
+
+	var w jsonWriter
+	w.beginObject()
+	if r.Flags&FlagNoReading != 0 {
+		for _, k := range []string{"time", "age_s", "temperature_c", "humidity_pct", "dew_point_c", "absolute_humidity_g_m3"} {
+			w.key(k)
+			w.null()
+		}
+	} else {
+		a.writeReading(&w, r, now, clock)
+		w.key("dew_point_c")
+		w.float(r.DewPoint(), 2)
+		w.key("absolute_humidity_g_m3")
+		w.float(r.AbsoluteHumidity(), 2)
+	}
+	w.key("flags")
+	w.beginArray()
+	for _, name := range r.Flags.Names() {
+		w.string(name)
+	}
+	w.endArray()
+	w.key("sensor_errors")
+	w.int(int64(a.readings.Errors()))
+	w.endObject()
+	return w.Bytes()
+}
+
+// readingsSenMLJSON and readingsSenMLCBOR return the latest reading, in SenML.
+// A failing sensor makes for an empty pack.
+func (a *apiServer) readingsSenMLJSON(req *httpwire.Request, now time.Time) []byte {
+	return appendSenMLJSON(nil, a.senmlReadings(now).Records)
+}
+
+func (a *apiServer) readingsSenMLCBOR(req *httpwire.Request, now time.Time) []byte {
+	return appendSenMLCBOR(nil, a.senmlReadings(now).Records)
+}
+
+// senmlReadings returns a SenML pack with the latest reading.
+func (a *apiServer) senmlReadings(now time.Time) *senmlPack {
+	p := newSenMLPack(deviceID(a.pn.HardwareAddr()))
+	p.add(a.readings.Latest(now), a.newWallClock(now), now)
+	return p
+}
+
+// statusJSON returns the status of the device and its network connection.
+func (a *apiServer) statusJSON(req *httpwire.Request, now time.Time) []byte {
+	stats := a.pn.InitStats()
+	clock := a.newWallClock(now)
+
+	var w jsonWriter
+	w.beginObject()
+	w.key("status")
+	w.string(a.pn.Status().String())
+	w.key("ssid")
+	w.string(a.pn.SSID())
+	w.key("ip")
+	if addr := a.pn.Addr(); addr.IsValid() {
+		w.string(addr.String())
+	} else {
+		w.null()
+	}
+	w.key("addr_mode")
+	w.string(a.pn.AddrMode().String())
+	w.key("firmware")
+	w.string(firmwareVersion)
+	w.key("uptime_s")
+	w.int(int64(now.Sub(a.bootTime) / time.Second))
+	w.key("time")
+	if clock.synced {
+		w.time(clock.wall)
+	} else {
+		w.null()
+	}
+
+	w.key("errors")
+	w.beginObject()
+	w.key("sensor")
+	w.int(int64(a.readings.Errors()))
+	w.key("link_losses")
+	w.int(int64(stats.LinkLosses))
+	w.key("init_rewinds")
+	w.int(int64(stats.Rewinds))
+	w.key("init_resets")
+	w.int(int64(stats.Resets))
+	w.key("init_failures")
+	w.beginObject()
+	for s := StatusCreatingDevice; s < StatusReadyToGo; s++ {
+		if failures := stats.Stages[s].Failures; failures > 0 {
+			w.key(s.String())
+			w.int(int64(failures))
+		}
+	}
+	w.endObject()
+	w.endObject()
+
+	w.key("sinks")
+	w.beginArray()
+	for _, h := range a.telemetry.Health() {
+		w.beginObject()
+		w.key("name")
+		w.string(h.Name)
+		w.key("healthy")
+		w.bool(h.Healthy())
+		w.key("queued")
+		w.int(int64(h.Queued))
+		w.key("delivered")
+		w.int(int64(h.Delivered))
+		w.key("dropped")
+		w.int(int64(h.Dropped))
+		w.key("failures")
+		w.int(int64(h.Failures))
+		w.key("last_error")
+		if h.LastError != nil {
+			w.string(h.LastError.Error())
+		} else {
+			w.null()
+		}
+		w.key("last_delivery_age_s")
+		if !h.LastDelivery.IsZero() {
+			w.int(int64(now.Sub(h.LastDelivery) / time.Second))
+		} else {
+			w.null()
+		}
+		w.endObject()
+	}
+	w.endArray()
+
+	w.endObject()
+	return w.Bytes()
+}
+
+// historyJSON returns the most recent readings from the history, oldest first.
+// The "limit" query parameter tells how many.
+func (a *apiServer) historyJSON(req *httpwire.Request, now time.Time) []byte {
+	limit := defaultHistoryLimit
+	if n, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, historySize)
+	}
+	history := a.readings.History()
+	history = history[max(0, len(history)-limit):]
+	clock := a.newWallClock(now)
+
+	var w jsonWriter
+	w.beginObject()
+	w.key("interval_s")
+	w.int(int64(historyInterval / time.Second))
+	w.key("samples")
+	w.beginArray()
+	for _, r := range history {
+		w.beginObject()
+		a.writeReading(&w, r, now, clock)
+		w.endObject()
+	}
+	w.endArray()
+	w.endObject()
+	return w.Bytes()
+}
+
+// writeReading writes the members of an object describing r.
+func (a *apiServer) writeReading(w *jsonWriter, r Reading, now time.Time, clock wallClock) {
+	w.key("time")
+	if clock.synced {
+		w.time(clock.at(r.Time))
+	} else {
+		w.null()
+	}
+	w.key("age_s")
+	w.float(now.Sub(r.Time).Seconds(), 1)
+	w.key("temperature_c")
+	w.float(float64(r.Temperature), -1)
+	w.key("humidity_pct")
+	w.float(float64(r.Humidity), -1)
+}
+
+// metrics returns the metrics, in the Prometheus text format.
+func (a *apiServer) metrics(req *httpwire.Request, now time.Time) []byte {
+	r := a.readings.Latest(now)
+	m := metricsSnapshot{
+		Reading:         r,
+		ReadingAge:      now.Sub(r.Time),
+		SensorErrors:    a.readings.Errors(),
+		DisplayFailures: int(counters.displayFailures.Load()),
+		UploadSuccesses: int(counters.uploadSuccesses.Load()),
+		UploadFailures:  int(counters.uploadFailures.Load()),
+		DroppedPackets:  a.pn.DroppedPackets(),
+		Uptime:          now.Sub(a.bootTime),
+		MAC:             a.pn.HardwareAddr(),
+	}
+	return appendMetrics(make([]byte, 0, 2048), &m)
+}
+
+// wallClock converts local clock readings to actual times, which we know only
+// after synchronizing the clock.
+type wallClock struct {
+	// local and wall are the same instant, according to the local clock and
+	// to the synchronized one.
+	local time.Time
+	wall  time.Time
+
+	// synced tells if the clock was ever synchronized. If not, conversions
+	// are meaningless.
+	synced bool
+}
+
+// newWallClock returns a wallClock for converting local clock readings, with
+// now being the current local time.
+func (a *apiServer) newWallClock(now time.Time) wallClock {
+	wall, synced := a.pn.nowAt(now)
+	return wallClock{local: now, wall: wall, synced: synced}
+}
+
+// at returns the actual time corresponding to the local clock reading t.
+func (c wallClock) at(t time.Time) time.Time {
+	return c.wall.Add(t.Sub(c.local))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+// apiBoot is when the device of newTestAPIServer booted, according to its
+// local clock, and apiNow when the requests come, 3 hours later.
+var (
+	apiBoot = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	apiNow  = apiBoot.Add(3*time.Hour + 4*time.Second)
+)
+
+// staticSink is a telemetry sink that does nothing, but tells how it's doing.
+type staticSink sinkHealth
+
+func (s staticSink) offer(r telemetryReading) {}
+func (s staticSink) run()                     {}
+func (s staticSink) health() sinkHealth       { return sinkHealth(s) }
+
+// newTestAPIServer returns an API server with a few readings, whose clock was
+// synchronized an hour after booting, and found to be at 10:00 then.
+func newTestAPIServer() *apiServer {
+	pn := &PicoNet{
+		status:        StatusReadyToGo,
+		ssid:          "home",
+		addr:          netip.MustParseAddr("192.168.1.42"),
+		picoMAC:       [6]byte{0x28, 0xcd, 0xc1, 0xa1, 0xb2, 0xc3},
+		clockBase:     time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC),
+		clockSyncedAt: apiBoot.Add(time.Hour),
+		initStats: InitStats{
+			Stages: map[PicoNetStatus]StageStats{
+				StatusConnectingToWiFi: {Attempts: 3, Failures: 2},
+				StatusObtainingIP:      {Attempts: 2, Failures: 1},
+				StatusConfiguringDNS:   {Attempts: 1},
+			},
+			Rewinds:    1,
+			LinkLosses: 4,
+		},
+	}
+
+	readings := &sensorReadings{}
+	readings.record(apiNow.Add(-3*time.Minute), 20.5, 48, nil)
+	readings.record(apiNow.Add(-2*time.Minute-500*time.Millisecond), 20.8, 47.2, nil)
+	readings.record(apiNow.Add(-90*time.Second), 0, 0, errors.New("checksum"))
+	readings.record(apiNow.Add(-time.Minute), 21.1, 46, nil)
+	readings.record(apiNow.Add(-2500*time.Millisecond), 21.3, 45.1, nil)
+
+	telemetry := &telemetry{sinks: []telemetrySink{
+		staticSink{Name: "env-server", Delivered: 42, LastDelivery: apiNow.Add(-7 * time.Second)},
+		staticSink{Name: "mqtt", Queued: 3, Dropped: 1, Failures: 2, LastError: errors.New(`broker said "no"`)},
+	}}
+	return &apiServer{pn: pn, readings: readings, telemetry: telemetry, bootTime: apiBoot}
+}
+
+// apiGet returns the body a handler serves for a GET of target at apiNow.
+func apiGet(t *testing.T, handler func(req *httpwire.Request, now time.Time) []byte, target string) string {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(handler(&httpwire.Request{Method: "GET", URL: u, Header: httpwire.Header{}}, apiNow))
+}
+
+// compactJSON strips the indentation from the golden JSON bodies below.
+func compactJSON(s string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString(strings.TrimLeft(line, "\t"))
+	}
+	return b.String()
+}
+
+func TestAPIReadings(t *testing.T) {
+	a := newTestAPIServer()
+	want := compactJSON(`{
+		"time":"2026-01-02T12:00:01.500Z",
+		"age_s":2.5,
+		"temperature_c":21.3,
+		"humidity_pct":45.1,
+		"dew_point_c":8.91,
+		"absolute_humidity_g_m3":8.41,
+		"flags":[],
+		"sensor_errors":1
+	}`)
+	if got := apiGet(t, a.readingsJSON, "/api/readings"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Without a synchronized clock, there's only the age to go by.
+	a.pn.clockSyncedAt = time.Time{}
+	want = strings.Replace(want, `"2026-01-02T12:00:01.500Z"`, "null", 1)
+	if got := apiGet(t, a.readingsJSON, "/api/readings"); got != want {
+		t.Errorf("not synced, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A failing sensor is in the flags.
+	a.readings.record(apiNow, 0, 0, errors.New("timeout"))
+	want = strings.Replace(want, `"flags":[],"sensor_errors":1`, `"flags":["sensor_error"],"sensor_errors":2`, 1)
+	if got := apiGet(t, a.readingsJSON, "/api/readings"); got != want {
+		t.Errorf("sensor error, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Before the first reading, the same members are there, empty.
+	a.readings = &sensorReadings{}
+	want = compactJSON(`{
+		"time":null,
+		"age_s":null,
+		"temperature_c":null,
+		"humidity_pct":null,
+		"dew_point_c":null,
+		"absolute_humidity_g_m3":null,
+		"flags":["no_reading"],
+		"sensor_errors":0
+	}`)
+	if got := apiGet(t, a.readingsJSON, "/api/readings"); got != want {
+		t.Errorf("no reading, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAPIStatus(t *testing.T) {
+	a := newTestAPIServer()
+	want := compactJSON(`{
+		"status":"ReadyToGo",
+		"ssid":"home",
+		"ip":"192.168.1.42",
+		"addr_mode":"DHCP",
+		"firmware":"` + firmwareVersion + `",
+		"uptime_s":10804,
+		"time":"2026-01-02T12:00:04.000Z",
+		"errors":{
+			"sensor":1,
+			"link_losses":4,
+			"init_rewinds":1,
+			"init_resets":0,
+			"init_failures":{"ConnectingToWiFi":2,"ObtainingIP":1}
+		},
+		"sinks":[
+			{
+				"name":"env-server",
+				"healthy":true,
+				"queued":0,
+				"delivered":42,
+				"dropped":0,
+				"failures":0,
+				"last_error":null,
+				"last_delivery_age_s":7
+			},
+			{
+				"name":"mqtt",
+				"healthy":false,
+				"queued":3,
+				"delivered":0,
+				"dropped":1,
+				"failures":2,
+				"last_error":"broker said \"no\"",
+				"last_delivery_age_s":null
+			}
+		]
+	}`)
+	if got := apiGet(t, a.statusJSON, "/api/status"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// While the network is being set up again, there's no address, and no
+	// sinks until they are set up.
+	a.pn.status = StatusConnectingToWiFi
+	a.pn.clockSyncedAt = time.Time{}
+	a.pn.initStats = InitStats{}
+	a.telemetry = &telemetry{}
+	want = compactJSON(`{
+		"status":"ConnectingToWiFi",
+		"ssid":"home",
+		"ip":null,
+		"addr_mode":"DHCP",
+		"firmware":"` + firmwareVersion + `",
+		"uptime_s":10804,
+		"time":null,
+		"errors":{
+			"sensor":1,
+			"link_losses":0,
+			"init_rewinds":0,
+			"init_resets":0,
+			"init_failures":{}
+		},
+		"sinks":[]
+	}`)
+	if got := apiGet(t, a.statusJSON, "/api/status"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	a := newTestAPIServer()
+
+	// The readings coming less than a minute after the previous sample
+	// didn't make it into the history.
+	samples := []string{
+		`{"time":"2026-01-02T11:57:04.000Z","age_s":180.0,"temperature_c":20.5,"humidity_pct":48}`,
+		`{"time":"2026-01-02T11:59:04.000Z","age_s":60.0,"temperature_c":21.1,"humidity_pct":46}`,
+	}
+	tests := []struct {
+		target  string
+		samples []string
+	}{
+		{"/api/history", samples},
+		{"/api/history?limit=1", samples[1:]},
+		{"/api/history?limit=2", samples},
+		{"/api/history?limit=1000", samples},
+		{"/api/history?limit=0", samples},
+		{"/api/history?limit=-1", samples},
+		{"/api/history?limit=many", samples},
+	}
+	for _, tt := range tests {
+		want := `{"interval_s":60,"samples":[` + strings.Join(tt.samples, ",") + `]}`
+		if got := apiGet(t, a.historyJSON, tt.target); got != want {
+			t.Errorf("%s, got:\n%s\nwant:\n%s", tt.target, got, want)
+		}
+	}
+
+	a.readings = &sensorReadings{}
+	if got, want := apiGet(t, a.historyJSON, "/api/history"), `{"interval_s":60,"samples":[]}`; got != want {
+		t.Errorf("empty, got %s, want %s", got, want)
+	}
+}
+
+func TestAPISenML(t *testing.T) {
+	a := newTestAPIServer()
+	want := `[{"bn":"smh-a1b2c3:","bt":1.7673552015e+09,"n":"temperature","u":"Cel","v":21.3},` +
+		`{"n":"humidity","u":"%RH","v":45.1}]`
+	if got := apiGet(t, a.readingsSenMLJSON, "/api/senml"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	a.pn.clockSyncedAt = time.Time{}
+	want = `[{"bn":"smh-a1b2c3:","n":"temperature","u":"Cel","t":-2.5,"v":21.3},` +
+		`{"n":"humidity","u":"%RH","t":-2.5,"v":45.1}]`
+	if got := apiGet(t, a.readingsSenMLJSON, "/api/senml"); got != want {
+		t.Errorf("not synced, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The same in CBOR.
+	wantCBOR := string(appendSenMLCBOR(nil, []senmlRecord{
+		{BaseName: "smh-a1b2c3:", Name: "temperature", Unit: "Cel", Time: -2.5, Value: float64(float32(21.3))},
+		{Name: "humidity", Unit: "%RH", Time: -2.5, Value: float64(float32(45.1))},
+	}))
+	if got := apiGet(t, a.readingsSenMLCBOR, "/api/senml"); got != wantCBOR {
+		t.Errorf("CBOR, got %x, want %x", got, wantCBOR)
+	}
+
+	// No reading, no records.
+	a.readings = &sensorReadings{}
+	if got := apiGet(t, a.readingsSenMLJSON, "/api/senml"); got != "[]" {
+		t.Errorf("no reading, got %s", got)
+	}
+}
+
+func TestAPIHandle(t *testing.T) {
+	a := newTestAPIServer()
+	tests := []struct {
+		method, target, accept string
+		status                 int
+		contentType            string
+	}{
+		{"GET", "/api/readings", "", 200, "application/json"},
+		{"HEAD", "/api/readings", "", 200, "application/json"},
+		{"GET", "/api/status", "", 200, "application/json"},
+		{"GET", "/api/history?limit=5", "", 200, "application/json"},
+		{"GET", "/api/senml", "", 200, senmlJSONContentType},
+		{"GET", "/api/senml", "application/senml+json", 200, senmlJSONContentType},
+		{"GET", "/api/senml", "application/json;q=0.5, application/senml+cbor", 200, senmlCBORContentType},
+		{"GET", "/metrics", "", 200, metricsContentType},
+		{"POST", "/api/readings", "", 405, "text/plain; charset=utf-8"},
+		{"GET", "/api/readings/", "", 404, "text/plain; charset=utf-8"},
+		{"GET", "/", "", 404, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &httpwire.Request{Method: tt.method, URL: u, Header: httpwire.Header{}}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		res := a.handle(req)
+		if res.StatusCode != tt.status || res.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s %s: got %d, %q, want %d, %q", tt.method, tt.target, res.StatusCode, res.Header.Get("Content-Type"), tt.status, tt.contentType)
+		}
+		if tt.status == 200 && (len(res.Body) == 0 || res.Header.Get("Cache-Control") != "no-store") {
+			t.Errorf("%s %s: %d bytes, Cache-Control %q", tt.method, tt.target, len(res.Body), res.Header.Get("Cache-Control"))
+		}
+		if tt.status == 405 && res.Header.Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s %s: Allow %q", tt.method, tt.target, res.Header.Get("Allow"))
+		}
+	}
+}
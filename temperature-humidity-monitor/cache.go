@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// expiringCache is a tiny key-value cache whose entries expire after a while.
+// We use it for things like ARP and DNS results, of which we only ever have a
+// handful, so a slice with linear search is the way to go.
+type expiringCache[K comparable, V any] struct {
+	// mutex protects entries.
+	mutex sync.Mutex
+
+	// maxSize is the maximum number of entries.
+	maxSize int
+
+	// entries are the cached values, in no particular order.
+	entries []expiringEntry[K, V]
+}
+
+// expiringEntry is an entry in an expiringCache.
+type expiringEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// newExpiringCache creates a new expiringCache holding up to maxSize entries.
+func newExpiringCache[K comparable, V any](maxSize int) *expiringCache[K, V] {
+	return &expiringCache[K, V]{maxSize: maxSize}
+}
+
+// lookup returns the cached value for key, if there's a non-expired one.
+func (c *expiringCache[K, V]) lookup(key K, now time.Time) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range c.entries {
+		if e.key == key && now.Before(e.expires) {
+			return e.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// store adds or updates the entry for key. If the cache is full, the entry
+// closest to expiring makes room for the new one.
+func (c *expiringCache[K, V]) store(key K, value V, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := expiringEntry[K, V]{key: key, value: value, expires: expires}
+
+	victim := -1
+	for i, e := range c.entries {
+		if e.key == key {
+			c.entries[i] = entry
+			return
+		}
+		if victim < 0 || e.expires.Before(c.entries[victim].expires) {
+			victim = i
+		}
+	}
+	if len(c.entries) < c.maxSize {
+		c.entries = append(c.entries, entry)
+		return
+	}
+	if victim >= 0 {
+		c.entries[victim] = entry
+	}
+}
+
+// forget removes the entry for key, if any.
+func (c *expiringCache[K, V]) forget(key K) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, e := range c.entries {
+		if e.key == key {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// clear removes all entries.
+func (c *expiringCache[K, V]) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = c.entries[:0]
+}
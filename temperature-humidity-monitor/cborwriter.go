@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// cborWriter builds a CBOR (RFC 8949) document, one item at a time. CBOR says
+// the same things as JSON in fewer bytes, which matters when sending things
+// over UDP.
+//
+// Maps and arrays have definite lengths, so the caller must know up front how
+// many items go in them. Like with jsonWriter, nothing checks if the document
+// makes sense.
+type cborWriter struct {
+	buf []byte
+}
+
+// CBOR major types, already shifted to the upper three bits of the initial
+// byte.
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborSimple = 7 << 5
+)
+
+// Bytes returns the document written so far.
+func (w *cborWriter) Bytes() []byte {
+	return w.buf
+}
+
+// beginMap starts a map with n key/value pairs. Write the keys and values
+// alternating.
+func (w *cborWriter) beginMap(n int) {
+	w.head(cborMap, uint64(n))
+}
+
+// beginArray starts an array with n items.
+func (w *cborWriter) beginArray(n int) {
+	w.head(cborArray, uint64(n))
+}
+
+// string writes a text string.
+func (w *cborWriter) string(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// int writes an integer.
+func (w *cborWriter) int(n int64) {
+	if n < 0 {
+		w.head(cborNegInt, uint64(-1-n))
+		return
+	}
+	w.head(cborUint, uint64(n))
+}
+
+// float32 writes a single precision float. That's all the precision our
+// sensor has, and it takes half the space of a double.
+func (w *cborWriter) float32(f float32) {
+	w.buf = append(w.buf, cborSimple|26)
+	w.buf = binary.BigEndian.AppendUint32(w.buf, math.Float32bits(f))
+}
+
+// float64 writes a double precision float.
+func (w *cborWriter) float64(f float64) {
+	w.buf = append(w.buf, cborSimple|27)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, math.Float64bits(f))
+}
+
+// number writes f in as few bytes as it takes: as an integer if it's a whole
+// number, as a single precision float if that's exact, and as a double
+// otherwise.
+func (w *cborWriter) number(f float64) {
+	switch {
+	case f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64:
+		w.int(int64(f))
+	case float64(float32(f)) == f || math.IsNaN(f):
+		w.float32(float32(f))
+	default:
+		w.float64(f)
+	}
+}
+
+// bool writes a boolean.
+func (w *cborWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, cborSimple|21)
+	} else {
+		w.buf = append(w.buf, cborSimple|20)
+	}
+}
+
+// head writes the initial bytes of an item of the given major type, with
+// argument n: the value itself for integers, or the length for everything
+// else. Uses the shortest encoding, as CBOR's "preferred serialization" wants.
+func (w *cborWriter) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, major|25)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+	case n <= math.MaxUint32:
+		w.buf = append(w.buf, major|26)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	default:
+		w.buf = append(w.buf, major|27)
+		w.buf = binary.BigEndian.AppendUint64(w.buf, n)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// CoAP (RFC 7252): HTTP's little cousin for constrained devices. It runs over
+// UDP, so there's no connection to set up, and a request with its response
+// usually fits in a datagram each way. For a device sending two numbers every
+// now and then, that's a lot lighter than HTTP over TCP.
+//
+// This file has the message format, the client, and the sink that uses it to
+// send the readings. The client does one request at a time (which is all RFC
+// 7252 allows by default anyway), with retransmissions for confirmable
+// requests.
+//
+
+// coapType is the type of a CoAP message.
+type coapType byte
+
+const (
+	coapCON coapType = 0 // Confirmable: must be acknowledged.
+	coapNON coapType = 1 // Non-confirmable: fire and forget.
+	coapACK coapType = 2 // Acknowledgement of a CON.
+	coapRST coapType = 3 // Reset: "I don't know what you are talking about".
+)
+
+// coapCode is the code of a CoAP message: a method for requests, a status for
+// responses. It's written as "c.dd", with the class in the upper three bits
+// and the detail in the lower five.
+type coapCode byte
+
+// String returns the code in the usual "c.dd" notation.
+func (c coapCode) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// IsSuccess tells if c is a success response code (2.xx).
+func (c coapCode) IsSuccess() bool {
+	return c>>5 == 2
+}
+
+// isRequest tells if c is a request method code (0.01 to 0.31).
+func (c coapCode) isRequest() bool {
+	return c>>5 == 0 && c != coapEmpty
+}
+
+// The CoAP codes we care about.
+const (
+	coapEmpty coapCode = 0
+
+	coapGET  coapCode = 0<<5 | 1
+	coapPOST coapCode = 0<<5 | 2
+
+	coapContent            coapCode = 2<<5 | 5
+	coapNotFound           coapCode = 4<<5 | 4
+	coapMethodNotAllowed   coapCode = 4<<5 | 5
+	coapNotAcceptable      coapCode = 4<<5 | 6
+	coapServiceUnavailable coapCode = 5<<5 | 3
+)
+
+// The CoAP options we use.
+const (
+	coapOptObserve       = 6
+	coapOptURIPath       = 11
+	coapOptContentFormat = 12
+	coapOptMaxAge        = 14
+	coapOptAccept        = 17
+)
+
+// The CoAP content formats we use.
+const (
+	coapFormatLinkFormat = 40
+	coapFormatCBOR       = 60
+)
+
+const (
+	// coapDefaultPort is the CoAP port, for URLs that don't have one.
+	coapDefaultPort = 5683
+
+	// coapAckTimeout, coapAckRandomFactor and coapMaxRetransmit are the
+	// transmission parameters from RFC 7252, section 4.8. With these, a
+	// confirmable message is sent up to five times over about 45 seconds.
+	coapAckTimeout      = 2 * time.Second
+	coapAckRandomFactor = 1.5
+	coapMaxRetransmit   = 4
+
+	// coapMaxTransmitWait is the longest we wait for the response to a
+	// request, if the context doesn't say otherwise. It's MAX_TRANSMIT_WAIT
+	// from RFC 7252.
+	coapMaxTransmitWait = 93 * time.Second
+
+	// coapMaxMessageSize is the largest message we send or accept. RFC 7252
+	// recommends staying under this to avoid IP fragmentation.
+	coapMaxMessageSize = 1152
+)
+
+var (
+	// errCoAPMalformed is returned when parsing something that is not a
+	// valid CoAP message.
+	errCoAPMalformed = errors.New("malformed CoAP message")
+
+	// errCoAPReset is returned when the other side answers a request with a
+	// reset, meaning it didn't understand it.
+	errCoAPReset = errors.New("CoAP request reset by peer")
+
+	// errCoAPTokenMismatch is returned when the other side acknowledges a
+	// request with a response carrying some other token. That's a broken
+	// server: retransmitting won't get us the right response.
+	errCoAPTokenMismatch = errors.New("CoAP response with the wrong token")
+)
+
+// coapOption is a CoAP option.
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+// coapMessage is a CoAP message.
+type coapMessage struct {
+	Type      coapType
+	Code      coapCode
+	MessageID uint16
+	Token     []byte
+
+	// Options are the options of the message. They don't need to be sorted:
+	// that's done when encoding.
+	Options []coapOption
+
+	Payload []byte
+}
+
+// addOption adds an option to m.
+func (m *coapMessage) addOption(number uint16, value []byte) {
+	m.Options = append(m.Options, coapOption{Number: number, Value: value})
+}
+
+// addUintOption adds an option with an unsigned integer value to m. Integers
+// are encoded in as few bytes as possible, with zero being no bytes at all.
+func (m *coapMessage) addUintOption(number uint16, value uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	i := 0
+	for i < 4 && buf[i] == 0 {
+		i++
+	}
+	m.addOption(number, buf[i:])
+}
+
+// setPath adds Uri-Path options for path, one per segment.
+func (m *coapMessage) setPath(path string) {
+	for _, seg := range strings.Split(strings.Trim(path, "/"), "/") {
+		if seg != "" {
+			m.addOption(coapOptURIPath, []byte(seg))
+		}
+	}
+}
+
+// path returns the path in the Uri-Path options, with a leading slash.
+func (m *coapMessage) path() string {
+	var b strings.Builder
+	for _, opt := range m.Options {
+		if opt.Number == coapOptURIPath {
+			b.WriteByte('/')
+			b.Write(opt.Value)
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// uintOption returns the value of the first option with the given number as an
+// unsigned integer, and whether it was present at all.
+func (m *coapMessage) uintOption(number uint16) (uint32, bool) {
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			var v uint32
+			for _, b := range opt.Value {
+				v = v<<8 | uint32(b)
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// appendTo appends the encoded message to dst.
+func (m *coapMessage) appendTo(dst []byte) []byte {
+	dst = append(dst, 1<<6|byte(m.Type)<<4|byte(len(m.Token)), byte(m.Code))
+	dst = binary.BigEndian.AppendUint16(dst, m.MessageID)
+	dst = append(dst, m.Token...)
+
+	// Options are encoded in order, each with the difference from the number
+	// of the previous one.
+	opts := append([]coapOption(nil), m.Options...)
+	sort.SliceStable(opts, func(i, j int) bool { return opts[i].Number < opts[j].Number })
+	prev := uint16(0)
+	for _, opt := range opts {
+		delta, deltaExt := coapOptionNibble(int(opt.Number - prev))
+		length, lengthExt := coapOptionNibble(len(opt.Value))
+		dst = append(dst, delta<<4|length)
+		dst = append(dst, deltaExt...)
+		dst = append(dst, lengthExt...)
+		dst = append(dst, opt.Value...)
+		prev = opt.Number
+	}
+
+	if len(m.Payload) > 0 {
+		dst = append(dst, 0xff)
+		dst = append(dst, m.Payload...)
+	}
+	return dst
+}
+
+// coapOptionNibble returns the 4-bit value encoding an option delta or length
+// n, and the extended bytes that follow the option header, if needed.
+func coapOptionNibble(n int) (byte, []byte) {
+	switch {
+	case n < 13:
+		return byte(n), nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(n-269))
+	}
+}
+
+// parseCoAPMessage parses a CoAP message from a datagram. The message
+// references data, which must not be changed while the message is in use.
+func parseCoAPMessage(data []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(data) < 4 {
+		return m, fmt.Errorf("%w: too short", errCoAPMalformed)
+	}
+	if data[0]>>6 != 1 {
+		return m, fmt.Errorf("%w: unknown version %d", errCoAPMalformed, data[0]>>6)
+	}
+	m.Type = coapType(data[0] >> 4 & 0x3)
+	tkl := int(data[0] & 0xf)
+	m.Code = coapCode(data[1])
+	m.MessageID = binary.BigEndian.Uint16(data[2:])
+	if tkl > 8 || len(data) < 4+tkl {
+		return m, fmt.Errorf("%w: bad token length", errCoAPMalformed)
+	}
+	m.Token = data[4 : 4+tkl]
+
+	rest := data[4+tkl:]
+	number := 0
+	for len(rest) > 0 {
+		if rest[0] == 0xff {
+			if len(rest) == 1 {
+				return m, fmt.Errorf("%w: empty payload after marker", errCoAPMalformed)
+			}
+			m.Payload = rest[1:]
+			break
+		}
+		header := rest[0]
+		rest = rest[1:]
+		var delta, length int
+		var err error
+		delta, rest, err = coapOptionValue(header>>4, rest)
+		if err != nil {
+			return m, err
+		}
+		length, rest, err = coapOptionValue(header&0xf, rest)
+		if err != nil {
+			return m, err
+		}
+		if len(rest) < length {
+			return m, fmt.Errorf("%w: option too long", errCoAPMalformed)
+		}
+		number += delta
+		if number > 0xffff {
+			return m, fmt.Errorf("%w: bad option number", errCoAPMalformed)
+		}
+		m.Options = append(m.Options, coapOption{Number: uint16(number), Value: rest[:length]})
+		rest = rest[length:]
+	}
+	return m, nil
+}
+
+// coapOptionValue decodes an option delta or length from its 4-bit value and
+// the extended bytes at the start of rest, returning it along with what's left
+// of rest.
+func coapOptionValue(nibble byte, rest []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(rest) < 1 {
+			return 0, nil, fmt.Errorf("%w: truncated option", errCoAPMalformed)
+		}
+		return int(rest[0]) + 13, rest[1:], nil
+	case 14:
+		if len(rest) < 2 {
+			return 0, nil, fmt.Errorf("%w: truncated option", errCoAPMalformed)
+		}
+		return int(binary.BigEndian.Uint16(rest)) + 269, rest[2:], nil
+	case 15:
+		return 0, nil, fmt.Errorf("%w: reserved option nibble", errCoAPMalformed)
+	default:
+		return int(nibble), rest, nil
+	}
+}
+
+// parseCoAPURL parses a CoAP URL, like "coap://192.168.10.2:5683/readings",
+// returning the "host:port" to send requests to and the path. The port is
+// optional.
+func parseCoAPURL(rawURL string) (address, path string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "coap" {
+		return "", "", fmt.Errorf("%w: %q, use coap", httpwire.ErrUnsupportedScheme, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return "", "", errors.New("URL must contain a host")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !addr.Is4() {
+		return "", "", fmt.Errorf("unsupported address %q: only IPv4 is supported", host)
+	}
+	port := uint64(coapDefaultPort)
+	if p := u.Port(); p != "" {
+		port, err = strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return "", "", fmt.Errorf("invalid port %q", p)
+		}
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(port, 10)), u.Path, nil
+}
+
+//
+// Client
+//
+
+// coapClient sends CoAP requests, one at a time, over a UDP socket.
+type coapClient struct {
+	// conn is the socket. It's used only by the client.
+	conn net.PacketConn
+
+	// mutex serializes requests.
+	mutex sync.Mutex
+
+	// lastMID is the last message ID used.
+	lastMID uint16
+}
+
+// newCoAPClient creates a coapClient using conn.
+func newCoAPClient(conn net.PacketConn) *coapClient {
+	return &coapClient{conn: conn, lastMID: uint16(mathrand.Intn(0x10000))}
+}
+
+// do sends req to the given address and waits for the response. The message
+// ID and token are filled in here. Confirmable requests are retransmitted
+// until acknowledged, following RFC 7252; for non-confirmable ones we just
+// wait for a response until ctx is done. Without a deadline in ctx, we give up
+// after coapMaxTransmitWait.
+func (c *coapClient) do(ctx context.Context, to netip.AddrPort, req *coapMessage) (*coapMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, coapMaxTransmitWait)
+		defer cancel()
+	}
+
+	c.lastMID++
+	req.MessageID = c.lastMID
+	req.Token = make([]byte, 4)
+	_, err := rand.Read(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	data := req.appendTo(nil)
+	if len(data) > coapMaxMessageSize {
+		return nil, fmt.Errorf("CoAP request too large (%d bytes)", len(data))
+	}
+	toAddr := net.UDPAddrFromAddrPort(to)
+
+	// The first timeout is random, so that a bunch of clients losing
+	// messages at the same time don't retransmit in lockstep.
+	timeout := coapAckTimeout + time.Duration(mathrand.Float64()*(coapAckRandomFactor-1)*float64(coapAckTimeout))
+	retransmissions := 0
+	acked := req.Type != coapCON
+
+	_, err = c.conn.WriteTo(data, toAddr)
+	if err != nil {
+		return nil, err
+	}
+	nextSend := time.Now().Add(timeout)
+
+	buf := make([]byte, coapMaxMessageSize)
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		ctxDeadline, _ := ctx.Deadline()
+		deadline := ctxDeadline
+		if !acked && nextSend.Before(deadline) {
+			deadline = nextSend
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctxError(ctx)
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, err
+			}
+			if acked || !time.Now().Before(ctxDeadline) {
+				// The socket deadline fired a hair before the
+				// context's. Go around and let ctx catch up.
+				continue
+			}
+			if retransmissions == coapMaxRetransmit {
+				return nil, fmt.Errorf("%w: no CoAP acknowledgement after %d retransmissions", ErrTimeout, retransmissions)
+			}
+			retransmissions++
+			timeout *= 2
+			_, err = c.conn.WriteTo(data, toAddr)
+			if err != nil {
+				return nil, err
+			}
+			nextSend = time.Now().Add(timeout)
+			continue
+		}
+
+		if fromAddr, ok := from.(*net.UDPAddr); !ok || fromAddr.AddrPort() != to {
+			continue // Not for us.
+		}
+		res, err := parseCoAPMessage(buf[:n])
+		if err != nil {
+			continue // Garbage. Ignore it, and maybe the real thing follows.
+		}
+
+		switch {
+		case res.Type == coapRST && res.MessageID == req.MessageID:
+			return nil, errCoAPReset
+
+		case res.Type == coapACK && res.MessageID == req.MessageID:
+			if res.Code == coapEmpty {
+				// The server got the request and will send the
+				// response later. Stop retransmitting and wait.
+				acked = true
+				continue
+			}
+			if string(res.Token) != string(req.Token) {
+				return nil, errCoAPTokenMismatch
+			}
+			return copyCoAPMessage(&res), nil
+
+		case (res.Type == coapCON || res.Type == coapNON) && string(res.Token) == string(req.Token):
+			// A separate response. A confirmable one must be
+			// acknowledged, or the server will keep sending it.
+			if res.Type == coapCON {
+				ack := coapMessage{Type: coapACK, MessageID: res.MessageID}
+				c.conn.WriteTo(ack.appendTo(nil), toAddr)
+			}
+			return copyCoAPMessage(&res), nil
+
+		case res.Type == coapCON:
+			// Something we didn't ask for. The polite answer is a reset.
+			rst := coapMessage{Type: coapRST, MessageID: res.MessageID}
+			c.conn.WriteTo(rst.appendTo(nil), toAddr)
+		}
+	}
+}
+
+// copyCoAPMessage returns a copy of m that doesn't reference the buffer it was
+// parsed from.
+func copyCoAPMessage(m *coapMessage) *coapMessage {
+	c := *m
+	c.Token = append([]byte(nil), m.Token...)
+	c.Options = make([]coapOption, len(m.Options))
+	for i, opt := range m.Options {
+		c.Options[i] = coapOption{Number: opt.Number, Value: append([]byte(nil), opt.Value...)}
+	}
+	c.Payload = append([]byte(nil), m.Payload...)
+	return &c
+}
+
+//
+// Sink
+//
+
+// coapSink POSTs readings to the CoAP server URL in the settings, when the
+// report policy says they are worth it. Readings from a failing sensor are sent
+// too, once when it fails and then with each heartbeat, with flags telling
+// what's wrong.
+//
+// Not safe for concurrent use; it belongs to its sinkRunner.
+type coapSink struct {
+	// pn is the network, and client the CoAP client we send with.
+	pn     *PicoNet
+	client *coapClient
+
+	// host, port and path tell where to send the readings.
+	host, port, path string
+
+	// location goes along with the readings.
+	location string
+
+	// reporter decides which readings are worth sending.
+	reporter *readingReporter
+}
+
+// newCoAPSink returns the CoAP sink, if the server URL in the settings is a
+// CoAP one.
+func newCoAPSink(env sinkEnv) (telemetrySink, error) {
+	if !strings.HasPrefix(env.settings.ServerURL, "coap:") {
+		return nil, nil
+	}
+	address, path, err := parseCoAPURL(env.settings.ServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the CoAP server URL: %w", err)
+	}
+	host, port, _ := net.SplitHostPort(address)
+
+	conn, err := env.pn.ListenUDP(0)
+	if err != nil {
+		return nil, fmt.Errorf("opening the CoAP client socket: %w", err)
+	}
+	s := &coapSink{
+		pn:       env.pn,
+		client:   newCoAPClient(conn),
+		host:     host,
+		port:     port,
+		path:     path,
+		location: env.settings.locationName(env.pn.HardwareAddr()),
+		reporter: newReadingReporter(env.settings.reportPolicies()),
+	}
+	config := sinkConfig{QueueSize: 4, MaxBatch: 1, Timeout: coapMaxTransmitWait}
+	return newSinkRunner(env.logger, env.pn, s, config), nil
+}
+
+func (s *coapSink) Name() string {
+	return "coap"
+}
+
+func (s *coapSink) Collect(queue []telemetryReading, r telemetryReading) []telemetryReading {
+	if !s.reporter.due(r.Now, r.Reading) {
+		return queue
+	}
+	s.reporter.markReported(r.Now, r.Reading)
+	return append(queue, r)
+}
+
+func (s *coapSink) Deliver(ctx context.Context, readings []telemetryReading) error {
+	for _, r := range readings {
+		payload := appendReadingCBOR(nil, r.Reading, r.Now, r.Clock, s.location)
+		err := postCoAPReading(ctx, s.pn, s.client, s.host, s.port, s.path, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postCoAPReading sends an encoded reading to the CoAP server at host and port,
+// as a confirmable POST to path.
+func postCoAPReading(ctx context.Context, pn *PicoNet, client *coapClient, host, port, path string, payload []byte) error {
+	addr, err := pn.resolveHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	addrPort, err := netip.ParseAddrPort(net.JoinHostPort(addr.String(), port))
+	if err != nil {
+		return err
+	}
+
+	req := &coapMessage{Type: coapCON, Code: coapPOST, Payload: payload}
+	req.setPath(path)
+	req.addUintOption(coapOptContentFormat, coapFormatCBOR)
+	res, err := client.do(ctx, addrPort, req)
+	if err != nil {
+		if errors.Is(err, ErrTimeout) {
+			pn.forgetRoute(addr)
+		}
+		return err
+	}
+	if !res.Code.IsSuccess() {
+		return errors.New("CoAP server responded " + res.Code.String())
+	}
+	return nil
+}
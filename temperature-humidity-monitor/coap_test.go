@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCoAPMessageEncoding(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 300)
+	tests := []struct {
+		name string
+		msg  func() coapMessage
+		want []byte
+	}{
+		{
+			// RFC 7252, appendix A, figure 16.
+			name: "GET with a path",
+			msg: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 0x7d34}
+				m.setPath("temperature")
+				return m
+			},
+			want: append([]byte{0x40, 0x01, 0x7d, 0x34, 0xbb}, "temperature"...),
+		},
+		{
+			name: "piggybacked response with a token and payload",
+			msg: func() coapMessage {
+				return coapMessage{Type: coapACK, Code: coapContent, MessageID: 0x7d34, Token: []byte{0x20}, Payload: []byte("22.3 C")}
+			},
+			want: append([]byte{0x61, 0x45, 0x7d, 0x34, 0x20, 0xff}, "22.3 C"...),
+		},
+		{
+			name: "empty ACK",
+			msg:  func() coapMessage { return coapMessage{Type: coapACK, MessageID: 0x1234} },
+			want: []byte{0x60, 0x00, 0x12, 0x34},
+		},
+		{
+			name: "options sorted, with deltas",
+			msg: func() coapMessage {
+				m := coapMessage{Type: coapNON, Code: coapPOST, MessageID: 1}
+				m.addUintOption(coapOptContentFormat, coapFormatCBOR)
+				m.setPath("/a/bc/")
+				m.addUintOption(coapOptObserve, 0)
+				return m
+			},
+			want: []byte{0x50, 0x02, 0x00, 0x01,
+				0x60,      // Observe (6), zero is no bytes at all.
+				0x51, 'a', // Uri-Path (11).
+				0x02, 'b', 'c', // Uri-Path (11) again: delta 0.
+				0x11, 60, // Content-Format (12).
+			},
+		},
+		{
+			name: "extended deltas and lengths",
+			msg: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapPOST, MessageID: 2}
+				m.addOption(20, []byte("0123456789abc"))
+				m.addOption(20+269, long)
+				return m
+			},
+			want: append(append(
+				[]byte{0x40, 0x02, 0x00, 0x02, 0xdd, 20 - 13, 0},
+				"0123456789abc"...),
+				append([]byte{0xee, 0, 0, 0, 300 - 269}, long...)...),
+		},
+		{
+			name: "integer options in as few bytes as possible",
+			msg: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 3}
+				m.addUintOption(coapOptMaxAge, 0x10000)
+				m.addUintOption(coapOptAccept, 0x1ff)
+				return m
+			},
+			want: []byte{0x40, 0x01, 0x00, 0x03, 0xd3, 14 - 13, 0x01, 0x00, 0x00, 0x32, 0x01, 0xff},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.msg()
+			got := m.appendTo(nil)
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got  % x\nwant % x", got, tt.want)
+			}
+
+			back, err := parseCoAPMessage(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(back.appendTo(nil), got) {
+				t.Errorf("parsed to %+v, which encodes differently", back)
+			}
+			if back.Type != m.Type || back.Code != m.Code || back.MessageID != m.MessageID || !bytes.Equal(back.Token, m.Token) || !bytes.Equal(back.Payload, m.Payload) {
+				t.Errorf("parsed to %+v, want %+v", back, m)
+			}
+		})
+	}
+}
+
+func TestCoAPMessageOptions(t *testing.T) {
+	m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 9, Token: []byte("12345678")}
+	m.setPath("/env/readings")
+	m.addUintOption(coapOptAccept, coapFormatCBOR)
+	m.addUintOption(coapOptObserve, 0)
+
+	got, err := parseCoAPMessage(m.appendTo(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := got.path(); p != "/env/readings" {
+		t.Errorf("path %q", p)
+	}
+	if v, ok := got.uintOption(coapOptAccept); !ok || v != coapFormatCBOR {
+		t.Errorf("Accept %d, %v", v, ok)
+	}
+	if v, ok := got.uintOption(coapOptObserve); !ok || v != 0 {
+		t.Errorf("Observe %d, %v", v, ok)
+	}
+	if _, ok := got.uintOption(coapOptMaxAge); ok {
+		t.Error("Max-Age is there")
+	}
+	if string(got.Token) != "12345678" || len(got.Payload) != 0 {
+		t.Errorf("token %q, payload %q", got.Token, got.Payload)
+	}
+	if p := (&coapMessage{}).path(); p != "/" {
+		t.Errorf("no path: %q", p)
+	}
+}
+
+func TestParseCoAPMessageErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"too short":                  {0x40, 0x01, 0x00},
+		"version 2":                  {0x80, 0x01, 0x00, 0x00},
+		"token longer than 8":        {0x49, 0x01, 0x00, 0x00, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		"truncated token":            {0x44, 0x01, 0x00, 0x00, 1, 2},
+		"payload marker, no payload": {0x40, 0x01, 0x00, 0x00, 0xff},
+		"reserved delta":             {0x40, 0x01, 0x00, 0x00, 0xf0},
+		"reserved length":            {0x40, 0x01, 0x00, 0x00, 0x0f},
+		"truncated extended delta":   {0x40, 0x01, 0x00, 0x00, 0xd0},
+		"truncated extended length":  {0x40, 0x01, 0x00, 0x00, 0x0e, 0x00},
+		"truncated option value":     {0x40, 0x01, 0x00, 0x00, 0x05, 'a'},
+		"option number too large":    {0x40, 0x01, 0x00, 0x00, 0xe0, 0xff, 0xff, 0xe0, 0xff, 0xff},
+	}
+	for name, data := range tests {
+		if m, err := parseCoAPMessage(data); !errors.Is(err, errCoAPMalformed) {
+			t.Errorf("%s: got %+v, %v", name, m, err)
+		}
+	}
+}
+
+func TestCoAPCode(t *testing.T) {
+	tests := []struct {
+		code             coapCode
+		want             string
+		success, request bool
+	}{
+		{coapEmpty, "0.00", false, false},
+		{coapGET, "0.01", false, true},
+		{coapPOST, "0.02", false, true},
+		{coapContent, "2.05", true, false},
+		{2<<5 | 1, "2.01", true, false},
+		{coapNotFound, "4.04", false, false},
+		{coapServiceUnavailable, "5.03", false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.code.String(); got != tt.want || tt.code.IsSuccess() != tt.success || tt.code.isRequest() != tt.request {
+			t.Errorf("%s: success %v, request %v", got, tt.code.IsSuccess(), tt.code.isRequest())
+		}
+	}
+}
+
+func TestParseCoAPURL(t *testing.T) {
+	tests := []struct{ url, address, path string }{
+		{"coap://10.0.0.2/readings", "10.0.0.2:5683", "/readings"},
+		{"coap://10.0.0.2:5684/env/readings", "10.0.0.2:5684", "/env/readings"},
+		{"coap://server.lan", "server.lan:5683", ""},
+	}
+	for _, tt := range tests {
+		address, path, err := parseCoAPURL(tt.url)
+		if err != nil || address != tt.address || path != tt.path {
+			t.Errorf("parseCoAPURL(%q) = %q, %q, %v", tt.url, address, path, err)
+		}
+	}
+	for _, bad := range []string{"http://10.0.0.2/", "coaps://10.0.0.2/", "coap:///readings", "coap://10.0.0.2:0/", "coap://[::1]/"} {
+		if _, _, err := parseCoAPURL(bad); err == nil {
+			t.Errorf("parseCoAPURL(%q) succeeded", bad)
+		}
+	}
+}
+
+//
+// Client
+//
+
+// listenLoopback returns a UDP socket on the loopback interface, closed at the
+// end of the test.
+func listenLoopback(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// addrPort returns the address conn is bound to.
+func addrPort(conn net.PacketConn) netip.AddrPort {
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// fakeCoAPServer answers the n-th request it gets with what reply returns.
+// Every message it gets goes to received.
+type fakeCoAPServer struct {
+	conn     net.PacketConn
+	received chan coapMessage
+}
+
+func newFakeCoAPServer(t *testing.T, reply func(req coapMessage, n int) []coapMessage) *fakeCoAPServer {
+	s := &fakeCoAPServer{conn: listenLoopback(t), received: make(chan coapMessage, 16)}
+	go func() {
+		buf := make([]byte, coapMaxMessageSize)
+		n := 0
+		for {
+			size, from, err := s.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := parseCoAPMessage(buf[:size])
+			if err != nil {
+				continue
+			}
+			s.received <- *copyCoAPMessage(&m)
+			if m.Type == coapACK || m.Type == coapRST {
+				continue
+			}
+			n++
+			for _, res := range reply(m, n) {
+				s.conn.WriteTo(res.appendTo(nil), from)
+			}
+		}
+	}()
+	return s
+}
+
+func TestCoAPClientRetransmit(t *testing.T) {
+	// The first transmission is lost.
+	s := newFakeCoAPServer(t, func(req coapMessage, n int) []coapMessage {
+		if n == 1 {
+			return nil
+		}
+		return []coapMessage{{Type: coapACK, Code: 2<<5 | 4, MessageID: req.MessageID, Token: req.Token}}
+	})
+	c := newCoAPClient(listenLoopback(t))
+
+	start := time.Now()
+	req := &coapMessage{Type: coapCON, Code: coapPOST, Payload: []byte{1}}
+	res, err := c.do(context.Background(), addrPort(s.conn), req)
+	if err != nil || res.Code != 2<<5|4 {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < coapAckTimeout || elapsed > time.Duration(coapAckRandomFactor*float64(coapAckTimeout))+time.Second {
+		t.Errorf("retransmitted after %v, want between %v and %v times that", elapsed, coapAckTimeout, coapAckRandomFactor)
+	}
+
+	// The retransmission is the same message, message ID and all.
+	first, second := <-s.received, <-s.received
+	if !bytes.Equal(first.appendTo(nil), second.appendTo(nil)) || first.MessageID != req.MessageID {
+		t.Errorf("sent %+v, then %+v", first, second)
+	}
+}
+
+func TestCoAPClientMatching(t *testing.T) {
+	clientConn, other := listenLoopback(t), listenLoopback(t)
+	s := newFakeCoAPServer(t, func(req coapMessage, n int) []coapMessage {
+		// None of these answer the request...
+		other.WriteTo((&coapMessage{Type: coapACK, Code: coapContent, MessageID: req.MessageID, Token: req.Token, Payload: []byte("wrong sender")}).appendTo(nil), clientConn.LocalAddr())
+		return []coapMessage{
+			{Type: coapACK, Code: coapContent, MessageID: req.MessageID + 1, Token: req.Token, Payload: []byte("wrong ID")},
+			{Type: coapNON, Code: coapContent, MessageID: 1, Token: []byte("nope"), Payload: []byte("someone else's")},
+			{Type: coapCON, Code: coapContent, MessageID: 2, Token: []byte("nope"), Payload: []byte("unsolicited")},
+			// ...unlike these: an empty ACK, then a separate response.
+			{Type: coapACK, MessageID: req.MessageID},
+			{Type: coapCON, Code: coapContent, MessageID: 4242, Token: req.Token, Payload: []byte("right")},
+		}
+	})
+	c := newCoAPClient(clientConn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.do(ctx, addrPort(s.conn), &coapMessage{Type: coapCON, Code: coapGET})
+	if err != nil || string(res.Payload) != "right" || res.MessageID != 4242 {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+
+	// The unsolicited confirmable message gets a reset, and the separate
+	// response an ACK, so that the server stops sending it.
+	var replies []string
+	for len(replies) < 2 {
+		select {
+		case m := <-s.received:
+			if m.Type == coapACK || m.Type == coapRST {
+				replies = append(replies, fmt.Sprintf("%d %d", m.Type, m.MessageID))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %q", replies)
+		}
+	}
+	if want := []string{"3 2", "2 4242"}; !reflect.DeepEqual(replies, want) {
+		t.Errorf("got type and message ID %q, want %q", replies, want)
+	}
+}
+
+func TestCoAPClientReset(t *testing.T) {
+	s := newFakeCoAPServer(t, func(req coapMessage, n int) []coapMessage {
+		return []coapMessage{{Type: coapRST, MessageID: req.MessageID}}
+	})
+	c := newCoAPClient(listenLoopback(t))
+	_, err := c.do(context.Background(), addrPort(s.conn), &coapMessage{Type: coapCON, Code: coapGET})
+	if !errors.Is(err, errCoAPReset) {
+		t.Errorf("got %v, want errCoAPReset", err)
+	}
+}
+
+func TestCoAPClientTokenMismatch(t *testing.T) {
+	s := newFakeCoAPServer(t, func(req coapMessage, n int) []coapMessage {
+		return []coapMessage{{Type: coapACK, Code: coapContent, MessageID: req.MessageID, Token: []byte("nope")}}
+	})
+	c := newCoAPClient(listenLoopback(t))
+
+	// The request was acknowledged, if wrongly, so there's no point in
+	// sending it again: it fails straight away.
+	start := time.Now()
+	_, err := c.do(context.Background(), addrPort(s.conn), &coapMessage{Type: coapCON, Code: coapGET})
+	if !errors.Is(err, errCoAPTokenMismatch) {
+		t.Errorf("got %v, want errCoAPTokenMismatch", err)
+	}
+	if elapsed := time.Since(start); elapsed >= coapAckTimeout {
+		t.Errorf("failed after %v", elapsed)
+	}
+	if n := len(s.received); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestCoAPClientTimeout(t *testing.T) {
+	nobody := listenLoopback(t)
+	c := newCoAPClient(listenLoopback(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for _, typ := range []coapType{coapCON, coapNON} {
+		_, err := c.do(ctx, addrPort(nobody), &coapMessage{Type: typ, Code: coapPOST})
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("type %d: got %v, want ErrTimeout", typ, err)
+		}
+	}
+}
+
+//
+// Server
+//
+
+// sentMessage is a message sent by a coapServer to a datagramRecorder.
+type sentMessage struct {
+	to  netip.AddrPort
+	msg coapMessage
+}
+
+// takeCoAP returns the messages sent to conn since the last call, failing the
+// test if any isn't CoAP.
+func takeCoAP(t *testing.T, conn *datagramRecorder) []sentMessage {
+	t.Helper()
+	var sent []sentMessage
+	for _, d := range conn.take() {
+		m, err := parseCoAPMessage(d.data)
+		if err != nil {
+			t.Fatalf("sent % x to %v: %v", d.data, d.to, err)
+		}
+		sent = append(sent, sentMessage{d.to, m})
+	}
+	return sent
+}
+
+// newTestCoAPServer returns a coapServer with a 21.5°C, 40% reading taken just
+// now, and a clock synchronized to 2023-11-14T22:13:20Z.
+func newTestCoAPServer() (*coapServer, *datagramRecorder) {
+	var readings sensorReadings
+	taken := time.Now()
+	readings.record(taken, 21.5, 40, nil)
+	conn := &datagramRecorder{}
+	clock := func() (time.Time, bool) { return time.Unix(1700000000, 0).Add(time.Since(taken)), true }
+	return newCoAPServer(discardLogger, conn, &readings, clock), conn
+}
+
+// readingsCBOR is the payload newTestCoAPServer serves.
+var readingsCBOR = []byte{
+	0xa4,
+	0x61, 't', 0x1a, 0x65, 0x53, 0xf1, 0x00,
+	0x64, 't', 'e', 'm', 'p', 0xfa, 0x41, 0xac, 0x00, 0x00,
+	0x63, 'h', 'u', 'm', 0xfa, 0x42, 0x20, 0x00, 0x00,
+	0x63, 'a', 'g', 'e', 0x00,
+}
+
+func TestCoAPServerRequests(t *testing.T) {
+	s, conn := newTestCoAPServer()
+	from := netip.MustParseAddrPort("192.168.1.50:40000")
+
+	tests := []struct {
+		name string
+		req  func() coapMessage
+		want coapMessage
+	}{
+		{
+			name: "readings",
+			req: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 7, Token: []byte("tk")}
+				m.setPath("/readings")
+				m.addUintOption(coapOptAccept, coapFormatCBOR)
+				return m
+			},
+			want: coapMessage{Type: coapACK, Code: coapContent, MessageID: 7, Token: []byte("tk"),
+				Options: []coapOption{{coapOptContentFormat, []byte{60}}, {coapOptMaxAge, []byte{90}}},
+				Payload: readingsCBOR},
+		},
+		{
+			name: "discovery",
+			req: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 8}
+				m.setPath("/.well-known/core")
+				return m
+			},
+			want: coapMessage{Type: coapACK, Code: coapContent, MessageID: 8, Token: []byte{},
+				Options: []coapOption{{coapOptContentFormat, []byte{40}}},
+				Payload: []byte(`</readings>;rt="thm.readings";ct=60;obs`)},
+		},
+		{
+			name: "not found",
+			req: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 9}
+				m.setPath("/nope")
+				return m
+			},
+			want: coapMessage{Type: coapACK, Code: coapNotFound, MessageID: 9, Token: []byte{}},
+		},
+		{
+			name: "POST",
+			req: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapPOST, MessageID: 10}
+				m.setPath("/readings")
+				return m
+			},
+			want: coapMessage{Type: coapACK, Code: coapMethodNotAllowed, MessageID: 10, Token: []byte{}},
+		},
+		{
+			name: "JSON",
+			req: func() coapMessage {
+				m := coapMessage{Type: coapCON, Code: coapGET, MessageID: 11}
+				m.setPath("/readings")
+				m.addUintOption(coapOptAccept, 50)
+				return m
+			},
+			want: coapMessage{Type: coapACK, Code: coapNotAcceptable, MessageID: 11, Token: []byte{}},
+		},
+		{
+			name: "ping",
+			req:  func() coapMessage { return coapMessage{Type: coapCON, MessageID: 12} },
+			want: coapMessage{Type: coapRST, MessageID: 12, Token: []byte{}},
+		},
+		{
+			name: "unsolicited response",
+			req:  func() coapMessage { return coapMessage{Type: coapCON, Code: coapContent, MessageID: 13} },
+			want: coapMessage{Type: coapRST, MessageID: 13, Token: []byte{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req()
+			s.handle(from, req.appendTo(nil))
+			sent := takeCoAP(t, conn)
+			if len(sent) != 1 || sent[0].to != from {
+				t.Fatalf("sent %+v", sent)
+			}
+			if !reflect.DeepEqual(sent[0].msg, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", sent[0].msg, tt.want)
+			}
+		})
+	}
+
+	// A non-confirmable request gets a non-confirmable response, with a
+	// message ID of its own.
+	req := coapMessage{Type: coapNON, Code: coapGET, MessageID: 14, Token: []byte("n")}
+	req.setPath("/readings")
+	s.handle(from, req.appendTo(nil))
+	if sent := takeCoAP(t, conn); len(sent) != 1 || sent[0].msg.Type != coapNON || sent[0].msg.MessageID == 14 || string(sent[0].msg.Token) != "n" {
+		t.Errorf("sent %+v", sent)
+	}
+
+	// No answer to garbage, or to a non-confirmable empty message.
+	s.handle(from, []byte{0xff, 0xff})
+	s.handle(from, (&coapMessage{Type: coapNON, MessageID: 15}).appendTo(nil))
+	if sent := takeCoAP(t, conn); len(sent) != 0 {
+		t.Errorf("sent %+v", sent)
+	}
+}
+
+func TestCoAPServerNoReading(t *testing.T) {
+	s := newCoAPServer(discardLogger, &datagramRecorder{}, &sensorReadings{}, func() (time.Time, bool) { return time.Time{}, false })
+	res := s.readingsResponse()
+	if res.Code != coapServiceUnavailable || len(res.Payload) != 0 {
+		t.Errorf("got %+v", res)
+	}
+}
+
+// observe registers an observer from addr with token, returning the response.
+func observe(t *testing.T, s *coapServer, conn *datagramRecorder, addr netip.AddrPort, token string, value uint32) coapMessage {
+	t.Helper()
+	req := coapMessage{Type: coapCON, Code: coapGET, Token: []byte(token)}
+	req.setPath("/readings")
+	req.addUintOption(coapOptObserve, value)
+	s.handle(addr, req.appendTo(nil))
+	sent := takeCoAP(t, conn)
+	if len(sent) != 1 || sent[0].msg.Code != coapContent {
+		t.Fatalf("sent %+v", sent)
+	}
+	return sent[0].msg
+}
+
+func TestCoAPServerObserve(t *testing.T) {
+	s, conn := newTestCoAPServer()
+	a := netip.MustParseAddrPort("192.168.1.50:40000")
+	b := netip.MustParseAddrPort("192.168.1.51:40000")
+
+	res := observe(t, s, conn, a, "a", 0)
+	if _, ok := res.uintOption(coapOptObserve); !ok {
+		t.Fatalf("no Observe option in %+v", res)
+	}
+	observe(t, s, conn, b, "b", 0)
+
+	// Notifications carry the observer's token and an increasing sequence
+	// number. Every coapConfirmEvery-th one is confirmable.
+	last := map[netip.AddrPort]uint32{}
+	for i := range coapConfirmEvery {
+		s.notify()
+		sent := takeCoAP(t, conn)
+		if len(sent) != 2 {
+			t.Fatalf("notification %d: sent %+v", i, sent)
+		}
+		for _, n := range sent {
+			want := coapNON
+			if i == coapConfirmEvery-1 {
+				want = coapCON
+			}
+			seq, _ := n.msg.uintOption(coapOptObserve)
+			if n.msg.Type != want || string(n.msg.Token) != map[netip.AddrPort]string{a: "a", b: "b"}[n.to] || seq <= last[n.to] || !bytes.Equal(n.msg.Payload, readingsCBOR) {
+				t.Fatalf("notification %d: %+v", i, n)
+			}
+			last[n.to] = seq
+			if n.msg.Type == coapCON && n.to == a {
+				s.handle(a, (&coapMessage{Type: coapACK, MessageID: n.msg.MessageID}).appendTo(nil))
+			}
+		}
+	}
+
+	// a acknowledged the confirmable notification, b didn't, so b is
+	// dropped when the next one is due.
+	for range coapConfirmEvery - 1 {
+		s.notify()
+	}
+	takeCoAP(t, conn)
+	s.notify()
+	if sent := takeCoAP(t, conn); len(sent) != 1 || sent[0].to != a || sent[0].msg.Type != coapCON {
+		t.Fatalf("sent %+v, want a confirmable notification to a only", sent)
+	}
+
+	// A reset to a notification deregisters, and so does Observe: 1.
+	s.notify()
+	sent := takeCoAP(t, conn)
+	s.handle(a, (&coapMessage{Type: coapRST, MessageID: sent[0].msg.MessageID}).appendTo(nil))
+	s.notify()
+	if sent := takeCoAP(t, conn); len(sent) != 0 {
+		t.Errorf("notified after a reset: %+v", sent)
+	}
+	observe(t, s, conn, a, "a", 0)
+	if res := observe(t, s, conn, a, "a", 1); res.Type != coapACK {
+		t.Errorf("deregistering got %+v", res)
+	}
+	s.notify()
+	if sent := takeCoAP(t, conn); len(sent) != 0 {
+		t.Errorf("notified after deregistering: %+v", sent)
+	}
+}
+
+func TestCoAPServerMaxObservers(t *testing.T) {
+	s, conn := newTestCoAPServer()
+	var addrs []netip.AddrPort
+	for i := range maxCoAPObservers + 1 {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 168, 1, byte(50 + i)}), 40000)
+		addrs = append(addrs, addr)
+		observe(t, s, conn, addr, "x", 0)
+	}
+	// Registering again replaces the old registration.
+	observe(t, s, conn, addrs[4], "y", 0)
+
+	s.notify()
+	got := map[netip.AddrPort]string{}
+	for _, n := range takeCoAP(t, conn) {
+		got[n.to] = string(n.msg.Token)
+	}
+	want := map[netip.AddrPort]string{addrs[1]: "x", addrs[2]: "x", addrs[3]: "x", addrs[4]: "y"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notified %v, want %v", got, want)
+	}
+}
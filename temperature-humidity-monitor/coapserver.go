@@ -0,0 +1,388 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+//
+// The CoAP side of the device: a small server where the readings can be
+// fetched or, better yet, observed (RFC 7641), so that whoever is interested
+// gets a notification whenever they change. The CoAP sink, which POSTs them
+// to a coap:// server URL, is in coap.go with the client it uses.
+//
+
+const (
+	// coapServerPort is the UDP port the CoAP server listens on.
+	coapServerPort = coapDefaultPort
+
+	// maxCoAPObservers is how many observers we keep track of. When a new
+	// one comes along, the oldest is dropped.
+	maxCoAPObservers = 4
+
+	// coapNotifyRefresh is how often observers are notified even if the
+	// readings haven't changed, so that they know we are still around.
+	coapNotifyRefresh = time.Minute
+
+	// coapMaxAge is the Max-Age of the readings we serve: how long they can
+	// be considered fresh. Observers get notified before it runs out.
+	coapMaxAge = 90 * time.Second
+
+	// coapConfirmEvery tells how often a notification is sent as
+	// confirmable. The rest are non-confirmable, which is cheaper, but
+	// never tells us if the observer is still there. An observer that
+	// doesn't acknowledge a confirmable notification by the time the next
+	// one is due is dropped.
+	coapConfirmEvery = 8
+
+	// coapReadingsPath is the path of the readings resource.
+	coapReadingsPath = "/readings"
+)
+
+// coapObserver is someone observing the readings.
+type coapObserver struct {
+	// addr is where the observer is, and token is the token of its
+	// request, which goes in every notification.
+	addr  netip.AddrPort
+	token []byte
+
+	// sent is how many notifications we sent.
+	sent int
+
+	// lastMID is the message ID of the last notification, which is what a
+	// reset from the observer refers to.
+	lastMID uint16
+
+	// awaitingAck tells if the last confirmable notification is still
+	// waiting for an acknowledgement.
+	awaitingAck bool
+}
+
+// coapServer serves the readings over CoAP.
+type coapServer struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// conn is the socket we serve on.
+	conn net.PacketConn
+
+	// readings are what we serve.
+	readings *sensorReadings
+
+	// clock tells the current time and whether it was synchronized, like
+	// PicoNet.Now.
+	clock func() (time.Time, bool)
+
+	// mutex protects everything below.
+	mutex sync.Mutex
+
+	// observers are the current observers, oldest first.
+	observers []*coapObserver
+
+	// lastMID is the last message ID used in a message we originated.
+	lastMID uint16
+
+	// seq is the sequence number of the last notification, which goes in
+	// the Observe option.
+	seq uint32
+}
+
+// newCoAPServer creates a coapServer serving readings on conn.
+func newCoAPServer(logger *slog.Logger, conn net.PacketConn, readings *sensorReadings, clock func() (time.Time, bool)) *coapServer {
+	return &coapServer{
+		logger:   logger,
+		conn:     conn,
+		readings: readings,
+		clock:    clock,
+		lastMID:  uint16(rand.Intn(0x10000)),
+	}
+}
+
+// runCoAPServer serves the readings over CoAP on pn, once it is ready, and
+// notifies observers when they change. Meant to run in its own goroutine;
+// returns only if something goes wrong.
+func runCoAPServer(logger *slog.Logger, pn *PicoNet, readings *sensorReadings) {
+	for pn.Status() != StatusReadyToGo {
+		time.Sleep(time.Second)
+	}
+
+	conn, err := pn.ListenUDP(coapServerPort)
+	if err != nil {
+		logger.Error("Listening for CoAP requests", slogError(err))
+		return
+	}
+
+	s := newCoAPServer(logger, conn, readings, pn.Now)
+	go s.notifyLoop(sensorReadInterval)
+	err = s.serve()
+	logger.Error("CoAP server stopped", slogError(err))
+}
+
+// serve handles incoming messages until the socket fails.
+func (s *coapServer) serve() error {
+	buf := make([]byte, coapMaxMessageSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		fromAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		s.handle(fromAddr.AddrPort(), buf[:n])
+	}
+}
+
+// handle handles a message received from the given address.
+func (s *coapServer) handle(from netip.AddrPort, data []byte) {
+	msg, err := parseCoAPMessage(data)
+	if err != nil {
+		return // Can't even reset what we can't parse.
+	}
+
+	switch {
+	case msg.Type == coapACK || msg.Type == coapRST:
+		s.handleReply(from, &msg)
+
+	case msg.Code == coapEmpty:
+		// A CoAP "ping": a confirmable empty message, answered with a
+		// reset.
+		if msg.Type == coapCON {
+			s.send(from, &coapMessage{Type: coapRST, MessageID: msg.MessageID})
+		}
+
+	case msg.Code.isRequest():
+		res := s.handleRequest(from, &msg)
+		res.Token = msg.Token
+		if msg.Type == coapCON {
+			// Piggybacked response: the acknowledgement carries it.
+			res.Type = coapACK
+			res.MessageID = msg.MessageID
+		} else {
+			res.Type = coapNON
+			res.MessageID = s.nextMID()
+		}
+		s.send(from, res)
+
+	case msg.Type == coapCON:
+		// A response? We never asked for one.
+		s.send(from, &coapMessage{Type: coapRST, MessageID: msg.MessageID})
+	}
+}
+
+// handleRequest handles a request, returning the response. Type, message ID
+// and token are filled in by the caller.
+func (s *coapServer) handleRequest(from netip.AddrPort, req *coapMessage) *coapMessage {
+	switch req.path() {
+	case "/.well-known/core":
+		if req.Code != coapGET {
+			return &coapMessage{Code: coapMethodNotAllowed}
+		}
+		res := &coapMessage{Code: coapContent, Payload: []byte(`<` + coapReadingsPath + `>;rt="thm.readings";ct=60;obs`)}
+		res.addUintOption(coapOptContentFormat, coapFormatLinkFormat)
+		return res
+
+	case coapReadingsPath:
+		if req.Code != coapGET {
+			return &coapMessage{Code: coapMethodNotAllowed}
+		}
+		if accept, ok := req.uintOption(coapOptAccept); ok && accept != coapFormatCBOR {
+			return &coapMessage{Code: coapNotAcceptable}
+		}
+
+		res := s.readingsResponse()
+		if observe, ok := req.uintOption(coapOptObserve); ok {
+			s.mutex.Lock()
+			switch observe {
+			case 0:
+				s.register(from, req.Token)
+				res.addUintOption(coapOptObserve, s.seq)
+			case 1:
+				s.deregister(from)
+			}
+			s.mutex.Unlock()
+		}
+		return res
+
+	default:
+		return &coapMessage{Code: coapNotFound}
+	}
+}
+
+// handleReply handles an acknowledgement or reset, which can only refer to our
+// notifications.
+func (s *coapServer) handleReply(from netip.AddrPort, msg *coapMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, o := range s.observers {
+		if o.addr != from || o.lastMID != msg.MessageID {
+			continue
+		}
+		if msg.Type == coapRST {
+			// The observer forgot about us, so we forget about it.
+			s.deregister(from)
+		} else {
+			o.awaitingAck = false
+		}
+		return
+	}
+}
+
+// register adds an observer, replacing any previous registration from the same
+// address. Must be called with the mutex held.
+func (s *coapServer) register(addr netip.AddrPort, token []byte) {
+	s.deregister(addr)
+	if len(s.observers) == maxCoAPObservers {
+		s.observers = s.observers[1:]
+	}
+	s.observers = append(s.observers, &coapObserver{addr: addr, token: append([]byte(nil), token...)})
+	s.logger.Info("New CoAP observer", slog.String("addr", addr.String()))
+}
+
+// deregister removes the observer at addr, if any. Must be called with the
+// mutex held.
+func (s *coapServer) deregister(addr netip.AddrPort) {
+	for i, o := range s.observers {
+		if o.addr == addr {
+			s.observers = append(s.observers[:i], s.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// notifyLoop checks the readings every interval, and notifies observers when
+// they change (or when it's been a while since the last notification).
+func (s *coapServer) notifyLoop(interval time.Duration) {
+	var last Reading
+	var lastNotified time.Time
+	for range time.Tick(interval) {
+		now := time.Now()
+		r := s.readings.Latest(now)
+		changed := r.Temperature != last.Temperature || r.Humidity != last.Humidity || r.Flags != last.Flags
+		if !changed && now.Sub(lastNotified) < coapNotifyRefresh {
+			continue
+		}
+		last = r
+		lastNotified = now
+		s.notify()
+	}
+}
+
+// notify sends the current readings to all observers.
+func (s *coapServer) notify() {
+	res := s.readingsResponse()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq = (s.seq + 1) & 0xffffff // The Observe option has 24 bits.
+	for _, o := range append([]*coapObserver(nil), s.observers...) {
+		msg := *res
+		msg.Options = append([]coapOption(nil), res.Options...)
+		msg.addUintOption(coapOptObserve, s.seq)
+		msg.Token = o.token
+		msg.Type = coapNON
+		if o.sent%coapConfirmEvery == coapConfirmEvery-1 {
+			if o.awaitingAck {
+				s.logger.Info("Dropping unresponsive CoAP observer", slog.String("addr", o.addr.String()))
+				s.deregister(o.addr)
+				continue
+			}
+			msg.Type = coapCON
+			o.awaitingAck = true
+		}
+		o.sent++
+		msg.MessageID = s.nextMIDLocked()
+		o.lastMID = msg.MessageID
+		s.send(o.addr, &msg)
+	}
+}
+
+// readingsResponse returns a response with the current readings.
+func (s *coapServer) readingsResponse() *coapMessage {
+	now := time.Now()
+	r := s.readings.Latest(now)
+	if r.Flags&FlagNoReading != 0 {
+		res := &coapMessage{Code: coapServiceUnavailable}
+		res.addUintOption(coapOptMaxAge, uint32(sensorReadInterval/time.Second))
+		return res
+	}
+
+	wall, synced := s.clock()
+	clock := wallClock{local: now, wall: wall, synced: synced}
+	res := &coapMessage{Code: coapContent, Payload: appendReadingCBOR(nil, r, now, clock, "")}
+	res.addUintOption(coapOptContentFormat, coapFormatCBOR)
+	res.addUintOption(coapOptMaxAge, uint32(coapMaxAge/time.Second))
+	return res
+}
+
+// send sends msg to addr. Errors are only logged: as far as CoAP is concerned,
+// a message that failed to go out is the same as one lost on the way.
+func (s *coapServer) send(addr netip.AddrPort, msg *coapMessage) {
+	_, err := s.conn.WriteTo(msg.appendTo(nil), net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		s.logger.Warn("Sending CoAP message", slog.String("addr", addr.String()), slogError(err))
+	}
+}
+
+// nextMID returns a new message ID.
+func (s *coapServer) nextMID() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nextMIDLocked()
+}
+
+// nextMIDLocked returns a new message ID. Must be called with the mutex held.
+func (s *coapServer) nextMIDLocked() uint16 {
+	s.lastMID++
+	return s.lastMID
+}
+
+// appendReadingCBOR appends r to dst, encoded as a CBOR map:
+//
+//   - "t": when the reading was taken, in Unix time (only if the clock is
+//     synchronized);
+//   - "temp" and "hum": temperature in °C and relative humidity in %;
+//   - "age": seconds since the reading was taken;
+//   - "flags": the ReadingFlags, if any;
+//   - "loc": the location, if not empty.
+func appendReadingCBOR(dst []byte, r Reading, now time.Time, clock wallClock, location string) []byte {
+	n := 3
+	if clock.synced {
+		n++
+	}
+	if r.Flags != 0 {
+		n++
+	}
+	if location != "" {
+		n++
+	}
+
+	w := cborWriter{buf: dst}
+	w.beginMap(n)
+	if clock.synced {
+		w.string("t")
+		w.int(clock.at(r.Time).Unix())
+	}
+	w.string("temp")
+	w.float32(r.Temperature)
+	w.string("hum")
+	w.float32(r.Humidity)
+	w.string("age")
+	w.int(int64(now.Sub(r.Time) / time.Second))
+	if r.Flags != 0 {
+		w.string("flags")
+		w.int(int64(r.Flags))
+	}
+	if location != "" {
+		w.string("loc")
+		w.string(location)
+	}
+	return w.Bytes()
+}
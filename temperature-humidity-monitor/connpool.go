@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps track of the connections used for HTTP requests, and allows
+// reusing idle ones (AKA HTTP keep-alive). It also limits the total number of
+// connections, since each one needs one of the very few TCP ports we have.
+//
+// The pool knows nothing about the network stack: it deals with plain
+// net.Conns, and is told how to close them and how to check if they are still
+// usable.
+type connPool struct {
+	// mutex protects everything below.
+	mutex sync.Mutex
+
+	// maxConns is the maximum number of connections, active or idle.
+	maxConns int
+
+	// idleTimeout is how long an idle connection is kept around. Zero or
+	// negative means connections are never reused.
+	idleTimeout time.Duration
+
+	// open is the number of connections (or reservations for connections
+	// being dialed) counting against maxConns.
+	open int
+
+	// idle contains the idle connections, oldest first.
+	idle []*pooledConn
+
+	// changed is closed (and replaced by a new channel) whenever a connection
+	// is returned to the pool or closed, so that anyone waiting for a free
+	// slot can try again.
+	changed chan struct{}
+
+	// closeConn closes a connection for good.
+	closeConn func(net.Conn)
+
+	// usable tells if an idle connection can still be used; for example, it
+	// may have been closed by the server. Can be nil.
+	usable func(net.Conn) bool
+}
+
+// pooledConn is a connection managed by a connPool.
+type pooledConn struct {
+	// key identifies the server this connection goes to, like "example.com:80".
+	key string
+
+	// conn is the connection itself. It is nil for a fresh reservation: the
+	// caller is expected to dial and fill it (along with br and tr).
+	conn net.Conn
+
+	// br buffers reads from tr. It must be kept across requests on the same
+	// connection, or we might lose buffered bytes.
+	br *bufio.Reader
+
+	// tr reads from conn, with timeouts.
+	tr *timeoutReader
+
+	// reused tells if this connection was used by some previous request.
+	reused bool
+
+	// idleSince is when the connection was last returned to the pool.
+	idleSince time.Time
+}
+
+// newConnPool creates a new connPool.
+func newConnPool(maxConns int, idleTimeout time.Duration, closeConn func(net.Conn), usable func(net.Conn) bool) *connPool {
+	return &connPool{
+		maxConns:    maxConns,
+		idleTimeout: idleTimeout,
+		changed:     make(chan struct{}),
+		closeConn:   closeConn,
+		usable:      usable,
+	}
+}
+
+// get returns a connection to the server identified by key. If allowIdle is
+// true and there's a usable idle connection to that server, it is returned;
+// otherwise the returned pooledConn has a nil conn, meaning that a slot was
+// reserved and the caller must dial the connection itself.
+//
+// If all slots are busy, get evicts an idle connection to some other server, or
+// waits until some slot is freed or ctx is done.
+//
+// Every connection obtained from get must be given back with either put or
+// discard.
+func (p *connPool) get(ctx context.Context, key string, allowIdle bool) (*pooledConn, error) {
+	for {
+		p.mutex.Lock()
+		stale := p.pruneLocked()
+
+		if allowIdle {
+			if pc := p.takeIdleLocked(key); pc != nil {
+				p.mutex.Unlock()
+				p.closeAll(stale)
+				pc.reused = true
+				return pc, nil
+			}
+		}
+
+		if p.open-len(stale) >= p.maxConns && len(p.idle) > 0 {
+			// Make room by evicting the oldest idle connection.
+			stale = append(stale, p.idle[0])
+			p.idle = p.idle[1:]
+		}
+
+		if p.open-len(stale) < p.maxConns {
+			p.open++
+			p.mutex.Unlock()
+			p.closeAll(stale)
+			return &pooledConn{key: key}, nil
+		}
+
+		changed := p.changed
+		p.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctxError(ctx)
+		}
+	}
+}
+
+// put returns a connection to the pool, so that it can be reused by later
+// requests to the same server.
+func (p *connPool) put(pc *pooledConn) {
+	if p.idleTimeout <= 0 || pc.conn == nil {
+		p.discard(pc)
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc.idleSince = time.Now()
+	p.idle = append(p.idle, pc)
+	p.signalLocked()
+}
+
+// discard closes a connection (if it was dialed at all) and frees its slot.
+func (p *connPool) discard(pc *pooledConn) {
+	p.closeAll([]*pooledConn{pc})
+}
+
+// closeAll closes the given connections and frees their slots. Must be called
+// without holding the mutex, because closing a connection can take a while.
+func (p *connPool) closeAll(pcs []*pooledConn) {
+	if len(pcs) == 0 {
+		return
+	}
+	for _, pc := range pcs {
+		if pc.conn != nil {
+			p.closeConn(pc.conn)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.open -= len(pcs)
+	p.signalLocked()
+}
+
+// pruneLocked removes from the idle list any connections that have been idle
+// for too long or are no longer usable, and returns them. They still count as
+// open until passed to closeAll.
+func (p *connPool) pruneLocked() []*pooledConn {
+	var stale []*pooledConn
+	now := time.Now()
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if now.Sub(pc.idleSince) > p.idleTimeout || (p.usable != nil && !p.usable(pc.conn)) {
+			stale = append(stale, pc)
+			continue
+		}
+		kept = append(kept, pc)
+	}
+	for i := len(kept); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = kept
+	return stale
+}
+
+// takeIdleLocked removes and returns the most recently used idle connection to
+// the given server, if any.
+func (p *connPool) takeIdleLocked(key string) *pooledConn {
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		pc := p.idle[i]
+		if pc.key != key {
+			continue
+		}
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+		return pc
+	}
+	return nil
+}
+
+// signalLocked wakes up anyone waiting in get.
+func (p *connPool) signalLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPool is a connPool over net.Pipe connections, keeping track of the ones
+// it closes.
+type testPool struct {
+	*connPool
+
+	mutex  sync.Mutex
+	closed []net.Conn
+}
+
+// newTestPool returns a pool of maxConns connections, kept idle for
+// idleTimeout.
+func newTestPool(maxConns int, idleTimeout time.Duration) *testPool {
+	p := &testPool{}
+	p.connPool = newConnPool(maxConns, idleTimeout, func(c net.Conn) {
+		c.Close()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.closed = append(p.closed, c)
+	}, nil)
+	return p
+}
+
+// closedConns returns how many connections the pool closed.
+func (p *testPool) closedConns() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.closed)
+}
+
+// dial gets a connection to key, which must be a fresh one, and dials it.
+func (p *testPool) dial(t *testing.T, key string) *pooledConn {
+	t.Helper()
+	pc, err := p.get(context.Background(), key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.conn != nil {
+		t.Fatalf("got an idle connection to %s, want a fresh one", key)
+	}
+	pc.conn, _ = net.Pipe()
+	return pc
+}
+
+// getAsync calls get in the background, returning where the result goes.
+func (p *testPool) getAsync(ctx context.Context, key string) <-chan *pooledConn {
+	got := make(chan *pooledConn, 1)
+	go func() {
+		pc, err := p.get(ctx, key, true)
+		if err != nil {
+			pc = nil
+		}
+		got <- pc
+	}()
+	return got
+}
+
+// stillWaiting checks that nothing came out of got for a little while.
+func stillWaiting(t *testing.T, got <-chan *pooledConn) {
+	t.Helper()
+	select {
+	case pc := <-got:
+		t.Fatalf("got %+v while all slots were taken", pc)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnPoolWaitsForSlot(t *testing.T) {
+	p := newTestPool(2, time.Minute)
+	a := p.dial(t, "a:80")
+	p.dial(t, "b:80")
+
+	// With every slot taken by a connection in use, others wait in line.
+	got := p.getAsync(context.Background(), "c:80")
+	stillWaiting(t, got)
+
+	// Returning a connection to the pool lets them go on, making room by
+	// closing it.
+	p.put(a)
+	select {
+	case pc := <-got:
+		if pc == nil || pc.key != "c:80" || pc.conn != nil {
+			t.Errorf("got %+v, want a fresh slot for c:80", pc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after put")
+	}
+	if n := p.closedConns(); n != 1 || p.closed[0] != a.conn {
+		t.Errorf("closed %d connections, want the one put back", n)
+	}
+	if p.open != 2 || len(p.idle) != 0 {
+		t.Errorf("%d open, %d idle", p.open, len(p.idle))
+	}
+}
+
+func TestConnPoolWaitExpires(t *testing.T) {
+	p := newTestPool(1, time.Minute)
+	p.dial(t, "a:80")
+
+	// Running out of time waiting for a slot is a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.get(ctx, "b:80", true)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+
+	// Being cancelled isn't.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = p.get(ctx, "b:80", true)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+
+	// Either way, the slot is still ours, and nothing else was reserved.
+	if p.open != 1 {
+		t.Errorf("%d open", p.open)
+	}
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	p := newTestPool(4, time.Minute)
+	a1 := p.dial(t, "a:80")
+	a2 := p.dial(t, "a:80")
+	p.put(a1)
+	p.put(a2)
+
+	// The idle connection used last goes first.
+	pc, err := p.get(context.Background(), "a:80", true)
+	if err != nil || pc != a2 || !pc.reused {
+		t.Errorf("got %+v, %v, want the second connection, reused", pc, err)
+	}
+
+	// Unless asked for a fresh one, or for another server.
+	for _, key := range []string{"a:80", "b:80", "a:8080"} {
+		pc, err := p.get(context.Background(), key, key != "a:80")
+		if err != nil || pc.conn != nil {
+			t.Errorf("%s: got %+v, %v, want a fresh slot", key, pc, err)
+		}
+		p.discard(pc)
+	}
+	if len(p.idle) != 1 || p.idle[0] != a1 || p.closedConns() != 0 {
+		t.Errorf("idle %v, %d closed", p.idle, p.closedConns())
+	}
+
+	// Connections are never kept without an idle timeout.
+	p = newTestPool(4, -1)
+	pc = p.dial(t, "a:80")
+	p.put(pc)
+	if len(p.idle) != 0 || p.open != 0 || p.closedConns() != 1 {
+		t.Errorf("%d idle, %d open, %d closed", len(p.idle), p.open, p.closedConns())
+	}
+}
+
+func TestConnPoolPrune(t *testing.T) {
+	p := newTestPool(4, time.Minute)
+	old := p.dial(t, "a:80")
+	recent := p.dial(t, "b:80")
+	p.put(old)
+	p.put(recent)
+	old.idleSince = time.Now().Add(-time.Minute - time.Second)
+	recent.idleSince = time.Now().Add(-time.Minute + time.Second)
+
+	// Connections idle for longer than the timeout are closed at the next
+	// get, whatever it's for.
+	pc, err := p.get(context.Background(), "c:80", true)
+	if err != nil || pc.conn != nil {
+		t.Fatalf("got %+v, %v", pc, err)
+	}
+	if p.closedConns() != 1 || p.closed[0] != old.conn || len(p.idle) != 1 || p.open != 2 {
+		t.Errorf("%d closed, %d idle, %d open", p.closedConns(), len(p.idle), p.open)
+	}
+	pc, err = p.get(context.Background(), "a:80", true)
+	if err != nil || pc.conn != nil {
+		t.Errorf("got %+v, %v, want a fresh slot", pc, err)
+	}
+
+	// And so are those that aren't usable anymore.
+	p.usable = func(c net.Conn) bool { return c != recent.conn }
+	pc, err = p.get(context.Background(), "b:80", true)
+	if err != nil || pc.conn != nil {
+		t.Errorf("got %+v, %v, want a fresh slot", pc, err)
+	}
+	if p.closedConns() != 2 || len(p.idle) != 0 || p.open != 3 {
+		t.Errorf("%d closed, %d idle, %d open", p.closedConns(), len(p.idle), p.open)
+	}
+}
+
+func TestConnPoolEvictsOldest(t *testing.T) {
+	p := newTestPool(3, time.Minute)
+	a := p.dial(t, "a:80")
+	b := p.dial(t, "b:80")
+	c := p.dial(t, "c:80")
+	p.put(b)
+	p.put(a)
+	p.put(c)
+
+	// With all slots taken, a new connection takes the place of the idle
+	// connection returned first.
+	for _, want := range []*pooledConn{b, a} {
+		pc, err := p.get(context.Background(), "d:80", true)
+		if err != nil || pc.conn != nil {
+			t.Fatalf("got %+v, %v", pc, err)
+		}
+		if n := p.closedConns(); p.closed[n-1] != want.conn {
+			t.Errorf("evicted the wrong connection, want the one to %s", want.key)
+		}
+		pc.conn, _ = net.Pipe()
+	}
+	if len(p.idle) != 1 || p.idle[0] != c || p.open != 3 {
+		t.Errorf("idle %v, %d open", p.idle, p.open)
+	}
+}
+
+func TestConnPoolWakesWaiters(t *testing.T) {
+	p := newTestPool(1, time.Minute)
+	a := p.dial(t, "a:80")
+	got := p.getAsync(context.Background(), "a:80")
+	stillWaiting(t, got)
+
+	// A connection put back goes to whoever was waiting for one to the same
+	// server.
+	p.put(a)
+	var pc *pooledConn
+	select {
+	case pc = <-got:
+		if pc != a || !pc.reused {
+			t.Errorf("got %+v, want the connection put back", pc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after put")
+	}
+
+	// A connection that failed frees its slot, and whoever was waiting for
+	// one gets a fresh connection, not the failed one.
+	got = p.getAsync(context.Background(), "a:80")
+	stillWaiting(t, got)
+	p.discard(pc)
+	select {
+	case pc := <-got:
+		if pc == nil || pc.conn != nil || pc.reused {
+			t.Errorf("got %+v, want a fresh slot", pc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after discard")
+	}
+	if p.closedConns() != 1 || p.open != 1 {
+		t.Errorf("%d closed, %d open", p.closedConns(), p.open)
+	}
+}
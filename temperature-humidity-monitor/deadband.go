@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+//
+// Report-on-change: deciding which readings are worth sending, so that we don't
+// spend radio time and database rows on the same values over and over. A
+// measurement is reported when it changes by more than some delta since it was
+// last reported, or when it hasn't been reported for a while, whichever comes
+// first. A change in the quality of the readings, as when the sensor fails or
+// recovers, is always reported.
+//
+// Like the aggregate package, nothing in here knows about the sensor or the
+// network. It takes timestamps, values and flags, so recorded sequences of
+// readings can be replayed through it.
+//
+
+const (
+	// defaultTemperatureDelta and defaultHumidityDelta are how much the
+	// measurements must change to be reported, unless the settings say
+	// otherwise. The DHT22 measures in tenths, and often flickers by one, so
+	// a change of a tenth is not worth telling.
+	defaultTemperatureDelta = 0.1
+	defaultHumidityDelta    = 1
+
+	// defaultReportHeartbeat is the longest we go without reporting, unless
+	// the settings say otherwise.
+	defaultReportHeartbeat = 15 * time.Minute
+
+	// reportFaults are the reading flags telling that the values can't be
+	// trusted. A single failed read is normal for the DHT22, so
+	// FlagSensorError isn't one: the values only go stale after a few.
+	reportFaults = FlagStale | FlagOutOfRange
+
+	// deadbandSlack is added to the deltas when comparing, because the
+	// values are tenths that went through float32: 20.1-20.0 is not quite
+	// 0.1.
+	deadbandSlack = 1e-3
+)
+
+// reportPolicy tells when a measurement is worth reporting.
+type reportPolicy struct {
+	// Delta is how much the value must change, since it was last reported,
+	// to report it again. Zero means any change.
+	Delta float64
+
+	// Heartbeat is the longest we go without reporting the value, changed
+	// or not, so that whoever receives it knows we are still there. Zero
+	// means forever.
+	Heartbeat time.Duration
+}
+
+// reportPolicies are the report policies for all of our measurements.
+type reportPolicies struct {
+	Temperature reportPolicy
+	Humidity    reportPolicy
+}
+
+// heartbeat returns the longest the reporter goes without reporting, with a
+// good sensor, or zero if there's no limit.
+func (p reportPolicies) heartbeat() time.Duration {
+	switch {
+	case p.Temperature.Heartbeat == 0:
+		return p.Humidity.Heartbeat
+	case p.Humidity.Heartbeat == 0:
+		return p.Temperature.Heartbeat
+	default:
+		return min(p.Temperature.Heartbeat, p.Humidity.Heartbeat)
+	}
+}
+
+// deadband follows what was last reported of a measurement, to decide if a
+// new value is worth reporting. The zero value, with the zero policy, reports
+// every change.
+//
+// Not safe for concurrent use.
+type deadband struct {
+	// policy is the policy to follow.
+	policy reportPolicy
+
+	// reported tells if we reported anything yet; value, quality and time
+	// tell what and when, quality being the reportFaults flags of the
+	// reading.
+	reported bool
+	value    float64
+	quality  ReadingFlags
+	time     time.Time
+}
+
+// due tells if value v, at time t and with the given quality, is worth
+// reporting. The values of readings with faults are meaningless, so only the
+// heartbeat and quality changes count for them.
+func (d *deadband) due(t time.Time, v float64, quality ReadingFlags) bool {
+	switch {
+	case !d.reported || quality != d.quality:
+		return true
+	case t.Before(d.time):
+		// The clock went back. Better to report twice than never.
+		return true
+	case d.policy.Heartbeat > 0 && t.Sub(d.time) >= d.policy.Heartbeat:
+		return true
+	case quality != 0:
+		return false
+	case math.IsNaN(v) || math.IsNaN(d.value):
+		return math.IsNaN(v) != math.IsNaN(d.value)
+	default:
+		return math.Abs(v-d.value) > d.policy.Delta+deadbandSlack
+	}
+}
+
+// markReported records that value v was reported at time t, with the given
+// quality.
+func (d *deadband) markReported(t time.Time, v float64, quality ReadingFlags) {
+	d.reported = true
+	d.value = v
+	d.quality = quality
+	d.time = t
+}
+
+// check is due followed by markReported, for when reporting can't fail.
+func (d *deadband) check(t time.Time, v float64, quality ReadingFlags) bool {
+	if !d.due(t, v, quality) {
+		return false
+	}
+	d.markReported(t, v, quality)
+	return true
+}
+
+// reset forgets what was reported, so that the next value is reported no
+// matter what. For when the receiving end may have missed it.
+func (d *deadband) reset() {
+	d.reported = false
+}
+
+// readingReporter decides which readings are worth reporting, for those who
+// send whole readings at once: if either measurement is due, both are sent.
+//
+// Not safe for concurrent use.
+type readingReporter struct {
+	temperature deadband
+	humidity    deadband
+}
+
+// newReadingReporter returns a reporter following the given policies.
+func newReadingReporter(policies reportPolicies) *readingReporter {
+	return &readingReporter{
+		temperature: deadband{policy: policies.Temperature},
+		humidity:    deadband{policy: policies.Humidity},
+	}
+}
+
+// due tells if reading r is worth reporting at time now. A reading with
+// FlagNoReading never is: there's nothing to report before the first one.
+//
+// The heartbeat counts from now, rather than from r.Time, which doesn't move
+// while the sensor is failing.
+func (rr *readingReporter) due(now time.Time, r Reading) bool {
+	if r.Flags&FlagNoReading != 0 {
+		return false
+	}
+	quality := r.Flags & reportFaults
+	return rr.temperature.due(now, float64(r.Temperature), quality) ||
+		rr.humidity.due(now, float64(r.Humidity), quality)
+}
+
+// markReported records that reading r was reported at time now.
+func (rr *readingReporter) markReported(now time.Time, r Reading) {
+	quality := r.Flags & reportFaults
+	rr.temperature.markReported(now, float64(r.Temperature), quality)
+	rr.humidity.markReported(now, float64(r.Humidity), quality)
+}
+
+// reset makes the next reading due, no matter what.
+func (rr *readingReporter) reset() {
+	rr.temperature.reset()
+	rr.humidity.reset()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"simple-minded-home/thm/internal/aggregate"
+)
+
+// deadbandEpoch is when the recordings below start.
+var deadbandEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// deadbandStep is a reading in a recording, and whether it should be reported.
+type deadbandStep struct {
+	sec     int
+	value   float32
+	quality ReadingFlags
+	want    bool
+}
+
+// replayDeadband feeds the steps to a deadband with the given policy, checking
+// which are reported. Values are float32, as they come from the sensor.
+func replayDeadband(t *testing.T, policy reportPolicy, steps []deadbandStep) {
+	t.Helper()
+	d := deadband{policy: policy}
+	for i, s := range steps {
+		at := deadbandEpoch.Add(time.Duration(s.sec) * time.Second)
+		if got := d.check(at, float64(s.value), s.quality); got != s.want {
+			t.Errorf("step %d, %v at %ds with quality %#x: reported %v, want %v", i, s.value, s.sec, s.quality, got, s.want)
+		}
+	}
+}
+
+func TestDeadbandDelta(t *testing.T) {
+	replayDeadband(t, reportPolicy{Delta: 0.1}, []deadbandStep{
+		{0, 20.0, 0, true},
+		{5, 20.1, 0, false},
+		{10, 19.9, 0, false},
+		{15, 20.2, 0, true},
+		{20, 20.1, 0, false},
+		{25, 20.3, 0, false},
+		{30, 20.0, 0, true},
+
+		// Creeping up a tenth at a time doesn't go unnoticed: it's
+		// measured from what was last reported.
+		{35, 20.1, 0, false},
+		{40, 20.2, 0, true},
+		{45, 20.3, 0, false},
+		{50, 20.4, 0, true},
+	})
+
+	// Below zero, too.
+	replayDeadband(t, reportPolicy{Delta: 0.5}, []deadbandStep{
+		{0, -0.2, 0, true},
+		{5, 0.3, 0, false},
+		{10, -0.7, 0, false},
+		{15, -0.8, 0, true},
+		{20, -0.3, 0, false},
+		{25, -1.4, 0, true},
+	})
+
+	// The zero policy reports any change.
+	replayDeadband(t, reportPolicy{}, []deadbandStep{
+		{0, 45.0, 0, true},
+		{5, 45.0, 0, false},
+		{10, 45.1, 0, true},
+		{15, 45.1, 0, false},
+		{20, 45.0, 0, true},
+		{3600, 45.0, 0, false},
+	})
+}
+
+func TestDeadbandDeltaTenths(t *testing.T) {
+	// Whatever the tenths, a change of exactly the delta is not reported,
+	// and a tenth more is, even though float32 doesn't quite get the
+	// tenths right.
+	for _, delta := range []float64{0.1, 0.2, 0.5, 1, 2.5} {
+		tenths := int(math.Round(delta * 10))
+		for base := -400; base <= 1000; base++ {
+			from := float64(float32(float64(base) / 10))
+			for _, sign := range []int{1, -1} {
+				d := deadband{policy: reportPolicy{Delta: delta}}
+				d.check(deadbandEpoch, from, 0)
+				exact := float64(float32(float64(base+sign*tenths) / 10))
+				more := float64(float32(float64(base+sign*(tenths+1)) / 10))
+				if d.due(deadbandEpoch, exact, 0) {
+					t.Fatalf("delta %v: %v to %v reported", delta, from, exact)
+				}
+				if !d.due(deadbandEpoch, more, 0) {
+					t.Fatalf("delta %v: %v to %v not reported", delta, from, more)
+				}
+			}
+		}
+	}
+}
+
+func TestDeadbandHeartbeat(t *testing.T) {
+	replayDeadband(t, reportPolicy{Delta: 1, Heartbeat: time.Minute}, []deadbandStep{
+		{0, 50, 0, true},
+		{30, 50, 0, false},
+		{59, 50.5, 0, false},
+		{60, 50.5, 0, true},
+
+		// The heartbeat counts from the last report, whatever the reason
+		// for it.
+		{90, 52, 0, true},
+		{149, 52, 0, false},
+		{150, 52, 0, true},
+		{300, 52, 0, true},
+		{301, 52, 0, false},
+	})
+
+	// The heartbeat goes on while the values can't be trusted.
+	replayDeadband(t, reportPolicy{Delta: 1, Heartbeat: time.Minute}, []deadbandStep{
+		{0, 50, FlagStale, true},
+		{59, 50, FlagStale, false},
+		{60, 50, FlagStale, true},
+	})
+
+	// Without a heartbeat, the same value is never reported again.
+	replayDeadband(t, reportPolicy{Delta: 1}, []deadbandStep{
+		{0, 50, 0, true},
+		{86400, 50, 0, false},
+		{365 * 86400, 50, 0, false},
+	})
+}
+
+func TestDeadbandQuality(t *testing.T) {
+	replayDeadband(t, reportPolicy{Delta: 0.1, Heartbeat: time.Minute}, []deadbandStep{
+		{0, 20.0, 0, true},
+
+		// The sensor goes stale: we say so right away, same value or
+		// not, and then only with the heartbeat, whatever the values.
+		{5, 20.0, FlagStale, true},
+		{10, 25.0, FlagStale, false},
+		{15, -40.0, FlagStale, false},
+		{65, 20.0, FlagStale, true},
+
+		// It comes back, even with the same value.
+		{70, 20.0, 0, true},
+		{75, 20.0, 0, false},
+
+		// A reading out of range is a different fault.
+		{80, 20.0, FlagOutOfRange, true},
+		{85, 20.0, FlagOutOfRange | FlagStale, true},
+		{90, 20.0, FlagOutOfRange | FlagStale, false},
+		{95, 20.0, FlagStale, true},
+		{100, 20.1, 0, true},
+	})
+}
+
+func TestDeadbandNaN(t *testing.T) {
+	nan := float32(math.NaN())
+	replayDeadband(t, reportPolicy{Delta: 0.1}, []deadbandStep{
+		{0, nan, 0, true},
+		{5, nan, 0, false},
+		{10, 20.0, 0, true},
+		{15, 20.0, 0, false},
+		{20, nan, 0, true},
+		{25, nan, 0, false},
+		{30, 20.0, 0, true},
+	})
+
+	// With faults, values don't count, NaN or not.
+	replayDeadband(t, reportPolicy{Delta: 0.1}, []deadbandStep{
+		{0, 20.0, FlagStale, true},
+		{5, nan, FlagStale, false},
+		{10, 20.0, FlagStale, false},
+	})
+}
+
+func TestDeadbandClockBack(t *testing.T) {
+	replayDeadband(t, reportPolicy{Delta: 0.1, Heartbeat: time.Minute}, []deadbandStep{
+		{3600, 20.0, 0, true},
+		{3610, 20.0, 0, false},
+
+		// The clock goes back an hour: better to report twice than to
+		// wait an hour for the heartbeat.
+		{10, 20.0, 0, true},
+		{20, 20.0, 0, false},
+		{70, 20.0, 0, true},
+
+		// Going back just a little counts too.
+		{69, 20.0, 0, true},
+	})
+}
+
+func TestDeadbandReset(t *testing.T) {
+	d := deadband{policy: reportPolicy{Delta: 1, Heartbeat: time.Hour}}
+	d.check(deadbandEpoch, 50, 0)
+	if d.check(deadbandEpoch.Add(time.Second), 50, 0) {
+		t.Error("reported the same value again")
+	}
+	d.reset()
+	if !d.check(deadbandEpoch.Add(2*time.Second), 50, 0) {
+		t.Error("not reported after reset")
+	}
+
+	// due doesn't record anything, so it keeps saying yes until the
+	// report is marked.
+	d.reset()
+	for range 2 {
+		if !d.due(deadbandEpoch.Add(3*time.Second), 50, 0) {
+			t.Error("not due after reset")
+		}
+	}
+	d.markReported(deadbandEpoch.Add(3*time.Second), 50, 0)
+	if d.due(deadbandEpoch.Add(4*time.Second), 50, 0) {
+		t.Error("due after being marked")
+	}
+}
+
+func TestReportPoliciesHeartbeat(t *testing.T) {
+	tests := []struct {
+		temperature, humidity, want time.Duration
+	}{
+		{0, 0, 0},
+		{time.Minute, 0, time.Minute},
+		{0, time.Hour, time.Hour},
+		{time.Hour, time.Minute, time.Minute},
+		{time.Minute, time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		p := reportPolicies{Temperature: reportPolicy{Heartbeat: tt.temperature}, Humidity: reportPolicy{Heartbeat: tt.humidity}}
+		if got := p.heartbeat(); got != tt.want {
+			t.Errorf("heartbeat(%v, %v) = %v, want %v", tt.temperature, tt.humidity, got, tt.want)
+		}
+	}
+}
+
+func TestReadingReporter(t *testing.T) {
+	rr := newReadingReporter(reportPolicies{
+		Temperature: reportPolicy{Delta: 0.1, Heartbeat: 15 * time.Minute},
+		Humidity:    reportPolicy{Delta: 1, Heartbeat: 15 * time.Minute},
+	})
+	readAt := deadbandEpoch
+	steps := []struct {
+		sec         int
+		temperature float32
+		humidity    float32
+		flags       ReadingFlags
+		want        bool
+	}{
+		// Nothing to say before the first reading.
+		{0, 0, 0, FlagNoReading, false},
+		{5, 20.0, 50.0, 0, true},
+		{10, 20.1, 50.9, 0, false},
+
+		// Either measurement changing sends both.
+		{15, 20.0, 51.5, 0, true},
+		{20, 20.2, 51.5, 0, true},
+
+		// A failed read is normal for the DHT22: not a fault until the
+		// reading goes stale.
+		{25, 20.2, 51.5, FlagSensorError, false},
+		{30, 20.2, 51.5, FlagSensorError | FlagStale, true},
+		{35, 20.2, 51.5, FlagSensorError | FlagStale, false},
+
+		// The heartbeat counts from now, even if the reading is stuck
+		// in the past.
+		{20 + 15*60, 20.2, 51.5, FlagSensorError | FlagStale, false},
+		{30 + 15*60, 20.2, 51.5, FlagSensorError | FlagStale, true},
+		{40 + 15*60, 20.2, 51.5, 0, true},
+	}
+	for i, s := range steps {
+		now := deadbandEpoch.Add(time.Duration(s.sec) * time.Second)
+		if s.flags&FlagStale == 0 {
+			readAt = now
+		}
+		r := Reading{Time: readAt, Temperature: s.temperature, Humidity: s.humidity, Flags: s.flags}
+		got := rr.due(now, r)
+		if got != s.want {
+			t.Errorf("step %d, %+v at %ds: due %v, want %v", i, r, s.sec, got, s.want)
+		}
+		if got {
+			rr.markReported(now, r)
+		}
+	}
+
+	// After a reset, the next reading is due, but a missing one still
+	// isn't.
+	rr.reset()
+	now := deadbandEpoch.Add(time.Hour)
+	if rr.due(now, Reading{Flags: FlagNoReading}) {
+		t.Error("no reading due after reset")
+	}
+	if !rr.due(now, Reading{Time: now, Temperature: 20.2, Humidity: 51.5}) {
+		t.Error("not due after reset")
+	}
+}
+
+func TestEnvServerWorthReporting(t *testing.T) {
+	s := &envServerSink{deadbands: []deadband{
+		{policy: reportPolicy{Delta: 0.1, Heartbeat: 15 * time.Minute}},
+		{policy: reportPolicy{Delta: 1, Heartbeat: 15 * time.Minute}},
+	}}
+	steps := []struct {
+		minute                int
+		temperature, humidity float64
+		want                  []int // The counts of the stats left, or nil if not reported.
+	}{
+		{0, 20.0, 50.0, []int{1, 1}},
+		{5, 20.05, 50.5, nil},
+		{10, 20.3, 50.5, []int{1, 0}},
+		{15, 20.3, 51.5, []int{0, 1}},
+		{20, 20.3, 51.5, nil},
+		{25, 20.3, 51.5, []int{1, 0}},
+		{30, 20.3, math.NaN(), nil},
+
+		// After a hole, everything is reported.
+		{40, 20.3, 51.5, []int{1, 1}},
+		{45, 20.3, 51.5, nil},
+
+		// The heartbeat, counting from the window starts.
+		{55, 20.3, 51.5, []int{1, 1}},
+	}
+	for _, step := range steps {
+		w := aggregate.Window{
+			Start: deadbandEpoch.Add(time.Duration(step.minute) * time.Minute),
+			Width: 5 * time.Minute,
+			Stats: make([]aggregate.Stats, 2),
+		}
+		w.Stats[0].Add(step.temperature)
+		w.Stats[1].Add(step.humidity)
+		got := s.worthReporting(&w)
+		if got != (step.want != nil) {
+			t.Errorf("minute %d: worth reporting %v, want %v", step.minute, got, step.want != nil)
+			continue
+		}
+		for i, count := range step.want {
+			if w.Stats[i].Count != count {
+				t.Errorf("minute %d: stats %d left with %d values, want %d", step.minute, i, w.Stats[i].Count, count)
+			}
+		}
+	}
+}
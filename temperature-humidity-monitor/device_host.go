@@ -0,0 +1,11 @@
+//go:build !tinygo
+
+package main
+
+import "github.com/soypat/cyw43439"
+
+// newPicoWDevice returns nil: off the Pico there's no WiFi chip to talk to. We
+// build for the host only to run the tests, which don't need one.
+func newPicoWDevice() *cyw43439.Device {
+	return nil
+}
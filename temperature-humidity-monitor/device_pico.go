@@ -0,0 +1,11 @@
+//go:build tinygo
+
+package main
+
+import "github.com/soypat/cyw43439"
+
+// newPicoWDevice returns the WiFi chip of the Pico W. Building with TinyGo for
+// any other board fails here, as it should: the firmware is for the Pico W.
+func newPicoWDevice() *cyw43439.Device {
+	return cyw43439.NewPicoWDevice()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth/dns"
+)
+
+//
+// DNS-SD browsing (RFC 6763): finding a service on the local network by its
+// type, like "_smh-env._tcp.local.", without knowing where it runs.
+//
+// We do it with one-shot mDNS queries, sent from an ephemeral port. Responders
+// answer these unicast, straight back to that port, so we don't depend on
+// receiving multicast, nor compete with our own responder for port 5353.
+//
+
+const (
+	// dnssdQueryInterval is how long we wait for answers before asking
+	// again. Each query asks for whatever we are still missing.
+	dnssdQueryInterval = time.Second
+)
+
+// errServiceNotFound is returned by browseDNSSD when nobody answered for the
+// service before the context ran out.
+var errServiceNotFound = errors.New("service not found")
+
+// dnssdService is a service instance found by browsing.
+type dnssdService struct {
+	// Instance is the instance name, like "env-server._smh-env._tcp.local.".
+	Instance string
+
+	// Host is the name of the host where the instance runs, like
+	// "pi3.local.", and AddrPort is its address and the service port.
+	Host     string
+	AddrPort netip.AddrPort
+
+	// TXT has the key/value pairs from the instance's TXT record. Keys are
+	// lowercase, as they are case-insensitive.
+	TXT map[string]string
+}
+
+// dnssdSRV is the interesting part of an SRV record.
+type dnssdSRV struct {
+	host string
+	port uint16
+}
+
+// dnssdBrowse is the state of a browse: everything we learned so far. Names
+// are kept lowercase, as DNS names are case-insensitive.
+type dnssdBrowse struct {
+	// service is the service type we are looking for.
+	service string
+
+	// instances are the instance names found, in the order they came.
+	instances []string
+
+	// srv, txt and addrs are the SRV, TXT and A records received, by name.
+	srv   map[string]dnssdSRV
+	txt   map[string]map[string]string
+	addrs map[string]netip.Addr
+}
+
+// browseDNSSD looks for an instance of service on the local network, returning
+// the first one found complete: with its host, port and address. Keeps asking
+// until it finds one or ctx is done.
+func (pn *PicoNet) browseDNSSD(ctx context.Context, service string) (dnssdService, error) {
+	conn, err := pn.ListenUDP(0)
+	if err != nil {
+		return dnssdService{}, err
+	}
+	defer conn.Close()
+
+	b := newDNSSDBrowse(service)
+	id := uint16(rand.Uint32())
+	group := net.UDPAddrFromAddrPort(netip.AddrPortFrom(mdnsGroup, mdnsPort))
+	buf := make([]byte, maxUDPPayload)
+	sendQuery := true
+	var nextQuery time.Time
+
+	for {
+		if s, ok := b.found(); ok {
+			return s, nil
+		}
+		if sendQuery || !time.Now().Before(nextQuery) {
+			query, err := b.appendQuery(nil, id)
+			if err != nil {
+				return dnssdService{}, err
+			}
+			_, err = conn.WriteTo(query, group)
+			if err != nil {
+				return dnssdService{}, err
+			}
+			sendQuery = false
+			nextQuery = time.Now().Add(dnssdQueryInterval)
+		}
+
+		deadline := nextQuery
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return dnssdService{}, err
+			}
+			if ctx.Err() != nil {
+				return dnssdService{}, fmt.Errorf("%w: %s: %w", errServiceNotFound, service, timeoutError(ctx, err))
+			}
+			continue
+		}
+
+		// A response that taught us something, but not all we need, is
+		// followed right away by a query for the rest.
+		progress, err := b.parse(buf[:n])
+		if err == nil && progress {
+			sendQuery = true
+		}
+	}
+}
+
+// newDNSSDBrowse returns a browse for service, with nothing learned yet.
+func newDNSSDBrowse(service string) *dnssdBrowse {
+	return &dnssdBrowse{
+		service: strings.ToLower(service),
+		srv:     make(map[string]dnssdSRV),
+		txt:     make(map[string]map[string]string),
+		addrs:   make(map[string]netip.Addr),
+	}
+}
+
+// found returns the first instance we know everything about, if any.
+func (b *dnssdBrowse) found() (dnssdService, bool) {
+	for _, instance := range b.instances {
+		srv, ok := b.srv[instance]
+		if !ok {
+			continue
+		}
+		addr, ok := b.addrs[srv.host]
+		if !ok {
+			continue
+		}
+		return dnssdService{
+			Instance: instance,
+			Host:     srv.host,
+			AddrPort: netip.AddrPortFrom(addr, srv.port),
+			TXT:      b.txt[instance],
+		}, true
+	}
+	return dnssdService{}, false
+}
+
+// appendQuery appends to dst a query asking for what we still miss: the
+// instances of the service, the SRV and TXT records of the instances, and the
+// addresses of their hosts.
+func (b *dnssdBrowse) appendQuery(dst []byte, id uint16) ([]byte, error) {
+	type question struct {
+		name string
+		typ  dns.Type
+	}
+	questions := []question{{b.service, dns.TypePTR}}
+	for _, instance := range b.instances {
+		srv, ok := b.srv[instance]
+		if !ok {
+			questions = append(questions, question{instance, dns.TypeSRV})
+			continue
+		}
+		if _, ok := b.txt[instance]; !ok {
+			questions = append(questions, question{instance, dns.TypeTXT})
+		}
+		if _, ok := b.addrs[srv.host]; !ok {
+			questions = append(questions, question{srv.host, dns.TypeA})
+		}
+	}
+	questions = questions[:min(len(questions), mdnsMaxQuestions)]
+
+	hdr := dns.Header{TransactionID: id, QDCount: uint16(len(questions))}
+	start := len(dst)
+	dst = append(dst, make([]byte, dns.SizeHeader)...)
+	hdr.Put(dst[start:])
+	for _, q := range questions {
+		name, err := dns.NewName(q.name)
+		if err != nil {
+			return nil, err
+		}
+		dst, err = name.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(q.typ))
+		dst = binary.BigEndian.AppendUint16(dst, uint16(dns.ClassINET))
+	}
+	return dst, nil
+}
+
+// parse takes in the records of the mDNS response msg. Returns whether we
+// learned anything new.
+//
+// The records are decoded one by one, right from msg, instead of with
+// dns.Message: names inside the records' data can be compressed, pointing
+// anywhere in the message, and dns.Resource keeps only a copy of the data.
+func (b *dnssdBrowse) parse(msg []byte) (progress bool, err error) {
+	if len(msg) < dns.SizeHeader {
+		return false, errors.New("DNS message too short")
+	}
+	hdr := dns.DecodeHeader(msg)
+	if !hdr.Flags.IsResponse() {
+		return false, nil
+	}
+
+	off := uint16(dns.SizeHeader)
+	for range hdr.QDCount {
+		var q dns.Question
+		off, err = q.Decode(msg, off)
+		if err != nil {
+			return progress, err
+		}
+	}
+
+	for range int(hdr.ANCount) + int(hdr.NSCount) + int(hdr.ARCount) {
+		var rh dns.ResourceHeader
+		off, err = rh.Decode(msg, off)
+		if err != nil {
+			return progress, err
+		}
+		end := int(off) + int(rh.Length)
+		if end > len(msg) {
+			return progress, errors.New("DNS record too long")
+		}
+		if b.parseRecord(msg, off, &rh) {
+			progress = true
+		}
+		off = uint16(end)
+	}
+	return progress, nil
+}
+
+// parseRecord takes in the record with header rh, whose data starts at off in
+// msg. Returns whether it was new and interesting.
+func (b *dnssdBrowse) parseRecord(msg []byte, off uint16, rh *dns.ResourceHeader) bool {
+	name := strings.ToLower(rh.Name.String())
+	data := msg[off : off+rh.Length]
+	switch rh.Type {
+	case dns.TypePTR:
+		if name != b.service {
+			return false
+		}
+		var target dns.Name
+		if _, err := target.Decode(msg, off); err != nil {
+			return false
+		}
+		instance := strings.ToLower(target.String())
+		for _, known := range b.instances {
+			if known == instance {
+				return false
+			}
+		}
+		b.instances = append(b.instances, instance)
+
+	case dns.TypeSRV:
+		if _, ok := b.srv[name]; ok || len(data) < 7 {
+			return false
+		}
+		var target dns.Name
+		if _, err := target.Decode(msg, off+6); err != nil {
+			return false
+		}
+		b.srv[name] = dnssdSRV{
+			host: strings.ToLower(target.String()),
+			port: binary.BigEndian.Uint16(data[4:]),
+		}
+
+	case dns.TypeTXT:
+		if _, ok := b.txt[name]; ok {
+			return false
+		}
+		b.txt[name] = parseTXT(data)
+
+	case dns.TypeA:
+		if _, ok := b.addrs[name]; ok || len(data) != 4 {
+			return false
+		}
+		b.addrs[name] = netip.AddrFrom4([4]byte(data))
+
+	default:
+		return false
+	}
+	return true
+}
+
+// parseTXT parses the data of a DNS-SD TXT record: a sequence of key=value
+// strings, each with its length in front. Keys without a value get an empty
+// one, and only the first occurrence of a key counts, as RFC 6763 says.
+func parseTXT(data []byte) map[string]string {
+	txt := make(map[string]string)
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			break
+		}
+		s := string(data[1 : 1+n])
+		data = data[1+n:]
+
+		key, value, _ := strings.Cut(s, "=")
+		key = strings.ToLower(key)
+		if _, ok := txt[key]; !ok && key != "" {
+			txt[key] = value
+		}
+	}
+	return txt
+}
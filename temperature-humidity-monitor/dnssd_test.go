@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soypat/seqs/eth/dns"
+	"github.com/soypat/seqs/stacks"
+)
+
+// dnsMessage builds DNS messages in wire format, by hand, so that tests can
+// put records in whatever section and compress names however they like.
+type dnsMessage struct {
+	buf []byte
+}
+
+// newDNSResponse starts a response with the given number of answers and
+// additional records, which must follow.
+func newDNSResponse(answers, additionals int) *dnsMessage {
+	m := &dnsMessage{buf: []byte{0, 0, 0x84, 0, 0, 0}}
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(answers))
+	m.buf = append(m.buf, 0, 0)
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(additionals))
+	return m
+}
+
+// record appends a record, returning the offset of its name, for pointers to
+// point at.
+func (m *dnsMessage) record(name []byte, typ dns.Type, data ...[]byte) int {
+	off := len(m.buf)
+	m.buf = append(m.buf, name...)
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(typ))
+	m.buf = append(m.buf, 0x80, 0x01, 0, 0, 0x11, 0x94) // Class IN, cache flush, TTL 4500.
+	n := 0
+	for _, d := range data {
+		n += len(d)
+	}
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	for _, d := range data {
+		m.buf = append(m.buf, d...)
+	}
+	return off
+}
+
+// offset returns where the next thing appended goes.
+func (m *dnsMessage) offset() int {
+	return len(m.buf)
+}
+
+// dnsPointer returns a compression pointer to off.
+func dnsPointer(off int) []byte {
+	return []byte{0xc0 | byte(off>>8), byte(off)}
+}
+
+// srvData returns the fixed part of SRV data, for the given port. The target
+// follows.
+func srvData(port uint16) []byte {
+	return binary.BigEndian.AppendUint16([]byte{0, 0, 0, 0}, port)
+}
+
+var (
+	wireEnvService  = []byte("\x08_smh-env\x04_tcp\x05local\x00")
+	wireEnvInstance = []byte("\x0aenv-server\x08_smh-env\x04_tcp\x05local\x00")
+	wirePi          = []byte("\x03pi3\x05local\x00")
+	envTXT          = []byte("\x09path=/env\x07version")
+)
+
+// envServerFound is what the browses below should find.
+var envServerFound = dnssdService{
+	Instance: "env-server._smh-env._tcp.local.",
+	Host:     "pi3.local.",
+	AddrPort: netip.MustParseAddrPort("10.0.0.7:8080"),
+	TXT:      map[string]string{"path": "/env", "version": ""},
+}
+
+func TestDNSSDParse(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  func() []byte
+	}{
+		{
+			name: "all answers",
+			msg: func() []byte {
+				m := newDNSResponse(4, 0)
+				m.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+				m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi)
+				m.record(wireEnvInstance, dns.TypeTXT, envTXT)
+				m.record(wirePi, dns.TypeA, []byte{10, 0, 0, 7})
+				return m.buf
+			},
+		},
+		{
+			// What responders usually send: the PTR answers the
+			// question, the rest come as a bonus.
+			name: "SRV, TXT and A only in the additional section",
+			msg: func() []byte {
+				m := newDNSResponse(1, 3)
+				m.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+				m.record(wirePi, dns.TypeA, []byte{10, 0, 0, 7})
+				m.record(wireEnvInstance, dns.TypeTXT, envTXT)
+				m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi)
+				return m.buf
+			},
+		},
+		{
+			// Names inside PTR and SRV data point elsewhere in the
+			// message, so they can only be decoded with all of it at
+			// hand.
+			name: "compressed names everywhere",
+			msg: func() []byte {
+				m := newDNSResponse(1, 3)
+				service := m.offset()
+				m.record(wireEnvService, dns.TypePTR, []byte("\x0aenv-server"), dnsPointer(service))
+				instance := service + len(wireEnvService) + 10
+				local := service + 14
+				m.record(dnsPointer(instance), dns.TypeSRV, srvData(8080), []byte("\x03pi3"), dnsPointer(local))
+				host := m.offset() - 6
+				m.record(dnsPointer(instance), dns.TypeTXT, envTXT)
+				m.record(dnsPointer(host), dns.TypeA, []byte{10, 0, 0, 7})
+				return m.buf
+			},
+		},
+		{
+			name: "names in capitals",
+			msg: func() []byte {
+				m := newDNSResponse(1, 3)
+				m.record([]byte("\x08_SMH-ENV\x04_TCP\x05LOCAL\x00"), dns.TypePTR, []byte("\x0aENV-SERVER\x08_smh-env\x04_tcp\x05local\x00"))
+				m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), []byte("\x03PI3\x05local\x00"))
+				m.record([]byte("\x0aenv-server\x08_smh-env\x04_tcp\x05LOCAL\x00"), dns.TypeTXT, []byte("\x09PATH=/env\x07VERSION"))
+				m.record([]byte("\x03Pi3\x05Local\x00"), dns.TypeA, []byte{10, 0, 0, 7})
+				return m.buf
+			},
+		},
+		{
+			name: "records for others along the way",
+			msg: func() []byte {
+				m := newDNSResponse(3, 4)
+				m.record(wireService, dns.TypePTR, wireInstance)
+				m.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+				m.record(wireHost, dns.TypeA, []byte{10, 0, 0, 8})
+				m.record(wireEnvInstance, dns.TypeAAAA, make([]byte, 16))
+				m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi)
+				m.record(wireEnvInstance, dns.TypeTXT, envTXT)
+				m.record(wirePi, dns.TypeA, []byte{10, 0, 0, 7})
+				return m.buf
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newDNSSDBrowse("_smh-env._tcp.local.")
+			msg := tt.msg()
+			progress, err := b.parse(msg)
+			if err != nil || !progress {
+				t.Fatalf("parse = %v, %v", progress, err)
+			}
+			got, ok := b.found()
+			if !ok || !reflect.DeepEqual(got, envServerFound) {
+				t.Fatalf("found %+v, %v, want %+v", got, ok, envServerFound)
+			}
+
+			// Hearing the same thing again teaches us nothing.
+			if progress, err := b.parse(msg); err != nil || progress {
+				t.Errorf("parsing again = %v, %v", progress, err)
+			}
+		})
+	}
+}
+
+func TestDNSSDParseErrors(t *testing.T) {
+	m := newDNSResponse(2, 0)
+	m.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+	m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi)
+
+	for name, msg := range map[string][]byte{
+		"too short":        m.buf[:dns.SizeHeader-1],
+		"truncated record": m.buf[:len(m.buf)-3],
+		"missing record":   m.buf[:len(m.buf)-len(wireEnvInstance)-10-6-len(wirePi)],
+	} {
+		if _, err := newDNSSDBrowse(envServerService).parse(msg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	// Records we can't make sense of are skipped, rather than failing the
+	// whole message.
+	bad := newDNSResponse(4, 0)
+	bad.record(wireEnvService, dns.TypePTR, []byte{0xc0, 0xff})
+	bad.record(wireEnvInstance, dns.TypeSRV, []byte{0, 0, 0, 0})
+	bad.record(wirePi, dns.TypeA, []byte{10, 0, 0})
+	bad.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+	b := newDNSSDBrowse(envServerService)
+	if progress, err := b.parse(bad.buf); err != nil || !progress {
+		t.Fatalf("parse = %v, %v", progress, err)
+	}
+	if len(b.instances) != 1 || len(b.srv) != 0 || len(b.addrs) != 0 {
+		t.Errorf("learned %+v", b)
+	}
+
+	// Queries are not responses.
+	query := append([]byte(nil), m.buf...)
+	query[2] = 0
+	if progress, err := newDNSSDBrowse(envServerService).parse(query); err != nil || progress {
+		t.Errorf("parsing a query = %v, %v", progress, err)
+	}
+}
+
+// browseQuestions returns the questions in the query b asks next.
+func browseQuestions(t *testing.T, b *dnssdBrowse) []string {
+	t.Helper()
+	query, err := b.appendQuery(nil, 0x4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := decodeDNS(t, query)
+	if m.TransactionID != 0x4242 || m.Flags.IsResponse() {
+		t.Errorf("header %+v", m.Header)
+	}
+	var questions []string
+	for _, q := range m.Questions {
+		if q.Class != dns.ClassINET {
+			t.Errorf("class %#x", uint16(q.Class))
+		}
+		questions = append(questions, q.Type.String()+" "+q.Name.String())
+	}
+	return questions
+}
+
+func TestDNSSDBrowseSteps(t *testing.T) {
+	// A responder that only answers exactly what it's asked, one record
+	// at a time.
+	b := newDNSSDBrowse(envServerService)
+	steps := []struct {
+		questions []string
+		answer    func(m *dnsMessage)
+	}{
+		{
+			[]string{"PTR _smh-env._tcp.local."},
+			func(m *dnsMessage) { m.record(wireEnvService, dns.TypePTR, wireEnvInstance) },
+		},
+		{
+			[]string{"PTR _smh-env._tcp.local.", "SRV env-server._smh-env._tcp.local."},
+			func(m *dnsMessage) { m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi) },
+		},
+		{
+			[]string{"PTR _smh-env._tcp.local.", "TXT env-server._smh-env._tcp.local.", "A pi3.local."},
+			func(m *dnsMessage) { m.record(wireEnvInstance, dns.TypeTXT, envTXT) },
+		},
+		{
+			[]string{"PTR _smh-env._tcp.local.", "A pi3.local."},
+			func(m *dnsMessage) { m.record(wirePi, dns.TypeA, []byte{10, 0, 0, 7}) },
+		},
+	}
+	for i, step := range steps {
+		if _, ok := b.found(); ok {
+			t.Fatalf("step %d: found already", i)
+		}
+		if got := browseQuestions(t, b); !reflect.DeepEqual(got, step.questions) {
+			t.Fatalf("step %d: asked %q, want %q", i, got, step.questions)
+		}
+		m := newDNSResponse(1, 0)
+		step.answer(m)
+		if progress, err := b.parse(m.buf); err != nil || !progress {
+			t.Fatalf("step %d: parse = %v, %v", i, progress, err)
+		}
+	}
+	if got, ok := b.found(); !ok || !reflect.DeepEqual(got, envServerFound) {
+		t.Errorf("found %+v, %v", got, ok)
+	}
+}
+
+func TestDNSSDFoundOrder(t *testing.T) {
+	// The first instance complete wins, even if it's not the first found.
+	m := newDNSResponse(2, 3)
+	m.record(wireEnvService, dns.TypePTR, []byte("\x05first\x08_smh-env\x04_tcp\x05local\x00"))
+	m.record(wireEnvService, dns.TypePTR, wireEnvInstance)
+	m.record([]byte("\x05first\x08_smh-env\x04_tcp\x05local\x00"), dns.TypeSRV, srvData(8080), []byte("\x07nowhere\x05local\x00"))
+	m.record(wireEnvInstance, dns.TypeSRV, srvData(8080), wirePi)
+	m.record(wirePi, dns.TypeA, []byte{10, 0, 0, 7})
+
+	b := newDNSSDBrowse(envServerService)
+	b.parse(m.buf)
+	got, ok := b.found()
+	if !ok || got.Instance != "env-server._smh-env._tcp.local." || got.TXT != nil {
+		t.Errorf("found %+v, %v", got, ok)
+	}
+	want := []string{"PTR _smh-env._tcp.local.", "TXT first._smh-env._tcp.local.", "A nowhere.local.", "TXT env-server._smh-env._tcp.local."}
+	if got := browseQuestions(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("asked %q, want %q", got, want)
+	}
+}
+
+func TestDNSSDAgainstResponder(t *testing.T) {
+	// Our own responder, browsed for our own service.
+	r, _ := newTestMDNSResponder()
+	b := newDNSSDBrowse("_HTTP._tcp.local.")
+	from := netip.MustParseAddrPort("192.168.1.20:50000")
+	for range 3 {
+		if _, ok := b.found(); ok {
+			break
+		}
+		query, err := b.appendQuery(nil, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := decodeDNS(t, query)
+		res, unicast, _ := r.respond(from, &m)
+		if !unicast || res == nil {
+			t.Fatalf("response %v, unicast %v", res, unicast)
+		}
+		if _, err := b.parse(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := dnssdService{
+		Instance: "smh-abcdef._http._tcp.local.",
+		Host:     "smh-abcdef.local.",
+		AddrPort: netip.MustParseAddrPort("192.168.1.10:80"),
+		TXT:      map[string]string{"path": "/api/readings", "loc": "Living room"},
+	}
+	if got, ok := b.found(); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("found %+v, %v, want %+v", got, ok, want)
+	}
+}
+
+func TestParseTXT(t *testing.T) {
+	tests := []struct {
+		data string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"\x03a=1", map[string]string{"a": "1"}},
+		{"\x03a=1\x03A=2", map[string]string{"a": "1"}},
+		{"\x01b\x04c=d=", map[string]string{"b": "", "c": "d="}},
+		{"\x00\x02=x\x02e=", map[string]string{"e": ""}},
+		{"\x03a=1\x09broken", map[string]string{"a": "1"}},
+	}
+	for _, tt := range tests {
+		if got := parseTXT([]byte(tt.data)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTXT(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+// newTestPicoNet returns a PicoNet that is ready to go at addr, on
+// 192.168.1.0/24, with frames going nowhere until the test moves them.
+func newTestPicoNet(addr string, mac byte) *PicoNet {
+	pn := &PicoNet{
+		logger:   discardLogger,
+		status:   StatusReadyToGo,
+		udpConns: make(map[uint16]*UDPConn),
+		udpTx:    make(chan []byte, udpTxQueueSize),
+		arpCache: newExpiringCache[netip.Addr, [6]byte](arpCacheSize),
+	}
+	pn.addr = netip.MustParseAddr(addr)
+	pn.setRoute(netip.MustParsePrefix("192.168.1.0/24"), netip.Addr{})
+	pn.stack = stacks.NewPortStack(stacks.PortStackConfig{MAC: [6]byte{2, 0, 0, 0, 0, mac}, MaxOpenPortsUDP: 1, MaxOpenPortsTCP: 1, MTU: mtu})
+	return pn
+}
+
+func TestBrowseDNSSD(t *testing.T) {
+	me := newTestPicoNet("192.168.1.10", 1)
+	server := newTestPicoNet("192.168.1.30", 3)
+	server.arpCache.store(me.addr, [6]byte{2, 0, 0, 0, 0, 1}, time.Now().Add(time.Hour))
+	conn, err := server.ListenUDP(mdnsPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.JoinGroup(mdnsGroup)
+	r := newMDNSResponder(discardLogger, conn, net.HardwareAddr{2, 0, 0, 0, 0, 3}, "", server.Addr)
+	go r.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	// The wire between the two.
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		buf := make([]byte, mtu)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if n := me.nextUDPFrame(buf); n > 0 {
+				server.recvUDP(append([]byte(nil), buf[:n]...))
+			}
+			if n := server.nextUDPFrame(buf); n > 0 {
+				me.recvUDP(append([]byte(nil), buf[:n]...))
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := me.browseDNSSD(ctx, mdnsServiceType)
+	if err != nil || s.AddrPort != netip.MustParseAddrPort("192.168.1.30:80") {
+		t.Fatalf("got %+v, %v", s, err)
+	}
+
+	// Nobody has this one.
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err = me.browseDNSSD(ctx, envServerService); !errors.Is(err, errServiceNotFound) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want errServiceNotFound and ErrTimeout", err)
+	}
+	me.udpMutex.Lock()
+	open := len(me.udpConns)
+	me.udpMutex.Unlock()
+	if open != 0 {
+		t.Errorf("%d sockets left open", open)
+	}
+}
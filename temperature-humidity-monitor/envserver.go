@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"simple-minded-home/thm/internal/aggregate"
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// Uploading readings to the env-server, over HTTP. The server can be given in
+// the settings, or found on the local network with DNS-SD, where it
+// advertises itself as an "_smh-env._tcp" service. This way, moving the
+// env-server to another box doesn't mean reconfiguring every device.
+//
+
+const (
+	// envServerService is the DNS-SD service type of the env-server.
+	envServerService = "_smh-env._tcp.local."
+
+	// envServerAPIPath is where the env-server API lives, relative to its
+	// base URL.
+	envServerAPIPath = "/api/v0"
+
+	// envServerTimeout is how long each upload to the env-server can take,
+	// looking for it and registering included.
+	envServerTimeout = 10 * time.Second
+
+	// envServerDiscoveryTimeout is how long we look for the env-server
+	// before giving up until the next upload.
+	envServerDiscoveryTimeout = 5 * time.Second
+)
+
+// errUnexpectedStatus is returned when the env-server answers with something
+// other than success.
+var errUnexpectedStatus = errors.New("unexpected HTTP status")
+
+// envServerLocator knows where the env-server is. That's the configured URL,
+// if any, until uploads to it fail; then we look for the server with DNS-SD,
+// falling back to the configured URL if it's not found. Ditto when uploads to
+// a discovered server fail: maybe it moved.
+//
+// Not safe for concurrent use; it belongs to the upload loop.
+type envServerLocator struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// configured is the base URL from the settings. May be empty.
+	configured string
+
+	// current is the base URL in use. Empty means we need to find one.
+	current string
+
+	// browse looks for instances of a DNS-SD service.
+	browse func(ctx context.Context, service string) (dnssdService, error)
+}
+
+// newEnvServerLocator returns a locator starting with the configured base URL,
+// which may be empty.
+func newEnvServerLocator(logger *slog.Logger, configured string, browse func(ctx context.Context, service string) (dnssdService, error)) *envServerLocator {
+	configured = strings.TrimSuffix(configured, "/")
+	return &envServerLocator{
+		logger:     logger,
+		configured: configured,
+		current:    configured,
+		browse:     browse,
+	}
+}
+
+// baseURL returns the base URL of the env-server, looking for it if needed.
+func (l *envServerLocator) baseURL(ctx context.Context) (string, error) {
+	if l.current != "" {
+		return l.current, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, envServerDiscoveryTimeout)
+	defer cancel()
+	s, err := l.browse(ctx, envServerService)
+	if err != nil {
+		if l.configured == "" {
+			return "", fmt.Errorf("looking for the env-server: %w", err)
+		}
+		l.logger.Warn("Env-server not found, using the configured URL", slogError(err))
+		l.current = l.configured
+		return l.current, nil
+	}
+
+	// We use the address rather than the host name, which is most likely
+	// a .local one: our resolver doesn't do mDNS.
+	l.current = "http://" + s.AddrPort.String() + strings.TrimSuffix(s.TXT["path"], "/")
+	l.logger.Info("Found the env-server",
+		slog.String("instance", s.Instance),
+		slog.String("host", s.Host),
+		slog.String("url", l.current),
+	)
+	return l.current, nil
+}
+
+// failed tells the locator that the last upload failed, so the server may be
+// somewhere else now. The next call to baseURL looks for it again.
+func (l *envServerLocator) failed() {
+	l.current = ""
+}
+
+// envServerMeasurements are the names of the measurements we report, in the
+// order they are given to the aggregator. Each is stored in the env-server as
+// three sensors: the plain name for the mean over a window, plus "_min" and
+// "_max" for the extremes.
+var envServerMeasurements = []string{"temperature", "humidity"}
+
+// envServerRetry tells how long to wait before trying again after failed
+// uploads.
+var envServerRetry = RetryPolicy{InitialBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}
+
+// envServerMaxPending is the maximum number of windows waiting to be uploaded.
+// When the env-server is unreachable for longer than that, the oldest are
+// dropped.
+const envServerMaxPending = 12
+
+// envServerDo sends an HTTP request to the env-server. That's PicoNet.Do on
+// the device.
+type envServerDo func(ctx context.Context, req *httpwire.Request) (*httpwire.Response, error)
+
+// envServerSample is a single value, as the env-server stores it.
+type envServerSample struct {
+	time   time.Time
+	sensor string
+	value  float64
+}
+
+// envServerSink aggregates readings and sends them to the env-server, a
+// window at a time.
+//
+// Not safe for concurrent use; it belongs to its sinkRunner.
+type envServerSink struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// do sends requests to the env-server, and locator tells where it is.
+	do      envServerDo
+	locator *envServerLocator
+
+	// location is what we report our readings under.
+	location string
+
+	// agg aggregates the readings, and last is the time of the last
+	// reading it got.
+	agg  *aggregate.Aggregator
+	last time.Time
+
+	// deadbands decide which measurements of each window are worth
+	// uploading, in the order of envServerMeasurements. lastEnd is when the
+	// last window we went through ended.
+	deadbands []deadband
+	lastEnd   time.Time
+
+	// registered is the base URL of the env-server we registered our
+	// location and sensors with, if any.
+	registered string
+
+	// noBatches is the base URL of an env-server that doesn't do batch
+	// uploads, if we found one. That's an older env-server, which takes
+	// values one by one.
+	noBatches string
+
+	// accepted are the samples that the env-server at acceptedBy stored,
+	// one by one, during a delivery that then failed. Retries leave them
+	// out, or they would be stored twice.
+	accepted   []envServerSample
+	acceptedBy string
+}
+
+// newEnvServerSink returns the env-server sink, unless the server URL in the
+// settings is a CoAP one. Without a URL, we look for the env-server.
+func newEnvServerSink(env sinkEnv) (telemetrySink, error) {
+	if strings.HasPrefix(env.settings.ServerURL, "coap:") {
+		return nil, nil
+	}
+	policies := env.settings.reportPolicies()
+	s := &envServerSink{
+		logger:    env.logger,
+		do:        env.pn.Do,
+		locator:   newEnvServerLocator(env.logger, env.settings.ServerURL, env.pn.browseDNSSD),
+		location:  env.settings.locationName(env.pn.HardwareAddr()),
+		agg:       aggregate.New(env.settings.UploadWindow, len(envServerMeasurements)),
+		deadbands: []deadband{{policy: policies.Temperature}, {policy: policies.Humidity}},
+	}
+	config := sinkConfig{QueueSize: envServerMaxPending, Retry: envServerRetry, Timeout: envServerTimeout}
+	return newSinkRunner(env.logger, env.pn, s, config), nil
+}
+
+func (s *envServerSink) Name() string {
+	return "env-server"
+}
+
+// Collect adds readings to the window being filled, and queues the windows as
+// they complete, if the report policy says they are worth it.
+func (s *envServerSink) Collect(queue []aggregate.Window, r telemetryReading) []aggregate.Window {
+	if !r.Clock.synced {
+		// The windows follow the wall clock, which we don't know yet.
+		return queue
+	}
+
+	var done aggregate.Window
+	var ok bool
+	if r.Time != s.last && r.Flags&(FlagNoReading|FlagStale|FlagOutOfRange) == 0 {
+		s.last = r.Time
+		done, ok = s.agg.Add(r.Clock.at(r.Time), float64(r.Temperature), float64(r.Humidity))
+	} else {
+		done, ok = s.agg.Flush(r.Clock.wall)
+	}
+	if !ok || !s.worthReporting(&done) {
+		return queue
+	}
+	return append(queue, done)
+}
+
+// Deliver uploads windows to the env-server.
+func (s *envServerSink) Deliver(ctx context.Context, windows []aggregate.Window) error {
+	return s.upload(ctx, envServerSamples(windows))
+}
+
+// worthReporting tells if window w is worth reporting, and clears the stats of
+// the measurements in it that the report policy says are not. The decision is
+// made on the means, and the minimum and maximum go along with them.
+func (s *envServerSink) worthReporting(w *aggregate.Window) bool {
+	if !w.Start.Equal(s.lastEnd) {
+		// There's a hole before this window, as when the sensor failed
+		// for a while, so we report it all.
+		for i := range s.deadbands {
+			s.deadbands[i].reset()
+		}
+	}
+	s.lastEnd = w.End()
+
+	worth := false
+	for i := range min(len(w.Stats), len(s.deadbands)) {
+		if w.Stats[i].Count == 0 {
+			continue
+		}
+		if s.deadbands[i].check(w.Start, w.Stats[i].Mean(), 0) {
+			worth = true
+		} else {
+			w.Stats[i] = aggregate.Stats{}
+		}
+	}
+	return worth
+}
+
+// upload sends samples to the env-server. Registers with it first, if we
+// haven't yet.
+func (s *envServerSink) upload(ctx context.Context, samples []envServerSample) error {
+	base, err := s.locator.baseURL(ctx)
+	if err != nil {
+		return err
+	}
+	if s.registered != base {
+		err = registerWithEnvServer(ctx, s.do, base, s.location, envServerSensorNames())
+		if err != nil {
+			s.locator.failed()
+			return fmt.Errorf("registering with the env-server: %w", err)
+		}
+		s.registered = base
+		s.logger.Info("Registered with the env-server",
+			slog.String("url", base),
+			slog.String("location", s.location),
+		)
+	}
+
+	err = s.put(ctx, base, samples)
+	if err != nil {
+		// Register again next time, too: the server may have lost our
+		// names, which makes it refuse the data.
+		s.locator.failed()
+		s.registered = ""
+	}
+	return err
+}
+
+// put sends samples to the env-server at base: all in one request if it can
+// take them like that, or else one by one. Samples it took in an earlier put
+// that failed halfway are not sent again.
+func (s *envServerSink) put(ctx context.Context, base string, samples []envServerSample) error {
+	if s.acceptedBy != base {
+		// Those samples are stored somewhere else, not here.
+		s.accepted = nil
+		s.acceptedBy = base
+	}
+	if len(s.accepted) > 0 {
+		samples = slices.DeleteFunc(slices.Clone(samples), s.wasAccepted)
+	}
+
+	if s.noBatches != base {
+		status, err := putEnvServer(ctx, s.do, base+envServerAPIPath+"/data_batch", appendEnvServerBatch(nil, s.location, samples))
+		if status != 404 && status != 405 {
+			return err
+		}
+		s.noBatches = base
+		s.logger.Info("The env-server doesn't take batches, sending values one by one", slog.String("url", base))
+	}
+
+	for _, sample := range samples {
+		_, err := putEnvServer(ctx, s.do, base+envServerAPIPath+"/data", appendEnvServerSample(nil, s.location, sample))
+		if err != nil {
+			return err
+		}
+		s.accepted = append(s.accepted, sample)
+	}
+	s.accepted = nil
+	return nil
+}
+
+// wasAccepted tells if sample is among the accepted ones. There's a single
+// sample per sensor and window, so that's what we look at.
+func (s *envServerSink) wasAccepted(sample envServerSample) bool {
+	return slices.ContainsFunc(s.accepted, func(a envServerSample) bool {
+		return a.sensor == sample.sensor && a.time.Equal(sample.time)
+	})
+}
+
+// envServerSensorNames returns the names of all the sensors we report to the
+// env-server.
+func envServerSensorNames() []string {
+	var names []string
+	for _, m := range envServerMeasurements {
+		names = append(names, m, m+"_min", m+"_max")
+	}
+	return names
+}
+
+// envServerSamples turns windows into the samples we store in the env-server:
+// the mean, minimum and maximum of each measurement, stamped with the start of
+// the window.
+func envServerSamples(windows []aggregate.Window) []envServerSample {
+	var samples []envServerSample
+	for _, w := range windows {
+		for i, stats := range w.Stats {
+			if stats.Count == 0 || i >= len(envServerMeasurements) {
+				continue
+			}
+			name := envServerMeasurements[i]
+			samples = append(samples,
+				envServerSample{w.Start, name, stats.Mean()},
+				envServerSample{w.Start, name + "_min", stats.Min},
+				envServerSample{w.Start, name + "_max", stats.Max},
+			)
+		}
+	}
+	return samples
+}
+
+// registerWithEnvServer makes sure the env-server at base knows our location
+// and sensors, which it requires before taking any data for them. Names it
+// already knows are left alone, so this can be done any number of times.
+func registerWithEnvServer(ctx context.Context, do envServerDo, base, location string, sensors []string) error {
+	err := ensureEnvServerName(ctx, do, base, "location", []string{location})
+	if err != nil {
+		return err
+	}
+	return ensureEnvServerName(ctx, do, base, "sensor", sensors)
+}
+
+// ensureEnvServerName creates the given names of some kind ("location" or
+// "sensor") in the env-server at base, unless they exist already.
+func ensureEnvServerName(ctx context.Context, do envServerDo, base, kind string, names []string) error {
+	// The env-server fails when creating a name that exists, so we ask
+	// first.
+	listURL := base + envServerAPIPath + "/" + kind + "s"
+	req, err := httpwire.NewRequest("GET", listURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := do(ctx, req)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: %d from %s", errUnexpectedStatus, res.StatusCode, listURL)
+	}
+	existing, err := parseJSONStrings(body)
+	if err != nil {
+		return fmt.Errorf("reading the env-server %ss: %w", kind, err)
+	}
+
+	for _, name := range names {
+		if slices.Contains(existing, name) {
+			continue
+		}
+		var w jsonWriter
+		w.beginObject()
+		w.key(kind)
+		w.string(name)
+		w.endObject()
+		_, err = putEnvServer(ctx, do, base+envServerAPIPath+"/"+kind, w.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendEnvServerBatch appends to dst the JSON body for sending samples in a
+// single request: an array of what appendEnvServerSample writes.
+func appendEnvServerBatch(dst []byte, location string, samples []envServerSample) []byte {
+	w := jsonWriter{buf: dst}
+	w.beginArray()
+	for _, sample := range samples {
+		writeEnvServerSample(&w, location, sample)
+	}
+	w.endArray()
+	return w.Bytes()
+}
+
+// appendEnvServerSample appends to dst the JSON body for sending sample on its
+// own.
+func appendEnvServerSample(dst []byte, location string, sample envServerSample) []byte {
+	w := jsonWriter{buf: dst}
+	writeEnvServerSample(&w, location, sample)
+	return w.Bytes()
+}
+
+// writeEnvServerSample writes sample as the env-server wants it.
+func writeEnvServerSample(w *jsonWriter, location string, sample envServerSample) {
+	w.beginObject()
+	w.key("unix_timestamp")
+	w.int(sample.time.Unix())
+	w.key("location")
+	w.string(location)
+	w.key("sensor")
+	w.string(sample.sensor)
+	w.key("value")
+	w.float(sample.value, 2)
+	w.endObject()
+}
+
+// putEnvServer PUTs the JSON body to url, which is somewhere in the
+// env-server, and checks that it worked. Returns the response status, if we got
+// that far.
+func putEnvServer(ctx context.Context, do envServerDo, url string, body []byte) (status int, err error) {
+	req, err := httpwire.NewRequest("PUT", url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := do(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("%w: %d from %s", errUnexpectedStatus, res.StatusCode, url)
+	}
+	return res.StatusCode, nil
+}
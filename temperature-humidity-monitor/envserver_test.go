@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+// fakeEnvServer is an env-server in memory, behaving like the real one: names
+// must be created before data can refer to them, and creating a name twice
+// fails.
+type fakeEnvServer struct {
+	mutex sync.Mutex
+
+	// locations and sensors are the names created so far.
+	locations []string
+	sensors   []string
+
+	// rows are the samples stored, as "location sensor time value".
+	rows []string
+
+	// requests are the requests received, as "METHOD /path".
+	requests []string
+
+	// noBatches makes this an older env-server, without /data_batch.
+	noBatches bool
+
+	// fail, when set, decides the status of each request instead of
+	// handling it, if not zero. It is given the request, and the sample in
+	// it for /data.
+	fail func(req *httpwire.Request, sample string) int
+}
+
+// fakeEnvServers returns an envServerDo sending requests to the servers, by
+// host and port. Requests to other servers fail as if they were down.
+func fakeEnvServers(servers map[string]*fakeEnvServer) envServerDo {
+	return func(ctx context.Context, req *httpwire.Request) (*httpwire.Response, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, errors.New("request without a deadline")
+		}
+		s := servers[req.URL.Host]
+		if s == nil {
+			return nil, fmt.Errorf("dialing %s: %w", req.URL.Host, ErrTimeout)
+		}
+		status, body := s.handle(req)
+		return &httpwire.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+}
+
+// envServerInput is what the env-server takes in its PUT requests.
+type envServerInput struct {
+	Location      string  `json:"location"`
+	Sensor        string  `json:"sensor"`
+	UnixTimestamp int64   `json:"unix_timestamp"`
+	Value         float64 `json:"value"`
+}
+
+func (s *fakeEnvServer) handle(req *httpwire.Request) (status int, body string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, path, _ := strings.Cut(req.URL.Path, envServerAPIPath)
+	s.requests = append(s.requests, req.Method+" "+path)
+	if req.Method == "PUT" && req.Header.Get("Content-Type") != "application/json" {
+		return 415, ""
+	}
+
+	var inputs []envServerInput
+	switch {
+	case req.Method == "PUT" && path == "/data_batch" && !s.noBatches:
+		if json.Unmarshal(req.Body, &inputs) != nil {
+			return 400, ""
+		}
+	case req.Method == "PUT" && path != "/data_batch":
+		var in envServerInput
+		if json.Unmarshal(req.Body, &in) != nil {
+			return 400, ""
+		}
+		inputs = []envServerInput{in}
+	}
+	var rows []string
+	for _, in := range inputs {
+		rows = append(rows, fmt.Sprintf("%s %s %d %g", in.Location, in.Sensor, in.UnixTimestamp, in.Value))
+	}
+	if s.fail != nil {
+		sample := ""
+		if path == "/data" {
+			sample = rows[0]
+		}
+		if status := s.fail(req, sample); status != 0 {
+			return status, ""
+		}
+	}
+
+	switch req.Method + " " + path {
+	case "GET /locations":
+		return 200, jsonStrings(s.locations)
+	case "GET /sensors":
+		return 200, jsonStrings(s.sensors)
+	case "PUT /location":
+		return s.create(&s.locations, inputs[0].Location), "Ok"
+	case "PUT /sensor":
+		return s.create(&s.sensors, inputs[0].Sensor), "Ok"
+	case "PUT /data", "PUT /data_batch":
+		if s.noBatches && path == "/data_batch" {
+			return 404, ""
+		}
+		// All or nothing.
+		for _, in := range inputs {
+			if !slices.Contains(s.locations, in.Location) || !slices.Contains(s.sensors, in.Sensor) {
+				return 400, ""
+			}
+		}
+		s.rows = append(s.rows, rows...)
+		return 200, "Ok"
+	}
+	return 404, ""
+}
+
+// create adds name to names, failing if it's there already, like the unique
+// constraints in the env-server database.
+func (s *fakeEnvServer) create(names *[]string, name string) int {
+	if name == "" || slices.Contains(*names, name) {
+		return 500
+	}
+	*names = append(*names, name)
+	return 200
+}
+
+// takeRequests returns the requests received since last time.
+func (s *fakeEnvServer) takeRequests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func jsonStrings(strs []string) string {
+	data, _ := json.Marshal(append([]string{}, strs...))
+	return string(data)
+}
+
+// testCtx returns a context for requests, which must have a deadline.
+func testCtx(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// envServerBrowse returns a browse function finding found, or failing with
+// *err if not nil, and counting the calls in *calls.
+func envServerBrowse(t *testing.T, found dnssdService, err *error, calls *int) func(ctx context.Context, service string) (dnssdService, error) {
+	return func(ctx context.Context, service string) (dnssdService, error) {
+		*calls++
+		if service != envServerService {
+			t.Errorf("browsing for %q", service)
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("browsing without a deadline")
+		}
+		if *err != nil {
+			return dnssdService{}, *err
+		}
+		return found, nil
+	}
+}
+
+// discoveredEnvServer is the env-server found by DNS-SD in the tests below.
+var discoveredEnvServer = dnssdService{
+	Instance: "env-server._smh-env._tcp.local.",
+	Host:     "pi3.local.",
+	AddrPort: netip.MustParseAddrPort("10.0.0.7:8080"),
+	TXT:      map[string]string{"path": "/env/"},
+}
+
+func TestEnvServerLocator(t *testing.T) {
+	var browseErr error
+	calls := 0
+	browse := envServerBrowse(t, discoveredEnvServer, &browseErr, &calls)
+
+	steps := []struct {
+		name      string
+		failed    bool
+		browseErr error
+		want      string
+		calls     int
+	}{
+		{"configured URL first", false, nil, "http://conf:8000", 0},
+		{"and again", false, nil, "http://conf:8000", 0},
+		{"discovered once the configured fails", true, nil, "http://10.0.0.7:8080/env", 1},
+		{"discovered stays", false, nil, "http://10.0.0.7:8080/env", 1},
+		{"configured if nothing found", true, errServiceNotFound, "http://conf:8000", 2},
+		{"configured stays", false, errServiceNotFound, "http://conf:8000", 2},
+		{"discovered again", true, nil, "http://10.0.0.7:8080/env", 3},
+	}
+	l := newEnvServerLocator(discardLogger, "http://conf:8000/", browse)
+	for _, step := range steps {
+		if step.failed {
+			l.failed()
+		}
+		browseErr = step.browseErr
+		got, err := l.baseURL(context.Background())
+		if err != nil || got != step.want || calls != step.calls {
+			t.Errorf("%s: got %q, %v after %d browses, want %q after %d", step.name, got, err, calls, step.want, step.calls)
+		}
+	}
+
+	// Without a configured URL there's nothing to fall back to, so we keep
+	// looking.
+	l = newEnvServerLocator(discardLogger, "", browse)
+	browseErr = errServiceNotFound
+	for range 2 {
+		if got, err := l.baseURL(context.Background()); !errors.Is(err, errServiceNotFound) || got != "" {
+			t.Errorf("got %q, %v, want errServiceNotFound", got, err)
+		}
+	}
+	browseErr = nil
+	if got, err := l.baseURL(context.Background()); err != nil || got != "http://10.0.0.7:8080/env" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// newTestEnvServerSink returns an env-server sink for the location "Attic",
+// talking to the given servers, configured with the given URL and finding
+// discoveredEnvServer when browsing, unless *browseErr is set.
+func newTestEnvServerSink(t *testing.T, configured string, servers map[string]*fakeEnvServer, browseErr *error, browses *int) *envServerSink {
+	return &envServerSink{
+		logger:   discardLogger,
+		do:       fakeEnvServers(servers),
+		locator:  newEnvServerLocator(discardLogger, configured, envServerBrowse(t, discoveredEnvServer, browseErr, browses)),
+		location: "Attic",
+	}
+}
+
+// testEnvServerSamples returns a window's worth of samples, starting the given
+// minutes after the tests' epoch.
+func testEnvServerSamples(minutes int) []envServerSample {
+	start := time.Unix(1700000000, 0).Add(time.Duration(minutes) * time.Minute)
+	return []envServerSample{
+		{start, "temperature", 20.5},
+		{start, "temperature_min", 20.25},
+		{start, "temperature_max", 20.75},
+		{start, "humidity", 50},
+		{start, "humidity_min", 49},
+		{start, "humidity_max", 51},
+	}
+}
+
+func TestEnvServerRediscover(t *testing.T) {
+	configured := &fakeEnvServer{}
+	discovered := &fakeEnvServer{}
+	servers := map[string]*fakeEnvServer{"10.0.0.7:8080": discovered}
+	var browseErr error
+	browses := 0
+	s := newTestEnvServerSink(t, "http://conf:8000", servers, &browseErr, &browses)
+
+	// The configured server is down, so the upload fails without looking
+	// elsewhere; that's for the next one.
+	if err := s.upload(testCtx(t), testEnvServerSamples(0)); !errors.Is(err, ErrTimeout) || browses != 0 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+
+	// Next time we find the other one, and register there first.
+	if err := s.upload(testCtx(t), testEnvServerSamples(0)); err != nil || browses != 1 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+	want := []string{"GET /locations", "PUT /location", "GET /sensors"}
+	for range envServerSensorNames() {
+		want = append(want, "PUT /sensor")
+	}
+	want = append(want, "PUT /data_batch")
+	if got := discovered.takeRequests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(discovered.rows) != 6 {
+		t.Errorf("stored %q", discovered.rows)
+	}
+
+	// While it works, we stay with it.
+	if err := s.upload(testCtx(t), testEnvServerSamples(5)); err != nil || browses != 1 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+	if got := discovered.takeRequests(); !reflect.DeepEqual(got, []string{"PUT /data_batch"}) {
+		t.Errorf("got %q", got)
+	}
+
+	// When the discovered server fails, we look again, and with nothing to
+	// find, go back to the configured one, which is up by now.
+	discovered.fail = func(*httpwire.Request, string) int { return 500 }
+	if err := s.upload(testCtx(t), testEnvServerSamples(10)); !errors.Is(err, errUnexpectedStatus) {
+		t.Fatalf("got %v", err)
+	}
+	servers["conf:8000"] = configured
+	browseErr = errServiceNotFound
+	if err := s.upload(testCtx(t), testEnvServerSamples(10)); err != nil || browses != 2 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+	if len(configured.rows) != 6 || len(discovered.rows) != 12 {
+		t.Errorf("stored %q and %q", configured.rows, discovered.rows)
+	}
+
+	// Going back to a server we already registered with registers again,
+	// in case it lost our names.
+	configured.takeRequests()
+	configured.sensors = nil
+	configured.fail = func(req *httpwire.Request, _ string) int {
+		if strings.HasSuffix(req.URL.Path, "/data_batch") && len(configured.sensors) == 0 {
+			return 400
+		}
+		return 0
+	}
+	if err := s.upload(testCtx(t), testEnvServerSamples(15)); !errors.Is(err, errUnexpectedStatus) {
+		t.Fatalf("got %v", err)
+	}
+	if err := s.upload(testCtx(t), testEnvServerSamples(15)); err != nil || browses != 3 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+	if len(configured.sensors) != 6 || len(configured.rows) != 12 {
+		t.Errorf("sensors %q, stored %q", configured.sensors, configured.rows)
+	}
+}
+
+func TestEnsureEnvServerName(t *testing.T) {
+	server := &fakeEnvServer{sensors: []string{"humidity", "pressure"}}
+	do := fakeEnvServers(map[string]*fakeEnvServer{"env:8000": server})
+	sensors := envServerSensorNames()
+
+	// The first time, only the missing names are created...
+	if err := registerWithEnvServer(testCtx(t), do, "http://env:8000", "Attic", sensors); err != nil {
+		t.Fatal(err)
+	}
+	requests := []string{"GET /locations", "PUT /location", "GET /sensors"}
+	for range len(sensors) - 1 {
+		requests = append(requests, "PUT /sensor")
+	}
+	if got := server.takeRequests(); !reflect.DeepEqual(got, requests) {
+		t.Errorf("got %q, want %q", got, requests)
+	}
+	if !reflect.DeepEqual(server.locations, []string{"Attic"}) {
+		t.Errorf("locations %q", server.locations)
+	}
+	want := append([]string{"humidity", "pressure"}, slices.DeleteFunc(slices.Clone(sensors), func(s string) bool { return s == "humidity" })...)
+	if !reflect.DeepEqual(server.sensors, want) {
+		t.Errorf("sensors %q, want %q", server.sensors, want)
+	}
+
+	// ...and after that, there's nothing to do, however many times.
+	for range 2 {
+		if err := registerWithEnvServer(testCtx(t), do, "http://env:8000", "Attic", sensors); err != nil {
+			t.Fatal(err)
+		}
+		if got := server.takeRequests(); !reflect.DeepEqual(got, []string{"GET /locations", "GET /sensors"}) {
+			t.Errorf("got %q", got)
+		}
+	}
+	if len(server.locations) != 1 || len(server.sensors) != 7 {
+		t.Errorf("locations %q, sensors %q", server.locations, server.sensors)
+	}
+
+	// The names don't get mixed up with others differing in case or
+	// spaces.
+	if err := ensureEnvServerName(testCtx(t), do, "http://env:8000", "location", []string{"attic", "Attic "}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(server.locations, []string{"Attic", "attic", "Attic "}) {
+		t.Errorf("locations %q", server.locations)
+	}
+}
+
+func TestEnsureEnvServerNameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(req *httpwire.Request, _ string) int
+		list string
+		want error
+	}{
+		{
+			name: "listing fails",
+			fail: func(req *httpwire.Request, _ string) int {
+				if req.Method == "GET" {
+					return 503
+				}
+				return 0
+			},
+			want: errUnexpectedStatus,
+		},
+		{
+			name: "creating fails",
+			fail: func(req *httpwire.Request, _ string) int {
+				if req.Method == "PUT" {
+					return 500
+				}
+				return 0
+			},
+			want: errUnexpectedStatus,
+		},
+		{name: "not a list", list: `{"locations":[]}`, want: errBadJSON},
+		{name: "not strings", list: `[1,2]`, want: errBadJSON},
+		{name: "truncated", list: `["Attic","Kit`, want: errBadJSON},
+	}
+	for _, tt := range tests {
+		server := &fakeEnvServer{fail: tt.fail}
+		do := fakeEnvServers(map[string]*fakeEnvServer{"env:8000": server})
+		if tt.list != "" {
+			do = func(context.Context, *httpwire.Request) (*httpwire.Response, error) {
+				return &httpwire.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(tt.list))}, nil
+			}
+		}
+		err := ensureEnvServerName(testCtx(t), do, "http://env:8000", "location", []string{"Attic"})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Nowhere to send it to.
+	do := fakeEnvServers(nil)
+	if err := ensureEnvServerName(testCtx(t), do, "http://env:8000", "location", []string{"Attic"}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want ErrTimeout", err)
+	}
+}
+
+func TestEnvServerPutOneByOne(t *testing.T) {
+	old := &fakeEnvServer{noBatches: true}
+	servers := map[string]*fakeEnvServer{"conf:8000": old}
+	browseErr := errServiceNotFound
+	browses := 0
+	s := newTestEnvServerSink(t, "http://conf:8000", servers, &browseErr, &browses)
+
+	// The server fails halfway through, having taken some of the samples.
+	failures := 1
+	old.fail = func(req *httpwire.Request, sample string) int {
+		if strings.Contains(sample, "humidity ") && failures > 0 {
+			failures--
+			return 500
+		}
+		return 0
+	}
+	samples := testEnvServerSamples(0)
+	if err := s.upload(testCtx(t), samples); !errors.Is(err, errUnexpectedStatus) {
+		t.Fatalf("got %v", err)
+	}
+	if len(old.rows) != 3 {
+		t.Fatalf("stored %q", old.rows)
+	}
+
+	// Retrying, with a new window on top, sends the rest only.
+	samples = append(samples, testEnvServerSamples(5)...)
+	old.takeRequests()
+	if err := s.upload(testCtx(t), samples); err != nil {
+		t.Fatal(err)
+	}
+	var puts int
+	for _, req := range old.takeRequests() {
+		if req == "PUT /data" {
+			puts++
+		}
+	}
+	if puts != 9 {
+		t.Errorf("%d samples sent, want 9", puts)
+	}
+	want := []string{
+		"Attic temperature 1700000000 20.5",
+		"Attic temperature_min 1700000000 20.25",
+		"Attic temperature_max 1700000000 20.75",
+		"Attic humidity 1700000000 50",
+		"Attic humidity_min 1700000000 49",
+		"Attic humidity_max 1700000000 51",
+		"Attic temperature 1700000300 20.5",
+		"Attic temperature_min 1700000300 20.25",
+		"Attic temperature_max 1700000300 20.75",
+		"Attic humidity 1700000300 50",
+		"Attic humidity_min 1700000300 49",
+		"Attic humidity_max 1700000300 51",
+	}
+	if !reflect.DeepEqual(old.rows, want) {
+		t.Errorf("stored:\n%q\nwant:\n%q", old.rows, want)
+	}
+
+	// Once delivered, the samples are forgotten: the same ones again
+	// would be new ones.
+	if err := s.upload(testCtx(t), testEnvServerSamples(0)); err != nil || len(old.rows) != 18 {
+		t.Errorf("got %v, stored %d", err, len(old.rows))
+	}
+}
+
+func TestEnvServerPutOneByOneMoved(t *testing.T) {
+	old := &fakeEnvServer{noBatches: true}
+	discovered := &fakeEnvServer{}
+	servers := map[string]*fakeEnvServer{"conf:8000": old, "10.0.0.7:8080": discovered}
+	var browseErr error
+	browses := 0
+	s := newTestEnvServerSink(t, "http://conf:8000", servers, &browseErr, &browses)
+
+	// The old server goes away halfway through...
+	old.fail = func(req *httpwire.Request, sample string) int {
+		if strings.Contains(sample, "humidity ") {
+			delete(servers, "conf:8000")
+		}
+		return 0
+	}
+	samples := testEnvServerSamples(0)
+	if err := s.upload(testCtx(t), samples); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v", err)
+	}
+
+	// ...so the new one gets everything, in a batch.
+	if err := s.upload(testCtx(t), samples); err != nil || browses != 1 {
+		t.Fatalf("got %v after %d browses", err, browses)
+	}
+	if len(old.rows) != 4 || len(discovered.rows) != 6 {
+		t.Errorf("stored %q and %q", old.rows, discovered.rows)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+//
+// Events. Instead of polling PicoNet.Status() every so often, interested parties
+// can subscribe to events and react to them right away.
+//
+
+// EventKind tells what kind of thing happened to a PicoNet.
+type EventKind int
+
+const (
+	// EventStatusChanged means the PicoNet status changed. Event.Err tells
+	// why, if the change was caused by some failure.
+	EventStatusChanged EventKind = iota
+
+	// EventIPAcquired means we got an IP address, given in Event.Addr.
+	EventIPAcquired
+
+	// EventLinkLost means we lost the connection to the WiFi network. The
+	// PicoNet will try to reconnect by itself.
+	EventLinkLost
+
+	// EventTimeSynced means the clock was synchronized with an NTP server.
+	// From now on PicoNet.Now() returns the actual time.
+	EventTimeSynced
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStatusChanged:
+		return "StatusChanged"
+	case EventIPAcquired:
+		return "IPAcquired"
+	case EventLinkLost:
+		return "LinkLost"
+	case EventTimeSynced:
+		return "TimeSynced"
+	default:
+		return "Invalid"
+	}
+}
+
+// Event is something that happened to a PicoNet.
+type Event struct {
+	// Kind tells what happened.
+	Kind EventKind
+
+	// Time is when it happened, according to the local clock.
+	Time time.Time
+
+	// Status is the PicoNet status right after the event.
+	Status PicoNetStatus
+
+	// PrevStatus is the status before the event. Only meaningful for
+	// EventStatusChanged.
+	PrevStatus PicoNetStatus
+
+	// Err is the reason behind the event, if it was caused by some failure.
+	// For example, when some initialization stage keeps failing and we go back
+	// to an earlier one, Err is the error from the failing stage.
+	Err error
+
+	// Addr is the IP address we got, for EventIPAcquired.
+	Addr netip.Addr
+}
+
+// Subscribe returns a channel on which events will be delivered, and a
+// function to call when no longer interested in them (which closes the
+// channel).
+//
+// Events are never allowed to hold up the network: if the channel buffer is
+// full, new events are dropped. So, use a buffer large enough for the events
+// you expect to get between two reads, and check PicoNet.Status() if you need
+// to be absolutely sure about the current state of things.
+func (pn *PicoNet) Subscribe(bufSize int) (<-chan Event, func()) {
+	ch := make(chan Event, bufSize)
+
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	pn.subscribers = append(pn.subscribers, ch)
+
+	unsubscribe := func() {
+		pn.mutex.Lock()
+		defer pn.mutex.Unlock()
+		for i, sub := range pn.subscribers {
+			if sub == ch {
+				pn.subscribers = append(pn.subscribers[:i], pn.subscribers[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}
+	return ch, unsubscribe
+}
+
+// publish delivers ev to all subscribers.
+func (pn *PicoNet) publish(ev Event) {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	ev.Status = pn.status
+	pn.publishLocked(ev)
+}
+
+// publishLocked is like publish, but must be called with pn.mutex held. Event
+// fields are delivered as they are.
+func (pn *PicoNet) publishLocked(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, ch := range pn.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			pn.logger.Warn("Subscriber not keeping up, dropped event", slog.String("kind", ev.Kind.String()))
+		}
+	}
+}
@@ -1,4 +1,4 @@
-module main
+module simple-minded-home/thm
 
 go 1.23.0
 
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/stacks"
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// The HTTP client side of PicoNet.
+//
+
+// Get does an HTTP GET request.
+//
+// As with all the other request methods, the caller must close the response
+// body when done with it.
+func (pn *PicoNet) Get(ctx context.Context, urlStr string) (res *httpwire.Response, err error) {
+	req, err := httpwire.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pn.Do(ctx, req)
+}
+
+// Post does an HTTP POST request, sending body with the given content type.
+func (pn *PicoNet) Post(ctx context.Context, urlStr, contentType string, body []byte) (res *httpwire.Response, err error) {
+	return pn.doWithBody(ctx, "POST", urlStr, contentType, body)
+}
+
+// Put does an HTTP PUT request, sending body with the given content type.
+func (pn *PicoNet) Put(ctx context.Context, urlStr, contentType string, body []byte) (res *httpwire.Response, err error) {
+	return pn.doWithBody(ctx, "PUT", urlStr, contentType, body)
+}
+
+// Delete does an HTTP DELETE request.
+func (pn *PicoNet) Delete(ctx context.Context, urlStr string) (res *httpwire.Response, err error) {
+	req, err := httpwire.NewRequest("DELETE", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pn.Do(ctx, req)
+}
+
+// ErrTooManyRedirects is returned when a request is redirected more times than
+// allowed by PicoNetConfig.MaxRedirects.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Do sends an arbitrary HTTP request and returns its response.
+//
+// The whole request, up to reading the response headers, is bound to ctx: it
+// can be cancelled, and it fails with ErrTimeout if the ctx deadline passes.
+// Reading the response body is bound to ctx, too.
+//
+// It is safe to call Do from multiple goroutines. Requests are serialized so
+// that no more than PicoNetConfig.TCPPorts connections are open at once; time
+// spent waiting in line counts against the ctx deadline.
+//
+// Connections are kept open after the response body is closed, and reused by
+// later requests to the same server. If the server closed a reused connection
+// in the meantime, the request is transparently retried on a fresh one.
+//
+// Redirects are followed, up to PicoNetConfig.MaxRedirects hops.
+func (pn *PicoNet) Do(ctx context.Context, req *httpwire.Request) (res *httpwire.Response, err error) {
+	if pn.Status() != StatusReadyToGo {
+		return nil, ErrNotReady
+	}
+
+	if pn.config.IdleTimeout < 0 && !req.Close {
+		r := *req
+		r.Close = true
+		req = &r
+	}
+
+	for redirects := 0; ; redirects++ {
+		res, err = pn.doSingle(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		location := res.Header.Get("Location")
+		if pn.config.MaxRedirects < 0 || !isRedirect(res.StatusCode) || location == "" {
+			return res, nil
+		}
+
+		// We don't care about the body of the redirect response, but we must
+		// close it to free the connection.
+		res.Body.Close()
+
+		if redirects >= pn.config.MaxRedirects {
+			return nil, fmt.Errorf("%w (%d)", ErrTooManyRedirects, redirects)
+		}
+
+		req, err = redirectRequest(req, res.StatusCode, location)
+		if err != nil {
+			return nil, fmt.Errorf("following redirect: %w", err)
+		}
+		pn.logger.Info("Following redirect",
+			slog.Int("statusCode", res.StatusCode),
+			slog.String("location", req.URL.Redacted()),
+		)
+	}
+}
+
+// doSingle does a single request, without following redirects.
+func (pn *PicoNet) doSingle(ctx context.Context, req *httpwire.Request) (res *httpwire.Response, err error) {
+	res, retry, err := pn.doRequest(ctx, req, true)
+	if retry {
+		pn.logger.Info("Reused connection failed, retrying on a fresh one", slogError(err))
+		res, _, err = pn.doRequest(ctx, req, false)
+	}
+	return res, err
+}
+
+func (pn *PicoNet) doWithBody(ctx context.Context, method, urlStr, contentType string, body []byte) (res *httpwire.Response, err error) {
+	req, err := httpwire.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return pn.Do(ctx, req)
+}
+
+// isRedirect tells if statusCode is a redirect we know how to follow.
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case 301, 302, 303, 307, 308:
+		return true
+	default:
+		return false
+	}
+}
+
+// redirectRequest creates the request to send after prev got redirected with
+// the given status code to location.
+func redirectRequest(prev *httpwire.Request, statusCode int, location string) (*httpwire.Request, error) {
+	u, err := prev.URL.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Location: %w", err)
+	}
+	err = httpwire.ValidateURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &httpwire.Request{
+		Method: prev.Method,
+		URL:    u,
+		Header: prev.Header.Clone(),
+		Body:   prev.Body,
+		Close:  prev.Close,
+	}
+
+	// 307 and 308 require repeating the same request at the new location. For
+	// 303, the new location must be fetched with a GET. And for 301 and 302,
+	// the RFC says the method should be kept, but everybody turns a POST into
+	// a GET, and servers expect that by now.
+	toGet := false
+	switch statusCode {
+	case 301, 302:
+		toGet = prev.Method == "POST"
+	case 303:
+		toGet = prev.Method != "GET" && prev.Method != "HEAD"
+	}
+	if toGet {
+		next.Method = "GET"
+		next.Body = nil
+		next.Header.Del("Content-Type")
+	}
+
+	// Don't leak credentials to some other server.
+	if canonicalHostPort(u) != canonicalHostPort(prev.URL) {
+		next.Header.Del("Authorization")
+	}
+
+	return next, nil
+}
+
+// getUsableAddress takes the URL of a request and returns the address we need
+// to connect to. This includes making a DNS request if necessary.
+func (pn *PicoNet) getUsableAddress(ctx context.Context, u *url.URL) (netip.AddrPort, error) {
+	host := u.Hostname()
+	port := uint16(80)
+	if strPort := u.Port(); strPort != "" {
+		// Already validated by httpwire.ValidateURL, but it's cheap to be careful.
+		n, err := strconv.ParseUint(strPort, 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid port %q: %w", strPort, err)
+		}
+		port = uint16(n)
+	}
+
+	addr, err := pn.resolveHost(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+// resolveHost returns the address of host, which can be either an IP address
+// or a name to look up.
+func (pn *PicoNet) resolveHost(ctx context.Context, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+
+	// Not an IP address, so we need to make a DNS request.
+	addrs, err := pn.lookupNetIP(ctx, host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("resolving %q: %w", host, err)
+	}
+
+	// lookupNetIP will return an error if it can't get any IPv4 addresses, so
+	// it's guaranteed that addrs[0] will contain something!
+	return addrs[0], nil
+}
+
+// doRequest does the actual work behind Do. If allowReuse is true, an idle
+// connection may be used. In that case, if things fail in a way that suggests
+// the server simply closed the connection in the meantime, retry is true and
+// the caller should try again with allowReuse set to false.
+func (pn *PicoNet) doRequest(ctx context.Context, req *httpwire.Request, allowReuse bool) (res *httpwire.Response, retry bool, err error) {
+	// Generate the request bytes before touching the network, so that a bad
+	// request doesn't cost us a TCP connection.
+	reqBytes, err := req.AppendTo(make([]byte, 0, 256+len(req.Body)))
+	if err != nil {
+		pn.logger.Error("Preparing request", slogError(err))
+		return nil, false, fmt.Errorf("preparing request: %w", err)
+	}
+
+	key := canonicalHostPort(req.URL)
+	pc, err := pn.pool.get(ctx, key, allowReuse)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// From now on, in case of errors the connection must go.
+	defer func() {
+		if err != nil {
+			pn.pool.discard(pc)
+		}
+	}()
+
+	if pc.conn == nil {
+		err = pn.connect(ctx, pc, req.URL)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	pc.tr.ctx = ctx
+
+	// Send the request.
+	conn := pc.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(reqBytes)
+	if err != nil {
+		pn.logger.Error("Writing request", slogError(err))
+		return nil, pc.reused && ctx.Err() == nil, fmt.Errorf("writing request: %w", timeoutError(ctx, err))
+	}
+
+	// Read the response headers. The body will be streamed from the
+	// connection as the caller reads it.
+	conn.SetWriteDeadline(time.Time{})
+	res, err = httpwire.ReadResponse(pc.br, req.Method)
+	if err != nil {
+		pn.logger.Error("Reading response", slogError(err))
+
+		// If a reused connection gets closed before we receive anything, it
+		// was most likely closed by the server while idle, and it's fine to
+		// retry -- as long as retrying can't cause any harm.
+		retry = pc.reused && ctx.Err() == nil && idempotent(req.Method) &&
+			(errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF))
+		return nil, retry, fmt.Errorf("reading response: %w", err)
+	}
+
+	if pn.config.MaxBodySize >= 0 && res.ContentLength > pn.config.MaxBodySize {
+		pn.logger.Error("Response body too large", slog.Int64("contentLength", res.ContentLength))
+		err = httpwire.ErrBodyTooLarge
+		return nil, false, err
+	}
+
+	reusable := !res.Close && !req.Close
+	res.Body = httpwire.NewLimitedBody(res.Body, pn.config.MaxBodySize, func(complete bool) error {
+		if complete && reusable {
+			pn.pool.put(pc)
+		} else {
+			pn.pool.discard(pc)
+		}
+		return nil
+	})
+
+	return res, false, nil
+}
+
+// connect dials a new connection to the server at u, filling pc with it.
+func (pn *PicoNet) connect(ctx context.Context, pc *pooledConn, u *url.URL) error {
+	addrPort, err := pn.getUsableAddress(ctx, u)
+	if err != nil {
+		pn.logger.Error("Preparing request", slogError(err))
+		return err
+	}
+	return pn.connectAddr(ctx, pc, addrPort, u.Redacted())
+}
+
+// connectAddr dials a new connection to addrPort, filling pc with it. server
+// describes the server for the logs.
+func (pn *PicoNet) connectAddr(ctx context.Context, pc *pooledConn, addrPort netip.AddrPort, server string) error {
+	conn, err := pn.dialConn(ctx, addrPort, server)
+	if err != nil {
+		return err
+	}
+
+	pc.conn = conn
+	pc.tr = &timeoutReader{ctx: ctx, conn: conn, timeout: pn.config.ReadTimeout}
+	pc.br = bufio.NewReader(pc.tr)
+	return nil
+}
+
+// dialStack opens a TCP connection to addrPort on the network stack. This is
+// what PicoNet.dialConn does outside of tests.
+func (pn *PicoNet) dialStack(ctx context.Context, addrPort netip.AddrPort, server string) (net.Conn, error) {
+	const tcpBufSize = 2030 // MTU - ethhdr - iphdr - tcphdr
+
+	// Create the TCP connection.
+	clientAddr := netip.AddrPortFrom(pn.stack.Addr(), uint16(rand.Intn(65535-1024)+1024))
+	conn, err := stacks.NewTCPConn(pn.stack, stacks.TCPConnConfig{
+		TxBufSize: tcpBufSize,
+		RxBufSize: tcpBufSize,
+	})
+	if err != nil {
+		pn.logger.Error("Creating TCP connection", slogError(err))
+		return nil, fmt.Errorf("creating TCP connection: %w", err)
+	}
+
+	pn.logger.Info("TCP connection ready, now dialing",
+		slog.String("clientAddr", clientAddr.String()),
+		slog.String("serverAddr", server),
+		slog.String("serverIPPort", addrPort.String()),
+	)
+
+	err = pn.dial(ctx, conn, clientAddr.Port(), addrPort)
+	if err != nil {
+		pn.logger.Error("Opening TCP connection", slogError(err))
+		return nil, fmt.Errorf("opening TCP connection: %w", err)
+	}
+	return conn, nil
+}
+
+// canonicalHostPort returns the "host:port" of a URL, with the port always
+// present, so that we can tell which requests go to the same server.
+func canonicalHostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// idempotent tells if requests with the given method can be safely retried.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+// dial opens conn, connecting it to addrPort, and waits until the connection is
+// established. In case of errors, conn is left closed.
+func (pn *PicoNet) dial(ctx context.Context, conn *stacks.TCPConn, localPort uint16, addrPort netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(ctx, pn.config.DialTimeout)
+	defer cancel()
+
+	mac, err := pn.hardwareAddrFor(ctx, addrPort.Addr())
+	if err != nil {
+		return err
+	}
+
+	err = conn.OpenDialTCP(localPort, mac, addrPort, seqs.Value(rand.Intn(65535-1024)+1024))
+	if err != nil {
+		return err
+	}
+
+	for conn.State() != seqs.StateEstablished {
+		// A reset while waiting for the SYN-ACK takes the connection straight
+		// back to closed.
+		if conn.State().IsClosed() {
+			pn.stack.CloseTCP(localPort)
+			return ErrConnRefused
+		}
+		err = sleepCtx(ctx, 100*time.Millisecond)
+		if err != nil {
+			pn.stack.CloseTCP(localPort)
+			if errors.Is(err, ErrTimeout) {
+				// Maybe we are sending our SYNs to a stale hardware address.
+				pn.forgetRoute(addrPort.Addr())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// closeConn closes a TCP connection and waits until it is actually closed.
+func (pn *PicoNet) closeConn(c net.Conn) {
+	conn := c.(*stacks.TCPConn)
+	err := conn.Close()
+	if err != nil {
+		pn.logger.Error("Closing TCP connection", slogError(err))
+		return
+	}
+	for !conn.State().IsClosed() {
+		pn.logger.Info("Waiting for TCP connection to close", slog.String("state", conn.State().String()))
+		time.Sleep(1000 * time.Millisecond)
+	}
+	pn.logger.Info("TCP connection closed")
+}
+
+// connUsable tells if an idle connection can still be used for requests. If
+// the server closed it, or sent us something out of the blue, it can't.
+func connUsable(c net.Conn) bool {
+	conn := c.(*stacks.TCPConn)
+	return conn.State() == seqs.StateEstablished && conn.BufferedInput() == 0
+}
+
+// timeoutReader reads from a TCP connection, making sure each read times out if
+// the server doesn't send anything for too long, or if ctx is done.
+type timeoutReader struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	// seqs reads block in a busy loop we can't interrupt, so we read in short
+	// slices of time, checking ctx between them. This makes cancellation
+	// reasonably responsive.
+	const slice = 100 * time.Millisecond
+
+	deadline := time.Now().Add(tr.timeout)
+	if ctxDeadline, ok := tr.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	for {
+		if tr.ctx.Err() != nil {
+			return 0, ctxError(tr.ctx)
+		}
+
+		sliceDeadline := time.Now().Add(slice)
+		if sliceDeadline.After(deadline) {
+			sliceDeadline = deadline
+		}
+
+		// This can fail if the server already closed its side of the
+		// connection, but then the Read below will fail, too.
+		tr.conn.SetReadDeadline(sliceDeadline)
+		n, err := tr.conn.Read(p)
+
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded) && n == 0:
+			if time.Now().Before(deadline) {
+				continue
+			}
+			return 0, timeoutError(tr.ctx, err)
+		case errors.Is(err, net.ErrClosed):
+			// Once the server closes its side of the connection, seqs refuses
+			// to read from it, so from our point of view the stream is over.
+			// This is what makes bodies delimited by connection close work.
+			return n, io.EOF
+		default:
+			return n, err
+		}
+	}
+}
+
+// timeoutError translates deadline errors coming from the network stack into
+// our own ErrTimeout (or into the cancellation error, if ctx was cancelled).
+func timeoutError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctxError(ctx)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+// testHTTPServer is an HTTP server at the other end of the connections a
+// PicoNet from newTestHTTPClient dials, which are net.Pipes.
+type testHTTPServer struct {
+	// respond returns the raw response to req, the nth request on its
+	// connection (counting from zero). An empty response closes the
+	// connection without answering. Nil means "200 OK" to everything.
+	respond func(req *httpwire.Request, n int) string
+
+	// dialErr, when not nil, is what dialing fails with.
+	dialErr error
+
+	mutex sync.Mutex
+
+	// dials are the addresses dialed, and requests the requests received,
+	// in order.
+	dials    []netip.AddrPort
+	requests []*httpwire.Request
+}
+
+// testOK is the response testHTTPServer sends by default.
+const testOK = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+func (s *testHTTPServer) dial(ctx context.Context, addrPort netip.AddrPort, server string) (net.Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dialErr != nil {
+		return nil, s.dialErr
+	}
+	s.dials = append(s.dials, addrPort)
+	client, conn := net.Pipe()
+	go s.serve(conn)
+	return client, nil
+}
+
+func (s *testHTTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for n := 0; ; n++ {
+		req, err := httpwire.ReadRequest(br, 1<<16)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.requests = append(s.requests, req)
+		s.mutex.Unlock()
+
+		res := testOK
+		if s.respond != nil {
+			res = s.respond(req, n)
+		}
+		if res == "" {
+			return
+		}
+		if _, err := io.WriteString(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+// counts returns how many connections were dialed, and how many requests
+// received.
+func (s *testHTTPServer) counts() (dials, requests int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.dials), len(s.requests)
+}
+
+// newTestHTTPClient returns a PicoNet ready to send requests to s.
+func newTestHTTPClient(s *testHTTPServer, config PicoNetConfig) *PicoNet {
+	pn := &PicoNet{
+		logger:   discardLogger,
+		status:   StatusReadyToGo,
+		config:   config.withDefaults(),
+		dnsCache: newExpiringCache[string, []netip.Addr](dnsCacheSize),
+		dialConn: s.dial,
+	}
+	pn.pool = newConnPool(pn.config.TCPPorts, pn.config.IdleTimeout, func(c net.Conn) { c.Close() }, nil)
+	return pn
+}
+
+// getBody does a GET of url and returns the body.
+func getBody(ctx context.Context, pn *PicoNet, url string) (string, error) {
+	res, err := pn.Get(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestDoErrors(t *testing.T) {
+	hang := make(chan struct{})
+	t.Cleanup(func() { close(hang) })
+	s := &testHTTPServer{respond: func(req *httpwire.Request, n int) string {
+		if req.URL.Path == "/hang" {
+			<-hang
+		}
+		return testOK
+	}}
+	pn := newTestHTTPClient(s, PicoNetConfig{Hosts: map[string]netip.Addr{"nas.lan": netip.MustParseAddr("192.168.1.20")}})
+	ctx := context.Background()
+
+	if body, err := getBody(ctx, pn, "http://nas.lan/"); err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if _, err := getBody(ctx, pn, "http://other.lan/"); !errors.Is(err, ErrDNS) {
+		t.Errorf("unknown host: got %v, want ErrDNS", err)
+	}
+
+	// A server taking too long to answer.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := getBody(timeoutCtx, pn, "http://nas.lan/hang"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("no answer: got %v, want ErrTimeout", err)
+	}
+
+	// A request cancelled while waiting for the answer.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := getBody(cancelCtx, pn, "http://nas.lan/hang"); !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("cancelled: got %v, want context.Canceled", err)
+	}
+
+	// Connections that failed like this aren't kept around.
+	waitFor(t, "the connections to be closed", func() bool {
+		pn.pool.mutex.Lock()
+		defer pn.pool.mutex.Unlock()
+		return pn.pool.open == len(pn.pool.idle)
+	})
+
+	// The stack tells when the server refused the connection, the way
+	// dialStack does.
+	s.mutex.Lock()
+	s.dialErr = fmt.Errorf("opening TCP connection: %w", ErrConnRefused)
+	s.mutex.Unlock()
+	if _, err := getBody(ctx, pn, "http://192.168.1.30:8080/"); !errors.Is(err, ErrConnRefused) {
+		t.Errorf("refused: got %v, want ErrConnRefused", err)
+	}
+
+	pn.setStatus(StatusObtainingIP, nil)
+	if _, err := getBody(ctx, pn, "http://nas.lan/"); !errors.Is(err, ErrNotReady) {
+		t.Errorf("not ready: got %v, want ErrNotReady", err)
+	}
+}
+
+func TestDoWaitsForSlot(t *testing.T) {
+	s := &testHTTPServer{}
+	pn := newTestHTTPClient(s, PicoNetConfig{TCPPorts: 1})
+	ctx := context.Background()
+
+	// A response whose body is still open holds its connection.
+	res, err := pn.Get(ctx, "http://192.168.1.20/first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// So a request to another server can't get one, and runs out of time.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := pn.Get(timeoutCtx, "http://192.168.1.30/"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want ErrTimeout", err)
+	}
+
+	// Or waits until the body is closed.
+	done := make(chan error, 1)
+	go func() {
+		_, err := getBody(ctx, pn, "http://192.168.1.30/second")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("second request done while the first held the only slot: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second request still waiting")
+	}
+	if dials, requests := s.counts(); dials != 2 || requests != 2 {
+		t.Errorf("%d dials, %d requests", dials, requests)
+	}
+}
+
+func TestDoReusesConnections(t *testing.T) {
+	s := &testHTTPServer{respond: func(req *httpwire.Request, n int) string {
+		if req.URL.Path == "/close" {
+			return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+		}
+		return testOK
+	}}
+	pn := newTestHTTPClient(s, PicoNetConfig{TCPPorts: 2})
+	ctx := context.Background()
+	tests := []struct {
+		url   string
+		dials int
+	}{
+		{"http://192.168.1.20/", 1},
+		{"http://192.168.1.20:80/again", 1},
+		{"http://192.168.1.20:8080/", 2},
+		{"http://192.168.1.20/close", 2},
+		{"http://192.168.1.20/", 3},
+		{"http://192.168.1.20/", 3},
+	}
+	for _, tt := range tests {
+		if body, err := getBody(ctx, pn, tt.url); err != nil || body != "ok" {
+			t.Fatalf("%s: got %q, %v", tt.url, body, err)
+		}
+		if dials, _ := s.counts(); dials != tt.dials {
+			t.Errorf("%s: %d dials, want %d", tt.url, dials, tt.dials)
+		}
+	}
+
+	// Closing a body without reading it drains it, so the connection can
+	// still be reused.
+	res, err := pn.Get(ctx, "http://192.168.1.20/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	getBody(ctx, pn, "http://192.168.1.20/")
+	if dials, _ := s.counts(); dials != 3 {
+		t.Errorf("%d dials after an unread body, want 3", dials)
+	}
+
+	// Nor is anything with reuse turned off, which tells the server, too.
+	s = &testHTTPServer{}
+	pn = newTestHTTPClient(s, PicoNetConfig{IdleTimeout: -1})
+	for range 2 {
+		if _, err := getBody(ctx, pn, "http://192.168.1.20/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials, _ := s.counts(); dials != 2 || !s.requests[0].Close {
+		t.Errorf("%d dials, first request closing: %v", dials, s.requests[0].Close)
+	}
+}
+
+func TestDoRetriesReusedConnection(t *testing.T) {
+	// The server answers one request per connection, and closes the
+	// connection when the next one arrives, as if it had timed out
+	// meanwhile.
+	s := &testHTTPServer{respond: func(req *httpwire.Request, n int) string {
+		if n > 0 {
+			return ""
+		}
+		return testOK
+	}}
+	pn := newTestHTTPClient(s, PicoNetConfig{})
+	ctx := context.Background()
+
+	for i := range 3 {
+		if body, err := getBody(ctx, pn, "http://192.168.1.20/"); err != nil || body != "ok" {
+			t.Fatalf("request %d: got %q, %v", i+1, body, err)
+		}
+	}
+
+	// Each request after the first went to the idle connection, got EOF,
+	// and was sent again once on a new one.
+	if dials, requests := s.counts(); dials != 3 || requests != 5 {
+		t.Errorf("%d dials, %d requests, want 3 and 5", dials, requests)
+	}
+
+	// Requests that might do something twice aren't retried.
+	res, err := pn.Post(ctx, "http://192.168.1.20/", "text/plain", []byte("hi"))
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("POST: got %v, %v, want EOF", res, err)
+	}
+	if dials, requests := s.counts(); dials != 3 || requests != 6 {
+		t.Errorf("%d dials, %d requests after the POST, want 3 and 6", dials, requests)
+	}
+
+	// Nor are requests on new connections.
+	s.respond = func(req *httpwire.Request, n int) string { return "" }
+	if _, err := getBody(ctx, pn, "http://192.168.1.20:8080/"); err == nil {
+		t.Error("no error from a server closing the connection")
+	}
+	if dials, requests := s.counts(); dials != 4 || requests != 7 {
+		t.Errorf("%d dials, %d requests for a new connection, want 4 and 7", dials, requests)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs/stacks"
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// A tiny HTTP server. Just enough to serve a page or two to a browser: one
+// request per connection, bodies read into memory, and responses built in
+// memory, too. The parsing is in httpwire, shared with the client side.
+//
+
+const (
+	// maxRequestBodySize is the maximum size of a request body we accept. Our
+	// forms are small, so anything larger than this is up to no good.
+	maxRequestBodySize = 4096
+
+	// serverReadTimeout is how long we wait for the client to send each bit
+	// of the request.
+	serverReadTimeout = 5 * time.Second
+
+	// serverWriteTimeout is how long we wait for the client to take the
+	// response.
+	serverWriteTimeout = 10 * time.Second
+
+	// serverReadBufSize is the size of the buffer used to read requests, which
+	// is also the maximum length of each line in the request header.
+	serverReadBufSize = 1024
+
+	// listenMaxConns is the number of connections a listener can handle at
+	// the same time. Browsers like to open an extra connection or two just in
+	// case, and if that's the one we take, the request on the other one would
+	// have to wait until we give up on the idle one.
+	listenMaxConns = 2
+
+	// listenBufSize is the size of the transmit and receive buffers of each
+	// connection accepted by a listener. As with the connections we dial,
+	// this is the MTU minus the Ethernet, IP and TCP headers.
+	listenBufSize = 2030
+)
+
+// serverResponse is a response sent by our HTTP server. Unlike
+// httpwire.Response, which is read from the network bit by bit, this is small
+// enough to be built in memory before sending.
+type serverResponse struct {
+	// StatusCode is the HTTP status code, like 200.
+	StatusCode int
+
+	// Header contains the header fields to send. Content-Length and
+	// Connection are filled in automatically.
+	Header httpwire.Header
+
+	// Body is the response body.
+	Body []byte
+}
+
+// statusTexts are the reason phrases for the status codes we use.
+var statusTexts = map[int]string{
+	200: "OK",
+	204: "No Content",
+	400: "Bad Request",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	413: "Payload Too Large",
+	500: "Internal Server Error",
+	503: "Service Unavailable",
+}
+
+// textResponse returns a plain text response with the given status code.
+func textResponse(statusCode int, text string) *serverResponse {
+	res := &serverResponse{
+		StatusCode: statusCode,
+		Header:     httpwire.Header{},
+		Body:       []byte(text + "\n"),
+	}
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return res
+}
+
+// appendTo appends the response, exactly as it should go over the wire, to
+// dst. method is the method of the request being answered: responses to HEAD
+// requests carry no body.
+func (res *serverResponse) appendTo(dst []byte, method string) ([]byte, error) {
+	text, ok := statusTexts[res.StatusCode]
+	if !ok {
+		text = "Unknown"
+	}
+	dst = append(dst, "HTTP/1.1 "...)
+	dst = strconv.AppendInt(dst, int64(res.StatusCode), 10)
+	dst = append(dst, ' ')
+	dst = append(dst, text...)
+	dst = append(dst, "\r\n"...)
+
+	// We close the connection after every response, and say so.
+	hdr := res.Header.Clone()
+	hdr.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	hdr.Set("Connection", "close")
+	dst, err := hdr.AppendTo(dst)
+	if err != nil {
+		return dst, err
+	}
+
+	dst = append(dst, "\r\n"...)
+	if method != "HEAD" {
+		dst = append(dst, res.Body...)
+	}
+	return dst, nil
+}
+
+// handlerFunc handles a request received by our HTTP server, returning the
+// response to send back.
+type handlerFunc func(req *httpwire.Request) *serverResponse
+
+// Listen starts accepting TCP connections on the given port. Each listener
+// takes one of the PicoNetConfig.ListenPorts.
+//
+// Note that Accept on the returned listener busy-waits for connections (that's
+// how the network stack works), so better call it from a goroutine that has
+// nothing else to do.
+func (pn *PicoNet) Listen(port uint16) (net.Listener, error) {
+	if pn.Status() != StatusReadyToGo {
+		return nil, ErrNotReady
+	}
+	if pn.config.ListenPorts <= 0 {
+		return nil, errors.New("no ports reserved for listening, see PicoNetConfig.ListenPorts")
+	}
+
+	l, err := stacks.NewTCPListener(pn.stack, stacks.TCPListenerConfig{
+		MaxConnections: listenMaxConns,
+		ConnTxBufSize:  listenBufSize,
+		ConnRxBufSize:  listenBufSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating TCP listener: %w", err)
+	}
+	err = l.StartListening(port)
+	if err != nil {
+		return nil, fmt.Errorf("listening on port %d: %w", port, err)
+	}
+
+	pn.logger.Info("Listening for TCP connections", slog.Int("port", int(port)))
+	return l, nil
+}
+
+// serveHTTP accepts connections from l and serves HTTP requests on them with
+// handler, until l is closed. Each connection is served on its own goroutine.
+func serveHTTP(l net.Listener, logger *slog.Logger, handler handlerFunc) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, logger, handler)
+	}
+}
+
+// serveConn serves a single request on conn, and then closes it.
+func serveConn(conn net.Conn, logger *slog.Logger, handler handlerFunc) {
+	defer conn.Close()
+	startTime := time.Now()
+
+	tr := &timeoutReader{ctx: context.Background(), conn: conn, timeout: serverReadTimeout}
+	br := bufio.NewReaderSize(tr, serverReadBufSize)
+
+	method := "GET"
+	var res *serverResponse
+	req, err := httpwire.ReadRequest(br, maxRequestBodySize)
+	switch {
+	case errors.Is(err, ErrTimeout) || errors.Is(err, io.ErrUnexpectedEOF):
+		// The client went quiet or away. Nobody to answer to.
+		logger.Info("HTTP client gave up before sending a request", slogError(err))
+		return
+	case errors.Is(err, httpwire.ErrRequestTooLarge):
+		res = textResponse(413, "Request too large")
+	case err != nil:
+		logger.Warn("Reading HTTP request", slogError(err))
+		res = textResponse(400, "Bad request")
+	default:
+		method = req.Method
+		res = handler(req)
+	}
+
+	buf, err := res.appendTo(make([]byte, 0, 256+len(res.Body)), method)
+	if err != nil {
+		logger.Error("Building HTTP response", slogError(err))
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	_, err = conn.Write(buf)
+	if err != nil {
+		logger.Warn("Sending HTTP response", slogError(err))
+		return
+	}
+
+	if req != nil {
+		logger.Info("Served HTTP request",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", res.StatusCode),
+			slogTook(startTime),
+		)
+	}
+}
@@ -0,0 +1,132 @@
+// Package aggregate sums up samples over time windows. We read the sensor
+// every few seconds, but nobody wants that many samples stored: the env-server
+// expects about one every five minutes. So the samples of each window are
+// summed up into their mean, minimum and maximum, and that's what gets
+// uploaded.
+//
+// Nothing in here knows about the sensor, the network or the clock. It takes
+// timestamps and values, and hands back complete windows.
+package aggregate
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultWindow is the width of the windows unless the settings say
+// otherwise.
+const DefaultWindow = 5 * time.Minute
+
+// Stats sums up the values of a measurement over a window.
+type Stats struct {
+	// Count is the number of values, and Min and Max the extremes among
+	// them. Min and Max are meaningless if Count is zero.
+	Count    int
+	Min, Max float64
+
+	// sum is the sum of the values, for the mean.
+	sum float64
+}
+
+// Add adds a value to the stats. NaNs are ignored.
+func (s *Stats) Add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.sum += v
+}
+
+// Mean returns the mean of the values, or NaN if there are none.
+func (s Stats) Mean() float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	return s.sum / float64(s.Count)
+}
+
+// Window is a time window, with the stats of each measurement over it.
+type Window struct {
+	// Start is when the window starts, and Width how long it lasts.
+	Start time.Time
+	Width time.Duration
+
+	// Stats has the stats of each measurement, in the order they were
+	// given to Aggregator.Add.
+	Stats []Stats
+}
+
+// End returns when the window ends, which is also when the next one starts.
+func (w Window) End() time.Time {
+	return w.Start.Add(w.Width)
+}
+
+// Aggregator splits a stream of samples into windows of a fixed width, aligned
+// to the wall clock: five-minute windows start at :00, :05, :10 and so on,
+// whenever the first sample arrives. Windows without samples are skipped.
+//
+// Not safe for concurrent use.
+type Aggregator struct {
+	// width is the width of the windows.
+	width time.Duration
+
+	// measurements is how many values each sample has.
+	measurements int
+
+	// current is the window being filled. Its Stats are nil if there is
+	// none.
+	current Window
+}
+
+// New returns an aggregator for samples of the given number of measurements,
+// over windows of the given width, or DefaultWindow if not positive. For the
+// windows to line up with the clock, the width should evenly divide a day;
+// anything dividing an hour does.
+func New(width time.Duration, measurements int) *Aggregator {
+	if width <= 0 {
+		width = DefaultWindow
+	}
+	return &Aggregator{width: width, measurements: measurements}
+}
+
+// Add adds a sample taken at time t, with one value per measurement. A sample
+// outside the window being filled completes it, and the completed window is
+// returned. That includes samples from before the window, in case the clock
+// goes back.
+func (a *Aggregator) Add(t time.Time, values ...float64) (done Window, ok bool) {
+	if a.current.Stats != nil && (t.Before(a.current.Start) || !t.Before(a.current.End())) {
+		done, ok = a.current, true
+		a.current.Stats = nil
+	}
+
+	if a.current.Stats == nil {
+		// Truncate counts from the zero time, which is midnight UTC, so
+		// windows dividing a day start at round times.
+		a.current = Window{
+			Start: t.Truncate(a.width),
+			Width: a.width,
+			Stats: make([]Stats, a.measurements),
+		}
+	}
+	for i := range min(len(values), a.measurements) {
+		a.current.Stats[i].Add(values[i])
+	}
+	return done, ok
+}
+
+// Flush returns the window being filled if it's over by now, for when the
+// samples stop coming and Add won't complete it.
+func (a *Aggregator) Flush(now time.Time) (done Window, ok bool) {
+	if a.current.Stats == nil || now.Before(a.current.End()) {
+		return Window{}, false
+	}
+	done = a.current
+	a.current.Stats = nil
+	return done, true
+}
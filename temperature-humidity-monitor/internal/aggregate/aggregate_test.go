@@ -0,0 +1,225 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// at returns 2026-01-02 at the given time of day, UTC.
+func at(hour, min, sec int) time.Time {
+	return time.Date(2026, 1, 2, hour, min, sec, 0, time.UTC)
+}
+
+func TestStats(t *testing.T) {
+	var s Stats
+	if s.Count != 0 || !math.IsNaN(s.Mean()) {
+		t.Errorf("empty: %+v, mean %v", s, s.Mean())
+	}
+
+	for _, v := range []float64{21.5, math.NaN(), 19, 23.25, math.NaN(), -0.5} {
+		s.Add(v)
+	}
+	if s.Count != 4 || s.Min != -0.5 || s.Max != 23.25 || s.Mean() != 15.8125 {
+		t.Errorf("got %+v, mean %v", s, s.Mean())
+	}
+
+	// Negative values only: the first one sets both extremes, rather
+	// than the zero value.
+	s = Stats{}
+	s.Add(-3)
+	s.Add(-1)
+	if s.Min != -3 || s.Max != -1 || s.Mean() != -2 {
+		t.Errorf("got %+v, mean %v", s, s.Mean())
+	}
+
+	// Only NaNs: nothing to say.
+	s = Stats{}
+	s.Add(math.NaN())
+	if s.Count != 0 || !math.IsNaN(s.Mean()) {
+		t.Errorf("got %+v, mean %v", s, s.Mean())
+	}
+}
+
+func TestAggregatorBoundaries(t *testing.T) {
+	tests := []struct {
+		name  string
+		width time.Duration
+		first time.Time
+		start time.Time
+	}{
+		{"five minutes", 5 * time.Minute, at(10, 3, 10), at(10, 0, 0)},
+		{"on the boundary", 5 * time.Minute, at(10, 5, 0), at(10, 5, 0)},
+		{"just before the boundary", 5 * time.Minute, at(10, 4, 59).Add(999 * time.Millisecond), at(10, 0, 0)},
+		{"fifteen minutes", 15 * time.Minute, at(10, 44, 59), at(10, 30, 0)},
+		{"an hour", time.Hour, at(23, 59, 59), at(23, 0, 0)},
+		{"default", 0, at(10, 9, 0), at(10, 5, 0)},
+		{"negative", -time.Minute, at(10, 9, 0), at(10, 5, 0)},
+
+		// Windows follow round times wherever in the world, for the
+		// time zones that are whole hours away from UTC, and half hours
+		// away with windows dividing half an hour.
+		{"another time zone", 15 * time.Minute, time.Date(2026, 1, 2, 10, 17, 0, 0, time.FixedZone("CET", 3600)), time.Date(2026, 1, 2, 10, 15, 0, 0, time.FixedZone("CET", 3600))},
+		{"half an hour away", 10 * time.Minute, time.Date(2026, 1, 2, 10, 47, 0, 0, time.FixedZone("IST", 5*3600+1800)), time.Date(2026, 1, 2, 10, 40, 0, 0, time.FixedZone("IST", 5*3600+1800))},
+	}
+	for _, tt := range tests {
+		a := New(tt.width, 1)
+		a.Add(tt.first, 1)
+		width := tt.width
+		if width <= 0 {
+			width = DefaultWindow
+		}
+
+		// Anything until the end of the window goes in it.
+		if w, ok := a.Add(tt.start.Add(width-time.Nanosecond), 2); ok {
+			t.Errorf("%s: window done early: %+v", tt.name, w)
+		}
+		w, ok := a.Add(tt.start.Add(width), 3)
+		if !ok || !w.Start.Equal(tt.start) || w.Width != width || w.Stats[0].Count != 2 {
+			t.Errorf("%s: got %+v, %v, want a window of 2 starting at %v", tt.name, w, ok, tt.start)
+		}
+		if w, ok := a.Flush(tt.start.Add(2 * width)); !ok || !w.Start.Equal(tt.start.Add(width)) {
+			t.Errorf("%s: next window %+v, %v, want it to start at %v", tt.name, w, ok, tt.start.Add(width))
+		}
+	}
+}
+
+func TestAggregatorStats(t *testing.T) {
+	a := New(5*time.Minute, 2)
+	samples := []struct {
+		t           time.Time
+		temperature float64
+		humidity    float64
+	}{
+		{at(10, 0, 10), 20, 50},
+		{at(10, 1, 10), 22, math.NaN()},
+		{at(10, 2, 10), math.NaN(), math.NaN()},
+		{at(10, 3, 10), 21, 54},
+		{at(10, 4, 10), 20.5, 52},
+	}
+	for _, s := range samples {
+		if w, ok := a.Add(s.t, s.temperature, s.humidity); ok {
+			t.Fatalf("window done at %v: %+v", s.t, w)
+		}
+	}
+	w, ok := a.Flush(at(10, 5, 0))
+	if !ok {
+		t.Fatal("nothing flushed")
+	}
+	want := []struct {
+		count          int
+		mean, min, max float64
+	}{
+		{4, 20.875, 20, 22},
+		{3, 52, 50, 54},
+	}
+	if len(w.Stats) != len(want) {
+		t.Fatalf("%d stats, want %d", len(w.Stats), len(want))
+	}
+	for i, s := range w.Stats {
+		if s.Count != want[i].count || s.Mean() != want[i].mean || s.Min != want[i].min || s.Max != want[i].max {
+			t.Errorf("stats %d: %+v, mean %v, want %+v", i, s, s.Mean(), want[i])
+		}
+	}
+
+	// A window where one of the measurements only got NaNs has nothing for
+	// it.
+	a.Add(at(10, 6, 0), 19, math.NaN())
+	w, _ = a.Flush(at(11, 0, 0))
+	if w.Stats[0].Count != 1 || w.Stats[1].Count != 0 || !math.IsNaN(w.Stats[1].Mean()) {
+		t.Errorf("got %+v", w.Stats)
+	}
+
+	// Values beyond the measurements are ignored, and missing ones too.
+	a.Add(at(11, 0, 0), 1, 2, 3)
+	a.Add(at(11, 0, 1), 4)
+	w, _ = a.Flush(at(12, 0, 0))
+	if len(w.Stats) != 2 || w.Stats[0].Count != 2 || w.Stats[1].Count != 1 {
+		t.Errorf("got %+v", w.Stats)
+	}
+}
+
+func TestAggregatorGaps(t *testing.T) {
+	a := New(5*time.Minute, 1)
+	a.Add(at(10, 0, 0), 1)
+
+	// The windows in between had no samples, so there's nothing for them.
+	w, ok := a.Add(at(11, 2, 0), 2)
+	if !ok || !w.Start.Equal(at(10, 0, 0)) {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+	w, ok = a.Flush(at(12, 0, 0))
+	if !ok || !w.Start.Equal(at(11, 0, 0)) || w.Stats[0].Mean() != 2 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+}
+
+func TestAggregatorClockBack(t *testing.T) {
+	a := New(5*time.Minute, 1)
+	a.Add(at(10, 7, 0), 1)
+	a.Add(at(10, 8, 0), 2)
+
+	// A sample from before the window completes it, even if it's not
+	// over, since we won't see the rest of it for a while.
+	w, ok := a.Add(at(10, 4, 59), 3)
+	if !ok || !w.Start.Equal(at(10, 5, 0)) || w.Stats[0].Count != 2 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+
+	// The sample from the past starts a window of its own, which the next
+	// sample in the right time completes.
+	w, ok = a.Add(at(10, 9, 0), 4)
+	if !ok || !w.Start.Equal(at(10, 0, 0)) || w.Stats[0].Count != 1 || w.Stats[0].Mean() != 3 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+	w, ok = a.Flush(at(10, 10, 0))
+	if !ok || !w.Start.Equal(at(10, 5, 0)) || w.Stats[0].Mean() != 4 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+
+	// Flushing with the clock behind the window does nothing.
+	a.Add(at(10, 12, 0), 5)
+	if w, ok := a.Flush(at(9, 0, 0)); ok {
+		t.Errorf("flushed %+v", w)
+	}
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	a := New(5*time.Minute, 1)
+
+	// Nothing to flush before the first sample.
+	if w, ok := a.Flush(at(10, 0, 0)); ok {
+		t.Errorf("flushed %+v", w)
+	}
+
+	a.Add(at(10, 1, 0), 1)
+	for _, now := range []time.Time{at(10, 1, 0), at(10, 4, 59)} {
+		if w, ok := a.Flush(now); ok {
+			t.Errorf("flushed at %v: %+v", now, w)
+		}
+	}
+	w, ok := a.Flush(at(10, 5, 0))
+	if !ok || !w.Start.Equal(at(10, 0, 0)) || !w.End().Equal(at(10, 5, 0)) || w.Stats[0].Count != 1 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+
+	// Once.
+	if w, ok := a.Flush(at(11, 0, 0)); ok {
+		t.Errorf("flushed again: %+v", w)
+	}
+
+	// The next sample starts afresh, not where the flushed window was.
+	if w, ok := a.Add(at(10, 6, 0), 2); ok {
+		t.Errorf("window done: %+v", w)
+	}
+	w, ok = a.Flush(at(10, 10, 0))
+	if !ok || !w.Start.Equal(at(10, 5, 0)) || w.Stats[0].Count != 1 || w.Stats[0].Mean() != 2 {
+		t.Errorf("got %+v, %v", w, ok)
+	}
+
+	// Flushed windows don't share their stats with later ones.
+	a.Add(at(10, 11, 0), 3)
+	if w.Stats[0].Mean() != 2 {
+		t.Errorf("flushed window changed: %+v", w)
+	}
+}
@@ -0,0 +1,172 @@
+package httpwire
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Header represents the headers of an HTTP request or response. Keys are
+// stored in canonical form (like "Content-Length"), so that lookups are
+// case-insensitive as long as they go through the methods below.
+//
+// This is pretty much a poor man's version of the `http.Header` from the
+// standard library, which we can't use because dragging `net/http` into the
+// Pico is not an option.
+type Header map[string][]string
+
+// Add adds the key, value pair to the header, appending to any existing values
+// associated with key.
+func (h Header) Add(key, value string) {
+	key = canonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set sets the header entries associated with key to the single element value,
+// replacing any existing values associated with key.
+func (h Header) Set(key, value string) {
+	h[canonicalHeaderKey(key)] = []string{value}
+}
+
+// Get gets the first value associated with the given key, or "" if there are no
+// values associated with the key.
+func (h Header) Get(key string) string {
+	values := h[canonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns all values associated with the given key.
+func (h Header) Values(key string) []string {
+	return h[canonicalHeaderKey(key)]
+}
+
+// Has tells if there is any value associated with the given key.
+func (h Header) Has(key string) bool {
+	_, ok := h[canonicalHeaderKey(key)]
+	return ok
+}
+
+// Del deletes the values associated with key.
+func (h Header) Del(key string) {
+	delete(h, canonicalHeaderKey(key))
+}
+
+// Clone returns a copy of h that can be modified without affecting h.
+func (h Header) Clone() Header {
+	c := make(Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// errInvalidHeader is returned when trying to send a header that would produce
+// a malformed (or maliciously crafted) HTTP message.
+var errInvalidHeader = errors.New("invalid HTTP header")
+
+// AppendTo appends the header in wire format (each field terminated by CRLF)
+// to dst, returning the extended buffer. Keys are written in sorted order, so
+// that the output is deterministic.
+func (h Header) AppendTo(dst []byte) ([]byte, error) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !validHeaderKey(k) {
+			return dst, errInvalidHeader
+		}
+		for _, v := range h[k] {
+			if !validHeaderValue(v) {
+				return dst, errInvalidHeader
+			}
+			dst = append(dst, k...)
+			dst = append(dst, ": "...)
+			dst = append(dst, v...)
+			dst = append(dst, "\r\n"...)
+		}
+	}
+	return dst, nil
+}
+
+// canonicalHeaderKey returns the canonical format of a header key: the first
+// letter and any letter following a hyphen are upper case, the rest are lower
+// case. For example, "content-TYPE" becomes "Content-Type".
+func canonicalHeaderKey(key string) string {
+	upper := true
+	needsChange := false
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (upper && 'a' <= c && c <= 'z') || (!upper && 'A' <= c && c <= 'Z') {
+			needsChange = true
+			break
+		}
+		upper = c == '-'
+	}
+	if !needsChange {
+		return key
+	}
+
+	b := []byte(key)
+	upper = true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			b[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
+
+// validHeaderKey checks if key is a valid HTTP token (RFC 9110, section 5.1).
+func validHeaderKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue checks if value can be safely sent as a header value. Mostly
+// this is about not allowing line breaks to sneak into the request.
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// parseContentLength parses a Content-Length value, which must be all digits
+// (RFC 9110, section 8.6). strconv.ParseInt alone would also take a sign, as
+// in "+5", which some other party on the way might read differently.
+func parseContentLength(value string) (int64, bool) {
+	if value == "" {
+		return 0, false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,259 @@
+// Package httpwire reads and writes HTTP/1.x messages, byte by byte, for the
+// HTTP client and server of the firmware. It does without net/http, which is
+// way too big for the Pico, and without any networking: requests are appended
+// to buffers, and responses read from a bufio.Reader, wherever they come from.
+package httpwire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// UserAgent is the value we send in the User-Agent header, unless the caller
+// sets one explicitly. The firmware sets it to its name and version at start.
+var UserAgent = "simple-minded-home-thm"
+
+// Request is an HTTP request, to be sent by a client or received by a server.
+type Request struct {
+	// Method is the HTTP method, like "GET" or "PUT".
+	Method string
+
+	// URL is the URL being requested. Only the "http" scheme is supported.
+	URL *url.URL
+
+	// Header contains additional header fields to send. Host, User-Agent,
+	// Content-Length and Connection are filled in automatically when writing
+	// the request, but User-Agent can be overridden here.
+	Header Header
+
+	// Body is the request body. Can be empty.
+	Body []byte
+
+	// Close asks the server to close the connection after responding,
+	// instead of keeping it open for further requests.
+	Close bool
+}
+
+// NewRequest creates a new Request for the given method, URL and body. The
+// body can be nil.
+func NewRequest(method, urlStr string, body []byte) (*Request, error) {
+	if !validMethod(method) {
+		return nil, fmt.Errorf("invalid HTTP method %q", method)
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL: %w", err)
+	}
+	err = ValidateURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Method: method,
+		URL:    u,
+		Header: Header{},
+		Body:   body,
+	}
+	return req, nil
+}
+
+var (
+	errMalformedRequestLine = errors.New("malformed HTTP request line")
+	errTransferEncoding     = errors.New("unsupported HTTP Transfer-Encoding")
+)
+
+// ErrRequestTooLarge is returned when reading a request with a body larger
+// than the maximum allowed size.
+var ErrRequestTooLarge = errors.New("HTTP request body too large")
+
+// ErrUnsupportedScheme is returned for URLs using any scheme other than "http".
+var ErrUnsupportedScheme = errors.New("unsupported URL scheme")
+
+// ValidateURL checks if u is something we can send a request to.
+func ValidateURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http":
+	case "https":
+		// No TLS here: it would take more RAM and flash than the Pico can
+		// spare, and the stack doesn't support it anyway.
+		return fmt.Errorf("%w: https is not supported, use http", ErrUnsupportedScheme)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("URL must contain a host")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !addr.Is4() {
+		return fmt.Errorf("unsupported address %q: only IPv4 is supported", host)
+	}
+
+	if port := u.Port(); port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	return nil
+}
+
+// requestURI returns the request target to be used in the request line, which
+// is the path plus the query string, if any.
+func (req *Request) requestURI() string {
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	return uri
+}
+
+// AppendTo appends the request, exactly as it should go over the wire, to dst.
+func (req *Request) AppendTo(dst []byte) ([]byte, error) {
+	if !validMethod(req.Method) {
+		return dst, fmt.Errorf("invalid HTTP method %q", req.Method)
+	}
+
+	// Request line.
+	dst = append(dst, req.Method...)
+	dst = append(dst, ' ')
+	dst = append(dst, req.requestURI()...)
+	dst = append(dst, " HTTP/1.1\r\n"...)
+
+	// Automatic headers. Host must come first, according to the RFC. The
+	// Content-Length goes even for empty bodies on methods that usually carry
+	// one, because some servers refuse a POST or PUT without it.
+	hdr := req.Header.Clone()
+	hdr.Del("Host")
+	if !hdr.Has("User-Agent") {
+		hdr.Set("User-Agent", UserAgent)
+	}
+	hdr.Del("Content-Length")
+	if len(req.Body) > 0 || methodExpectsBody(req.Method) {
+		hdr.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	hdr.Del("Connection")
+	if req.Close {
+		hdr.Set("Connection", "close")
+	}
+	if req.URL.User != nil && !hdr.Has("Authorization") {
+		hdr.Set("Authorization", basicAuth(req.URL.User))
+	}
+
+	if !validHeaderValue(req.URL.Host) {
+		return dst, errInvalidHeader
+	}
+	dst = append(dst, "Host: "...)
+	dst = append(dst, req.URL.Host...)
+	dst = append(dst, "\r\n"...)
+
+	dst, err := hdr.AppendTo(dst)
+	if err != nil {
+		return dst, err
+	}
+
+	// Blank line and body.
+	dst = append(dst, "\r\n"...)
+	dst = append(dst, req.Body...)
+	return dst, nil
+}
+
+// Write writes the request to w in wire format, in a single call to w.Write.
+func (req *Request) Write(w io.Writer) error {
+	buf, err := req.AppendTo(make([]byte, 0, 256+len(req.Body)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// validMethod checks if method is something we can put on a request line.
+func validMethod(method string) bool {
+	return validHeaderKey(method)
+}
+
+// methodExpectsBody tells if requests with the given method are expected to
+// carry a body.
+func methodExpectsBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+// basicAuth returns the value of an Authorization header using the Basic scheme
+// with the given credentials.
+func basicAuth(user *url.Userinfo) string {
+	password, _ := user.Password()
+	credentials := user.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// ReadRequest reads an HTTP/1.x request from br, body included. Bodies larger
+// than maxBodySize bytes are refused with ErrRequestTooLarge.
+//
+// Only bodies with a Content-Length are supported. Browsers never send chunked
+// bodies for forms, and neither does anything else we expect to talk to.
+func ReadRequest(br *bufio.Reader, maxBodySize int64) (*Request, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+
+	method, rest, ok1 := bytes.Cut(line, []byte{' '})
+	target, proto, ok2 := bytes.Cut(rest, []byte{' '})
+	major, minor, ok3 := parseHTTPVersion(proto)
+	if !ok1 || !ok2 || !ok3 || major != 1 || !validMethod(string(method)) {
+		return nil, fmt.Errorf("%w: %q", errMalformedRequestLine, line)
+	}
+
+	u, err := url.ParseRequestURI(string(target))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errMalformedRequestLine, err)
+	}
+
+	req := &Request{
+		Method: string(method),
+		URL:    u,
+		Header: Header{},
+	}
+	err = readHeader(br, req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	connection := strings.ToLower(req.Header.Get("Connection"))
+	req.Close = connection == "close" || (minor == 0 && connection != "keep-alive")
+
+	if req.Header.Has("Transfer-Encoding") {
+		return nil, errTransferEncoding
+	}
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		n, ok := parseContentLength(cl)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", errBadContentLength, cl)
+		}
+		if n > maxBodySize {
+			return nil, ErrRequestTooLarge
+		}
+		req.Body = make([]byte, n)
+		_, err = io.ReadFull(br, req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+	}
+
+	return req, nil
+}
@@ -0,0 +1,501 @@
+package httpwire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Response is the response from an HTTP request. This ain't no standard http
+// package, but it does try to parse HTTP/1.x responses properly.
+type Response struct {
+	// Status contains the response status, like "200 OK".
+	Status string
+
+	// StatusCode contains the status code, like 200.
+	StatusCode int
+
+	// Proto contains the protocol version, like "HTTP/1.0".
+	Proto string
+
+	// ProtoMajor and ProtoMinor contain the protocol version numbers, like 1
+	// and 0 for "HTTP/1.0".
+	ProtoMajor, ProtoMinor int
+
+	// Header contains the response headers.
+	Header Header
+
+	// Body streams the response body straight from the network connection.
+	// Callers must close it when done, even if they don't read it: this is
+	// what releases the underlying TCP connection.
+	Body io.ReadCloser
+
+	// ContentLength contains the length of the associated content, as declared
+	// in the Content-Length header. It is -1 if the length was not declared
+	// (for example, for chunked or connection-close-delimited responses).
+	ContentLength int64
+
+	// Close tells if the server asked us to close the connection after this
+	// response (or if it is an HTTP/1.0 server not asking to keep it alive).
+	Close bool
+}
+
+const (
+	// maxHeaderFields is the maximum number of header fields we accept in a
+	// response. Anything beyond that is either broken or malicious.
+	maxHeaderFields = 64
+
+	// maxChunkSizeLineLen is the maximum length of a chunk size line,
+	// including any chunk extensions.
+	maxChunkSizeLineLen = 256
+)
+
+var (
+	errMalformedStatusLine = errors.New("malformed HTTP status line")
+	errMalformedHeader     = errors.New("malformed HTTP header")
+	errTooManyHeaders      = errors.New("too many HTTP header fields")
+	errBadContentLength    = errors.New("bad Content-Length")
+	errMalformedChunk      = errors.New("malformed chunked encoding")
+)
+
+// ErrBodyTooLarge is returned when reading a response body larger than the
+// maximum allowed size.
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// ReadResponse reads the status line and headers of an HTTP/1.x response from
+// br. method is the method of the request this response is answering, which is
+// needed to know if there is a body to read.
+//
+// The body is not read: the returned Response.Body reads it from br on demand,
+// so only the header section must fit in the memory. Closing the body does
+// nothing; it's up to the caller to wrap it with something that releases the
+// connection.
+func ReadResponse(br *bufio.Reader, method string) (*Response, error) {
+	res := &Response{
+		Header:        Header{},
+		ContentLength: -1,
+	}
+
+	// Status line. Any 1xx informational responses are skipped: we never send
+	// anything that requires handling them.
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		err = res.parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		err = readHeader(br, res.Header)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 200 || res.StatusCode == 101 {
+			break
+		}
+		res.Header = Header{}
+	}
+
+	err := res.setupFraming(method)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := res.bodyReader(br, method)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(body)
+	return res, nil
+}
+
+// parseStatusLine parses a line like "HTTP/1.1 404 Not Found" into res.
+func (res *Response) parseStatusLine(line []byte) error {
+	proto, rest, ok := bytes.Cut(line, []byte{' '})
+	if !ok {
+		return errMalformedStatusLine
+	}
+	major, minor, ok := parseHTTPVersion(proto)
+	if !ok || major != 1 {
+		return fmt.Errorf("%w: unsupported protocol %q", errMalformedStatusLine, proto)
+	}
+
+	// The reason phrase may be missing altogether, or may contain spaces.
+	code, reason, _ := bytes.Cut(rest, []byte{' '})
+	if len(code) != 3 {
+		return fmt.Errorf("%w: bad status code %q", errMalformedStatusLine, code)
+	}
+	statusCode := 0
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("%w: bad status code %q", errMalformedStatusLine, code)
+		}
+		statusCode = statusCode*10 + int(c-'0')
+	}
+	if statusCode < 100 {
+		return fmt.Errorf("%w: bad status code %q", errMalformedStatusLine, code)
+	}
+
+	res.Proto = string(proto)
+	res.ProtoMajor = major
+	res.ProtoMinor = minor
+	res.StatusCode = statusCode
+	res.Status = string(code)
+	if len(reason) > 0 {
+		res.Status += " " + string(reason)
+	}
+	return nil
+}
+
+// setupFraming looks at the headers and figures out the ContentLength and
+// Close fields.
+func (res *Response) setupFraming(method string) error {
+	connection := strings.ToLower(strings.Join(res.Header.Values("Connection"), ","))
+	if res.ProtoMinor == 0 {
+		res.Close = !strings.Contains(connection, "keep-alive")
+	} else {
+		res.Close = strings.Contains(connection, "close")
+	}
+
+	if !responseHasBody(res.StatusCode, method) {
+		res.ContentLength = 0
+		return nil
+	}
+
+	// Transfer-Encoding takes precedence over Content-Length. In fact, a
+	// response with both is kinda suspicious, but the RFC says we should
+	// just ignore Content-Length in this case.
+	if res.isChunked() {
+		res.ContentLength = -1
+		return nil
+	}
+
+	// Multiple Content-Length values are fine only if they all agree.
+	values := res.Header.Values("Content-Length")
+	if len(values) == 0 {
+		return nil
+	}
+	var length int64 = -1
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			n, ok := parseContentLength(strings.TrimSpace(v))
+			if !ok || (length >= 0 && n != length) {
+				return errBadContentLength
+			}
+			length = n
+		}
+	}
+	res.ContentLength = length
+	return nil
+}
+
+// isChunked tells if the response body uses the chunked transfer coding.
+func (res *Response) isChunked() bool {
+	codings := strings.Join(res.Header.Values("Transfer-Encoding"), ",")
+	if codings == "" {
+		return false
+	}
+	// Chunked must be the last coding applied.
+	i := strings.LastIndexByte(codings, ',')
+	return strings.EqualFold(strings.TrimSpace(codings[i+1:]), "chunked")
+}
+
+// bodyReader returns a reader yielding the (decoded) response body from br.
+func (res *Response) bodyReader(br *bufio.Reader, method string) (io.Reader, error) {
+	switch {
+	case !responseHasBody(res.StatusCode, method):
+		return bytes.NewReader(nil), nil
+	case res.isChunked():
+		return &chunkedReader{br: br}, nil
+	case res.ContentLength >= 0:
+		return &lengthReader{r: br, remaining: res.ContentLength}, nil
+	default:
+		// No framing information: the body goes until the server closes the
+		// connection.
+		res.Close = true
+		return br, nil
+	}
+}
+
+// responseHasBody tells if a response with the given status code, answering a
+// request with the given method, can have a body.
+func responseHasBody(statusCode int, method string) bool {
+	if method == "HEAD" {
+		return false
+	}
+	if statusCode >= 100 && statusCode < 200 {
+		return false
+	}
+	return statusCode != 204 && statusCode != 304
+}
+
+// parseHTTPVersion parses a protocol string like "HTTP/1.1".
+func parseHTTPVersion(proto []byte) (major, minor int, ok bool) {
+	if len(proto) != len("HTTP/X.Y") || !bytes.HasPrefix(proto, []byte("HTTP/")) || proto[6] != '.' {
+		return 0, 0, false
+	}
+	ma, mi := proto[5], proto[7]
+	if ma < '0' || ma > '9' || mi < '0' || mi > '9' {
+		return 0, 0, false
+	}
+	return int(ma - '0'), int(mi - '0'), true
+}
+
+// readHeader reads header fields from br into h, up to and including the empty
+// line that terminates the header section.
+func readHeader(br *bufio.Reader, h Header) error {
+	lastKey := ""
+	for fields := 0; ; fields++ {
+		line, err := readLine(br)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			return nil
+		}
+		if fields >= maxHeaderFields {
+			return errTooManyHeaders
+		}
+
+		// Obsolete line folding: a line starting with whitespace continues
+		// the previous field value.
+		if line[0] == ' ' || line[0] == '\t' {
+			values := h[lastKey]
+			if len(values) == 0 {
+				return errMalformedHeader
+			}
+			values[len(values)-1] += " " + string(bytes.TrimSpace(line))
+			continue
+		}
+
+		key, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok || !validHeaderKey(string(key)) {
+			return fmt.Errorf("%w: %q", errMalformedHeader, line)
+		}
+		lastKey = canonicalHeaderKey(string(key))
+		h[lastKey] = append(h[lastKey], string(bytes.Trim(value, " \t")))
+	}
+}
+
+// readLine reads a single CRLF- (or LF-) terminated line from br, returning it
+// without the line terminator. Lines longer than the buffer size of br are
+// rejected, which bounds the amount of memory a misbehaving server can make us
+// use.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("HTTP line too long")
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// chunkedReader decodes a body sent with the chunked transfer coding.
+type chunkedReader struct {
+	br *bufio.Reader
+
+	// remaining is how many bytes are still left in the current chunk.
+	remaining uint64
+
+	// done is set after reading the last chunk and the trailer section.
+	done bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+
+	if cr.remaining == 0 {
+		size, err := cr.readChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			// Last chunk. Trailer fields aren't interesting to us, so we just
+			// read and discard them.
+			err = readHeader(cr.br, Header{})
+			if err != nil {
+				return 0, err
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.remaining = size
+	}
+
+	if uint64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.br.Read(p)
+	cr.remaining -= uint64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	// Each chunk's data is followed by a CRLF.
+	if cr.remaining == 0 {
+		line, err := readLine(cr.br)
+		if err != nil {
+			return n, err
+		}
+		if len(line) != 0 {
+			return n, errMalformedChunk
+		}
+	}
+	return n, nil
+}
+
+// readChunkSize reads a chunk size line, discarding any chunk extensions.
+func (cr *chunkedReader) readChunkSize() (uint64, error) {
+	line, err := readLine(cr.br)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) > maxChunkSizeLineLen {
+		return 0, errMalformedChunk
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	if len(line) == 0 || len(line) > 16 {
+		return 0, errMalformedChunk
+	}
+	size, err := strconv.ParseUint(string(line), 16, 64)
+	if err != nil {
+		return 0, errMalformedChunk
+	}
+	return size, nil
+}
+
+// lengthReader reads exactly the given number of bytes from an underlying
+// reader. Unlike io.LimitReader, it complains if the underlying reader ends
+// before that.
+type lengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *lengthReader) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if err == io.EOF && lr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// maxBodyDrain is how many unread body bytes we are willing to read and throw
+// away when a body is closed, in order to be able to reuse the connection.
+const maxBodyDrain = 2048
+
+// limitedBody is a response body that refuses to yield more than a maximum
+// number of bytes, and that runs a custom function when closed.
+type limitedBody struct {
+	r io.Reader
+
+	// remaining is how many bytes we are still willing to read. Negative
+	// means unlimited.
+	remaining int64
+
+	// onClose is called (once) when the body is closed. complete tells if the
+	// whole body was read, which means that the connection is ready for
+	// another response.
+	onClose func(complete bool) error
+
+	// eof is set once we've hit the end of the body.
+	eof bool
+
+	// failed is set if any read failed, in which case the connection is in
+	// an unknown state.
+	failed bool
+
+	closed bool
+}
+
+// NewLimitedBody returns a body reading from r, which yields ErrBodyTooLarge
+// if the body turns out to be larger than maxSize bytes. A negative maxSize
+// means no limit at all.
+func NewLimitedBody(r io.Reader, maxSize int64, onClose func(complete bool) error) io.ReadCloser {
+	return &limitedBody{r: r, remaining: maxSize, onClose: onClose}
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.closed {
+		return 0, errors.New("read on closed response body")
+	}
+	n, err := lb.read(p)
+	if err == io.EOF {
+		lb.eof = true
+	} else if err != nil {
+		lb.failed = true
+	}
+	return n, err
+}
+
+func (lb *limitedBody) read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return lb.r.Read(p)
+	}
+	if lb.remaining == 0 {
+		// We've read all we're willing to. Probe one more byte to tell a body
+		// that happens to be exactly at the limit from one that is too big.
+		var probe [1]byte
+		n, err := lb.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > lb.remaining {
+		p = p[:lb.remaining]
+	}
+	n, err := lb.r.Read(p)
+	lb.remaining -= int64(n)
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	if lb.closed {
+		return nil
+	}
+
+	// If just a little bit is left unread, read it, so that the connection
+	// can be reused. The extra byte is room for seeing the end of the body.
+	if !lb.eof && !lb.failed {
+		_, err := io.CopyN(io.Discard, lb, maxBodyDrain+1)
+		if err != io.EOF {
+			lb.failed = true
+		}
+	}
+
+	lb.closed = true
+	if lb.onClose == nil {
+		return nil
+	}
+	return lb.onClose(lb.eof && !lb.failed)
+}
@@ -0,0 +1,345 @@
+package httpwire
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Captures of what servers send, and what we make of them.
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		method        string
+		status        string
+		statusCode    int
+		proto         string
+		contentLength int64
+		close         bool
+		body          string
+		rest          string // What's left in the reader after the body.
+	}{
+		{
+			name:          "content length",
+			in:            "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloHTTP/1.1",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: 5,
+			body:          "hello",
+			rest:          "HTTP/1.1",
+		},
+		{
+			name:          "multi-word reason phrase",
+			in:            "HTTP/1.1 503 Service Temporarily Unavailable\r\nContent-Length: 0\r\n\r\n",
+			method:        "GET",
+			status:        "503 Service Temporarily Unavailable",
+			statusCode:    503,
+			proto:         "HTTP/1.1",
+			contentLength: 0,
+		},
+		{
+			name:          "no reason phrase",
+			in:            "HTTP/1.1 200\r\nContent-Length: 0\r\n\r\n",
+			method:        "GET",
+			status:        "200",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: 0,
+		},
+		{
+			name:          "bare LF line endings",
+			in:            "HTTP/1.1 200 OK\nContent-Length: 2\n\nok",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: 2,
+			body:          "ok",
+		},
+		{
+			name: "chunked with extensions and trailers",
+			in: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;name=value\r\nhello\r\n" +
+				"6\r\n world\r\n" +
+				"0\r\nX-Checksum: abc\r\nX-Other: def\r\n\r\n" +
+				"next",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: -1,
+			body:          "hello world",
+			rest:          "next",
+		},
+		{
+			name: "chunked wins over Content-Length",
+			in: "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" +
+				"2\r\nok\r\n0\r\n\r\n",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: -1,
+			body:          "ok",
+		},
+		{
+			name:          "delimited by connection close",
+			in:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nall of this\r\nuntil the end",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: -1,
+			close:         true,
+			body:          "all of this\r\nuntil the end",
+		},
+		{
+			name:          "HTTP/1.0 closes by default",
+			in:            "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.0",
+			contentLength: 2,
+			close:         true,
+			body:          "ok",
+		},
+		{
+			name:          "HTTP/1.0 keep-alive",
+			in:            "HTTP/1.0 200 OK\r\nConnection: Keep-Alive\r\nContent-Length: 2\r\n\r\nok",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.0",
+			contentLength: 2,
+			body:          "ok",
+		},
+		{
+			name:          "repeated Content-Length values that agree",
+			in:            "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 2, 2\r\n\r\nok",
+			method:        "GET",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: 2,
+			body:          "ok",
+		},
+		{
+			name: "1xx responses skipped",
+			in: "HTTP/1.1 100 Continue\r\n\r\n" +
+				"HTTP/1.1 102 Processing\r\nX-Progress: 50\r\n\r\n" +
+				"HTTP/1.1 201 Created\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			method:        "PUT",
+			status:        "201 Created",
+			statusCode:    201,
+			proto:         "HTTP/1.1",
+			contentLength: 0,
+			close:         true,
+		},
+		{
+			name:          "no body for HEAD",
+			in:            "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\nnext",
+			method:        "HEAD",
+			status:        "200 OK",
+			statusCode:    200,
+			proto:         "HTTP/1.1",
+			contentLength: 0,
+			rest:          "next",
+		},
+		{
+			name:          "no body for 204",
+			in:            "HTTP/1.1 204 No Content\r\n\r\nnext",
+			method:        "DELETE",
+			status:        "204 No Content",
+			statusCode:    204,
+			proto:         "HTTP/1.1",
+			contentLength: 0,
+			rest:          "next",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.in))
+			res, err := ReadResponse(br, tt.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tt.status || res.StatusCode != tt.statusCode || res.Proto != tt.proto {
+				t.Errorf("status line: got %q %q %d", res.Proto, res.Status, res.StatusCode)
+			}
+			if res.ContentLength != tt.contentLength {
+				t.Errorf("ContentLength = %d, want %d", res.ContentLength, tt.contentLength)
+			}
+			if res.Close != tt.close {
+				t.Errorf("Close = %v, want %v", res.Close, tt.close)
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != tt.rest {
+				t.Errorf("left in the reader: %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestReadResponseHeaders(t *testing.T) {
+	in := "HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1\r\n" +
+		"set-cookie: b=2\r\n" +
+		"X-Folded: first\r\n" +
+		"\t second\r\n" +
+		"X-Spaces:   padded \t\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n"
+	res, err := ReadResponse(bufio.NewReader(strings.NewReader(in)), "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Values("SET-COOKIE"); len(got) != 2 || got[0] != "a=1" || got[1] != "b=2" {
+		t.Errorf("Set-Cookie = %q", got)
+	}
+	if got := res.Header.Get("x-folded"); got != "first second" {
+		t.Errorf("X-Folded = %q", got)
+	}
+	if got := res.Header.Get("X-Spaces"); got != "padded" {
+		t.Errorf("X-Spaces = %q", got)
+	}
+}
+
+func TestReadResponseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error // Nil when any error will do.
+	}{
+		{"HTTP/2", "HTTP/2.0 200 OK\r\n\r\n", errMalformedStatusLine},
+		{"short status code", "HTTP/1.1 20 OK\r\n\r\n", errMalformedStatusLine},
+		{"status code below 100", "HTTP/1.1 099 Huh\r\n\r\n", errMalformedStatusLine},
+		{"no status code", "HTTP/1.1\r\n\r\n", errMalformedStatusLine},
+		{"conflicting Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", errBadContentLength},
+		{"conflicting Content-Length in a list", "HTTP/1.1 200 OK\r\nContent-Length: 2, 3\r\n\r\nab", errBadContentLength},
+		{"negative Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: -2\r\n\r\n", errBadContentLength},
+		{"signed Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: +5\r\n\r\nhello", errBadContentLength},
+		{"signed Content-Length in a list", "HTTP/1.1 200 OK\r\nContent-Length: 5, +5\r\n\r\nhello", errBadContentLength},
+		{"hexadecimal Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: 0x5\r\n\r\nhello", errBadContentLength},
+		{"Content-Length with an exponent", "HTTP/1.1 200 OK\r\nContent-Length: 5e0\r\n\r\nhello", errBadContentLength},
+		{"empty Content-Length in a list", "HTTP/1.1 200 OK\r\nContent-Length: 5,\r\n\r\nhello", errBadContentLength},
+		{"Content-Length too large", "HTTP/1.1 200 OK\r\nContent-Length: 99999999999999999999\r\n\r\n", errBadContentLength},
+		{"space in a key", "HTTP/1.1 200 OK\r\nBad Key: 1\r\n\r\n", errMalformedHeader},
+		{"folding without a field", "HTTP/1.1 200 OK\r\n folded\r\n\r\n", errMalformedHeader},
+		{"too many fields", "HTTP/1.1 200 OK\r\n" + strings.Repeat("X: y\r\n", maxHeaderFields+1) + "\r\n", errTooManyHeaders},
+		{"line too long", "HTTP/1.1 200 OK\r\nX: " + strings.Repeat("y", 5000) + "\r\n\r\n", nil},
+		{"truncated header", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n", io.ErrUnexpectedEOF},
+		{"bad chunk size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", errMalformedChunk},
+		{"chunk without CRLF", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nokX\r\n0\r\n\r\n", errMalformedChunk},
+		{"truncated chunk", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n10\r\nshort", io.ErrUnexpectedEOF},
+		{"truncated body", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ReadResponse(bufio.NewReader(strings.NewReader(tt.in)), "GET")
+			if err == nil {
+				_, err = io.ReadAll(res.Body)
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		maxSize  int64
+		wantErr  error
+		complete bool
+	}{
+		{"hello", 5, nil, true},
+		{"hello", 100, nil, true},
+		{"hello", -1, nil, true},
+		{"", 0, nil, true},
+		{"hello", 4, ErrBodyTooLarge, false},
+	}
+	for _, tt := range tests {
+		calls := 0
+		var complete bool
+		body := NewLimitedBody(strings.NewReader(tt.body), tt.maxSize, func(c bool) error {
+			calls++
+			complete = c
+			return nil
+		})
+		_, err := io.ReadAll(body)
+		if err != tt.wantErr {
+			t.Errorf("%q, max %d: got error %v, want %v", tt.body, tt.maxSize, err, tt.wantErr)
+		}
+		body.Close()
+		body.Close()
+		if calls != 1 || complete != tt.complete {
+			t.Errorf("%q, max %d: onClose called %d times, complete %v", tt.body, tt.maxSize, calls, complete)
+		}
+	}
+}
+
+func TestLimitedBodyDrainsOnClose(t *testing.T) {
+	var complete bool
+	body := NewLimitedBody(strings.NewReader(strings.Repeat("x", maxBodyDrain)), -1, func(c bool) error {
+		complete = c
+		return nil
+	})
+	body.Close()
+	if !complete {
+		t.Error("a small unread body wasn't drained")
+	}
+
+	body = NewLimitedBody(strings.NewReader(strings.Repeat("x", maxBodyDrain+1)), -1, func(c bool) error {
+		complete = c
+		return nil
+	})
+	body.Close()
+	if complete {
+		t.Error("a large unread body was drained")
+	}
+}
+
+func FuzzReadResponse(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", "GET")
+	f.Add("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;x=y\r\nhello\r\n0\r\nX-T: 1\r\n\r\n", "GET")
+	f.Add("HTTP/1.0 200 OK\r\n\r\nuntil close", "GET")
+	f.Add("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n", "PUT")
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 1, 1\r\nX: a\r\n b\r\n\r\nx", "HEAD")
+	f.Fuzz(func(t *testing.T, in, method string) {
+		res, err := ReadResponse(bufio.NewReader(strings.NewReader(in)), method)
+		if err != nil {
+			return
+		}
+		if res.StatusCode < 100 || res.StatusCode > 999 {
+			t.Fatalf("status code %d", res.StatusCode)
+		}
+		if res.ContentLength < -1 {
+			t.Fatalf("ContentLength %d", res.ContentLength)
+		}
+		// The body can never give more than what came after the header.
+		body, _ := io.ReadAll(NewLimitedBody(res.Body, 1<<16, nil))
+		if len(body) > len(in) {
+			t.Fatalf("body of %d bytes from %d bytes of input", len(body), len(in))
+		}
+		if res.ContentLength >= 0 && int64(len(body)) > res.ContentLength {
+			t.Fatalf("body of %d bytes with a Content-Length of %d", len(body), res.ContentLength)
+		}
+	})
+}
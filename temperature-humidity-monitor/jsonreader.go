@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// errBadJSON is returned when parsing JSON that is malformed, or not what we
+// expected.
+var errBadJSON = errors.New("bad JSON")
+
+// parseJSONStrings parses a JSON array of strings, like the lists of locations
+// and sensors the env-server returns. That's all the JSON we ever need to read,
+// so encoding/json, with its appetite for flash, stays out of the firmware.
+func parseJSONStrings(data []byte) ([]string, error) {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '[' {
+		return nil, errBadJSON
+	}
+	i = skipJSONSpace(data, i+1)
+
+	var strs []string
+	if i < len(data) && data[i] == ']' {
+		i++
+	} else {
+		for {
+			s, next, err := parseJSONString(data, i)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, s)
+
+			i = skipJSONSpace(data, next)
+			if i >= len(data) {
+				return nil, errBadJSON
+			}
+			if data[i] == ']' {
+				i++
+				break
+			}
+			if data[i] != ',' {
+				return nil, errBadJSON
+			}
+			i = skipJSONSpace(data, i+1)
+		}
+	}
+
+	if skipJSONSpace(data, i) != len(data) {
+		return nil, errBadJSON
+	}
+	return strs, nil
+}
+
+// parseJSONString parses the JSON string starting at data[i], returning it and
+// the index right after it.
+func parseJSONString(data []byte, i int) (string, int, error) {
+	if i >= len(data) || data[i] != '"' {
+		return "", 0, errBadJSON
+	}
+	i++
+
+	var s []byte
+	for i < len(data) {
+		c := data[i]
+		switch {
+		case c == '"':
+			return string(s), i + 1, nil
+		case c < 0x20:
+			return "", 0, errBadJSON
+		case c != '\\':
+			s = append(s, c)
+			i++
+			continue
+		}
+
+		// An escape sequence.
+		if i+1 >= len(data) {
+			return "", 0, errBadJSON
+		}
+		switch data[i+1] {
+		case '"', '\\', '/':
+			s = append(s, data[i+1])
+		case 'b':
+			s = append(s, '\b')
+		case 'f':
+			s = append(s, '\f')
+		case 'n':
+			s = append(s, '\n')
+		case 'r':
+			s = append(s, '\r')
+		case 't':
+			s = append(s, '\t')
+		case 'u':
+			r, n, ok := parseJSONUnicodeEscape(data[i:])
+			if !ok {
+				return "", 0, errBadJSON
+			}
+			s = utf8.AppendRune(s, r)
+			i += n
+			continue
+		default:
+			return "", 0, errBadJSON
+		}
+		i += 2
+	}
+	return "", 0, errBadJSON
+}
+
+// parseJSONUnicodeEscape parses the \uXXXX escape at the start of data, which
+// may be followed by a second one when the two make a UTF-16 surrogate pair.
+// Returns the rune and how many bytes it took.
+func parseJSONUnicodeEscape(data []byte) (rune, int, bool) {
+	hex := func(b []byte) (rune, bool) {
+		if len(b) < 6 || b[0] != '\\' || b[1] != 'u' {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(string(b[2:6]), 16, 16)
+		return rune(n), err == nil
+	}
+
+	r, ok := hex(data)
+	if !ok {
+		return 0, 0, false
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, 6, true
+	}
+	r2, ok := hex(data[6:])
+	if !ok {
+		// A lone surrogate, which can't be represented in UTF-8.
+		return utf8.RuneError, 6, true
+	}
+	if r = utf16.DecodeRune(r, r2); r == utf8.RuneError {
+		// Not a pair after all. The second escape stands on its own.
+		return r, 6, true
+	}
+	return r, 12, true
+}
+
+// skipJSONSpace returns the index of the first non-whitespace byte in data,
+// starting at i.
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
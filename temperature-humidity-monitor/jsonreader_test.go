@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONStrings(t *testing.T) {
+	tests := []struct {
+		json string
+		want []string
+	}{
+		{`[]`, nil},
+		{" [\t]\n", nil},
+		{`["Attic"]`, []string{"Attic"}},
+		{` [ "Attic" , "Living room" ]  `, []string{"Attic", "Living room"}},
+		{`["", ""]`, []string{"", ""}},
+		{`["q\"\\\/\b\f\n\r\t"]`, []string{"q\"\\/\b\f\n\r\t"}},
+		{`["Baño", "ñ€"]`, []string{"Baño", "ñ€"}},
+		{`["😀"]`, []string{"😀"}},
+
+		// Lone surrogates become replacement characters, as in
+		// encoding/json.
+		{`["\ud83d"]`, []string{"�"}},
+		{`["\ud83dA"]`, []string{"�A"}},
+		{`["\ude00"]`, []string{"�"}},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONStrings([]byte(tt.json))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJSONStrings(%s) = %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseJSONStringsMalformed(t *testing.T) {
+	for _, json := range []string{
+		``,
+		` `,
+		`[`,
+		`]`,
+		`["Attic"`,
+		`["Attic",`,
+		`["Attic",]`,
+		`[,"Attic"]`,
+		`["Attic" "Kitchen"]`,
+		`["Attic"]]`,
+		`["Attic"] x`,
+		`["Attic`,
+		`["Attic\`,
+		`[1]`,
+		`[null]`,
+		`["Attic", 2]`,
+		`[["Attic"]]`,
+		`{"locations":["Attic"]}`,
+		`"Attic"`,
+		`["\x"]`,
+		`["\u12"]`,
+		`["\u12g4"]`,
+		"[\"Att\nic\"]",
+		"[\"\x00\"]",
+	} {
+		if got, err := parseJSONStrings([]byte(json)); !errors.Is(err, errBadJSON) {
+			t.Errorf("parseJSONStrings(%q) = %q, %v, want errBadJSON", json, got, err)
+		}
+	}
+}
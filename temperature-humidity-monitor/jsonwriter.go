@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonWriter builds a JSON document, one value at a time. It's much lighter on
+// the flash than encoding/json, and our documents are simple enough that we
+// don't miss reflection.
+//
+// Keys and values are written in order; the writer only takes care of the
+// commas. It doesn't check if the document makes sense (like a value without a
+// key inside an object): that's on the caller.
+type jsonWriter struct {
+	buf []byte
+
+	// more tells if the container being written already has some value, so
+	// that the next one needs a comma before it.
+	more bool
+}
+
+// Bytes returns the document written so far.
+func (w *jsonWriter) Bytes() []byte {
+	return w.buf
+}
+
+// beginObject starts an object.
+func (w *jsonWriter) beginObject() {
+	w.sep()
+	w.buf = append(w.buf, '{')
+	w.more = false
+}
+
+// endObject ends the current object.
+func (w *jsonWriter) endObject() {
+	w.buf = append(w.buf, '}')
+	w.more = true
+}
+
+// beginArray starts an array.
+func (w *jsonWriter) beginArray() {
+	w.sep()
+	w.buf = append(w.buf, '[')
+	w.more = false
+}
+
+// endArray ends the current array.
+func (w *jsonWriter) endArray() {
+	w.buf = append(w.buf, ']')
+	w.more = true
+}
+
+// key writes the key of the next object member.
+func (w *jsonWriter) key(k string) {
+	w.sep()
+	w.buf = appendJSONString(w.buf, k)
+	w.buf = append(w.buf, ':')
+	w.more = false
+}
+
+// string writes a string value.
+func (w *jsonWriter) string(s string) {
+	w.sep()
+	w.buf = appendJSONString(w.buf, s)
+}
+
+// int writes an integer value.
+func (w *jsonWriter) int(n int64) {
+	w.sep()
+	w.buf = strconv.AppendInt(w.buf, n, 10)
+}
+
+// float writes a number with prec decimal places, or the shortest
+// representation that reads back to the same float32 if prec is negative. NaNs
+// and infinities, which JSON can't represent, are written as null.
+func (w *jsonWriter) float(f float64, prec int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		w.null()
+		return
+	}
+	w.sep()
+	bitSize := 64
+	if prec < 0 {
+		bitSize = 32
+	}
+	w.buf = strconv.AppendFloat(w.buf, f, 'f', prec, bitSize)
+}
+
+// number writes f in the shortest form that reads back to the same float64,
+// or to the same float32 if f is one, with an exponent if that's shorter. NaNs
+// and infinities are written as null.
+func (w *jsonWriter) number(f float64) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		w.null()
+		return
+	}
+	w.sep()
+	bitSize := 64
+	if float64(float32(f)) == f {
+		bitSize = 32
+	}
+	w.buf = strconv.AppendFloat(w.buf, f, 'g', -1, bitSize)
+}
+
+// bool writes a boolean value.
+func (w *jsonWriter) bool(b bool) {
+	w.sep()
+	w.buf = strconv.AppendBool(w.buf, b)
+}
+
+// time writes t as an RFC 3339 string, with millisecond precision.
+func (w *jsonWriter) time(t time.Time) {
+	w.sep()
+	w.buf = append(w.buf, '"')
+	w.buf = t.UTC().AppendFormat(w.buf, "2006-01-02T15:04:05.000Z07:00")
+	w.buf = append(w.buf, '"')
+}
+
+// null writes a null value.
+func (w *jsonWriter) null() {
+	w.sep()
+	w.buf = append(w.buf, "null"...)
+}
+
+// sep writes the comma between values, when needed.
+func (w *jsonWriter) sep() {
+	if w.more {
+		w.buf = append(w.buf, ',')
+	}
+	w.more = true
+}
+
+// appendJSONString appends s to dst as a JSON string. Invalid UTF-8 is replaced
+// by U+FFFD.
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		dst = utf8.AppendRune(dst, r)
+		i += size
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// logSink logs the readings to the serial console, when the report policy
+// says they are worth it. Handy for watching a device on the bench.
+//
+// Not safe for concurrent use; it belongs to its sinkRunner.
+type logSink struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// reporter decides which readings are worth logging.
+	reporter *readingReporter
+}
+
+// newLogSink returns the log sink, if the settings ask for logging readings.
+func newLogSink(env sinkEnv) (telemetrySink, error) {
+	if !env.settings.LogReadings {
+		return nil, nil
+	}
+	s := &logSink{
+		logger:   env.logger,
+		reporter: newReadingReporter(env.settings.reportPolicies()),
+	}
+	return newSinkRunner(env.logger, env.pn, s, sinkConfig{Local: true}), nil
+}
+
+func (s *logSink) Name() string {
+	return "log"
+}
+
+func (s *logSink) Collect(queue []Reading, r telemetryReading) []Reading {
+	if !s.reporter.due(r.Now, r.Reading) {
+		return queue
+	}
+	s.reporter.markReported(r.Now, r.Reading)
+	return append(queue, r.Reading)
+}
+
+func (s *logSink) Deliver(ctx context.Context, readings []Reading) error {
+	for _, r := range readings {
+		s.logger.Info("Reading",
+			slog.Any("temperature", r.Temperature),
+			slog.Any("humidity", r.Humidity),
+			slog.String("flags", r.Flags.String()),
+		)
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
+//go:build tinygo
+
 package main
 
 import (
+	"errors"
 	"fmt"
 	"image/color"
 	"log/slog"
@@ -18,15 +21,6 @@ import (
 // so using an RGBA color here is merely a requirement from the interfaces used.
 var pixelColor = color.RGBA{255, 255, 255, 255}
 
-// temperature is the most recent temperature reading.
-var temperature float32
-
-// humidity is the most recent humidity reading.
-var humidity float32
-
-// muReadings is the mutex protecting `temperature` and `humidity`.
-var muReadings sync.Mutex
-
 // muGPIO is the mutex used tos serialize access to the GPIO pins on the Pi Pico
 // W. I was getting some random timing I2C errors when running the program for a
 // while, which I strongly believe were caused by the display and the DHT22
@@ -34,6 +28,7 @@ var muReadings sync.Mutex
 var muGPIO sync.Mutex
 
 func main() {
+	bootTime := time.Now()
 	logger := createLogger()
 
 	// It seems that it takes a while until the serial console is ready to be
@@ -43,8 +38,50 @@ func main() {
 
 	logger.Info("The device is alive!")
 
-	// TODO: Testing networking!
-	// pn := NewPicoNet(logger)
+	// Without proper settings (say, on the first boot), we can't do much
+	// other than asking the user for them.
+	settings, err := loadSettings()
+	if err != nil && !errors.Is(err, errNoSettings) {
+		logger.Warn("Loading settings", slogError(err))
+	}
+	provisioning := err != nil || settings.Provisioning
+
+	// One port to listen on, for the provisioning form or the API.
+	netConfig := PicoNetConfig{Reset: machine.CPUReset, ListenPorts: 1}
+	apPassword := ""
+	if provisioning {
+		apPassword, err = randomAPPassword()
+		if err != nil {
+			// An open network is not great, but better than being stuck.
+			logger.Warn("Generating the access point password, using an open network", slogError(err))
+		}
+		netConfig.AccessPoint = &AccessPointConfig{SSID: provisioningSSID, Password: apPassword}
+		// The password goes on the display, and nowhere else: anyone with
+		// a cable on the serial console shouldn't get it for free.
+		logger.Info("Entering provisioning mode", slog.String("ssid", provisioningSSID))
+	} else {
+		netConfig.WiFiNetworks = settings.wifiNetworks(WiFiNetwork{SSID: wifiSSID, Password: wifiPassword})
+		if settings.MQTTURL != "" {
+			// The MQTT connection keeps a port to itself, so we need
+			// another one for everything else.
+			netConfig.TCPPorts = 2
+		}
+	}
+
+	pn := NewPicoNet(logger, netConfig)
+	chNet, _ := pn.Subscribe(8)
+	netText := netStatusText(pn.Status())
+
+	if provisioning {
+		settings.Provisioning = false
+		go runProvisioning(logger, pn, settings, saveSettings, machine.CPUReset)
+	} else {
+		var tel telemetry
+		go tel.run(logger, pn, settings, &readings)
+		go runAPIServer(logger, pn, &readings, &tel, bootTime)
+		go runCoAPServer(logger, pn, &readings)
+		go runMDNSResponder(logger, pn, settings.Location)
+	}
 
 	chClick, _ := initButton()
 	dht22 := dht.New(machine.GPIO21, dht.DHT22)
@@ -63,6 +100,9 @@ func main() {
 	for {
 		select {
 		case d := <-chClick:
+			if d.Seconds() > 10.0 {
+				requestProvisioning(display, logger, settings)
+			}
 			if d.Seconds() > 4.0 {
 				resetDevice(display, logger)
 			}
@@ -70,45 +110,37 @@ func main() {
 			displayOn = !displayOn
 			turnDisplayOnOff(display, displayOn)
 		case <-chTicker:
-			if displayOn {
-				updateDisplay(display, logger)
+			if displayOn && provisioning {
+				showProvisioningInfo(display, logger, apPassword)
+			} else if displayOn {
+				updateDisplay(display, logger, netText)
+			}
+		case ev := <-chNet:
+			logger.Info("PicoNet event",
+				slog.String("kind", ev.Kind.String()),
+				slog.String("status", ev.Status.String()),
+				slogError(ev.Err),
+			)
+
+			// The on-board LED tells if we are online, at a glance.
+			err := pn.SetLED(ev.Status == StatusReadyToGo)
+			if err != nil && !errors.Is(err, ErrNotReady) {
+				logger.Warn("Setting the LED", slogError(err))
 			}
-		}
 
-		// TODO: Testing networking!
-		// status := pn.Status()
-		// logger.Info("PicoNet status", slog.String("status", status.String()))
-		// time.Sleep(5 * time.Second)
-		// deadline := time.Now().Add(5 * time.Second)
-		// for time.Now().Before(deadline) {
-		// 	// Nothing!
-		// }
+			netText = netStatusText(ev.Status)
+			if displayOn && provisioning {
+				showProvisioningInfo(display, logger, apPassword)
+			} else if displayOn {
+				updateDisplay(display, logger, netText)
+			}
+		}
 
 		// if button.Get() {
 		// 	logger.Info("...")
 		// } else {
 		// 	logger.Info("!!!! BUTTON !!!!!")
 		// }
-
-		// TODO: Testing networking!
-		// if status == StatusReadyToGo {
-		// 	res, err := pn.Get("http://stackedboxes.org/2021/12/30/from-bare-docs-to-bare-metal/")
-		// 	if err != nil {
-		// 		logger.Warn("GET request failed", slogError(err))
-		// 		continue
-		// 	}
-
-		// 	logger.Info("GET RESPONSE!",
-		// 		slog.String("proto", res.Proto),
-		// 		slog.String("status", res.Status),
-		// 		slog.Int("contentLength", res.ContentLength),
-		// 		slog.Int("statusCode", res.StatusCode),
-		// 	)
-
-		// 	print(string(res.Body))
-
-		// 	logger.Info("THAT'S IT!")
-		// }
 	}
 }
 
@@ -117,6 +149,7 @@ func displayText(display ssd1306.Device, text string, x, y int16) {
 		if img, ok := runeToImage[r]; ok {
 			err := display.DrawBitmap(x, y, img)
 			if err != nil {
+				counters.displayFailures.Add(1)
 				fmt.Fprintf(os.Stderr, "Displaying a character: %v", err)
 			}
 			w, _ := img.Size()
@@ -125,17 +158,10 @@ func displayText(display ssd1306.Device, text string, x, y int16) {
 	}
 }
 
-func updateDisplay(d ssd1306.Device, logger *slog.Logger) {
-	var t float32
-	var h float32
-
-	muReadings.Lock()
-	t = temperature
-	h = humidity
-	muReadings.Unlock()
-
-	textTemperature := fmt.Sprintf("🌡️%.1f°C", t)
-	textHumidity := fmt.Sprintf("💧%.0f%%", h)
+func updateDisplay(d ssd1306.Device, logger *slog.Logger, netText string) {
+	r := readings.Latest(time.Now())
+	textTemperature := fmt.Sprintf("🌡️%.1f°C", r.Temperature)
+	textHumidity := fmt.Sprintf("💧%.0f%%", r.Humidity)
 
 	muGPIO.Lock()
 	defer muGPIO.Unlock()
@@ -154,11 +180,11 @@ func updateDisplay(d ssd1306.Device, logger *slog.Logger) {
 	// tinyfont.WriteLine(&display, &tinyfont.TomThumb, 84, 48, "More debug...", pixelColor)
 	// tinyfont.WriteLine(&display, &tinyfont.TomThumb, 84, 56, "n' then some.", pixelColor)
 
-	// TODO: Testing networking!
-	// tinyfont.WriteLine(&display, &tinyfont.TomThumb, 84, 40, string(status), pixelColor)
+	tinyfont.WriteLine(&d, &tinyfont.TomThumb, 84, 40, netText, pixelColor)
 
 	err := d.Display()
 	if err != nil {
+		counters.displayFailures.Add(1)
 		logger.Warn("Updating the display", slogError(err))
 
 		// Rebooting the device after a display issue may be a bit drastic, but
@@ -172,6 +198,54 @@ func updateDisplay(d ssd1306.Device, logger *slog.Logger) {
 	}
 }
 
+// netStatusText returns a short text describing the network status, small
+// enough to fit in the corner of the display.
+func netStatusText(s PicoNetStatus) string {
+	switch s {
+	case StatusReadyToGo:
+		return "online"
+	case StatusConnectingToWiFi:
+		return "wifi..."
+	case StatusStartingAP:
+		return "ap..."
+	case StatusObtainingIP:
+		return "dhcp..."
+	case StatusConfiguringStaticIP:
+		return "ip..."
+	case StatusStartingDHCPServer:
+		return "dhcpd..."
+	case StatusConfiguringDNS:
+		return "dns..."
+	case StatusObtainingRouterMAC:
+		return "arp..."
+	default:
+		return "init..."
+	}
+}
+
+// showProvisioningInfo shows what the user needs to know to provision the
+// device: how to connect to our WiFi network and where to point the browser.
+func showProvisioningInfo(d ssd1306.Device, logger *slog.Logger, apPassword string) {
+	if apPassword == "" {
+		apPassword = "(none)"
+	}
+
+	muGPIO.Lock()
+	defer muGPIO.Unlock()
+
+	d.ClearBuffer()
+	tinyfont.WriteLine(&d, &tinyfont.TomThumb, 0, 8, "Setup mode", pixelColor)
+	tinyfont.WriteLine(&d, &tinyfont.TomThumb, 0, 24, "WiFi: "+provisioningSSID, pixelColor)
+	tinyfont.WriteLine(&d, &tinyfont.TomThumb, 0, 32, "Password: "+apPassword, pixelColor)
+	tinyfont.WriteLine(&d, &tinyfont.TomThumb, 0, 48, fmt.Sprintf("http://%v", apAddr.Addr()), pixelColor)
+
+	err := d.Display()
+	if err != nil {
+		counters.displayFailures.Add(1)
+		logger.Warn("Updating the display", slogError(err))
+	}
+}
+
 func turnDisplayOnOff(d ssd1306.Device, on bool) {
 	d.Sleep(!on)
 }
@@ -179,24 +253,22 @@ func turnDisplayOnOff(d ssd1306.Device, on bool) {
 // sensorUpdateLoop is an infinite loop updating the sensor readings every so
 // often. Meant to run in a separate goroutine.
 func sensorUpdateLoop(d dht.Device, logger *slog.Logger) {
-	chTick := time.Tick(5 * time.Second)
+	chTick := time.Tick(sensorReadInterval)
 
 	for {
 		muGPIO.Lock()
-		t, err := d.TemperatureFloat(dht.C)
-		if err != nil {
-			logger.Warn("Reading temperature", slogError(err))
+		t, errT := d.TemperatureFloat(dht.C)
+		if errT != nil {
+			logger.Warn("Reading temperature", slogError(errT))
 		}
 
-		h, err := d.HumidityFloat()
-		if err != nil {
-			logger.Warn("Reading humidity", slogError(err))
+		h, errH := d.HumidityFloat()
+		if errH != nil {
+			logger.Warn("Reading humidity", slogError(errH))
 		}
 		muGPIO.Unlock()
 
-		muReadings.Lock()
-		temperature, humidity = t, h
-		muReadings.Unlock()
+		readings.record(time.Now(), t, h, errors.Join(errT, errH))
 
 		<-chTick
 	}
@@ -243,6 +315,21 @@ func resetDevice(display ssd1306.Device, logger *slog.Logger) {
 	machine.CPUReset()
 }
 
+// requestProvisioning makes the device enter provisioning mode on the next boot,
+// and reboots it. settings are the current settings, which are kept so that the
+// form starts with them.
+func requestProvisioning(display ssd1306.Device, logger *slog.Logger, settings Settings) {
+	logger.Info("Provisioning requested")
+	settings.Provisioning = true
+	err := saveSettings(settings)
+	if err != nil {
+		// Reset anyway. At worst we come back in the same mode, and the user
+		// can try again.
+		logger.Error("Saving settings", slogError(err))
+	}
+	resetDevice(display, logger)
+}
+
 func initDisplay() (ssd1306.Device, error) {
 	displayI2C := machine.I2C1
 	err := displayI2C.Configure(machine.I2CConfig{
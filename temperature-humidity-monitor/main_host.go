@@ -0,0 +1,16 @@
+//go:build !tinygo
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// main is here only so that the package builds on the host, where we run the
+// tests. The firmware itself runs on a Pico W: see main.go, and flash it with
+// TinyGo.
+func main() {
+	fmt.Fprintln(os.Stderr, "This is firmware for the Pico W. Build it with TinyGo.")
+	os.Exit(1)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth/dns"
+)
+
+//
+// Multicast DNS (RFC 6762) and DNS-based service discovery (RFC 6763). With
+// these, each device can be reached as smh-xxxxxx.local instead of by whatever
+// address DHCP gave it this time, and its HTTP API shows up in any service
+// browser on the network.
+//
+// This is a bare-bones responder. Our name comes from the MAC address, so it
+// should be unique already, and we skip probing for conflicts. We also ignore
+// the known answers listed in queries, which only means we sometimes tell the
+// asker something it knew.
+//
+
+const (
+	// mdnsPort is the UDP port of mDNS, for both queries and responses.
+	mdnsPort = 5353
+
+	// mdnsHostTTL is the TTL, in seconds, of the records that carry our
+	// host name, and mdnsServiceTTL is the one of all others. These are
+	// the values RFC 6762 recommends.
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 75 * 60
+
+	// mdnsLegacyTTL is the maximum TTL, in seconds, in responses to
+	// "legacy" queries: the ones from plain DNS resolvers, which don't
+	// listen to multicast and so never hear about changes.
+	mdnsLegacyTTL = 10
+
+	// mdnsMaxQuestions is the number of questions in a query we look at.
+	// Queries usually have one, or a few.
+	mdnsMaxQuestions = 8
+
+	// mdnsAnnouncements is how many times we announce our records after
+	// getting an address. The first two are one second apart, and the
+	// interval doubles after each.
+	mdnsAnnouncements = 3
+
+	// mdnsUnicastResponse is the bit in the class of a question asking for
+	// the response to be sent unicast. mdnsCacheFlush is the same bit in
+	// the class of a record, telling that the record replaces anything
+	// cached for its name and type.
+	mdnsUnicastResponse = 1 << 15
+	mdnsCacheFlush      = 1 << 15
+
+	// mdnsServiceType is the DNS-SD service type we advertise: the HTTP
+	// API. mdnsServicesName is the name that lists all service types
+	// around.
+	mdnsServiceType  = "_http._tcp.local."
+	mdnsServicesName = "_services._dns-sd._udp.local."
+)
+
+// mdnsGroup is the multicast group where mDNS happens.
+var mdnsGroup = netip.AddrFrom4([4]byte{224, 0, 0, 251})
+
+// mdnsRecord is a resource record we can answer with.
+type mdnsRecord struct {
+	// name is the name of the record, dotted and with the trailing dot.
+	name string
+
+	// typ and ttl are the type and TTL of the record.
+	typ dns.Type
+	ttl uint32
+
+	// unique tells if the record is ours alone, and so is sent with the
+	// cache-flush bit. The alternative is shared, like the PTR records
+	// every device advertising the same service has.
+	unique bool
+
+	// data is the record's data, in wire format.
+	data []byte
+}
+
+// mdnsResponder answers mDNS queries for our host name and service.
+type mdnsResponder struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// conn is the socket, on mdnsPort.
+	conn net.PacketConn
+
+	// hostname is our host name, without the ".local" part, and instance
+	// is the DNS-SD instance name of our HTTP API.
+	hostname string
+	instance string
+
+	// location goes in the TXT record, so that service browsers tell
+	// which device is where.
+	location string
+
+	// addr returns our current IPv4 address, which may be invalid when the
+	// network is down.
+	addr func() netip.Addr
+}
+
+// newMDNSResponder returns a responder answering on conn for the device with
+// the given MAC address and location.
+func newMDNSResponder(logger *slog.Logger, conn net.PacketConn, mac net.HardwareAddr, location string, addr func() netip.Addr) *mdnsResponder {
+	hostname := deviceID(mac)
+	return &mdnsResponder{
+		logger:   logger,
+		conn:     conn,
+		hostname: hostname,
+		instance: hostname + "." + mdnsServiceType,
+		location: location,
+		addr:     addr,
+	}
+}
+
+// runMDNSResponder runs the mDNS responder on pn, once it is ready. Meant to
+// run in its own goroutine; returns only if something goes wrong.
+func runMDNSResponder(logger *slog.Logger, pn *PicoNet, location string) {
+	for pn.Status() != StatusReadyToGo {
+		time.Sleep(time.Second)
+	}
+
+	conn, err := pn.ListenUDP(mdnsPort)
+	if err != nil {
+		logger.Error("Listening for mDNS queries", slogError(err))
+		return
+	}
+	err = conn.JoinGroup(mdnsGroup)
+	if err != nil {
+		logger.Error("Joining the mDNS group", slogError(err))
+		return
+	}
+
+	r := newMDNSResponder(logger, conn, pn.HardwareAddr(), location, pn.Addr)
+	logger.Info("mDNS responder running", slog.String("hostname", r.hostname+".local"))
+
+	// Announce ourselves now, and again whenever we get an address, which
+	// may have changed.
+	events, _ := pn.Subscribe(4)
+	go func() {
+		r.announce()
+		for ev := range events {
+			if ev.Kind == EventIPAcquired {
+				r.announce()
+			}
+		}
+	}()
+
+	err = r.serve()
+	logger.Error("mDNS responder stopped", slogError(err))
+}
+
+// serve answers incoming queries until the socket fails.
+func (r *mdnsResponder) serve() error {
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		fromAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		r.handle(fromAddr.AddrPort(), buf[:n])
+	}
+}
+
+// handle answers the query in data, received from the given address, if it
+// asks about anything of ours.
+func (r *mdnsResponder) handle(from netip.AddrPort, data []byte) {
+	msg := dns.Message{Questions: make([]dns.Question, 0, mdnsMaxQuestions)}
+	_, incompleteButOK, err := msg.Decode(data)
+	if err != nil && !incompleteButOK {
+		return
+	}
+	if msg.Flags.IsResponse() || msg.Flags.OpCode() != dns.OpCodeQuery {
+		return
+	}
+
+	res, unicast, shared := r.respond(from, &msg)
+	if res == nil {
+		return
+	}
+
+	to := netip.AddrPortFrom(mdnsGroup, mdnsPort)
+	if unicast {
+		to = from
+	} else if shared {
+		// Other devices may be answering with the same shared records,
+		// and the RFC wants us to wait a little, at random, so that we
+		// don't all answer at once.
+		time.Sleep(time.Duration(20+rand.Intn(100)) * time.Millisecond)
+	}
+	_, err = r.conn.WriteTo(res, net.UDPAddrFromAddrPort(to))
+	if err != nil {
+		r.logger.Warn("Sending mDNS response", slogError(err))
+	}
+}
+
+// respond builds the response to the query msg, received from the given
+// address. Returns nil if we have nothing to say. Also tells if the response
+// goes unicast, back to the asker, and if it has any shared records.
+func (r *mdnsResponder) respond(from netip.AddrPort, msg *dns.Message) (res []byte, unicast, shared bool) {
+	addr := r.addr()
+	if !addr.IsValid() {
+		return nil, false, false
+	}
+	records := r.records(addr)
+
+	// Queries not from the mDNS port come from plain DNS resolvers. These
+	// get a plain DNS response, unicast.
+	legacy := from.Port() != mdnsPort
+	unicast = true
+
+	var answers, additionals []mdnsRecord
+	for _, q := range msg.Questions {
+		if q.Class&mdnsUnicastResponse == 0 {
+			unicast = false
+		}
+		class := dns.Class(q.Class &^ mdnsUnicastResponse)
+		if class != dns.ClassINET && class != dns.ClassANY {
+			continue
+		}
+		name := q.Name.String()
+		for _, rec := range records {
+			if strings.EqualFold(rec.name, name) && (rec.typ == q.Type || q.Type == dns.TypeALL) {
+				answers = appendMDNSRecord(answers, rec)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false, false
+	}
+
+	// Add the records the asker will most likely want next, as RFC 6763
+	// suggests: whoever finds our service wants to know where it is.
+	for _, ans := range answers {
+		var extra []string
+		switch ans.typ {
+		case dns.TypePTR:
+			if ans.name == mdnsServiceType {
+				extra = []string{r.instance, r.hostname + ".local."}
+			}
+		case dns.TypeSRV:
+			extra = []string{r.hostname + ".local."}
+		}
+		for _, rec := range records {
+			if slices.Contains(extra, rec.name) && !mdnsRecordIn(answers, rec) {
+				additionals = appendMDNSRecord(additionals, rec)
+			}
+		}
+	}
+
+	for _, ans := range answers {
+		shared = shared || !ans.unique
+	}
+	var questions []dns.Question
+	if legacy {
+		questions = msg.Questions
+	}
+	res, err := appendMDNSResponse(nil, msg.TransactionID, questions, answers, additionals, legacy)
+	if err != nil {
+		r.logger.Warn("Building mDNS response", slogError(err))
+		return nil, false, false
+	}
+	return res, unicast || legacy, shared
+}
+
+// announce sends all our records, unsolicited, so that everyone updates their
+// caches. Does it a few times, in case some get lost.
+func (r *mdnsResponder) announce() {
+	interval := time.Second
+	for i := range mdnsAnnouncements {
+		if i > 0 {
+			time.Sleep(interval)
+			interval *= 2
+		}
+		addr := r.addr()
+		if !addr.IsValid() {
+			return
+		}
+		res, err := appendMDNSResponse(nil, 0, nil, r.records(addr), nil, false)
+		if err == nil {
+			_, err = r.conn.WriteTo(res, net.UDPAddrFromAddrPort(netip.AddrPortFrom(mdnsGroup, mdnsPort)))
+		}
+		if err != nil {
+			r.logger.Warn("Sending mDNS announcement", slogError(err))
+			return
+		}
+	}
+}
+
+// records returns all the records we answer for, given our current address.
+func (r *mdnsResponder) records(addr netip.Addr) []mdnsRecord {
+	host := r.hostname + ".local."
+	a := addr.As4()
+
+	// The SRV data: priority, weight, port, and where to find it.
+	srv := binary.BigEndian.AppendUint16(nil, 0)
+	srv = binary.BigEndian.AppendUint16(srv, 0)
+	srv = binary.BigEndian.AppendUint16(srv, apiPort)
+	srv = appendDNSName(srv, host)
+
+	// The TXT data: key=value strings, each with its length in front.
+	var txt []byte
+	strs := []string{"path=/api/readings"}
+	if r.location != "" {
+		strs = append(strs, "loc="+r.location)
+	}
+	for _, s := range strs {
+		s = s[:min(len(s), 255)]
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+
+	return []mdnsRecord{
+		{name: host, typ: dns.TypeA, ttl: mdnsHostTTL, unique: true, data: a[:]},
+		{name: mdnsServicesName, typ: dns.TypePTR, ttl: mdnsServiceTTL, data: appendDNSName(nil, mdnsServiceType)},
+		{name: mdnsServiceType, typ: dns.TypePTR, ttl: mdnsServiceTTL, data: appendDNSName(nil, r.instance)},
+		{name: r.instance, typ: dns.TypeSRV, ttl: mdnsHostTTL, unique: true, data: srv},
+		{name: r.instance, typ: dns.TypeTXT, ttl: mdnsServiceTTL, unique: true, data: txt},
+	}
+}
+
+// appendMDNSResponse appends to dst an mDNS response with the given ID,
+// questions and records. Legacy responses, for plain DNS resolvers, have their
+// TTLs capped and no cache-flush bits, which would only confuse them.
+func appendMDNSResponse(dst []byte, id uint16, questions []dns.Question, answers, additionals []mdnsRecord, legacy bool) ([]byte, error) {
+	hdr := dns.Header{
+		TransactionID: id,
+		Flags:         1<<15 | 1<<10, // Response, authoritative.
+		QDCount:       uint16(len(questions)),
+		ANCount:       uint16(len(answers)),
+		ARCount:       uint16(len(additionals)),
+	}
+	start := len(dst)
+	dst = append(dst, make([]byte, dns.SizeHeader)...)
+	hdr.Put(dst[start:])
+
+	var err error
+	for _, q := range questions {
+		dst, err = q.Name.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(q.Type))
+		dst = binary.BigEndian.AppendUint16(dst, uint16(q.Class)&^mdnsUnicastResponse)
+	}
+
+	for _, rec := range append(answers[:len(answers):len(answers)], additionals...) {
+		name, err := dns.NewName(rec.name)
+		if err != nil {
+			return nil, err
+		}
+		dst, err = name.AppendTo(dst)
+		if err != nil {
+			return nil, err
+		}
+		class := uint16(dns.ClassINET)
+		ttl := rec.ttl
+		if legacy {
+			ttl = min(ttl, mdnsLegacyTTL)
+		} else if rec.unique {
+			class |= mdnsCacheFlush
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(rec.typ))
+		dst = binary.BigEndian.AppendUint16(dst, class)
+		dst = binary.BigEndian.AppendUint32(dst, ttl)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(rec.data)))
+		dst = append(dst, rec.data...)
+	}
+
+	if len(dst)-start > maxUDPPayload {
+		return nil, fmt.Errorf("%w: %d bytes", errDatagramTooLarge, len(dst)-start)
+	}
+	return dst, nil
+}
+
+// appendDNSName appends the dotted name to dst, in wire format. The names we
+// use are all constants or derived from constants, so they are always valid.
+func appendDNSName(dst []byte, name string) []byte {
+	n := dns.MustNewName(name)
+	dst, _ = n.AppendTo(dst)
+	return dst
+}
+
+// appendMDNSRecord appends rec to records, unless it's already there. A query
+// for ANY and one for a specific type could both match the same record.
+func appendMDNSRecord(records []mdnsRecord, rec mdnsRecord) []mdnsRecord {
+	if mdnsRecordIn(records, rec) {
+		return records
+	}
+	return append(records, rec)
+}
+
+// mdnsRecordIn tells if rec is in records.
+func mdnsRecordIn(records []mdnsRecord, rec mdnsRecord) bool {
+	for _, r := range records {
+		if r.name == rec.name && r.typ == rec.typ {
+			return true
+		}
+	}
+	return false
+}
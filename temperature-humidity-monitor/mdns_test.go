@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/soypat/seqs/eth/dns"
+)
+
+// decodeDNS decodes a DNS message, failing the test if it can't.
+func decodeDNS(t *testing.T, data []byte) dns.Message {
+	t.Helper()
+	var m dns.Message
+	m.LimitResourceDecoding(16, 16, 16, 16)
+	if _, _, err := m.Decode(data); err != nil {
+		t.Fatalf("decoding % x: %v", data, err)
+	}
+	return m
+}
+
+// dnsQuestion returns a question in wire format: name (already encoded, maybe
+// with compression pointers), type and class.
+func dnsQuestion(name []byte, typ dns.Type, class uint16) []byte {
+	q := append([]byte(nil), name...)
+	q = binary.BigEndian.AppendUint16(q, uint16(typ))
+	return binary.BigEndian.AppendUint16(q, class)
+}
+
+// dnsQuery returns a query in wire format with the given ID and questions.
+func dnsQuery(id uint16, questions ...[]byte) []byte {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	q = append(q, 0, 0) // Flags: a standard query.
+	q = binary.BigEndian.AppendUint16(q, uint16(len(questions)))
+	q = append(q, 0, 0, 0, 0, 0, 0)
+	for _, question := range questions {
+		q = append(q, question...)
+	}
+	return q
+}
+
+// newTestMDNSResponder returns a responder for smh-abcdef.local, at
+// 192.168.1.10, in the living room.
+func newTestMDNSResponder() (*mdnsResponder, *datagramRecorder) {
+	conn := &datagramRecorder{}
+	addr := netip.AddrFrom4([4]byte{192, 168, 1, 10})
+	r := newMDNSResponder(discardLogger, conn, net.HardwareAddr{0x28, 0xcd, 0xc1, 0xab, 0xcd, 0xef}, "Living room", func() netip.Addr { return addr })
+	return r, conn
+}
+
+var (
+	mdnsGroupAddr = netip.AddrPortFrom(mdnsGroup, mdnsPort)
+	mdnsPeer      = netip.MustParseAddrPort("192.168.1.5:5353")
+
+	// The names involved, in wire format.
+	wireHost     = []byte("\x0asmh-abcdef\x05local\x00")
+	wireService  = []byte("\x05_http\x04_tcp\x05local\x00")
+	wireInstance = []byte("\x0asmh-abcdef\x05_http\x04_tcp\x05local\x00")
+	wireServices = []byte("\x09_services\x07_dns-sd\x04_udp\x05local\x00")
+)
+
+// wantRecord is a record expected in a response.
+type wantRecord struct {
+	name  string
+	typ   dns.Type
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+// mdnsRecords are our records, as they should go on the wire.
+var mdnsRecords = map[string]wantRecord{
+	"A":        {"smh-abcdef.local.", dns.TypeA, 0x8001, 120, []byte{192, 168, 1, 10}},
+	"PTR":      {"_http._tcp.local.", dns.TypePTR, 1, 4500, wireInstance},
+	"SRV":      {"smh-abcdef._http._tcp.local.", dns.TypeSRV, 0x8001, 120, append([]byte{0, 0, 0, 0, 0, 80}, wireHost...)},
+	"TXT":      {"smh-abcdef._http._tcp.local.", dns.TypeTXT, 0x8001, 4500, []byte("\x12path=/api/readings\x0floc=Living room")},
+	"services": {"_services._dns-sd._udp.local.", dns.TypePTR, 1, 4500, wireService},
+}
+
+// checkRecords checks that got are the records named in want, in order.
+func checkRecords(t *testing.T, section string, got []dns.Resource, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%d %s, want %d", len(got), section, len(want))
+		return
+	}
+	for i, name := range want {
+		w := mdnsRecords[name]
+		h := got[i].Header
+		if h.Name.String() != w.name || h.Type != w.typ || uint16(h.Class) != w.class || h.TTL != w.ttl || !bytes.Equal(got[i].RawData(), w.data) {
+			t.Errorf("%s %d: got %s %v class %#x TTL %d data %q, want %s: %+v", section, i, h.Name.String(), h.Type, uint16(h.Class), h.TTL, got[i].RawData(), name, w)
+		}
+	}
+}
+
+func TestMDNSResponseEncoding(t *testing.T) {
+	r, _ := newTestMDNSResponder()
+
+	// The whole response to a question for our address, byte by byte.
+	res, unicast, shared := r.respond(mdnsPeer, &dns.Message{Questions: []dns.Question{{Name: dns.MustNewName("smh-abcdef.local."), Type: dns.TypeA, Class: 1}}})
+	want := []byte{
+		0x00, 0x00, 0x84, 0x00, // ID 0, response, authoritative.
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, // One answer.
+	}
+	want = append(want, wireHost...)
+	want = append(want, 0x00, 0x01, 0x80, 0x01, 0x00, 0x00, 0x00, 120, 0x00, 0x04, 192, 168, 1, 10)
+	if !bytes.Equal(res, want) || unicast || shared {
+		t.Errorf("got % x (unicast %v, shared %v)\nwant % x", res, unicast, shared, want)
+	}
+
+	// The announcement has every record, with SRV and TXT data in their
+	// own formats.
+	res, err := appendMDNSResponse(nil, 0, nil, r.records(netip.AddrFrom4([4]byte{192, 168, 1, 10})), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := decodeDNS(t, res)
+	if !m.Flags.IsResponse() || m.QDCount != 0 {
+		t.Errorf("header %+v", m.Header)
+	}
+	checkRecords(t, "answers", m.Answers, "A", "services", "PTR", "SRV", "TXT")
+}
+
+func TestMDNSQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		from        netip.AddrPort
+		query       []byte
+		to          netip.AddrPort
+		answers     []string
+		additionals []string
+	}{
+		{
+			name:    "address",
+			from:    mdnsPeer,
+			query:   dnsQuery(0, dnsQuestion(wireHost, dns.TypeA, 1)),
+			to:      mdnsGroupAddr,
+			answers: []string{"A"},
+		},
+		{
+			name:    "address, in capitals, with the unicast-response bit",
+			from:    mdnsPeer,
+			query:   dnsQuery(0, dnsQuestion([]byte("\x0aSMH-ABCDEF\x05LOCAL\x00"), dns.TypeA, 0x8001)),
+			to:      mdnsPeer,
+			answers: []string{"A"},
+		},
+		{
+			name:        "browsing",
+			from:        mdnsPeer,
+			query:       dnsQuery(0, dnsQuestion(wireService, dns.TypePTR, 1)),
+			to:          mdnsGroupAddr,
+			answers:     []string{"PTR"},
+			additionals: []string{"A", "SRV", "TXT"},
+		},
+		{
+			// The second question points back into the first for the
+			// common part of the name, as queries with several
+			// questions usually do.
+			name: "compression pointer",
+			from: mdnsPeer,
+			query: dnsQuery(0,
+				dnsQuestion(wireService, dns.TypePTR, 0x8001),
+				dnsQuestion([]byte("\x0asmh-abcdef\xc0\x0c"), dns.TypeSRV, 0x8001)),
+			to:          mdnsPeer,
+			answers:     []string{"PTR", "SRV"},
+			additionals: []string{"A", "TXT"},
+		},
+		{
+			// The unicast-response bit only counts if every question
+			// has it.
+			name: "unicast response bit in some questions",
+			from: mdnsPeer,
+			query: dnsQuery(0,
+				dnsQuestion(wireHost, dns.TypeA, 0x8001),
+				dnsQuestion(wireInstance, dns.TypeTXT, 1)),
+			to:      mdnsGroupAddr,
+			answers: []string{"A", "TXT"},
+		},
+		{
+			name:        "ANY",
+			from:        mdnsPeer,
+			query:       dnsQuery(0, dnsQuestion(wireInstance, dns.TypeALL, 255)),
+			to:          mdnsGroupAddr,
+			answers:     []string{"SRV", "TXT"},
+			additionals: []string{"A"},
+		},
+		{
+			name:    "service types",
+			from:    mdnsPeer,
+			query:   dnsQuery(0, dnsQuestion(wireServices, dns.TypePTR, 1)),
+			to:      mdnsGroupAddr,
+			answers: []string{"services"},
+		},
+		{
+			name:  "somebody else",
+			from:  mdnsPeer,
+			query: dnsQuery(0, dnsQuestion([]byte("\x05other\x05local\x00"), dns.TypeA, 1)),
+		},
+		{
+			name:  "wrong type",
+			from:  mdnsPeer,
+			query: dnsQuery(0, dnsQuestion(wireHost, dns.TypeAAAA, 1)),
+		},
+		{
+			name:  "wrong class",
+			from:  mdnsPeer,
+			query: dnsQuery(0, dnsQuestion(wireHost, dns.TypeA, 3)),
+		},
+		{
+			name:  "a response",
+			from:  mdnsPeer,
+			query: append([]byte{0, 0, 0x84, 0}, dnsQuery(0, dnsQuestion(wireHost, dns.TypeA, 1))[4:]...),
+		},
+		{
+			name:  "garbage",
+			from:  mdnsPeer,
+			query: []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x3f, 'x'},
+		},
+		{
+			name:  "pointer loop",
+			from:  mdnsPeer,
+			query: dnsQuery(0, dnsQuestion([]byte{0xc0, 0x0c}, dns.TypeA, 1)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, conn := newTestMDNSResponder()
+			r.handle(tt.from, tt.query)
+			sent := conn.take()
+			if tt.answers == nil {
+				if len(sent) != 0 {
+					t.Fatalf("answered % x", sent[0].data)
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d responses", len(sent))
+			}
+			if sent[0].to != tt.to {
+				t.Errorf("sent to %v, want %v", sent[0].to, tt.to)
+			}
+			m := decodeDNS(t, sent[0].data)
+			if !m.Flags.IsResponse() || m.QDCount != 0 {
+				t.Errorf("header %+v", m.Header)
+			}
+			checkRecords(t, "answers", m.Answers, tt.answers...)
+			checkRecords(t, "additionals", m.Additionals, tt.additionals...)
+		})
+	}
+}
+
+func TestMDNSLegacyQuery(t *testing.T) {
+	r, conn := newTestMDNSResponder()
+	from := netip.MustParseAddrPort("192.168.1.5:40000")
+	r.handle(from, dnsQuery(0x1234, dnsQuestion(wireInstance, dns.TypeSRV, 1)))
+
+	sent := conn.take()
+	if len(sent) != 1 || sent[0].to != from {
+		t.Fatalf("sent %+v", sent)
+	}
+	m := decodeDNS(t, sent[0].data)
+	if m.TransactionID != 0x1234 || len(m.Questions) != 1 || m.Questions[0].Name.String() != "smh-abcdef._http._tcp.local." {
+		t.Errorf("the response doesn't echo the query: %+v", m)
+	}
+
+	// Plain resolvers get short TTLs and no cache-flush bit.
+	for _, rr := range append(m.Answers, m.Additionals...) {
+		if rr.Header.TTL != mdnsLegacyTTL || rr.Header.Class != dns.ClassINET {
+			t.Errorf("%s %v: class %#x, TTL %d", rr.Header.Name.String(), rr.Header.Type, uint16(rr.Header.Class), rr.Header.TTL)
+		}
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Header.Type != dns.TypeSRV || len(m.Additionals) != 1 || m.Additionals[0].Header.Type != dns.TypeA {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestMDNSNoAddress(t *testing.T) {
+	r := newMDNSResponder(discardLogger, &datagramRecorder{}, net.HardwareAddr{0x28, 0xcd, 0xc1, 0xab, 0xcd, 0xef}, "", func() netip.Addr { return netip.Addr{} })
+	r.handle(mdnsPeer, dnsQuery(0, dnsQuestion(wireHost, dns.TypeA, 1)))
+	r.announce()
+	if sent := r.conn.(*datagramRecorder).take(); len(sent) != 0 {
+		t.Errorf("sent %+v without an address", sent)
+	}
+}
+
+func TestMDNSTXTRecord(t *testing.T) {
+	// Without a location there's no loc, and a long one is cut to fit.
+	r, _ := newTestMDNSResponder()
+	for _, tt := range []struct{ location, want string }{
+		{"", "\x12path=/api/readings"},
+		{strings.Repeat("x", 300), "\x12path=/api/readings\xff" + "loc=" + strings.Repeat("x", 251)},
+	} {
+		r.location = tt.location
+		for _, rec := range r.records(netip.AddrFrom4([4]byte{192, 168, 1, 10})) {
+			if rec.typ == dns.TypeTXT && string(rec.data) != tt.want {
+				t.Errorf("location %q: TXT %q, want %q", tt.location, rec.data, tt.want)
+			}
+		}
+	}
+}
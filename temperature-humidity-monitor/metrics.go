@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Metrics, in the Prometheus text exposition format, so that a Prometheus
+// server can scrape the device directly. The format is simple enough to write
+// by hand, and doing so lets us append everything to a single buffer, without
+// a pile of little strings along the way.
+//
+
+// metricsContentType is the content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// deviceCounters count things happening around the device, for the metrics.
+// Network-related counts are kept by the PicoNet itself.
+type deviceCounters struct {
+	// displayFailures is how many times drawing on or updating the display
+	// failed.
+	displayFailures atomic.Uint32
+
+	// uploadSuccesses and uploadFailures count the attempts to deliver
+	// readings to the telemetry sinks.
+	uploadSuccesses atomic.Uint32
+	uploadFailures  atomic.Uint32
+}
+
+// counters are the device counters.
+var counters deviceCounters
+
+// metricsSnapshot is everything that goes into the metrics, gathered in one
+// place so that formatting it doesn't depend on the hardware.
+type metricsSnapshot struct {
+	Reading         Reading
+	ReadingAge      time.Duration
+	SensorErrors    int
+	DisplayFailures int
+	UploadSuccesses int
+	UploadFailures  int
+	DroppedPackets  int
+	Uptime          time.Duration
+	MAC             net.HardwareAddr
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	buf []byte
+}
+
+// family writes the HELP and TYPE lines of a metric family.
+func (w *metricsWriter) family(name, typ, help string) {
+	w.buf = append(w.buf, "# HELP "...)
+	w.buf = append(w.buf, name...)
+	w.buf = append(w.buf, ' ')
+	w.buf = append(w.buf, help...)
+	w.buf = append(w.buf, "\n# TYPE "...)
+	w.buf = append(w.buf, name...)
+	w.buf = append(w.buf, ' ')
+	w.buf = append(w.buf, typ...)
+	w.buf = append(w.buf, '\n')
+}
+
+// sample writes a sample of the metric called name. labels are label names
+// and values, alternating. bitSize tells if value came from a float32 or a
+// float64, so that it is written with only the digits that matter.
+func (w *metricsWriter) sample(name string, value float64, bitSize int, labels ...string) {
+	w.buf = append(w.buf, name...)
+	if len(labels) > 0 {
+		w.buf = append(w.buf, '{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf = append(w.buf, ',')
+			}
+			w.buf = append(w.buf, labels[i]...)
+			w.buf = append(w.buf, '=', '"')
+			w.buf = appendLabelValue(w.buf, labels[i+1])
+			w.buf = append(w.buf, '"')
+		}
+		w.buf = append(w.buf, '}')
+	}
+	w.buf = append(w.buf, ' ')
+
+	switch {
+	case math.IsNaN(value):
+		w.buf = append(w.buf, "NaN"...)
+	case math.IsInf(value, 1):
+		w.buf = append(w.buf, "+Inf"...)
+	case math.IsInf(value, -1):
+		w.buf = append(w.buf, "-Inf"...)
+	default:
+		w.buf = strconv.AppendFloat(w.buf, value, 'g', -1, bitSize)
+	}
+	w.buf = append(w.buf, '\n')
+}
+
+// appendLabelValue appends a label value to dst, escaped as the format wants.
+func appendLabelValue(dst []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		case '"':
+			dst = append(dst, '\\', '"')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// appendMetrics appends the metrics in m to dst, in the Prometheus text format.
+func appendMetrics(dst []byte, m *metricsSnapshot) []byte {
+	w := metricsWriter{buf: dst}
+
+	// Without a reading there's nothing to report, and reporting zeros would
+	// be misleading. An absent sample is the way to say "don't know".
+	if m.Reading.Flags&FlagNoReading == 0 {
+		w.family("thm_temperature_celsius", "gauge", "Temperature measured by the sensor.")
+		w.sample("thm_temperature_celsius", float64(m.Reading.Temperature), 32)
+		w.family("thm_humidity_percent", "gauge", "Relative humidity measured by the sensor.")
+		w.sample("thm_humidity_percent", float64(m.Reading.Humidity), 32)
+		w.family("thm_dew_point_celsius", "gauge", "Dew point, derived from the temperature and humidity.")
+		w.sample("thm_dew_point_celsius", math.Round(m.Reading.DewPoint()*100)/100, 64)
+		w.family("thm_reading_age_seconds", "gauge", "Time since the last good sensor reading.")
+		w.sample("thm_reading_age_seconds", m.ReadingAge.Seconds(), 64)
+	}
+
+	w.family("thm_sensor_read_errors_total", "counter", "Failed attempts to read the sensor.")
+	w.sample("thm_sensor_read_errors_total", float64(m.SensorErrors), 64)
+	w.family("thm_display_failures_total", "counter", "Failed attempts to draw on or update the display.")
+	w.sample("thm_display_failures_total", float64(m.DisplayFailures), 64)
+	w.family("thm_uploads_total", "counter", "Attempts to deliver readings to the telemetry sinks, by result.")
+	w.sample("thm_uploads_total", float64(m.UploadSuccesses), 64, "result", "success")
+	w.sample("thm_uploads_total", float64(m.UploadFailures), 64, "result", "failure")
+	w.family("thm_nic_dropped_packets_total", "counter", "Outgoing packets dropped after failing to send them.")
+	w.sample("thm_nic_dropped_packets_total", float64(m.DroppedPackets), 64)
+	w.family("thm_uptime_seconds", "gauge", "Time since the device booted.")
+	w.sample("thm_uptime_seconds", math.Floor(m.Uptime.Seconds()), 64)
+
+	mac := ""
+	if m.MAC != nil {
+		mac = m.MAC.String()
+	}
+	w.family("thm_build_info", "gauge", "Information about the device. The value is always 1.")
+	w.sample("thm_build_info", 1, 64, "version", firmwareVersion, "mac", mac)
+
+	return w.buf
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricsCounters is the part of the metrics that doesn't depend on having a
+// reading, for both golden tests below.
+const metricsCounters = `# HELP thm_sensor_read_errors_total Failed attempts to read the sensor.
+# TYPE thm_sensor_read_errors_total counter
+thm_sensor_read_errors_total 3
+# HELP thm_display_failures_total Failed attempts to draw on or update the display.
+# TYPE thm_display_failures_total counter
+thm_display_failures_total 1
+# HELP thm_uploads_total Attempts to deliver readings to the telemetry sinks, by result.
+# TYPE thm_uploads_total counter
+thm_uploads_total{result="success"} 10
+thm_uploads_total{result="failure"} 2
+# HELP thm_nic_dropped_packets_total Outgoing packets dropped after failing to send them.
+# TYPE thm_nic_dropped_packets_total counter
+thm_nic_dropped_packets_total 7
+# HELP thm_uptime_seconds Time since the device booted.
+# TYPE thm_uptime_seconds gauge
+thm_uptime_seconds 3723
+# HELP thm_build_info Information about the device. The value is always 1.
+# TYPE thm_build_info gauge
+`
+
+func testMetricsSnapshot() metricsSnapshot {
+	return metricsSnapshot{
+		Reading:         Reading{Temperature: 21.3, Humidity: 45.1},
+		ReadingAge:      2500 * time.Millisecond,
+		SensorErrors:    3,
+		DisplayFailures: 1,
+		UploadSuccesses: 10,
+		UploadFailures:  2,
+		DroppedPackets:  7,
+		Uptime:          3723*time.Second + 400*time.Millisecond,
+		MAC:             net.HardwareAddr{0x28, 0xcd, 0xc1, 0, 0x01, 0xab},
+	}
+}
+
+func TestAppendMetrics(t *testing.T) {
+	m := testMetricsSnapshot()
+	// The float32 readings come out as written, not as 21.299999237060547.
+	want := `# HELP thm_temperature_celsius Temperature measured by the sensor.
+# TYPE thm_temperature_celsius gauge
+thm_temperature_celsius 21.3
+# HELP thm_humidity_percent Relative humidity measured by the sensor.
+# TYPE thm_humidity_percent gauge
+thm_humidity_percent 45.1
+# HELP thm_dew_point_celsius Dew point, derived from the temperature and humidity.
+# TYPE thm_dew_point_celsius gauge
+thm_dew_point_celsius 8.91
+# HELP thm_reading_age_seconds Time since the last good sensor reading.
+# TYPE thm_reading_age_seconds gauge
+thm_reading_age_seconds 2.5
+` + metricsCounters + `thm_build_info{version="` + firmwareVersion + `",mac="28:cd:c1:00:01:ab"} 1
+`
+	if got := string(appendMetrics(nil, &m)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAppendMetricsNoReading(t *testing.T) {
+	m := testMetricsSnapshot()
+	m.Reading.Flags = FlagNoReading
+	m.MAC = nil
+
+	// No reading means no sample at all, rather than zeros.
+	want := metricsCounters + `thm_build_info{version="` + firmwareVersion + `",mac=""} 1
+`
+	if got := string(appendMetrics(nil, &m)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAppendMetricsCounters(t *testing.T) {
+	m := testMetricsSnapshot()
+	got := string(appendMetrics(nil, &m))
+
+	// Prometheus wants counters, and only counters, to end in _total.
+	var family, typ string
+	for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			family, typ, _ = strings.Cut(rest, " ")
+			if strings.HasSuffix(family, "_total") != (typ == "counter") {
+				t.Errorf("%s is a %s", family, typ)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, _, _ := strings.Cut(line, " "); !strings.HasPrefix(name, family) {
+			t.Errorf("sample %q under the %s family", line, family)
+		}
+	}
+}
+
+func TestAppendMetricsAllocs(t *testing.T) {
+	m := testMetricsSnapshot()
+	buf := make([]byte, 0, 4096)
+	if n := testing.AllocsPerRun(100, func() { buf = appendMetrics(buf[:0], &m) }); n > 1 {
+		t.Errorf("%v allocations, want at most 1 for the MAC address", n)
+	}
+}
+
+func TestMetricsWriterSample(t *testing.T) {
+	tests := []struct {
+		value   float64
+		bitSize int
+		labels  []string
+		want    string
+	}{
+		{1, 64, nil, "m 1\n"},
+		{float64(float32(0.1)), 32, nil, "m 0.1\n"},
+		{1e21, 64, nil, "m 1e+21\n"},
+		{math.NaN(), 64, nil, "m NaN\n"},
+		{math.Inf(1), 64, nil, "m +Inf\n"},
+		{math.Inf(-1), 64, nil, "m -Inf\n"},
+		{1, 64, []string{"a", "x"}, `m{a="x"} 1` + "\n"},
+		{1, 64, []string{"a", "x", "b", ""}, `m{a="x",b=""} 1` + "\n"},
+		{1, 64, []string{"a", `say "hi"`}, `m{a="say \"hi\""} 1` + "\n"},
+		{1, 64, []string{"a", `C:\temp`}, `m{a="C:\\temp"} 1` + "\n"},
+		{1, 64, []string{"a", "two\nlines"}, `m{a="two\nlines"} 1` + "\n"},
+		{1, 64, []string{"a", "tab\tand ünïcode"}, "m{a=\"tab\tand ünïcode\"} 1\n"},
+	}
+	for _, tt := range tests {
+		var w metricsWriter
+		w.sample("m", tt.value, tt.bitSize, tt.labels...)
+		if got := string(w.buf); got != tt.want {
+			t.Errorf("sample(%v, %q) = %q, want %q", tt.value, tt.labels, got, tt.want)
+		}
+	}
+}
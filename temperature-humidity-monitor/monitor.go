@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth/ntp"
+	"github.com/soypat/seqs/stacks"
+)
+
+//
+// Keeping an eye on the network after initialization: noticing when the WiFi
+// link goes down, and keeping the clock in sync.
+//
+
+const (
+	// linkCheckInterval is how often we check if the WiFi link is still up.
+	linkCheckInterval = time.Second
+
+	// ntpTimeout is how long we wait for an NTP server to answer.
+	ntpTimeout = 5 * time.Second
+
+	// defaultNTPServer is the default for PicoNetConfig.NTPServer.
+	defaultNTPServer = "pool.ntp.org"
+
+	// defaultTimeSyncInterval is the default for
+	// PicoNetConfig.TimeSyncInterval. The Pico clock is not too bad, so once
+	// an hour is plenty.
+	defaultTimeSyncInterval = time.Hour
+)
+
+// Now returns the current time, as synchronized via NTP. The second return
+// value is false if the clock was never synchronized, in which case the time
+// returned is just the local clock, which starts from some arbitrary point
+// when the device boots.
+func (pn *PicoNet) Now() (time.Time, bool) {
+	return pn.nowAt(time.Now())
+}
+
+// nowAt is like Now, but for the given local clock reading instead of the
+// current one, so that both refer to exactly the same instant.
+func (pn *PicoNet) nowAt(local time.Time) (time.Time, bool) {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	if pn.clockSyncedAt.IsZero() {
+		return local, false
+	}
+	return pn.clockBase.Add(local.Sub(pn.clockSyncedAt)), true
+}
+
+// watch runs forever after the initial initialization. It re-runs
+// initialization whenever the WiFi link goes down, and synchronizes the clock
+// every so often.
+func (pn *PicoNet) watch() {
+	var nextSync time.Time
+	syncFailures := 0
+
+	for {
+		if !pn.device.IsLinkUp() {
+			pn.logger.Warn("WiFi link lost", slog.String("ssid", pn.SSID()))
+			pn.mutex.Lock()
+			pn.initStats.LinkLosses++
+			pn.mutex.Unlock()
+			pn.publish(Event{Kind: EventLinkLost, Err: ErrLinkLost})
+			pn.initialize(StatusConnectingToWiFi, ErrLinkLost)
+			continue
+		}
+
+		if pn.config.TimeSyncInterval > 0 && !time.Now().Before(nextSync) {
+			err := pn.syncTime(context.Background())
+			if err != nil {
+				syncFailures++
+				backoff := pn.config.Retry.backoff(syncFailures)
+				pn.logger.Error("Synchronizing the clock", slog.Duration("backoff", backoff), slogError(err))
+				nextSync = time.Now().Add(backoff)
+			} else {
+				syncFailures = 0
+				nextSync = time.Now().Add(pn.config.TimeSyncInterval)
+			}
+		}
+
+		time.Sleep(linkCheckInterval)
+	}
+}
+
+// syncTime synchronizes the clock with the configured NTP server.
+func (pn *PicoNet) syncTime(ctx context.Context) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, ntpTimeout)
+	defer cancel()
+
+	server, err := netip.ParseAddr(pn.config.NTPServer)
+	if err != nil {
+		addrs, err := pn.lookupNetIP(ctx, pn.config.NTPServer)
+		if err != nil {
+			return err
+		}
+		server = addrs[0]
+	}
+
+	serverMAC, err := pn.hardwareAddrFor(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	ntpClient := stacks.NewNTPClient(pn.stack, ntp.ClientPort)
+	requestTime := time.Now()
+	err = ntpClient.BeginDefaultRequest(serverMAC, server)
+	if err != nil {
+		return fmt.Errorf("starting NTP request: %w", err)
+	}
+	defer pn.stack.CloseUDP(ntp.ClientPort)
+
+	for !ntpClient.IsDone() {
+		err = sleepCtx(ctx, 50*time.Millisecond)
+		if err != nil {
+			ntpClient.Abort()
+			if errors.Is(err, ErrTimeout) {
+				pn.forgetRoute(server)
+			}
+			return fmt.Errorf("waiting for NTP response: %w", err)
+		}
+	}
+
+	// The client measures time from when the request was sent, so what we
+	// get here is the time at that moment (give or take the few
+	// milliseconds until the NIC loop actually sent it). This will stop
+	// working sometime in 2036, when the NTP era rolls over. I'll worry about
+	// it then.
+	now := ntp.BaseTime().Add(ntpClient.Offset())
+
+	pn.mutex.Lock()
+	pn.clockBase = now
+	pn.clockSyncedAt = requestTime
+	pn.publishLocked(Event{Kind: EventTimeSynced, Status: pn.status})
+	pn.mutex.Unlock()
+
+	pn.logger.Info("Synchronized the clock",
+		slog.String("server", server.String()),
+		slog.String("time", now.Format(time.RFC3339)),
+		slogTook(startTime),
+	)
+	return nil
+}
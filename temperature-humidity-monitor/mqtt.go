@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// A minimal MQTT 3.1.1 client. It does just what we need to publish readings:
+// connecting (with a last will), publishing with QoS 0 or 1, keeping the
+// connection alive, and reconnecting when it drops. We never subscribe to
+// anything, so there's no support for that.
+//
+// The client knows nothing about the network stack: it gets its connections
+// from a dial function, which is PicoNet.DialTCP on the device.
+//
+
+// MQTTMessage is a message to publish.
+type MQTTMessage struct {
+	// Topic is where the message goes. Wildcards are not allowed.
+	Topic string
+
+	// Payload is the message contents.
+	Payload []byte
+
+	// QoS is the quality of service level: 0 (at most once) or 1 (at least
+	// once). QoS 2 is not supported.
+	QoS byte
+
+	// Retain asks the broker to keep the message and hand it to future
+	// subscribers of the topic.
+	Retain bool
+}
+
+// MQTTConfig contains the knobs to tweak how an MQTTClient behaves. Fields left
+// as zero get sensible defaults, except for ClientID, which is required.
+type MQTTConfig struct {
+	// ClientID identifies us to the broker. It must be unique among the
+	// broker's clients.
+	ClientID string
+
+	// Username and Password are the credentials to connect with. Both can be
+	// empty for anonymous access; Password is ignored without a Username.
+	Username string
+	Password string
+
+	// KeepAlive is the interval between keep alive pings. If the broker
+	// doesn't hear from us for one and a half times this long, it assumes
+	// we are gone and publishes our Will.
+	KeepAlive time.Duration
+
+	// Will is the message the broker publishes on our behalf when we
+	// disappear without saying goodbye. Can be nil.
+	Will *MQTTMessage
+
+	// Timeout is how long we wait for the broker to acknowledge things, and
+	// for writes to go through.
+	Timeout time.Duration
+
+	// Retry tells how long to wait before reconnecting after the connection
+	// fails. Only the backoff-related fields are used.
+	Retry RetryPolicy
+
+	// OnConnect, if not nil, is called after each successful connection,
+	// before anything else is published. It's the place to publish things
+	// the broker may have forgotten while we were away. If it fails, the
+	// connection is closed and we try again later.
+	OnConnect func(ctx context.Context, c *MQTTClient) error
+}
+
+const (
+	// defaultMQTTKeepAlive is the default for MQTTConfig.KeepAlive.
+	defaultMQTTKeepAlive = time.Minute
+
+	// defaultMQTTTimeout is the default for MQTTConfig.Timeout.
+	defaultMQTTTimeout = 10 * time.Second
+
+	// maxMQTTIncomingSize is the largest packet we accept from the broker.
+	// Since we don't subscribe to anything, all we expect are tiny
+	// acknowledgements.
+	maxMQTTIncomingSize = 256
+)
+
+// withDefaults returns a copy of cfg with zero fields replaced by defaults.
+func (cfg MQTTConfig) withDefaults() MQTTConfig {
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = defaultMQTTKeepAlive
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultMQTTTimeout
+	}
+	cfg.Retry = cfg.Retry.withDefaults()
+	return cfg
+}
+
+var (
+	// ErrMQTTNotConnected is returned when publishing while not connected
+	// to the broker, or when the connection drops before the broker
+	// acknowledges a message.
+	ErrMQTTNotConnected = errors.New("not connected to the MQTT broker")
+
+	// ErrMQTTRefused is returned when the broker refuses our connection.
+	ErrMQTTRefused = errors.New("MQTT connection refused")
+
+	// errMQTTProtocol is returned when the broker sends something that
+	// makes no sense.
+	errMQTTProtocol = errors.New("MQTT protocol error")
+)
+
+// MQTT control packet types, already shifted to the upper nibble of the first
+// byte of the packet.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnAck    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPubAck     = 4 << 4
+	mqttPingReq    = 12 << 4
+	mqttPingResp   = 13 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// MQTTClient is an MQTT client. Call Run to connect (and keep connected), and
+// Publish to publish messages. Safe for concurrent use.
+type MQTTClient struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// dial opens a connection to the broker.
+	dial func(ctx context.Context) (net.Conn, error)
+
+	// config is the configuration, with defaults filled in.
+	config MQTTConfig
+
+	// writeMutex serializes writes to the connection, so that packets don't
+	// get mixed up.
+	writeMutex sync.Mutex
+
+	// mutex protects everything below.
+	mutex sync.Mutex
+
+	// conn is the connection to the broker, or nil if not connected.
+	conn net.Conn
+
+	// lastID is the last packet identifier used.
+	lastID uint16
+
+	// pending are the QoS 1 messages waiting for an acknowledgement, by
+	// packet identifier. Whoever published them waits on the channel.
+	pending map[uint16]chan error
+}
+
+// NewMQTTClient creates a new MQTTClient, which connects to the broker with
+// dial. It doesn't connect to anything until Run is called.
+func NewMQTTClient(logger *slog.Logger, dial func(ctx context.Context) (net.Conn, error), config MQTTConfig) *MQTTClient {
+	return &MQTTClient{
+		logger:  logger,
+		dial:    dial,
+		config:  config.withDefaults(),
+		pending: make(map[uint16]chan error),
+	}
+}
+
+// Connected tells if we are currently connected to the broker.
+func (c *MQTTClient) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+// Run connects to the broker and keeps reconnecting whenever the connection
+// drops, until ctx is done. Then it disconnects cleanly (so that the broker
+// doesn't publish our Will) and returns.
+func (c *MQTTClient) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			failures = 0
+		}
+		failures++
+
+		backoff := c.config.Retry.backoff(failures)
+		c.logger.Warn("MQTT connection lost", slog.Duration("backoff", backoff), slogError(err))
+		if sleepCtx(ctx, backoff) != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Publish publishes msg. With QoS 1, waits until the broker acknowledges it.
+// Messages are not queued nor retransmitted after reconnecting: if we are not
+// connected, or get disconnected before the acknowledgement, Publish fails
+// with ErrMQTTNotConnected and it's up to the caller to try again.
+func (c *MQTTClient) Publish(ctx context.Context, msg MQTTMessage) error {
+	err := validateMQTTTopic(msg.Topic)
+	if err != nil {
+		return err
+	}
+	if msg.QoS > 1 {
+		return fmt.Errorf("unsupported MQTT QoS %d", msg.QoS)
+	}
+
+	c.mutex.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mutex.Unlock()
+		return ErrMQTTNotConnected
+	}
+	var id uint16
+	var ack chan error
+	if msg.QoS == 1 {
+		id = c.nextIDLocked()
+		ack = make(chan error, 1)
+		c.pending[id] = ack
+	}
+	c.mutex.Unlock()
+
+	err = c.write(conn, appendMQTTPublish(nil, &msg, id))
+	if err != nil || ack == nil {
+		c.forget(id)
+		return err
+	}
+
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case err = <-ack:
+		return err
+	case <-timer.C:
+		c.forget(id)
+		return fmt.Errorf("%w: waiting for PUBACK", ErrTimeout)
+	case <-ctx.Done():
+		c.forget(id)
+		return ctxError(ctx)
+	}
+}
+
+// session connects to the broker and handles the connection until it fails or
+// ctx is done. connected tells if we got as far as being connected.
+func (c *MQTTClient) session(ctx context.Context) (connected bool, err error) {
+	dialCtx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	conn, err := c.dial(dialCtx)
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("dialing MQTT broker: %w", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(conn, maxMQTTIncomingSize+8)
+	err = c.handshake(conn, br)
+	if err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.mutex.Unlock()
+	c.logger.Info("Connected to the MQTT broker", slog.String("clientID", c.config.ClientID))
+
+	// From now on, packets from the broker are handled by readLoop. When it
+	// stops, the connection is done for.
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readLoop(conn, br)
+	}()
+
+	defer func() {
+		c.mutex.Lock()
+		c.conn = nil
+		for id, ack := range c.pending {
+			ack <- ErrMQTTNotConnected
+			delete(c.pending, id)
+		}
+		c.mutex.Unlock()
+
+		conn.Close()
+		<-readErr
+	}()
+
+	if c.config.OnConnect != nil {
+		err = c.config.OnConnect(ctx, c)
+		if err != nil {
+			return true, fmt.Errorf("after connecting: %w", err)
+		}
+	}
+
+	// We ping the broker every KeepAlive, whether or not we are publishing
+	// other stuff. This way readLoop can count on hearing from the broker
+	// every so often, and knows something is wrong if it doesn't.
+	ticker := time.NewTicker(c.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.write(conn, []byte{mqttDisconnect, 0})
+			return true, ctx.Err()
+		case err = <-readErr:
+			readErr <- err // For the deferred function.
+			return true, err
+		case <-ticker.C:
+			err = c.write(conn, []byte{mqttPingReq, 0})
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// handshake sends the CONNECT packet and waits for the broker to accept it.
+func (c *MQTTClient) handshake(conn net.Conn, br *bufio.Reader) error {
+	err := c.write(conn, appendMQTTConnect(nil, &c.config))
+	if err != nil {
+		return fmt.Errorf("sending CONNECT: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+	header, body, err := readMQTTPacket(br)
+	if err != nil {
+		return fmt.Errorf("waiting for CONNACK: %w", mqttReadError(err))
+	}
+	if header != mqttConnAck || len(body) != 2 {
+		return fmt.Errorf("%w: expected CONNACK, got packet type %d", errMQTTProtocol, header>>4)
+	}
+	if code := body[1]; code != 0 {
+		return fmt.Errorf("%w: %s", ErrMQTTRefused, mqttConnAckReason(code))
+	}
+	return nil
+}
+
+// readLoop handles the packets received from the broker, until something goes
+// wrong (which includes not hearing from the broker for too long).
+func (c *MQTTClient) readLoop(conn net.Conn, br *bufio.Reader) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.config.KeepAlive + c.config.Timeout))
+		header, body, err := readMQTTPacket(br)
+		if err != nil {
+			return mqttReadError(err)
+		}
+
+		switch header & 0xf0 {
+		case mqttPubAck:
+			if len(body) != 2 {
+				return fmt.Errorf("%w: bad PUBACK", errMQTTProtocol)
+			}
+			id := binary.BigEndian.Uint16(body)
+			c.mutex.Lock()
+			if ack, ok := c.pending[id]; ok {
+				ack <- nil
+				delete(c.pending, id)
+			}
+			c.mutex.Unlock()
+		case mqttPingResp:
+			// Nothing to do: hearing from the broker is all that matters.
+		case mqttPublish:
+			// We never subscribe, so this shouldn't happen. But it's
+			// harmless.
+			c.logger.Warn("Ignoring unexpected MQTT PUBLISH")
+		default:
+			return fmt.Errorf("%w: unexpected packet type %d", errMQTTProtocol, header>>4)
+		}
+	}
+}
+
+// write writes a packet to conn. If that fails the connection is closed, as a
+// partially written packet leaves it in an unusable state.
+func (c *MQTTClient) write(conn net.Conn, pkt []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	_, err := conn.Write(pkt)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("writing MQTT packet: %w", mqttReadError(err))
+	}
+	return nil
+}
+
+// nextIDLocked returns a packet identifier not in use. Must be called with the
+// mutex held.
+func (c *MQTTClient) nextIDLocked() uint16 {
+	for {
+		c.lastID++
+		if _, busy := c.pending[c.lastID]; c.lastID != 0 && !busy {
+			return c.lastID
+		}
+	}
+}
+
+// forget stops waiting for the acknowledgement of packet id, if any.
+func (c *MQTTClient) forget(id uint16) {
+	if id == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, id)
+}
+
+//
+// Packet encoding and decoding
+//
+
+// appendMQTTConnect appends a CONNECT packet for the given configuration to
+// dst.
+func appendMQTTConnect(dst []byte, cfg *MQTTConfig) []byte {
+	var flags byte = 0x02 // Clean session: we keep no state across connections.
+	if cfg.Will != nil {
+		flags |= 0x04 | cfg.Will.QoS<<3
+		if cfg.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if cfg.Username != "" {
+		flags |= 0x80
+		if cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4, flags) // Protocol level 4 is MQTT 3.1.1.
+	body = binary.BigEndian.AppendUint16(body, uint16(min(cfg.KeepAlive/time.Second, 0xffff)))
+	body = appendMQTTString(body, cfg.ClientID)
+	if cfg.Will != nil {
+		body = appendMQTTString(body, cfg.Will.Topic)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(cfg.Will.Payload)))
+		body = append(body, cfg.Will.Payload...)
+	}
+	if flags&0x80 != 0 {
+		body = appendMQTTString(body, cfg.Username)
+	}
+	if flags&0x40 != 0 {
+		body = appendMQTTString(body, cfg.Password)
+	}
+
+	dst = append(dst, mqttConnect)
+	dst = appendMQTTLength(dst, len(body))
+	return append(dst, body...)
+}
+
+// appendMQTTPublish appends a PUBLISH packet for msg to dst. id is the packet
+// identifier, used only for QoS 1.
+func appendMQTTPublish(dst []byte, msg *MQTTMessage, id uint16) []byte {
+	header := byte(mqttPublish) | msg.QoS<<1
+	if msg.Retain {
+		header |= 0x01
+	}
+	length := 2 + len(msg.Topic) + len(msg.Payload)
+	if msg.QoS > 0 {
+		length += 2
+	}
+
+	dst = append(dst, header)
+	dst = appendMQTTLength(dst, length)
+	dst = appendMQTTString(dst, msg.Topic)
+	if msg.QoS > 0 {
+		dst = binary.BigEndian.AppendUint16(dst, id)
+	}
+	return append(dst, msg.Payload...)
+}
+
+// appendMQTTString appends s to dst, prefixed by its length.
+func appendMQTTString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+// appendMQTTLength appends the "remaining length" of a packet to dst, encoded
+// the MQTT way: seven bits per byte, least significant first, with the high
+// bit telling if more bytes follow.
+func appendMQTTLength(dst []byte, n int) []byte {
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		dst = append(dst, b)
+		if n == 0 {
+			return dst
+		}
+	}
+}
+
+// readMQTTPacket reads a packet from br, returning the first byte of its fixed
+// header (type and flags) and the rest of it, after the length.
+func readMQTTPacket(br *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	for i, shift := 0, 0; ; i, shift = i+1, shift+7 {
+		if i == 4 {
+			return 0, nil, fmt.Errorf("%w: bad remaining length", errMQTTProtocol)
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxMQTTIncomingSize {
+		return 0, nil, fmt.Errorf("%w: packet too large (%d bytes)", errMQTTProtocol, length)
+	}
+
+	body = make([]byte, length)
+	_, err = io.ReadFull(br, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// validateMQTTTopic checks if topic is something we can publish to.
+func validateMQTTTopic(topic string) error {
+	if topic == "" || len(topic) > 0xffff {
+		return fmt.Errorf("invalid MQTT topic length %d", len(topic))
+	}
+	if strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("invalid MQTT topic %q: wildcards are not allowed when publishing", topic)
+	}
+	return nil
+}
+
+// mqttConnAckReason describes a CONNACK return code.
+func mqttConnAckReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// mqttReadError translates I/O errors into our usual ones. In particular,
+// deadlines become ErrTimeout.
+func mqttReadError(err error) error {
+	return timeoutError(context.Background(), err)
+}
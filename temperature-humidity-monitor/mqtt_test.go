@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardLogger is a logger for tests that don't care about the logs.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// mqttPacket is a packet received by a fakeBroker.
+type mqttPacket struct {
+	header byte
+	body   []byte
+	at     time.Time
+}
+
+// fakeBroker is just enough of an MQTT broker to test the client against. It
+// records everything it gets, and answers the way it's told to.
+type fakeBroker struct {
+	mutex sync.Mutex
+
+	// refuse is the CONNACK return code to answer with, and noAck makes it
+	// ignore QoS 1 publishes.
+	refuse byte
+	noAck  bool
+
+	// dialErrors is how many of the next dials fail.
+	dialErrors int
+
+	// dials are the times dial was called, conns the server end of each
+	// connection, and packets what came through them.
+	dials   []time.Time
+	conns   []net.Conn
+	packets []mqttPacket
+}
+
+func (b *fakeBroker) dial(ctx context.Context) (net.Conn, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.dials = append(b.dials, time.Now())
+	if b.dialErrors > 0 {
+		b.dialErrors--
+		return nil, ErrConnRefused
+	}
+	client, server := net.Pipe()
+	b.conns = append(b.conns, server)
+	go b.serve(server)
+	return client, nil
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		// readMQTTPacket won't do here: it is meant for tiny
+		// acknowledgements, and discovery messages are larger than that.
+		header, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		length, shift := 0, 0
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return
+			}
+			length |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return
+		}
+
+		b.mutex.Lock()
+		b.packets = append(b.packets, mqttPacket{header, body, time.Now()})
+		refuse, noAck := b.refuse, b.noAck
+		b.mutex.Unlock()
+
+		switch header & 0xf0 {
+		case mqttConnect:
+			conn.Write([]byte{mqttConnAck, 2, 0, refuse})
+			if refuse != 0 {
+				return
+			}
+		case mqttPublish:
+			if (header>>1)&3 == 1 && !noAck {
+				n := int(binary.BigEndian.Uint16(body))
+				conn.Write([]byte{mqttPubAck, 2, body[2+n], body[3+n]})
+			}
+		case mqttPingReq:
+			conn.Write([]byte{mqttPingResp, 0})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// received returns the packets of type typ the broker got.
+func (b *fakeBroker) received(typ byte) []mqttPacket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var pkts []mqttPacket
+	for _, p := range b.packets {
+		if p.header&0xf0 == typ {
+			pkts = append(pkts, p)
+		}
+	}
+	return pkts
+}
+
+// publishes returns the messages published to the broker.
+func (b *fakeBroker) publishes() []MQTTMessage {
+	var msgs []MQTTMessage
+	for _, p := range b.received(mqttPublish) {
+		qos := (p.header >> 1) & 3
+		n := int(binary.BigEndian.Uint16(p.body))
+		payload := p.body[2+n:]
+		if qos > 0 {
+			payload = payload[2:]
+		}
+		msgs = append(msgs, MQTTMessage{
+			Topic:   string(p.body[2 : 2+n]),
+			Payload: payload,
+			QoS:     qos,
+			Retain:  p.header&1 != 0,
+		})
+	}
+	return msgs
+}
+
+// dropConnection closes the current connection, from the broker's side.
+func (b *fakeBroker) dropConnection() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.conns[len(b.conns)-1].Close()
+}
+
+// waitFor waits until cond is true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// runMQTTClient starts c.Run, stopping it at the end of the test.
+func runMQTTClient(t *testing.T, c *MQTTClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v", err)
+		}
+	})
+}
+
+func TestAppendMQTTConnect(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+		want []byte
+	}{
+		{
+			name: "anonymous",
+			cfg:  MQTTConfig{ClientID: "abc", KeepAlive: time.Minute},
+			want: []byte{
+				0x10, 15,
+				0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60,
+				0, 3, 'a', 'b', 'c',
+			},
+		},
+		{
+			name: "user name and password",
+			cfg:  MQTTConfig{ClientID: "abc", Username: "u", Password: "p", KeepAlive: 90 * time.Second},
+			want: []byte{
+				0x10, 21,
+				0, 4, 'M', 'Q', 'T', 'T', 4, 0x80 | 0x40 | 0x02, 0, 90,
+				0, 3, 'a', 'b', 'c',
+				0, 1, 'u',
+				0, 1, 'p',
+			},
+		},
+		{
+			name: "password without a user name",
+			cfg:  MQTTConfig{ClientID: "abc", Password: "p", KeepAlive: time.Minute},
+			want: []byte{
+				0x10, 15,
+				0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60,
+				0, 3, 'a', 'b', 'c',
+			},
+		},
+		{
+			name: "retained QoS 1 will",
+			cfg: MQTTConfig{
+				ClientID:  "abc",
+				KeepAlive: time.Minute,
+				Will:      &MQTTMessage{Topic: "w", Payload: []byte("off"), QoS: 1, Retain: true},
+			},
+			want: []byte{
+				0x10, 23,
+				0, 4, 'M', 'Q', 'T', 'T', 4, 0x20 | 0x08 | 0x04 | 0x02, 0, 60,
+				0, 3, 'a', 'b', 'c',
+				0, 1, 'w',
+				0, 3, 'o', 'f', 'f',
+			},
+		},
+		{
+			name: "everything",
+			cfg: MQTTConfig{
+				ClientID:  "abc",
+				Username:  "u",
+				Password:  "p",
+				KeepAlive: 24 * time.Hour,
+				Will:      &MQTTMessage{Topic: "w", Payload: []byte("off")},
+			},
+			want: []byte{
+				0x10, 29,
+				0, 4, 'M', 'Q', 'T', 'T', 4, 0x80 | 0x40 | 0x04 | 0x02, 0xff, 0xff,
+				0, 3, 'a', 'b', 'c',
+				0, 1, 'w',
+				0, 3, 'o', 'f', 'f',
+				0, 1, 'u',
+				0, 1, 'p',
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendMQTTConnect(nil, &tt.cfg); !bytes.Equal(got, tt.want) {
+				t.Errorf("got  % x\nwant % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendMQTTPublish(t *testing.T) {
+	got := appendMQTTPublish(nil, &MQTTMessage{Topic: "a/b", Payload: []byte("hi")}, 0)
+	want := []byte{0x30, 7, 0, 3, 'a', '/', 'b', 'h', 'i'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("QoS 0: got % x, want % x", got, want)
+	}
+
+	got = appendMQTTPublish(nil, &MQTTMessage{Topic: "a/b", Payload: []byte("hi"), QoS: 1, Retain: true}, 0x1234)
+	want = []byte{0x33, 9, 0, 3, 'a', '/', 'b', 0x12, 0x34, 'h', 'i'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("QoS 1: got % x, want % x", got, want)
+	}
+}
+
+func TestMQTTLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		if got := appendMQTTLength(nil, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendMQTTLength(%d) = % x, want % x", tt.n, got, tt.want)
+		}
+	}
+
+	pkt := append([]byte{mqttPingResp}, appendMQTTLength(nil, 200)...)
+	pkt = append(pkt, make([]byte, 200)...)
+	header, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(pkt)))
+	if err != nil || header != mqttPingResp || len(body) != 200 {
+		t.Errorf("readMQTTPacket = %x, %d bytes, %v", header, len(body), err)
+	}
+
+	for name, pkt := range map[string][]byte{
+		"too large":      append([]byte{mqttPubAck}, appendMQTTLength(nil, maxMQTTIncomingSize+1)...),
+		"five byte size": {mqttPubAck, 0x80, 0x80, 0x80, 0x80, 0x01},
+	} {
+		if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(pkt))); !errors.Is(err, errMQTTProtocol) {
+			t.Errorf("%s: got %v, want errMQTTProtocol", name, err)
+		}
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	b := &fakeBroker{}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{ClientID: "thm", Timeout: 100 * time.Millisecond})
+	ctx := context.Background()
+
+	if err := c.Publish(ctx, MQTTMessage{Topic: "t"}); !errors.Is(err, ErrMQTTNotConnected) {
+		t.Errorf("before connecting: got %v, want ErrMQTTNotConnected", err)
+	}
+
+	runMQTTClient(t, c)
+	waitFor(t, "the connection", c.Connected)
+
+	// The PUBACK is what completes a QoS 1 publish.
+	for i := range 3 {
+		if err := c.Publish(ctx, MQTTMessage{Topic: "t", Payload: []byte{byte(i)}, QoS: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Publish(ctx, MQTTMessage{Topic: "t", Payload: []byte{3}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the QoS 0 message", func() bool { return len(b.publishes()) == 4 })
+	ids := make(map[uint16]bool)
+	for _, p := range b.received(mqttPublish)[:3] {
+		ids[binary.BigEndian.Uint16(p.body[3:])] = true
+	}
+	if len(ids) != 3 || ids[0] {
+		t.Errorf("packet identifiers %v", ids)
+	}
+
+	for _, msg := range []MQTTMessage{{Topic: "a/+"}, {Topic: "a/#"}, {Topic: ""}, {Topic: "t", QoS: 2}} {
+		if err := c.Publish(ctx, msg); err == nil {
+			t.Errorf("publishing %+v succeeded", msg)
+		}
+	}
+
+	b.mutex.Lock()
+	b.noAck = true
+	b.mutex.Unlock()
+	if err := c.Publish(ctx, MQTTMessage{Topic: "t", QoS: 1}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("without a PUBACK: got %v, want ErrTimeout", err)
+	}
+	c.mutex.Lock()
+	pending := len(c.pending)
+	c.mutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d publishes still pending after timing out", pending)
+	}
+}
+
+func TestMQTTPublishDisconnected(t *testing.T) {
+	b := &fakeBroker{noAck: true}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{
+		ClientID: "thm",
+		Timeout:  5 * time.Second,
+		Retry:    RetryPolicy{InitialBackoff: time.Hour, Jitter: -1},
+	})
+	runMQTTClient(t, c)
+	waitFor(t, "the connection", c.Connected)
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- c.Publish(context.Background(), MQTTMessage{Topic: "t", QoS: 1}) }()
+	}
+	waitFor(t, "the publishes", func() bool { return len(b.received(mqttPublish)) == 2 })
+
+	b.dropConnection()
+	for range 2 {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrMQTTNotConnected) {
+				t.Errorf("got %v, want ErrMQTTNotConnected", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the publish is still waiting for its PUBACK")
+		}
+	}
+	waitFor(t, "the disconnection", func() bool { return !c.Connected() })
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	const keepAlive = 20 * time.Millisecond
+	b := &fakeBroker{}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{ClientID: "thm", KeepAlive: keepAlive})
+	runMQTTClient(t, c)
+
+	waitFor(t, "the pings", func() bool { return len(b.received(mqttPingReq)) >= 4 })
+	connected := b.received(mqttConnect)[0].at
+	for i, p := range b.received(mqttPingReq)[:4] {
+		if want := connected.Add(time.Duration(i+1) * keepAlive); p.at.Before(want) {
+			t.Errorf("ping %d after %v, want at least %v", i+1, p.at.Sub(connected), want.Sub(connected))
+		}
+	}
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	const initial = 20 * time.Millisecond
+	b := &fakeBroker{dialErrors: 4}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{
+		ClientID: "thm",
+		Retry:    RetryPolicy{InitialBackoff: initial, MaxBackoff: time.Hour, Jitter: -1},
+		OnConnect: func(ctx context.Context, c *MQTTClient) error {
+			return c.Publish(ctx, MQTTMessage{Topic: "hello", QoS: 1})
+		},
+	})
+	runMQTTClient(t, c)
+	waitFor(t, "the connection", func() bool { return len(b.publishes()) == 1 })
+
+	// The backoff doubles with every failure.
+	b.mutex.Lock()
+	dials := append([]time.Time(nil), b.dials...)
+	b.mutex.Unlock()
+	if len(dials) != 5 {
+		t.Fatalf("%d dials, want 5", len(dials))
+	}
+	for i := 1; i < len(dials); i++ {
+		if got, want := dials[i].Sub(dials[i-1]), initial<<(i-1); got < want {
+			t.Errorf("waited %v before dial %d, want at least %v", got, i+1, want)
+		}
+	}
+
+	// Having connected, the next failure starts over from the initial
+	// backoff, rather than 16 times it. And OnConnect runs again.
+	dropped := time.Now()
+	b.dropConnection()
+	waitFor(t, "the reconnection", func() bool { return len(b.publishes()) == 2 })
+	b.mutex.Lock()
+	waited := b.dials[5].Sub(dropped)
+	b.mutex.Unlock()
+	if waited >= 16*initial {
+		t.Errorf("waited %v before reconnecting, want about %v", waited, initial)
+	}
+	if n := len(b.received(mqttConnect)); n != 2 {
+		t.Errorf("%d CONNECT packets, want 2", n)
+	}
+}
+
+func TestMQTTOnConnectFailure(t *testing.T) {
+	b := &fakeBroker{}
+	var attempts int
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{
+		ClientID: "thm",
+		Retry:    RetryPolicy{InitialBackoff: time.Millisecond, Jitter: -1},
+		OnConnect: func(ctx context.Context, c *MQTTClient) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("not today")
+			}
+			return nil
+		},
+	})
+	runMQTTClient(t, c)
+	waitFor(t, "the connection", c.Connected)
+	if n := len(b.received(mqttConnect)); n != 3 {
+		t.Errorf("%d CONNECT packets, want 3", n)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	b := &fakeBroker{refuse: 5}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{ClientID: "thm", Timeout: time.Second})
+	connected, err := c.session(context.Background())
+	if connected || !errors.Is(err, ErrMQTTRefused) || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("got %v, %v", connected, err)
+	}
+}
+
+func TestMQTTDisconnectOnCancel(t *testing.T) {
+	b := &fakeBroker{}
+	c := NewMQTTClient(discardLogger, b.dial, MQTTConfig{ClientID: "thm"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	waitFor(t, "the connection", c.Connected)
+
+	// A clean goodbye, so that the broker doesn't publish the will.
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v", err)
+	}
+	waitFor(t, "the DISCONNECT", func() bool { return len(b.received(mqttDisconnect)) == 1 })
+	if c.Connected() {
+		t.Error("still connected")
+	}
+}
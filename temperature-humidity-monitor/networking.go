@@ -1,25 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"math/rand"
 	"net"
 	"net/netip"
-	"net/url"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/soypat/cyw43439"
-	"github.com/soypat/seqs"
 	"github.com/soypat/seqs/eth/dhcp"
 	"github.com/soypat/seqs/eth/dns"
-	"github.com/soypat/seqs/httpx"
 	"github.com/soypat/seqs/stacks"
 )
 
@@ -38,18 +33,27 @@ import (
 // PicoNetStatus represents the status of a PicoNet.
 //
 // Things on PicoNet are initialized sequentially. It goes from status to status
-// in the order they are declared below. So, knowing the current status allows
-// to know where in the initialization sequence we are. And if we spend too much
-// time on the same state, it probably means that some error is happening in the
-// next step of the initialization process.
+// in the order they are declared below, though it may go back to an earlier
+// status if some stage keeps failing (see RetryPolicy). Not all of them are
+// used every time: only one of StatusObtainingIP and StatusConfiguringStaticIP
+// is used, depending on whether the address comes from DHCP or from
+// PicoNetConfig.StaticIP; and in access point mode (see
+// PicoNetConfig.AccessPoint), StatusStartingAP and StatusStartingDHCPServer
+// replace the stages that deal with joining a network. So, knowing the current
+// status allows to know where in the initialization sequence we are. And if we
+// spend too much time on the same state, it probably means that some error is
+// happening in that step of the initialization process.
 type PicoNetStatus int
 
 const (
 	StatusUninitialized PicoNetStatus = iota
 	StatusCreatingDevice
 	StatusConnectingToWiFi
+	StatusStartingAP
 	StatusCreatingStack
 	StatusObtainingIP
+	StatusConfiguringStaticIP
+	StatusStartingDHCPServer
 	StatusConfiguringDNS
 	StatusObtainingRouterMAC
 	StatusReadyToGo
@@ -63,10 +67,16 @@ func (s PicoNetStatus) String() string {
 		return "CreatingDevice"
 	case StatusConnectingToWiFi:
 		return "ConnectingToWiFi"
+	case StatusStartingAP:
+		return "StartingAP"
 	case StatusCreatingStack:
 		return "CreatingStack"
 	case StatusObtainingIP:
 		return "ObtainingIP"
+	case StatusConfiguringStaticIP:
+		return "ConfiguringStaticIP"
+	case StatusStartingDHCPServer:
+		return "StartingDHCPServer"
 	case StatusConfiguringDNS:
 		return "ConfiguringDNS"
 	case StatusObtainingRouterMAC:
@@ -91,9 +101,36 @@ type PicoNet struct {
 	// logger is used internally for all the logging.
 	logger *slog.Logger
 
+	// config is the configuration passed to NewPicoNet, with defaults filled
+	// in.
+	config PicoNetConfig
+
 	// status tells how things are.
 	status PicoNetStatus
 
+	// initStats has diagnostics about the initialization process.
+	initStats InitStats
+
+	// subscribers are the channels to which events are delivered.
+	subscribers []chan Event
+
+	// wifiIndex is the index in config.WiFiNetworks of the network to join,
+	// and wifiFailures is how many consecutive times we failed to join it.
+	wifiIndex    int
+	wifiFailures int
+
+	// ssid is the SSID of the network we are connected to, if any.
+	ssid string
+
+	// addr is our IP address, once we have one.
+	addr netip.Addr
+
+	// clockBase is the time we got from NTP, and clockSyncedAt is the local
+	// clock reading when we got it. Both are zero until the first successful
+	// time sync.
+	clockBase     time.Time
+	clockSyncedAt time.Time
+
 	// device is the Raspberry Pi Pico W WiFi device.
 	device *cyw43439.Device
 
@@ -103,412 +140,790 @@ type PicoNet struct {
 	// dhcpClient is the DHCP client used internally.
 	dhcpClient *stacks.DHCPClient
 
+	// dhcpServer hands out addresses in access point mode.
+	dhcpServer *stacks.DHCPServer
+
 	// dnsClient is used to resolve names.
 	dnsClient *stacks.DNSClient
 
-	// dnsIP is the IP address of the primary DNS server. We currently don't try
-	// to use any DNS server other than the primary one.
-	dnsIP netip.Addr
+	// dnsMutex serializes DNS lookups, since there's a single DNS client
+	// (using a single UDP port). It also protects dnsClient, dnsServers and
+	// dnsPreferred.
+	dnsMutex sync.Mutex
+
+	// dnsCache caches the results of DNS lookups, by host name.
+	dnsCache *expiringCache[string, []netip.Addr]
+
+	// pool manages the TCP connections used for HTTP requests.
+	pool *connPool
+
+	// dialConn opens the TCP connections going into pool. It's
+	// PicoNet.dialStack, except in tests, which talk to servers in the same
+	// process.
+	dialConn func(ctx context.Context, addrPort netip.AddrPort, server string) (net.Conn, error)
+
+	// dnsServers are the IP addresses of the DNS servers we got from DHCP,
+	// in order of preference.
+	dnsServers []netip.Addr
+
+	// dnsPreferred is the index in dnsServers of the server to try first:
+	// the one that answered last time.
+	dnsPreferred int
 
 	// picoMAC is the MAC address of the Pico W.
 	picoMAC [6]byte
 
-	// routerMAC is the MAC address of the router the Pico W is connected to.
-	// We'll send our packets to it.
-	routerMAC [6]byte
+	// droppedPackets is how many outgoing packets the NIC loop dropped after
+	// failing to send them.
+	droppedPackets int
+
+	// subnet is our own subnet. Hosts in it are reached directly, everything
+	// else goes through the gateway. Both are set under mutex, and read with
+	// route, as packets come and go from other goroutines.
+	subnet netip.Prefix
+
+	// gateway is the IP address of the router the Pico W is connected to.
+	gateway netip.Addr
+
+	// arpMutex serializes ARP requests, since the stack has a single ARP
+	// client.
+	arpMutex sync.Mutex
+
+	// arpCache caches the hardware addresses we send our packets to.
+	arpCache *expiringCache[netip.Addr, [6]byte]
+
+	// udpMutex protects udpConns and udpIPID.
+	udpMutex sync.Mutex
+
+	// udpConns are our own UDP sockets, by local port.
+	udpConns map[uint16]*UDPConn
+
+	// udpIPID is the ID of the last IP packet sent from our UDP sockets.
+	udpIPID uint16
+
+	// udpTx are the frames sent from our UDP sockets, waiting for the NIC
+	// loop to pick them up.
+	udpTx chan []byte
+}
+
+// PicoNetConfig contains the knobs to tweak how a PicoNet behaves. The zero
+// value is a perfectly reasonable configuration: any field left as zero gets a
+// sensible default.
+type PicoNetConfig struct {
+	// MaxBodySize is the maximum number of bytes we are willing to read from a
+	// response body. Reading beyond that yields ErrBodyTooLarge. Use a
+	// negative value to disable the limit, for example when streaming
+	// something large straight to flash.
+	MaxBodySize int64
+
+	// ReadTimeout is how long we wait for the server to send us something
+	// when reading a response. It applies to each individual read, so a large
+	// body can take much longer than this to arrive, as long as it keeps
+	// trickling in.
+	ReadTimeout time.Duration
+
+	// DialTimeout is how long we wait for a TCP connection to be established.
+	// A shorter deadline in the context passed to Do wins.
+	DialTimeout time.Duration
+
+	// TCPPorts is the number of TCP ports to open in the network stack, which
+	// is also the maximum number of simultaneous connections. Requests beyond
+	// that wait in line for a free port. Each port costs some 4kB of RAM for
+	// buffers.
+	TCPPorts int
+
+	// ListenPorts is the number of TCP ports reserved for PicoNet.Listen, on
+	// top of TCPPorts. Defaults to zero, as we usually don't serve anything.
+	ListenPorts int
+
+	// IdleTimeout is how long an idle HTTP connection is kept open, waiting
+	// to be reused by another request to the same server. Use a negative
+	// value to disable connection reuse.
+	IdleTimeout time.Duration
+
+	// MaxRedirects is the maximum number of redirects followed by a single
+	// request. Use a negative value to not follow redirects at all, in which
+	// case the redirect response itself is returned.
+	MaxRedirects int
+
+	// DNSTimeout is how long we wait for each DNS server to answer a query
+	// before trying the next one.
+	DNSTimeout time.Duration
+
+	// WiFiNetworks are the WiFi networks we know how to join. Required,
+	// unless running an access point.
+	//
+	// Ideally we'd scan for networks and join the strongest one we know, but
+	// the WiFi driver we use can't scan (and therefore can't tell signal
+	// strengths) yet. So we try networks in priority order, sticking to the
+	// last one that worked, and move on to the next one after JoinAttempts
+	// consecutive failures.
+	WiFiNetworks []WiFiNetwork
+
+	// JoinAttempts is how many consecutive times we fail to join a WiFi
+	// network before trying the next one.
+	JoinAttempts int
+
+	// StaticIP, if not nil, configures the network statically, for networks
+	// without a DHCP server. By default (nil), we use DHCP.
+	StaticIP *StaticIPConfig
+
+	// AccessPoint, if not nil, makes us create our own WiFi network instead
+	// of joining one of WiFiNetworks. Our address will be 192.168.1.1, and
+	// whoever connects to us gets an address via DHCP. StaticIP, DNS and
+	// time synchronization are not used in this mode.
+	AccessPoint *AccessPointConfig
+
+	// Hosts is a static table of host names and their addresses, checked
+	// before asking DNS. Handy for hosts on the local network that don't have
+	// a DNS entry, like the env-server running on some box in the living room.
+	Hosts map[string]netip.Addr
+
+	// Retry is the policy for retrying failed initialization stages.
+	Retry RetryPolicy
+
+	// NTPServer is the host name or IP address of the NTP server used to
+	// synchronize the clock.
+	NTPServer string
+
+	// TimeSyncInterval is how often the clock is synchronized. Use a negative
+	// value to disable time synchronization altogether.
+	TimeSyncInterval time.Duration
+
+	// Reset is called as a last resort, when initialization keeps failing
+	// even after re-running earlier stages. It is meant to reset the device
+	// (machine.CPUReset is the obvious choice), and is not expected to return.
+	// If it does, or if it is nil, initialization starts over from the first
+	// stage.
+	Reset func()
+}
+
+// WiFiNetwork is a WiFi network we know how to join. Only WPA2 networks are
+// supported.
+type WiFiNetwork struct {
+	SSID     string
+	Password string
+
+	// Priority tells which networks to try first: higher priorities come
+	// first. Networks with the same priority are tried in the order given.
+	Priority int
+}
+
+// StaticIPConfig is the network configuration used instead of DHCP.
+type StaticIPConfig struct {
+	// Addr is our address and the subnet it belongs to, like
+	// 192.168.10.42/24.
+	Addr netip.Prefix
+
+	// Gateway is the router through which we reach anything outside our
+	// subnet. Can be left unset if we only need to talk to local hosts.
+	Gateway netip.Addr
+
+	// DNSServers are the DNS servers to use, in order of preference. Can be
+	// empty if we only need the hosts in PicoNetConfig.Hosts or IP addresses.
+	DNSServers []netip.Addr
+}
+
+// AddrMode tells how a PicoNet gets its IP address.
+type AddrMode int
+
+const (
+	AddrModeDHCP AddrMode = iota
+	AddrModeStatic
+	AddrModeAccessPoint
+)
+
+func (m AddrMode) String() string {
+	switch m {
+	case AddrModeDHCP:
+		return "DHCP"
+	case AddrModeStatic:
+		return "static"
+	case AddrModeAccessPoint:
+		return "access point"
+	default:
+		return "Invalid"
+	}
+}
+
+const (
+	// defaultMaxBodySize is the default for PicoNetConfig.MaxBodySize. The Pico
+	// has 264kB of RAM, and we have better things to do with it.
+	defaultMaxBodySize = 16 * 1024
+
+	// defaultReadTimeout is the default for PicoNetConfig.ReadTimeout.
+	defaultReadTimeout = 5 * time.Second
+
+	// defaultDialTimeout is the default for PicoNetConfig.DialTimeout.
+	defaultDialTimeout = 5 * time.Second
+
+	// defaultTCPPorts is the default for PicoNetConfig.TCPPorts. One is enough
+	// to make one HTTP request at a time, which is all we usually need.
+	defaultTCPPorts = 1
+
+	// defaultIdleTimeout is the default for PicoNetConfig.IdleTimeout. Many
+	// servers close idle connections after a few seconds anyway, so there's
+	// not much point in keeping them around for longer.
+	defaultIdleTimeout = 30 * time.Second
+
+	// defaultMaxRedirects is the default for PicoNetConfig.MaxRedirects.
+	defaultMaxRedirects = 10
+
+	// defaultJoinAttempts is the default for PicoNetConfig.JoinAttempts.
+	defaultJoinAttempts = 2
+
+	// defaultDNSTimeout is the default for PicoNetConfig.DNSTimeout. DNS
+	// servers answer in a few milliseconds or not at all, so there's no point
+	// in waiting much longer before trying another one.
+	defaultDNSTimeout = 2 * time.Second
+)
+
+// withDefaults returns a copy of cfg with zero fields replaced by defaults.
+func (cfg PicoNetConfig) withDefaults() PicoNetConfig {
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = defaultMaxBodySize
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.TCPPorts <= 0 {
+		cfg.TCPPorts = defaultTCPPorts
+	}
+	if cfg.ListenPorts < 0 {
+		cfg.ListenPorts = 0
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.MaxRedirects == 0 {
+		cfg.MaxRedirects = defaultMaxRedirects
+	}
+	if len(cfg.WiFiNetworks) > 0 {
+		// Copy before sorting, to leave the caller's slice alone.
+		cfg.WiFiNetworks = append([]WiFiNetwork(nil), cfg.WiFiNetworks...)
+		sort.SliceStable(cfg.WiFiNetworks, func(i, j int) bool {
+			return cfg.WiFiNetworks[i].Priority > cfg.WiFiNetworks[j].Priority
+		})
+	}
+	if cfg.JoinAttempts <= 0 {
+		cfg.JoinAttempts = defaultJoinAttempts
+	}
+	if cfg.DNSTimeout <= 0 {
+		cfg.DNSTimeout = defaultDNSTimeout
+	}
+
+	// Copy the hosts table, normalizing names along the way, so that lookups
+	// are case-insensitive and the caller can't change it under our feet.
+	hosts := make(map[string]netip.Addr, len(cfg.Hosts))
+	for name, addr := range cfg.Hosts {
+		hosts[normalizeHostName(name)] = addr
+	}
+	cfg.Hosts = hosts
+
+	if cfg.NTPServer == "" {
+		cfg.NTPServer = defaultNTPServer
+	}
+	if cfg.TimeSyncInterval == 0 {
+		cfg.TimeSyncInterval = defaultTimeSyncInterval
+	}
+
+	if cfg.AccessPoint != nil {
+		ap := *cfg.AccessPoint
+		if ap.Channel == 0 {
+			ap.Channel = defaultAPChannel
+		}
+		cfg.AccessPoint = &ap
+	}
+
+	cfg.Retry = cfg.Retry.withDefaults()
+	return cfg
 }
 
 // NewPicoNet creates a new PicoNet and starts the background initialization
 // process.
 //
-// The background initialization process will keep retrying any failing
-// operations, even if some of them are pretty much guaranteed to fail again.
-// You should check the initialization progress with PicoNet.Status() and handle
-// long-running initialization errors as desired.
-func NewPicoNet(logger *slog.Logger) *PicoNet {
+// The background initialization process retries failing operations according
+// to config.Retry, re-running earlier stages and eventually calling
+// config.Reset if things don't get better. You can check the initialization
+// progress with PicoNet.Status(), and see what's going wrong with
+// PicoNet.InitStats().
+func NewPicoNet(logger *slog.Logger, config PicoNetConfig) *PicoNet {
 	pn := &PicoNet{
 		logger: logger,
+		config: config.withDefaults(),
 	}
+	pn.pool = newConnPool(pn.config.TCPPorts, pn.config.IdleTimeout, pn.closeConn, connUsable)
+	pn.dialConn = pn.dialStack
+	pn.arpCache = newExpiringCache[netip.Addr, [6]byte](arpCacheSize)
+	pn.dnsCache = newExpiringCache[string, []netip.Addr](dnsCacheSize)
+	pn.udpConns = make(map[uint16]*UDPConn)
+	pn.udpTx = make(chan []byte, udpTxQueueSize)
 
-	go func() {
-		pn.setStatus(StatusCreatingDevice)
-		pn.createDevice()
-
-		pn.setStatus(StatusConnectingToWiFi)
-		pn.connectToWifi()
+	pn.initStats.Stages = make(map[PicoNetStatus]StageStats)
 
-		pn.setStatus(StatusCreatingStack)
-		pn.createStack()
-
-		pn.setStatus(StatusObtainingIP)
-		pn.obtainIPAddress()
-
-		pn.setStatus(StatusConfiguringDNS)
-		pn.configureDNS()
-
-		pn.setStatus(StatusObtainingRouterMAC)
-		pn.obtainRouterMAC()
+	go func() {
+		pn.initialize(StatusCreatingDevice, nil)
 
-		pn.setStatus(StatusReadyToGo)
+		// In access point mode we are the network, so there's no link to
+		// lose and no NTP server to ask for the time.
+		if pn.AddrMode() != AddrModeAccessPoint {
+			pn.watch()
+		}
 	}()
 	return pn
 }
 
+// Status returns the current PicoNet status.
 func (pn *PicoNet) Status() PicoNetStatus {
 	pn.mutex.Lock()
 	defer pn.mutex.Unlock()
 	return pn.status
 }
 
-// Get does an HTTP GET request.
-func (pn *PicoNet) Get(urlStr string) (res *Response, err error) {
-	rawRes, body, err := pn.doRequest("GET", urlStr, []byte{})
-	if err != nil {
-		return nil, err
+// SSID returns the SSID of the WiFi network we are connected to (or that we
+// created, in access point mode), or an empty string if not connected.
+func (pn *PicoNet) SSID() string {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	return pn.ssid
+}
+
+// Addr returns our IP address, or an invalid address if we are not ready to
+// use the network.
+func (pn *PicoNet) Addr() netip.Addr {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	if pn.status != StatusReadyToGo {
+		return netip.Addr{}
 	}
+	return pn.addr
+}
 
-	return pn.translateHeaders(rawRes, body)
+// AddrMode tells how the PicoNet gets its IP address.
+func (pn *PicoNet) AddrMode() AddrMode {
+	if pn.config.AccessPoint != nil {
+		return AddrModeAccessPoint
+	}
+	if pn.config.StaticIP != nil {
+		return AddrModeStatic
+	}
+	return AddrModeDHCP
 }
 
-// Post does an HTTP POST request.
-func (pn *PicoNet) Post(urlStr string, body []byte) (resp *Response, err error) {
-	rawRes, body, err := pn.doRequest("POST", urlStr, body)
-	if err != nil {
-		return nil, err
+// HardwareAddr returns the MAC address of the WiFi device, or nil if the device
+// is not initialized yet.
+func (pn *PicoNet) HardwareAddr() net.HardwareAddr {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	if pn.picoMAC == [6]byte{} {
+		return nil
 	}
+	mac := pn.picoMAC
+	return mac[:]
+}
 
-	return pn.translateHeaders(rawRes, body)
+// DroppedPackets returns how many outgoing packets were dropped because the
+// WiFi device refused to send them, even after retrying.
+func (pn *PicoNet) DroppedPackets() int {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	return pn.droppedPackets
 }
 
-// Response is the response from an HTTP request. This ain't no standard http
-// package, so don't expect super standard-respecting parsing of a response.
-// Just to give one example: this will not handle duplicate headers nicely.
-type Response struct {
-	// Status contains the response status, like "200 OK".
-	Status string
+// SetLED turns the Pi Pico W on-board LED on or off. The LED is wired to the
+// WiFi chip, not to the RP2040, so it can't be used before the WiFi device is
+// initialized.
+func (pn *PicoNet) SetLED(on bool) error {
+	if pn.Status() <= StatusCreatingDevice {
+		return ErrNotReady
+	}
+	return pn.device.GPIOSet(0, on)
+}
 
-	// StatusCode contains the status code, like 200.
-	StatusCode int
+// Errors returned by the PicoNet request methods. They are usually wrapped with
+// more details, so check for them with errors.Is.
+var (
+	// ErrNotReady is returned when trying to use the network before the
+	// initialization is complete.
+	ErrNotReady = errors.New("network not ready")
 
-	// Proto contains the protocol version, like "HTTP/1.0".
-	Proto string
+	// ErrDNS is returned when a host name can't be resolved.
+	ErrDNS = errors.New("DNS resolution failed")
 
-	// Headers maps header keys to their values.
-	Headers map[string]string
+	// ErrTimeout is returned when some operation takes longer than allowed,
+	// either by the PicoNet configuration or by the context deadline.
+	ErrTimeout = errors.New("timed out")
 
-	// Body contains the response body.
-	Body []byte
+	// ErrConnRefused is returned when the server refuses the TCP connection.
+	ErrConnRefused = errors.New("connection refused")
 
-	// ContentLength contains the length of the associated content.
-	ContentLength int
-}
+	// ErrLinkLost is the reason given when the connection to the WiFi network
+	// is lost.
+	ErrLinkLost = errors.New("WiFi link lost")
+)
 
 //
 // Initialization
 //
 
 const (
-	// We need one TCP port to make one HTTP request at a time.
-	tcpPortsCount = 1
-
-	// We need two UDP ports: one for DNS, one for DHCP.
-	udpPortsCount = 2
+	// We need three UDP ports: one for DNS, one for DHCP, one for NTP.
+	udpPortsCount = 3
 
 	// Use the MTU for the WiFi device.
 	mtu = cyw43439.MTU
 )
 
-func (pn *PicoNet) createDevice() {
-	for {
-		startTime := time.Now()
+// createDevice creates and initializes the Pico W WiFi device.
+func (pn *PicoNet) createDevice() error {
+	if pn.stack != nil {
+		// We are re-running this stage after something went wrong further
+		// down the line. The NIC loop is already running, though, and
+		// re-initializing the chip under its feet is asking for trouble. A
+		// reset is the way to go in this case.
+		pn.logger.Info("Not re-initializing the WiFi device while the stack is running")
+		return nil
+	}
 
+	startTime := time.Now()
+	if pn.device == nil {
 		// Create the Pico W device.
 		pn.logger.Info("Creating the WiFi device")
-		pn.device = cyw43439.NewPicoWDevice()
+		pn.device = newPicoWDevice()
 		if pn.device == nil {
-			pn.logger.Error("Got a nil WiFi device")
-
-			// I think that retrying here unlikely to succeed, but I also don't
-			// see much else we could do. Rebooting the device would not be a
-			// bad idea, but this is better done by the caller.
-			time.Sleep(5 * time.Second)
-			continue
+			return errors.New("got a nil WiFi device")
 		}
-
 		pn.logger.Info("WiFi device created successfully", slogTook(startTime))
-		break
 	}
 
-	for {
-		startTime := time.Now()
+	// Initialize the Pico W device.
+	startTime = time.Now()
+	pn.logger.Info("Initializing the WiFi device")
+	wifiCfg := cyw43439.DefaultWifiConfig()
+	wifiCfg.Logger = pn.logger
 
-		// Initialize the Pico W device.
-		pn.logger.Info("Initializing the WiFi device")
-		wifiCfg := cyw43439.DefaultWifiConfig()
-		wifiCfg.Logger = pn.logger
+	err := pn.device.Init(wifiCfg)
+	if err != nil {
+		return fmt.Errorf("initializing the WiFi device: %w", err)
+	}
 
-		err := pn.device.Init(wifiCfg)
-		if err != nil {
-			pn.logger.Error("Initializing the WiFi device", slogError(err))
-			time.Sleep(5 * time.Second)
-			continue
-		}
+	mac, err := pn.device.HardwareAddr6()
+	if err != nil {
+		return fmt.Errorf("obtaining the WiFi device MAC address: %w", err)
+	}
+	pn.mutex.Lock()
+	pn.picoMAC = mac
+	pn.mutex.Unlock()
 
-		pn.picoMAC, err = pn.device.HardwareAddr6()
-		if err != nil {
-			pn.logger.Error("Obtaining the WiFi device MAC address", slogError(err))
-			time.Sleep(5 * time.Second)
-			continue
-		}
+	pn.logger.Info("Pico W device successfully initialized", slogTook(startTime), slogMAC(pn.picoMAC))
+	return nil
+}
 
-		pn.logger.Info("Pico W device successfully initialized", slogTook(startTime), slogMAC(pn.picoMAC))
+// connectToWifi joins one of the known WiFi networks. Each call tries a single
+// network, moving on to the next one after too many failures.
+func (pn *PicoNet) connectToWifi() error {
+	pn.mutex.Lock()
+	pn.ssid = ""
+	pn.mutex.Unlock()
 
-		break
+	networks := pn.config.WiFiNetworks
+	if len(networks) == 0 {
+		return errors.New("no WiFi networks to join")
 	}
-}
+	network := networks[pn.wifiIndex]
 
-func (pn *PicoNet) connectToWifi() {
-	for {
-		startTime := time.Now()
-		pn.logger.Info("Connecting to WiFi", slog.String("ssid", wifiSSID), slog.Int("passwordLen", len(wifiPassword)))
-		err := pn.device.JoinWPA2(wifiSSID, wifiPassword)
-		if err != nil {
-			pn.logger.Error("Connecting to WiFi", slogError(err))
-			time.Sleep(5 * time.Second)
-			continue
+	startTime := time.Now()
+	pn.logger.Info("Connecting to WiFi",
+		slog.String("ssid", network.SSID),
+		slog.Int("passwordLen", len(network.Password)),
+		slog.Int("priority", network.Priority),
+	)
+	err := pn.device.JoinWPA2(network.SSID, network.Password)
+	if err != nil {
+		pn.wifiFailures++
+		if pn.wifiFailures >= pn.config.JoinAttempts && len(networks) > 1 {
+			pn.wifiFailures = 0
+			pn.wifiIndex = (pn.wifiIndex + 1) % len(networks)
+			pn.logger.Warn("Giving up on WiFi network for now",
+				slog.String("ssid", network.SSID),
+				slog.String("next", networks[pn.wifiIndex].SSID),
+			)
 		}
-		pn.logger.Info("Successfully Connected to WiFi", slogTook(startTime))
-		break
+		return fmt.Errorf("connecting to WiFi network %q: %w", network.SSID, err)
 	}
-}
 
-func (pn *PicoNet) createStack() {
-	for {
-		startTime := time.Now()
-
-		pn.logger.Info("Creating the port stack")
-		pn.stack = stacks.NewPortStack(stacks.PortStackConfig{
-			MAC:             pn.picoMAC,
-			MaxOpenPortsUDP: udpPortsCount,
-			MaxOpenPortsTCP: tcpPortsCount,
-			MTU:             mtu,
-			Logger:          pn.logger,
-		})
+	pn.wifiFailures = 0
+	pn.mutex.Lock()
+	pn.ssid = network.SSID
+	pn.mutex.Unlock()
 
-		if pn.stack == nil {
-			pn.logger.Error("Got a nil port stack")
-			time.Sleep(5 * time.Second)
-			continue
-		}
+	pn.logger.Info("Successfully Connected to WiFi", slog.String("ssid", network.SSID), slogTook(startTime))
+	return nil
+}
 
-		pn.device.RecvEthHandle(pn.stack.RecvEth)
-		go pn.nicLoop()
+// createStack creates the port stack and starts the NIC loop, which moves
+// packets between the stack and the WiFi device. This is done only once: the
+// stack survives re-running the stages that come after it.
+func (pn *PicoNet) createStack() error {
+	if pn.stack != nil {
+		return nil
+	}
 
-		pn.logger.Info("Successfully created port stack", slogTook(startTime))
-		break
+	startTime := time.Now()
+	pn.logger.Info("Creating the port stack")
+	stack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             pn.picoMAC,
+		MaxOpenPortsUDP: udpPortsCount,
+		MaxOpenPortsTCP: pn.config.TCPPorts + pn.config.ListenPorts,
+		MTU:             mtu,
+		Logger:          pn.logger,
+	})
+	if stack == nil {
+		return errors.New("got a nil port stack")
 	}
+
+	pn.stack = stack
+	pn.device.RecvEthHandle(pn.recvEth)
+	go pn.nicLoop()
+
+	pn.logger.Info("Successfully created port stack", slogTook(startTime))
+	return nil
 }
 
+// obtainIPAddress gets an IP address (and the rest of the network
+// configuration) via DHCP.
+//
 // TODO: This assumes that we never need to renewal the IP address we received
 // from DHCP. I think this is not correct.
-func (pn *PicoNet) obtainIPAddress() {
-	for {
-		startTime := time.Now()
-		pn.logger.Info("Creating DHCP client")
-		pn.dhcpClient = stacks.NewDHCPClient(pn.stack, dhcp.DefaultClientPort)
-		if pn.dhcpClient == nil {
-			pn.logger.Error("Got a nil DHCP client")
-			time.Sleep(5 * time.Second)
-			continue
-		}
+func (pn *PicoNet) obtainIPAddress() error {
+	// If we are here for a second time, get rid of whatever the previous
+	// attempt left behind. The network may even be a different one now.
+	if pn.dhcpClient != nil {
+		pn.dhcpClient.Abort()
+		pn.stack.CloseUDP(dhcp.DefaultClientPort)
+	}
+	pn.arpCache.clear()
+	pn.dnsCache.clear()
+
+	startTime := time.Now()
+	pn.logger.Info("Creating DHCP client")
+	pn.dhcpClient = stacks.NewDHCPClient(pn.stack, dhcp.DefaultClientPort)
+	if pn.dhcpClient == nil {
+		return errors.New("got a nil DHCP client")
+	}
+	pn.logger.Info("Successfully created DHCP client", slogTook(startTime))
+
+	startTime = time.Now()
+	pn.logger.Info("Starting DHCP request")
+
+	err := pn.dhcpClient.BeginRequest(stacks.DHCPRequestConfig{
+		// The original code set two additional fields here: `RequestedAddr`
+		// and `Hostname`. I am skipping these intentionally. I am not
+		// experienced with DHCP, but from what I saw, `RequestedAddr` is
+		// used when we want to ask for a specific IP address; not our case
+		// here, any will do. And `Hostname` is our own hostname, which the
+		// DHCP server could use for whatever reason, but doesn't make much
+		// sense in this case (I intend to have several devices running the
+		// same firmware, and I don't intend to make things like the host
+		// name configurable).
+		Xid: uint32(time.Now().Nanosecond()),
+	})
+	if err != nil {
+		return fmt.Errorf("starting DHCP request: %w", err)
+	}
+	pn.logger.Info("Successfully started DHCP request", slogTook(startTime))
 
-		pn.logger.Info("Successfully created DHCP client", slogTook(startTime))
-		break
+	startTime = time.Now()
+	const maxPolls = 15
+	for polls := 0; pn.dhcpClient.State() != dhcp.StateBound; polls++ {
+		if polls == maxPolls {
+			return errors.New("DHCP did not complete")
+		}
+		pn.logger.Info("DHCP ongoing...")
+		time.Sleep(time.Second / 2)
 	}
 
-	for {
-		startTime := time.Now()
-		pn.logger.Info("Starting DHCP request")
-
-		err := pn.dhcpClient.BeginRequest(stacks.DHCPRequestConfig{
-			// The original code set two additional fields here: `RequestedAddr`
-			// and `Hostname`. I am skipping these intentionally. I am not
-			// experienced with DHCP, but from what I saw, `RequestedAddr` is
-			// used when we want to ask for a specific IP address; not our case
-			// here, any will do. And `Hostname` is our own hostname, which the
-			// DHCP server could use for whatever reason, but doesn't make much
-			// sense in this case (I intend to have several devices running the
-			// same firmware, and I don't intend to make things like the host
-			// name configurable).
-			Xid: uint32(time.Now().Nanosecond()),
-		})
+	var primaryDNS netip.Addr
+	dnsServers := pn.dhcpClient.DNSServers()
+	if len(dnsServers) > 0 {
+		primaryDNS = dnsServers[0]
+	}
 
-		if err != nil {
-			pn.logger.Error("Starting DHCP request", slogError(err))
-			time.Sleep(5 * time.Second)
-			continue
-		}
+	// We've got an IP address!
+	ip := pn.dhcpClient.Offer()
+	pn.setAddr(ip)
+	pn.setRoute(netip.PrefixFrom(ip, int(pn.dhcpClient.CIDRBits())).Masked(), pn.dhcpClient.Router())
+	pn.publish(Event{Kind: EventIPAcquired, Addr: ip})
+
+	pn.logger.Info("Successfully completed the DHCP request",
+		slog.Uint64("cidrBits", uint64(pn.dhcpClient.CIDRBits())),
+		slog.String("ourIP", ip.String()),
+		slog.String("dns", primaryDNS.String()),
+		slog.String("broadcast", pn.dhcpClient.BroadcastAddr().String()),
+		slog.String("gateway", pn.dhcpClient.Gateway().String()),
+		slog.String("router", pn.dhcpClient.Router().String()),
+		slog.String("dhcp", pn.dhcpClient.DHCPServer().String()),
+		slog.String("hostname", string(pn.dhcpClient.Hostname())),
+		slog.Duration("lease", pn.dhcpClient.IPLeaseTime()),
+		slog.Duration("renewal", pn.dhcpClient.RenewalTime()),
+		slog.Duration("rebinding", pn.dhcpClient.RebindingTime()),
+		slogTook(startTime),
+	)
+	return nil
+}
 
-		pn.logger.Info("Successfully started DHCP request", slogTook(startTime))
-		break
+// configureStaticIP sets our address and routing from PicoNetConfig.StaticIP.
+// This replaces obtainIPAddress when not using DHCP, including in access point
+// mode.
+func (pn *PicoNet) configureStaticIP() error {
+	cfg := pn.config.StaticIP
+	if pn.AddrMode() == AddrModeAccessPoint {
+		cfg = &StaticIPConfig{Addr: apAddr}
+	}
+	ip := cfg.Addr.Addr()
+	if !ip.Is4() || cfg.Addr.Bits() <= 0 {
+		return fmt.Errorf("invalid static address %v: need an IPv4 address with prefix length", cfg.Addr)
+	}
+	if cfg.Gateway.IsValid() && !cfg.Addr.Contains(cfg.Gateway) {
+		return fmt.Errorf("static gateway %v is not in our subnet %v", cfg.Gateway, cfg.Addr.Masked())
 	}
 
-	for {
-		startTime := time.Now()
-
-		const maxRetries = 15
-		retries := maxRetries
-		for pn.dhcpClient.State() != dhcp.StateBound {
-			retries--
-			pn.logger.Info("DHCP ongoing...")
-			if retries == 0 {
-				pn.logger.Error("DHCP did not complete")
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			time.Sleep(time.Second / 2)
-		}
+	pn.arpCache.clear()
+	pn.dnsCache.clear()
 
-		var primaryDNS netip.Addr
-		dnsServers := pn.dhcpClient.DNSServers()
-		if len(dnsServers) > 0 {
-			primaryDNS = dnsServers[0]
-		}
+	pn.setAddr(ip)
+	pn.setRoute(cfg.Addr.Masked(), cfg.Gateway)
+	pn.publish(Event{Kind: EventIPAcquired, Addr: ip})
 
-		// We've got an IP address!
-		ip := pn.dhcpClient.Offer()
-		pn.stack.SetAddr(ip)
-
-		pn.logger.Info("Successfully completed the DHCP request",
-			slog.Uint64("cidrBits", uint64(pn.dhcpClient.CIDRBits())),
-			slog.String("ourIP", ip.String()),
-			slog.String("dns", primaryDNS.String()),
-			slog.String("broadcast", pn.dhcpClient.BroadcastAddr().String()),
-			slog.String("gateway", pn.dhcpClient.Gateway().String()),
-			slog.String("router", pn.dhcpClient.Router().String()),
-			slog.String("dhcp", pn.dhcpClient.DHCPServer().String()),
-			slog.String("hostname", string(pn.dhcpClient.Hostname())),
-			slog.Duration("lease", pn.dhcpClient.IPLeaseTime()),
-			slog.Duration("renewal", pn.dhcpClient.RenewalTime()),
-			slog.Duration("rebinding", pn.dhcpClient.RebindingTime()),
-			slogTook(startTime),
-		)
-		break
-	}
-}
-
-func (pn *PicoNet) configureDNS() {
-	for {
-		startTime := time.Now()
-		pn.logger.Info("Configuring DNS")
+	pn.logger.Info("Configured static IP address",
+		slog.String("ourIP", ip.String()),
+		slog.String("subnet", cfg.Addr.Masked().String()),
+		slog.String("gateway", cfg.Gateway.String()),
+	)
+	return nil
+}
 
-		dnsServers := pn.dhcpClient.DNSServers()
+// dnsServers returns the configured DNS servers. Works on a nil config, too.
+func (cfg *StaticIPConfig) dnsServers() []netip.Addr {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.DNSServers
+}
 
-		if len(dnsServers) == 0 || !dnsServers[0].IsValid() {
-			// This is one case in which retrying is pointless. We do follow the
-			// same pattern, nevertheless, to make error handling consistent.
-			pn.logger.Error("Didn't get any DNS server via DHCP")
-			time.Sleep(5 * time.Second)
-			continue
+// configureDNS sets things up for resolving names, using the DNS servers we got
+// via DHCP or from the static configuration.
+func (pn *PicoNet) configureDNS() error {
+	startTime := time.Now()
+	pn.logger.Info("Configuring DNS")
+
+	var dnsServers []netip.Addr
+	candidates := pn.config.StaticIP.dnsServers()
+	if pn.AddrMode() == AddrModeDHCP {
+		candidates = pn.dhcpClient.DNSServers()
+	}
+	for _, addr := range candidates {
+		if addr.Is4() && !addr.IsUnspecified() {
+			dnsServers = append(dnsServers, addr)
 		}
+	}
+
+	if len(dnsServers) == 0 && len(pn.config.Hosts) == 0 && pn.AddrMode() == AddrModeDHCP {
+		// Retrying this is pointless, as the DHCP response won't change by
+		// itself. That's why this stage has a single attempt and goes
+		// straight to asking DHCP again.
+		return errors.New("didn't get any DNS server via DHCP")
+	}
+	if len(dnsServers) == 0 {
+		pn.logger.Warn("No DNS servers, only the static hosts table and IP addresses will work",
+			slog.String("mode", pn.AddrMode().String()))
+	}
 
+	// Lookups may be going on, if we are here again after losing the link.
+	pn.dnsMutex.Lock()
+	if pn.dnsClient == nil {
 		pn.dnsClient = stacks.NewDNSClient(pn.stack, dns.ClientPort)
-		pn.dnsIP = dnsServers[0]
+	}
+	pn.dnsServers = dnsServers
+	pn.dnsPreferred = 0
+	pn.dnsMutex.Unlock()
 
-		pn.logger.Info("Successfully configured DNS", slogTook(startTime))
-		break
+	servers := make([]string, len(dnsServers))
+	for i, addr := range dnsServers {
+		servers[i] = addr.String()
 	}
+	pn.logger.Info("Successfully configured DNS",
+		slog.String("servers", strings.Join(servers, ",")),
+		slogTook(startTime),
+	)
+	return nil
 }
 
-func (pn *PicoNet) obtainRouterMAC() {
-	for {
-		startTime := time.Now()
-		pn.logger.Info("Obtaining router MAC address")
-
-		var err error
-		pn.routerMAC, err = resolveHardwareAddr(pn.stack, pn.dhcpClient.Router())
-		if err != nil {
-			pn.logger.Error("Obtaining router MAC address", slogError(err))
-			time.Sleep(5 * time.Second)
-			continue
-		}
+// obtainRouterMAC resolves the router MAC address. Strictly speaking this isn't
+// needed, as addresses are resolved on demand anyway, but the router is where
+// most of our packets go, so this warms up the ARP cache and makes sure we can
+// actually talk to it before declaring the network ready.
+func (pn *PicoNet) obtainRouterMAC() error {
+	_, gateway := pn.route()
+	if !gateway.IsValid() {
+		// Can only happen with a static configuration.
+		pn.logger.Warn("No gateway configured, only hosts on our subnet are reachable")
+		return nil
+	}
 
-		pn.logger.Info("Successfully obtained the router MAC address", slogMAC(pn.routerMAC), slogTook(startTime))
-		break
+	startTime := time.Now()
+	pn.logger.Info("Obtaining router MAC address")
+
+	mac, err := pn.hardwareAddrFor(context.Background(), gateway)
+	if err != nil {
+		return fmt.Errorf("obtaining router MAC address: %w", err)
 	}
+
+	pn.logger.Info("Successfully obtained the router MAC address", slogMAC(mac), slogTook(startTime))
+	return nil
 }
 
 //
 // Helpers
 //
 
-func (pn *PicoNet) setStatus(s PicoNetStatus) {
+// setStatus sets the PicoNet status, notifying subscribers if it changed. The
+// reason is the error that caused the change, if any.
+func (pn *PicoNet) setStatus(s PicoNetStatus, reason error) {
 	pn.mutex.Lock()
 	defer pn.mutex.Unlock()
+	prev := pn.status
 	pn.status = s
-}
-
-func (pn *PicoNet) lookupNetIP(host string) ([]netip.Addr, error) {
-	name, err := dns.NewName(host)
-	if err != nil {
-		return nil, err
-	}
-
-	err = pn.dnsClient.StartResolve(pn.dnsConfig(name))
-	if err != nil {
-		return nil, err
+	if s != prev {
+		pn.publishLocked(Event{Kind: EventStatusChanged, Status: s, PrevStatus: prev, Err: reason})
 	}
-	defer pn.stack.CloseUDP(dns.ClientPort)
+}
 
-	time.Sleep(5 * time.Millisecond)
+// setAddr sets our IP address.
+func (pn *PicoNet) setAddr(ip netip.Addr) {
+	pn.stack.SetAddr(ip)
+	pn.mutex.Lock()
+	pn.addr = ip
+	pn.mutex.Unlock()
+}
 
-	// 100 retries with 50ms delays gives us 5s to resolve. Should be more than
-	// enough even with really bad networking.
-	retries := 100
-	for retries > 0 {
-		done, _ := pn.dnsClient.IsDone()
-		if done {
-			break
-		}
-		retries--
-		time.Sleep(50 * time.Millisecond)
-	}
-	done, retCode := pn.dnsClient.IsDone()
-	if !done && retries == 0 {
-		return nil, errors.New("DNS lookup timed out")
-	} else if retCode != dns.RCodeSuccess {
-		return nil, errors.New("DNS lookup failed:" + retCode.String())
-	}
-	answers := pn.dnsClient.Answers()
-	if len(answers) == 0 {
-		return nil, errors.New("no DNS answers")
-	}
-	var addrs []netip.Addr
-	for i := range answers {
-		data := answers[i].RawData()
-		if len(data) == 4 {
-			addrs = append(addrs, netip.AddrFrom4([4]byte(data)))
-		}
-	}
-	if len(addrs) == 0 {
-		return nil, errors.New("no IPv4 DNS answers")
-	}
-	return addrs, nil
+// setRoute sets our subnet and gateway.
+func (pn *PicoNet) setRoute(subnet netip.Prefix, gateway netip.Addr) {
+	pn.mutex.Lock()
+	pn.subnet = subnet
+	pn.gateway = gateway
+	pn.mutex.Unlock()
 }
 
-func (pn *PicoNet) dnsConfig(name dns.Name) stacks.DNSResolveConfig {
-	return stacks.DNSResolveConfig{
-		Questions: []dns.Question{
-			{
-				Name:  name,
-				Type:  dns.TypeA,
-				Class: dns.ClassINET,
-			},
-		},
-		DNSAddr:         pn.dnsIP,     // Send DNS the request to this server...
-		DNSHWAddr:       pn.routerMAC, // ...through our router.
-		EnableRecursion: true,
-	}
+// route returns our subnet and gateway, which are invalid until we have an IP
+// address (and the gateway may stay so, with a static configuration).
+func (pn *PicoNet) route() (subnet netip.Prefix, gateway netip.Addr) {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	return pn.subnet, pn.gateway
 }
 
 func (pn *PicoNet) nicLoop() {
@@ -559,6 +974,11 @@ func (pn *PicoNet) nicLoop() {
 				lenBuf[i] = 0
 				continue
 			}
+			if lenBuf[i] == 0 {
+				// Nothing from the stack; maybe from our own UDP
+				// sockets.
+				lenBuf[i] = pn.nextUDPFrame(buf)
+			}
 			if lenBuf[i] == 0 {
 				break
 			}
@@ -584,6 +1004,9 @@ func (pn *PicoNet) nicLoop() {
 				retries[i]++
 				if retries[i] > maxRetriesBeforeDropping {
 					markSent(i)
+					pn.mutex.Lock()
+					pn.droppedPackets++
+					pn.mutex.Unlock()
 					pn.logger.Error("Dropped outgoing packet in NIC loop", slogError(err))
 				}
 			} else {
@@ -593,208 +1016,27 @@ func (pn *PicoNet) nicLoop() {
 	}
 }
 
-// Pretty bad naming here, and possibly because this function is trying to do
-// too much. Anyway, takes something like "http://example.com/whatever" or
-// "http://192.168.171.171:8080" and returns the important bits in data types we
-// can actually use. And, yes, this includes making a DNS request if necessary.
-func (pn *PicoNet) getUsableAddress(urlStr string) (addrPort netip.AddrPort, host, path string, err error) {
-
-	if !strings.HasPrefix(urlStr, "http://") {
-		err = errors.New("URL must use the http scheme")
-		return
-	}
-
-	u, err := url.Parse(urlStr)
-
-	path = u.Path
-	host = u.Hostname()
-	strPort := u.Port()
-	if strPort == "" {
-		strPort = "80"
-	}
-
-	hostPort := host + ":" + strPort
-
-	uint64Port, err := strconv.ParseUint(strPort, 10, 16)
-	if err != nil {
-		err = fmt.Errorf("resolving %q: %w", host, err)
-		return
-	}
-
-	uint16Port := uint16(uint64Port)
-
-	isIP := net.ParseIP(host) != nil
-	if isIP {
-		addrPort, err = netip.ParseAddrPort(hostPort)
-		return
-	}
-
-	// The passed URL does not use an IP directly, so we need to make a DNS
-	// request.
-	addrs, err := pn.lookupNetIP(host)
-	if err != nil {
-		err = fmt.Errorf("resolving %q: %w", host, err)
-		return
-	}
-
-	// lookupNetIP will return an error if it can't get any IPv4 addresses, so
-	// it's guaranteed that addrs[0] will contain something!
-	addrPort = netip.AddrPortFrom(addrs[0], uint16Port)
-
-	return
-}
-
-func (pn *PicoNet) doRequest(method, urlStr string, reqBody []byte) (resHeader *httpx.ResponseHeader, resBody []byte, err error) {
-	const connTimeout = 5 * time.Second
-	const tcpBufSize = 2030 // MTU - ethhdr - iphdr - tcphdr
-
-	addrPort, host, path, err := pn.getUsableAddress(urlStr)
-	if err != nil {
-		pn.logger.Error("Preparing request", slogError(err))
-		return nil, nil, err
-	}
-
-	// Create the TCP connection, set this up so it gets closed eventually.
-	clientAddr := netip.AddrPortFrom(pn.stack.Addr(), uint16(rand.Intn(65535-1024)+1024))
-	conn, err := stacks.NewTCPConn(pn.stack, stacks.TCPConnConfig{
-		TxBufSize: tcpBufSize,
-		RxBufSize: tcpBufSize,
-	})
-
-	if err != nil {
-		panic("conn create:" + err.Error())
-	}
-
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			pn.logger.Error("Closing TCP connection", slogError(err))
-			return
-		}
-		for !conn.State().IsClosed() {
-			pn.logger.Info("Waiting for TCP connection to close", slog.String("state", conn.State().String()))
-			time.Sleep(1000 * time.Millisecond)
-		}
-		pn.logger.Info("TCP connection closed")
-	}()
-
-	// Here we create the HTTP request and generate the bytes. The Header method
-	// returns the raw header bytes as should be sent over the wire.
-	var req httpx.RequestHeader
-	req.SetRequestURI(path)
-
-	req.SetMethod(method)
-	req.SetHost(host)
-	reqBytes := req.Header()
-	reqBytes = append(reqBytes, resBody...)
-
-	pn.logger.Info("TCP connection ready, now dialing",
-		slog.String("clientAddr", clientAddr.String()),
-		slog.String("serverAddr", urlStr),
-		slog.String("serverIPPort", addrPort.String()),
-	)
-
-	// Make sure to timeout the connection if it takes too long.
-	conn.SetDeadline(time.Now().Add(connTimeout))
-	err = conn.OpenDialTCP(clientAddr.Port(), pn.routerMAC, addrPort, seqs.Value(rand.Intn(65535-1024)+1024))
-	if err != nil {
-		pn.logger.Error("Opening TCP connection", slogError(err))
-		return nil, nil, fmt.Errorf("opening TCP connection: %w", err)
-	}
-
-	retries := 50
-	for conn.State() != seqs.StateEstablished && retries > 0 {
-		time.Sleep(100 * time.Millisecond)
-		retries--
-	}
-
-	if retries == 0 {
-		pn.logger.Error("Retry limit exceeded opening TCP connection")
-		return nil, nil, errors.New("retry limit exceeded opening TCP connection")
-	}
-
-	// Send the request.
-	conn.SetDeadline(time.Now().Add(3 * connTimeout))
-	_, err = conn.Write(reqBytes)
-	if err != nil {
-		pn.logger.Error("Writing request", slogError(err))
-		return nil, nil, fmt.Errorf("writing request: %w", err)
-	}
-
-	// Read the response; first the headers...
-	conn.SetDeadline(time.Now().Add(connTimeout))
-	br := bufio.NewReader(conn)
-
-	resHeader = &httpx.ResponseHeader{}
-	err = resHeader.Hdr.Read(br)
-	if err != nil {
-		pn.logger.Error("Reading response", slogError(err))
-		return nil, nil, fmt.Errorf("reading response: %w", err)
-	}
-
-	// ...then read the body.
-	resBody = make([]byte, resHeader.Hdr.ContentLength())
-	_, err = io.ReadFull(br, resBody)
-	if err != nil {
-		pn.logger.Error("Reading response body", slogError(err))
-		return nil, nil, err
-	}
-
-	return resHeader, resBody, nil
-}
-
-func (pn *PicoNet) translateHeaders(resHeader *httpx.ResponseHeader, resBody []byte) (resp *Response, err error) {
-	// These mappings between `resHeader` and `res` look completely nuts, I know.
-	// It turns out that the low-level networking code I am using (the `seqs`
-	// library) seems to be in a very early stage of development, and therefore
-	// it can't properly parse HTTP responses. What I am doing in `doRequest()`
-	// is effectively to parse the HTTP response as if it were an HTTP request,
-	// and then reading the information I want from the request fields that by
-	// coincidence match the wanted response fields.
-	statusCode, err := strconv.ParseInt(string(resHeader.Hdr.RequestURI()), 10, 32)
-	if err != nil {
-		pn.logger.Warn("Parsing HTTP status code", slogError(err))
-		statusCode = 0
-	}
-
-	res := &Response{
-		Status:        string(resHeader.Hdr.RequestURI()) + " " + string(resHeader.Hdr.Protocol()),
-		StatusCode:    int(statusCode),
-		Proto:         string(resHeader.Hdr.Method()),
-		Headers:       resHeader.Hdr.GetAll(),
-		ContentLength: resHeader.Hdr.ContentLength(),
-		Body:          resBody,
+// sleepCtx sleeps for the given duration, or until ctx is done, whatever
+// happens first. Returns a non-nil error (see ctxError) if ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctxError(ctx)
+	case <-timer.C:
+		return nil
 	}
-
-	return res, nil
 }
 
-// resolveHardwareAddr obtains the hardware address of the given IP address.
-func resolveHardwareAddr(stack *stacks.PortStack, ip netip.Addr) ([6]byte, error) {
-	if !ip.IsValid() {
-		return [6]byte{}, errors.New("invalid ip")
-	}
-	arpClient := stack.ARP()
-	arpClient.Abort() // Remove any previous ARP requests.
-	err := arpClient.BeginResolve(ip)
-	if err != nil {
-		return [6]byte{}, err
-	}
-	time.Sleep(4 * time.Millisecond)
-
-	// ARP exchanges should be fast, don't wait too long for them.
-	const timeout = time.Second
-	const maxRetries = 20
-	retries := maxRetries
-	for !arpClient.IsDone() && retries > 0 {
-		retries--
-		if retries == 0 {
-			return [6]byte{}, errors.New("arp timed out")
-		}
-		time.Sleep(timeout / maxRetries)
+// ctxError returns the error to report when ctx is done: something wrapping
+// ErrTimeout if its deadline has passed, or the cancellation error otherwise.
+func ctxError(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
 	}
-	_, hw, err := arpClient.ResultAs6()
-	return hw, err
+	return err
 }
 
 //
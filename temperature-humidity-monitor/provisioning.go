@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"simple-minded-home/thm/internal/aggregate"
+	"simple-minded-home/thm/internal/httpwire"
+)
+
+//
+// Provisioning. On the first boot (or when asked to, with a long button press)
+// we don't know which WiFi network to join, nor where to send our readings. So
+// we create our own WiFi network and serve a little web form where the user can
+// tell us. Once the settings are saved, we reboot and join the network like
+// normal.
+//
+// This isn't quite a proper captive portal: that would need a DNS server
+// answering every query with our address, and the network stack gives us no way
+// to write one. So the user has to open http://192.168.1.1 by hand. The display
+// says so.
+//
+
+const (
+	// provisioningSSID is the SSID of the network we create for provisioning.
+	provisioningSSID = "thm-setup"
+
+	// provisioningPort is the TCP port on which the form is served.
+	provisioningPort = 80
+
+	// provisioningRebootDelay is how long we wait between saving the settings
+	// and rebooting, so that the browser has a chance to get our response.
+	provisioningRebootDelay = 3 * time.Second
+)
+
+// runProvisioning serves the provisioning form on pn, which must be in access
+// point mode. current are the settings the form starts with (from a previous
+// provisioning, or empty). Once the user submits valid settings, they are
+// passed to save, and then reboot is called. Meant to run in its own goroutine;
+// returns only if something goes wrong or if reboot returns.
+func runProvisioning(logger *slog.Logger, pn *PicoNet, current Settings, save func(Settings) error, reboot func()) {
+	for pn.Status() != StatusReadyToGo {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	l, err := pn.Listen(provisioningPort)
+	if err != nil {
+		logger.Error("Listening for provisioning requests", slogError(err))
+		return
+	}
+
+	p := newProvisioner(current, save)
+	go func() {
+		err := serveHTTP(l, logger, p.handle)
+		logger.Error("Provisioning server stopped", slogError(err))
+	}()
+
+	logger.Info("Provisioning form ready", slog.String("url", fmt.Sprintf("http://%v/", apAddr.Addr())))
+	<-p.saved
+
+	logger.Info("Settings saved, rebooting")
+	time.Sleep(provisioningRebootDelay)
+	reboot()
+}
+
+// randomAPPassword returns a random password for the provisioning network. It
+// is made of digits only, as it has to be typed on a phone after reading it
+// from the display.
+func randomAPPassword() (string, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = '0' + b[i]%10
+	}
+	return string(b[:]), nil
+}
+
+// provisioner handles the requests to the provisioning form. It knows nothing
+// about networks or flash memory, so that it can be exercised anywhere.
+type provisioner struct {
+	// mutex protects everything below. Requests may be handled concurrently.
+	mutex sync.Mutex
+
+	// current are the settings shown in the form.
+	current Settings
+
+	// save stores the settings submitted by the user.
+	save func(Settings) error
+
+	// saved is closed once valid settings have been saved.
+	saved chan struct{}
+
+	// done tells if saved is already closed.
+	done bool
+}
+
+// newProvisioner creates a new provisioner showing current settings and saving
+// new ones with save.
+func newProvisioner(current Settings, save func(Settings) error) *provisioner {
+	return &provisioner{
+		current: current,
+		save:    save,
+		saved:   make(chan struct{}),
+	}
+}
+
+// handle handles a request to the provisioning server. Every path gets the
+// form, which is handy when the phone insists on opening some page of its own
+// choosing.
+func (p *provisioner) handle(req *httpwire.Request) *serverResponse {
+	if req.URL.Path == "/favicon.ico" {
+		return textResponse(404, "Not found")
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return formResponse(200, p.current, "")
+	case "POST":
+		return p.submit(req)
+	default:
+		res := textResponse(405, "Method not allowed")
+		res.Header.Set("Allow", "GET, HEAD, POST")
+		return res
+	}
+}
+
+// submit handles the submission of the provisioning form.
+func (p *provisioner) submit(req *httpwire.Request) *serverResponse {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	form, err := url.ParseQuery(string(req.Body))
+	if err != nil {
+		return formResponse(400, p.current, "Could not read the form. Please try again.")
+	}
+
+	s := Settings{
+		ServerURL:   strings.TrimSpace(form.Get("server")),
+		Location:    strings.TrimSpace(form.Get("location")),
+		MQTTURL:     strings.TrimSpace(form.Get("mqtt")),
+		WebhookURL:  strings.TrimSpace(form.Get("webhook")),
+		InfluxURL:   strings.TrimSpace(form.Get("influx")),
+		LogReadings: form.Get("log") != "",
+	}
+
+	// The WiFi networks come in numbered rows, and empty rows are skipped.
+	// SSIDs aren't trimmed: spaces are fair game in them.
+	passwordless := false
+	for i := 1; i <= maxWiFiNetworks; i++ {
+		n := strconv.Itoa(i)
+		network := WiFiNetwork{SSID: form.Get("ssid" + n), Password: form.Get("password" + n)}
+		if network.SSID == "" {
+			passwordless = passwordless || network.Password != ""
+			continue
+		}
+		s.WiFiNetworks = append(s.WiFiNetworks, network)
+	}
+	if passwordless {
+		return formResponse(400, s, "Please fix this: there is a WiFi password without a network name.")
+	}
+	if window := strings.TrimSpace(form.Get("window")); window != "" {
+		minutes, err := strconv.Atoi(window)
+		if err != nil {
+			return formResponse(400, s, "Please fix this: the upload window must be a number of minutes.")
+		}
+		s.UploadWindow = time.Duration(minutes) * time.Minute
+	}
+	if delta := strings.TrimSpace(form.Get("tdelta")); delta != "" {
+		s.TemperatureDelta, err = strconv.ParseFloat(delta, 64)
+		if err != nil {
+			return formResponse(400, s, "Please fix this: the temperature change to report must be a number.")
+		}
+	}
+	if delta := strings.TrimSpace(form.Get("hdelta")); delta != "" {
+		s.HumidityDelta, err = strconv.ParseFloat(delta, 64)
+		if err != nil {
+			return formResponse(400, s, "Please fix this: the humidity change to report must be a number.")
+		}
+	}
+	if heartbeat := strings.TrimSpace(form.Get("heartbeat")); heartbeat != "" {
+		minutes, err := strconv.Atoi(heartbeat)
+		if err != nil {
+			return formResponse(400, s, "Please fix this: the longest time without reporting must be a number of minutes.")
+		}
+		s.ReportHeartbeat = time.Duration(minutes) * time.Minute
+	}
+
+	// We never send the WiFi passwords back to the browser, so an empty one
+	// means "keep the one we have" -- as long as we know the network, in
+	// whichever row it was.
+	for i := range s.WiFiNetworks {
+		network := &s.WiFiNetworks[i]
+		if network.Password != "" {
+			continue
+		}
+		for _, current := range p.current.WiFiNetworks {
+			if current.SSID == network.SSID {
+				network.Password = current.Password
+			}
+		}
+	}
+
+	// Same for the MQTT password and the InfluxDB token, which go back to the
+	// browser redacted.
+	s.MQTTURL = unredactURL(s.MQTTURL, p.current.MQTTURL)
+	s.InfluxURL = unredactURL(s.InfluxURL, p.current.InfluxURL)
+
+	err = s.validate()
+	if err != nil {
+		return formResponse(400, s, "Please fix this: "+err.Error()+".")
+	}
+
+	err = p.save(s)
+	if err != nil {
+		return formResponse(500, s, "Could not save the settings: "+err.Error()+".")
+	}
+
+	p.current = s
+	if !p.done {
+		p.done = true
+		close(p.saved)
+	}
+	return htmlResponse(200, savedPage)
+}
+
+// htmlResponse returns an HTML response with the given status code.
+func htmlResponse(statusCode int, html string) *serverResponse {
+	res := &serverResponse{
+		StatusCode: statusCode,
+		Header:     httpwire.Header{},
+		Body:       []byte(html),
+	}
+	res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	res.Header.Set("Cache-Control", "no-store")
+	return res
+}
+
+// formResponse returns the provisioning form, filled with s, and with an error
+// message if msg is not empty.
+func formResponse(statusCode int, s Settings, msg string) *serverResponse {
+	var b strings.Builder
+	b.WriteString(pageHead)
+	if msg != "" {
+		b.WriteString(`<p class="err">` + htmlEscape(msg) + "</p>\n")
+	}
+
+	uploadWindow := ""
+	if s.UploadWindow != 0 {
+		uploadWindow = strconv.Itoa(int(s.UploadWindow / time.Minute))
+	}
+
+	temperatureDelta, humidityDelta, heartbeat := "", "", ""
+	if s.TemperatureDelta != 0 {
+		temperatureDelta = strconv.FormatFloat(s.TemperatureDelta, 'f', -1, 64)
+	}
+	if s.HumidityDelta != 0 {
+		humidityDelta = strconv.FormatFloat(s.HumidityDelta, 'f', -1, 64)
+	}
+	if s.ReportHeartbeat != 0 {
+		heartbeat = strconv.Itoa(int(s.ReportHeartbeat / time.Minute))
+	}
+
+	logChecked := ""
+	if s.LogReadings {
+		logChecked = " checked"
+	}
+
+	b.WriteString(`<form method="post" action="/">
+`)
+	for i := 0; i < maxWiFiNetworks; i++ {
+		var network WiFiNetwork
+		if i < len(s.WiFiNetworks) {
+			network = s.WiFiNetworks[i]
+		}
+		n := strconv.Itoa(i + 1)
+		name, passwordName, required := "WiFi network", "WiFi password", " required"
+		if i > 0 {
+			name, passwordName, required = "WiFi network "+n+" (optional, tried next)", "WiFi network "+n+" password", ""
+		}
+		passwordHint := ""
+		if network.Password != "" {
+			passwordHint = "(unchanged)"
+		}
+		b.WriteString(`<label>` + name + `<input name="ssid` + n + `" maxlength="32"` + required + ` value="` + htmlEscape(network.SSID) + `"></label>
+<label>` + passwordName + `<input name="password` + n + `" type="password" maxlength="63" placeholder="` + passwordHint + `"></label>
+`)
+	}
+	b.WriteString(`<label>Server URL (optional)<input name="server" type="url" maxlength="255" placeholder="found automatically" value="` + htmlEscape(s.ServerURL) + `"></label>
+<label>Location (optional)<input name="location" maxlength="64" placeholder="Living room" value="` + htmlEscape(s.Location) + `"></label>
+<label>Upload window, in minutes<input name="window" type="number" min="1" max="60" placeholder="` + strconv.Itoa(int(aggregate.DefaultWindow/time.Minute)) + `" value="` + uploadWindow + `"></label>
+<label>Report temperature changes over, in °C<input name="tdelta" type="number" min="0.1" max="25.5" step="0.1" placeholder="` + strconv.FormatFloat(defaultTemperatureDelta, 'f', -1, 64) + `" value="` + temperatureDelta + `"></label>
+<label>Report humidity changes over, in %<input name="hdelta" type="number" min="0.1" max="25.5" step="0.1" placeholder="` + strconv.FormatFloat(defaultHumidityDelta, 'f', -1, 64) + `" value="` + humidityDelta + `"></label>
+<label>Report at least every, in minutes<input name="heartbeat" type="number" min="1" max="255" placeholder="` + strconv.Itoa(int(defaultReportHeartbeat/time.Minute)) + `" value="` + heartbeat + `"></label>
+<label>MQTT broker (optional)<input name="mqtt" maxlength="255" placeholder="mqtt://192.168.1.10:1883" value="` + htmlEscape(redactURL(s.MQTTURL)) + `"></label>
+<label>Webhook URL (optional)<input name="webhook" type="url" maxlength="255" placeholder="http://192.168.1.10:8123/api/webhook/thm" value="` + htmlEscape(s.WebhookURL) + `"></label>
+<label>InfluxDB write URL (optional)<input name="influx" maxlength="255" placeholder="http://192.168.1.10:8086/write?db=thm" value="` + htmlEscape(redactURL(s.InfluxURL)) + `"></label>
+<label><input name="log" type="checkbox"` + logChecked + `> Log readings to the serial console</label>
+<button>Save and reboot</button>
+</form>
+</body>
+</html>
+`)
+	return htmlResponse(statusCode, b.String())
+}
+
+// redactURL returns rawURL with its password, if any, replaced by "xxxxx".
+// Anything that doesn't parse is returned as is.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// unredactURL undoes redactURL: if rawURL has the redacted password and
+// current has a password, returns rawURL with the password from current.
+// Otherwise, returns rawURL unchanged. This way the user can edit other parts
+// of the URL without typing the password again.
+func unredactURL(rawURL, current string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if pass, ok := u.User.Password(); !ok || pass != "xxxxx" {
+		return rawURL
+	}
+	cur, err := url.Parse(current)
+	if err != nil || cur.User == nil {
+		return rawURL
+	}
+	if pass, ok := cur.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), pass)
+		return u.String()
+	}
+	return rawURL
+}
+
+// pageHead is the start of every page we serve during provisioning.
+const pageHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Sensor setup</title>
+<style>body{font-family:sans-serif;max-width:24em;margin:1em auto;padding:0 1em}label{display:block;margin:1em 0}input{display:block;width:100%;box-sizing:border-box;padding:.4em}input[type=checkbox]{display:inline;width:auto}button{padding:.6em 1.2em}.err{color:#b00}</style>
+</head>
+<body>
+<h1>Sensor setup</h1>
+`
+
+// savedPage is the page we serve after saving the settings.
+const savedPage = pageHead + `<p>Settings saved! The sensor will now reboot and join your WiFi network.</p>
+</body>
+</html>
+`
+
+// htmlEscaper escapes text to be placed in HTML, including attribute values.
+// We don't use the html package because it drags along a huge table of
+// character entities, which we don't need and the flash could do without.
+var htmlEscaper = strings.NewReplacer(
+	`&`, "&amp;",
+	`<`, "&lt;",
+	`>`, "&gt;",
+	`"`, "&#34;",
+	`'`, "&#39;",
+)
+
+// htmlEscape escapes s to be placed in HTML.
+func htmlEscape(s string) string {
+	return htmlEscaper.Replace(s)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Sensor readings: the latest one, what we can derive from it, how much we
+// trust it, and a short history of past readings.
+//
+
+const (
+	// sensorReadInterval is how often we read the sensor. The DHT22 can't be
+	// read more often than every two seconds anyway.
+	sensorReadInterval = 5 * time.Second
+
+	// staleAfter is how old the latest good reading can get before we flag it
+	// as stale. A few failed reads in a row are normal for the DHT22, so we
+	// give it some slack.
+	staleAfter = 4 * sensorReadInterval
+
+	// historyInterval is the time between samples in the history.
+	historyInterval = time.Minute
+
+	// historySize is the number of samples in the history: three hours worth
+	// of them, at some 40 bytes each.
+	historySize = 180
+)
+
+// DHT22 measurement range, according to its datasheet. Anything outside this
+// is garbage.
+const (
+	minValidTemperature = -40
+	maxValidTemperature = 80
+	minValidHumidity    = 0
+	maxValidHumidity    = 100
+)
+
+// ReadingFlags tell how much we can trust a reading.
+type ReadingFlags uint8
+
+const (
+	// FlagSensorError means the most recent attempt to read the sensor
+	// failed, so the values are from an earlier reading (or zero if we never
+	// got one).
+	FlagSensorError ReadingFlags = 1 << iota
+
+	// FlagStale means the values are older than they should be, because the
+	// sensor hasn't been read successfully for a while.
+	FlagStale
+
+	// FlagOutOfRange means the values are outside what the sensor can
+	// measure, which usually means a bad reading that got past the checksum.
+	FlagOutOfRange
+
+	// FlagNoReading means we never got a good reading at all.
+	FlagNoReading
+)
+
+// readingFlagNames are the names of the flags, in bit order.
+var readingFlagNames = []string{"sensor_error", "stale", "out_of_range", "no_reading"}
+
+// Names returns the names of the flags that are set.
+func (f ReadingFlags) Names() []string {
+	names := []string{}
+	for i, name := range readingFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (f ReadingFlags) String() string {
+	return strings.Join(f.Names(), ",")
+}
+
+// Reading is a temperature and humidity reading.
+type Reading struct {
+	// Time is when the reading was taken, according to the local clock.
+	Time time.Time
+
+	// Temperature is in degrees Celsius.
+	Temperature float32
+
+	// Humidity is the relative humidity, in percent.
+	Humidity float32
+
+	// Flags tell how much we can trust the reading.
+	Flags ReadingFlags
+}
+
+// DewPoint returns the dew point in degrees Celsius, using the Magnus formula.
+// Returns NaN if the humidity is zero, as there's no dew point then.
+func (r Reading) DewPoint() float64 {
+	if r.Humidity <= 0 {
+		return math.NaN()
+	}
+	const a, b = 17.62, 243.12
+	t := float64(r.Temperature)
+	gamma := math.Log(float64(r.Humidity)/100) + a*t/(b+t)
+	return b * gamma / (a - gamma)
+}
+
+// AbsoluteHumidity returns the absolute humidity in grams of water per cubic
+// meter of air.
+func (r Reading) AbsoluteHumidity() float64 {
+	t := float64(r.Temperature)
+	saturation := 6.112 * math.Exp(17.67*t/(t+243.5)) // hPa
+	return saturation * float64(r.Humidity) * 2.1674 / (273.15 + t)
+}
+
+// sensorReadings keeps track of the sensor readings. Safe for concurrent use.
+type sensorReadings struct {
+	// mutex protects everything below.
+	mutex sync.Mutex
+
+	// latest is the most recent good reading.
+	latest Reading
+
+	// lastErr tells if the most recent attempt to read the sensor failed.
+	lastErr bool
+
+	// errors is how many times reading the sensor failed since boot.
+	errors int
+
+	// history is a ring buffer of past readings. historyNext is the index
+	// of the next sample to write, and historyLen the number of samples in
+	// it.
+	history     [historySize]Reading
+	historyNext int
+	historyLen  int
+}
+
+// readings are the sensor readings.
+var readings sensorReadings
+
+// record records the result of an attempt to read the sensor at the given time.
+func (sr *sensorReadings) record(now time.Time, temperature, humidity float32, err error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if err != nil {
+		sr.errors++
+		sr.lastErr = true
+		return
+	}
+	sr.lastErr = false
+
+	r := Reading{Time: now, Temperature: temperature, Humidity: humidity}
+	if temperature < minValidTemperature || temperature > maxValidTemperature ||
+		humidity < minValidHumidity || humidity > maxValidHumidity {
+		r.Flags |= FlagOutOfRange
+	}
+	sr.latest = r
+
+	// One sample per interval is plenty for the history.
+	if r.Flags == 0 && (sr.historyLen == 0 || now.Sub(sr.lastSampleLocked().Time) >= historyInterval) {
+		sr.history[sr.historyNext] = r
+		sr.historyNext = (sr.historyNext + 1) % historySize
+		sr.historyLen = min(sr.historyLen+1, historySize)
+	}
+}
+
+// lastSampleLocked returns the most recent sample in the history, which must
+// not be empty. Must be called with the mutex held.
+func (sr *sensorReadings) lastSampleLocked() Reading {
+	return sr.history[(sr.historyNext+historySize-1)%historySize]
+}
+
+// Latest returns the latest reading, with flags telling how much to trust it
+// right now.
+func (sr *sensorReadings) Latest(now time.Time) Reading {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	r := sr.latest
+	if r.Time.IsZero() {
+		r.Flags |= FlagNoReading
+	} else if now.Sub(r.Time) > staleAfter {
+		r.Flags |= FlagStale
+	}
+	if sr.lastErr {
+		r.Flags |= FlagSensorError
+	}
+	return r
+}
+
+// History returns the readings in the history, oldest first.
+func (sr *sensorReadings) History() []Reading {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	h := make([]Reading, sr.historyLen)
+	start := (sr.historyNext - sr.historyLen + historySize) % historySize
+	for i := range h {
+		h[i] = sr.history[(start+i)%historySize]
+	}
+	return h
+}
+
+// Errors returns how many times reading the sensor failed since boot.
+func (sr *sensorReadings) Errors() int {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	return sr.errors
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth/dns"
+	"github.com/soypat/seqs/stacks"
+)
+
+//
+// DNS resolution. The stack gives us a bare-bones DNS client that sends one
+// query and decodes (part of) the response. On top of that we try every DNS
+// server we got from DHCP, follow CNAMEs, and cache the results, so that we
+// don't have to bother any DNS server for every single request.
+//
+
+const (
+	// dnsCacheSize is the maximum number of host names in the DNS cache.
+	dnsCacheSize = 16
+
+	// maxDNSCacheTTL caps how long we keep a DNS answer, whatever its TTL
+	// says. Just in case some server tells us to keep it for a month.
+	maxDNSCacheTTL = time.Hour
+
+	// maxCNAMEChain is the maximum number of CNAMEs we follow for a single
+	// lookup. Real-world chains are much shorter than this; longer ones are
+	// probably loops.
+	maxCNAMEChain = 8
+)
+
+// errNoSuchHost is returned (wrapped in ErrDNS) when a DNS server tells us the
+// name doesn't exist. Asking other servers is pointless in this case.
+var errNoSuchHost = errors.New("no such host")
+
+// dnsAnswer is what we got from a DNS query: either some addresses or a CNAME
+// to follow.
+type dnsAnswer struct {
+	addrs []netip.Addr
+	cname string
+	ttl   time.Duration
+}
+
+// lookupNetIP returns the IPv4 addresses of host. It checks the static hosts
+// table and the cache first, and only then asks DNS.
+func (pn *PicoNet) lookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = normalizeHostName(host)
+	if addr, ok := pn.config.Hosts[host]; ok {
+		return []netip.Addr{addr}, nil
+	}
+	if addrs, ok := pn.dnsCache.lookup(host, time.Now()); ok {
+		return addrs, nil
+	}
+
+	pn.dnsMutex.Lock()
+	defer pn.dnsMutex.Unlock()
+
+	// Someone else may have resolved the same name while we waited for the
+	// mutex.
+	if addrs, ok := pn.dnsCache.lookup(host, time.Now()); ok {
+		return addrs, nil
+	}
+
+	startTime := time.Now()
+	name := host
+	ttl := maxDNSCacheTTL
+	for range maxCNAMEChain {
+		answer, err := pn.queryA(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ttl = min(ttl, answer.ttl)
+
+		if answer.cname == "" {
+			if ttl > 0 {
+				pn.dnsCache.store(host, answer.addrs, time.Now().Add(ttl))
+			}
+			pn.logger.Info("Resolved host name",
+				slog.String("host", host),
+				slog.String("addr", answer.addrs[0].String()),
+				slog.Duration("ttl", ttl),
+				slogTook(startTime),
+			)
+			return answer.addrs, nil
+		}
+
+		pn.logger.Info("Following CNAME", slog.String("from", name), slog.String("to", answer.cname))
+		name = answer.cname
+	}
+
+	return nil, fmt.Errorf("%w: CNAME chain for %s is too long", ErrDNS, host)
+}
+
+// queryA asks the DNS servers for the A records of name. Servers are tried in
+// turn, starting with the one that answered last time, until one of them gives
+// a proper answer. Must be called with dnsMutex held.
+func (pn *PicoNet) queryA(ctx context.Context, name string) (dnsAnswer, error) {
+	if len(pn.dnsServers) == 0 {
+		return dnsAnswer{}, fmt.Errorf("%w: no DNS servers", ErrDNS)
+	}
+
+	var err error
+	for i := range pn.dnsServers {
+		idx := (pn.dnsPreferred + i) % len(pn.dnsServers)
+		server := pn.dnsServers[idx]
+
+		var answer dnsAnswer
+		answer, err = pn.queryServer(ctx, server, name)
+		if err == nil {
+			pn.dnsPreferred = idx
+			return answer, nil
+		}
+		if errors.Is(err, errNoSuchHost) || ctx.Err() != nil {
+			return dnsAnswer{}, err
+		}
+		pn.logger.Warn("DNS query failed",
+			slog.String("server", server.String()),
+			slog.String("name", name),
+			slogError(err),
+		)
+	}
+	return dnsAnswer{}, err
+}
+
+// queryServer asks a single DNS server for the A records of name.
+func (pn *PicoNet) queryServer(ctx context.Context, server netip.Addr, name string) (dnsAnswer, error) {
+	qname, err := dns.NewName(name)
+	if err != nil {
+		return dnsAnswer{}, fmt.Errorf("%w: %w", ErrDNS, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pn.config.DNSTimeout)
+	defer cancel()
+
+	serverMAC, err := pn.hardwareAddrFor(ctx, server)
+	if err != nil {
+		return dnsAnswer{}, fmt.Errorf("%w: %w", ErrDNS, err)
+	}
+
+	err = pn.dnsClient.StartResolve(dnsConfig(qname, server, serverMAC))
+	if err != nil {
+		return dnsAnswer{}, fmt.Errorf("%w: %w", ErrDNS, err)
+	}
+	defer pn.stack.CloseUDP(dns.ClientPort)
+
+	time.Sleep(5 * time.Millisecond)
+	for {
+		done, _ := pn.dnsClient.IsDone()
+		if done {
+			break
+		}
+		err = sleepCtx(ctx, 50*time.Millisecond)
+		if err != nil {
+			pn.dnsClient.Abort()
+			if errors.Is(err, ErrTimeout) {
+				pn.forgetRoute(server)
+			}
+			return dnsAnswer{}, fmt.Errorf("%w: %w", ErrDNS, err)
+		}
+	}
+
+	_, retCode := pn.dnsClient.IsDone()
+	switch retCode {
+	case dns.RCodeSuccess:
+	case dns.RCodeNameError:
+		return dnsAnswer{}, fmt.Errorf("%w: %s: %w", ErrDNS, name, errNoSuchHost)
+	default:
+		return dnsAnswer{}, fmt.Errorf("%w: %s", ErrDNS, retCode.String())
+	}
+
+	return parseDNSAnswers(qname, pn.dnsClient.Answers())
+}
+
+// parseDNSAnswers extracts what we care about from the answers to an A query
+// for qname.
+//
+// The stack decodes only the first answer (or the first few, depending on how
+// its buffers have grown). When the name is an alias, the server usually sends
+// the whole chain, CNAME first, so quite often all we see is the CNAME. That's
+// fine: we just follow it with another query.
+func parseDNSAnswers(qname dns.Name, answers []dns.Resource) (dnsAnswer, error) {
+	var answer dnsAnswer
+	ttl := uint32(maxDNSCacheTTL / time.Second)
+	for i := range answers {
+		data := answers[i].RawData()
+		switch answers[i].Header.Type {
+		case dns.TypeA:
+			if len(data) != 4 {
+				continue
+			}
+			answer.addrs = append(answer.addrs, netip.AddrFrom4([4]byte(data)))
+		case dns.TypeCNAME:
+			if answer.cname != "" {
+				continue
+			}
+			cname, err := decodeCNAME(qname, data, i == 0)
+			if err != nil {
+				return dnsAnswer{}, fmt.Errorf("%w: decoding CNAME: %w", ErrDNS, err)
+			}
+			answer.cname = cname
+		default:
+			continue
+		}
+		ttl = min(ttl, answers[i].Header.TTL)
+	}
+	answer.ttl = time.Duration(ttl) * time.Second
+
+	switch {
+	case len(answer.addrs) > 0:
+		// If we got the addresses, no need to follow any CNAME.
+		answer.cname = ""
+		return answer, nil
+	case answer.cname != "":
+		return answer, nil
+	default:
+		return dnsAnswer{}, fmt.Errorf("%w: no IPv4 DNS answers", ErrDNS)
+	}
+}
+
+// decodeCNAME decodes the name in the data of a CNAME record received in
+// response to a query for qname.
+//
+// This is trickier than it should be. The target name is usually compressed,
+// which means it points to names elsewhere in the message (typically, to the
+// question). But all the stack gives us is the record data, not the whole
+// message. So, for the first answer, we rebuild the start of the message as the
+// server most likely sent it (header, question, and an answer whose name points
+// back to the question) and decode the target within that. For other answers,
+// we can only handle uncompressed names.
+func decodeCNAME(qname dns.Name, data []byte, firstAnswer bool) (string, error) {
+	msg := []byte{}
+	if firstAnswer {
+		msg = make([]byte, dns.SizeHeader, dns.SizeHeader+int(qname.Len())+16+len(data))
+		msg, _ = qname.AppendTo(msg)
+		msg = append(msg, 0, 0, 0, 0) // Question type and class.
+		msg = append(msg, 0xc0, dns.SizeHeader)
+		msg = append(msg, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0) // Rest of the resource header.
+	}
+	off := len(msg)
+	msg = append(msg, data...)
+
+	var target dns.Name
+	_, err := target.Decode(msg, uint16(off))
+	if err != nil {
+		return "", err
+	}
+	cname := normalizeHostName(target.String())
+	if cname == "" {
+		return "", errors.New("empty CNAME")
+	}
+	return cname, nil
+}
+
+// dnsConfig returns the configuration for a DNS query for name to the given
+// server, whose packets go to serverMAC.
+func dnsConfig(name dns.Name, server netip.Addr, serverMAC [6]byte) stacks.DNSResolveConfig {
+	return stacks.DNSResolveConfig{
+		Questions: []dns.Question{
+			{
+				Name:  name,
+				Type:  dns.TypeA,
+				Class: dns.ClassINET,
+			},
+		},
+		DNSAddr:         server,    // Send DNS the request to this server...
+		DNSHWAddr:       serverMAC, // ...through this hop (the router, unless the server is on our subnet).
+		EnableRecursion: true,
+	}
+}
+
+// normalizeHostName returns host in the form we use for lookups and cache keys:
+// lower case, without the trailing dot.
+func normalizeHostName(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
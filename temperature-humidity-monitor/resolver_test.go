@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// Run with -race: the DNS servers are set again when the network is
+// re-initialized after losing the WiFi link, while other goroutines resolve
+// names.
+func TestConfigureDNSConcurrentLookups(t *testing.T) {
+	pn := newTestPicoNet("192.168.1.10", 1)
+	pn.config = PicoNetConfig{
+		StaticIP: &StaticIPConfig{Addr: netip.MustParsePrefix("192.168.1.10/24")},
+		Hosts:    map[string]netip.Addr{"nas.lan": netip.MustParseAddr("192.168.1.20")},
+	}.withDefaults()
+	pn.dnsCache = newExpiringCache[string, []netip.Addr](dnsCacheSize)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			if err := pn.configureDNS(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			if _, err := pn.lookupNetIP(context.Background(), "printer.lan"); !errors.Is(err, ErrDNS) {
+				t.Errorf("got %v, want ErrDNS", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
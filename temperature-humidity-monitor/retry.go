@@ -0,0 +1,307 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+//
+// Retrying the PicoNet initialization stages. Some failures are transient (the
+// access point is busy, a DHCP packet got lost), and retrying after a while is
+// all it takes. Others are not, and retrying the same stage forever won't
+// help. So each stage gets a budget of attempts, with exponential backoff
+// between them. When the budget runs out we escalate: first by re-running an
+// earlier stage (say, joining the WiFi network again when DHCP doesn't work),
+// and then, as a last resort, by resetting the device.
+//
+
+// RetryPolicy tells how failing PicoNet initialization stages are retried. The
+// zero value is a reasonable policy.
+type RetryPolicy struct {
+	// InitialBackoff is how long to wait after the first failed attempt of a
+	// stage. The wait doubles after each further failure.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum wait between attempts.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction by which waits are randomly shortened or
+	// lengthened, so that a bunch of devices rebooting together after a power
+	// outage don't all hammer the access point in lockstep. Use a negative
+	// value to disable jitter.
+	Jitter float64
+
+	// Attempts overrides the number of attempts for specific stages before
+	// escalating. Stages not in here use their built-in budgets. A negative
+	// value means retrying the stage forever.
+	Attempts map[PicoNetStatus]int
+
+	// MaxRewinds is how many times we re-run earlier stages before giving up
+	// and calling PicoNetConfig.Reset. Use a negative value to go straight to
+	// the reset.
+	MaxRewinds int
+}
+
+const (
+	// defaultInitialBackoff is the default for RetryPolicy.InitialBackoff.
+	defaultInitialBackoff = time.Second
+
+	// defaultMaxBackoff is the default for RetryPolicy.MaxBackoff.
+	defaultMaxBackoff = 30 * time.Second
+
+	// defaultJitter is the default for RetryPolicy.Jitter.
+	defaultJitter = 0.2
+
+	// defaultMaxRewinds is the default for RetryPolicy.MaxRewinds.
+	defaultMaxRewinds = 2
+)
+
+// withDefaults returns a copy of p with zero fields replaced by defaults.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultJitter
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if p.MaxRewinds == 0 {
+		p.MaxRewinds = defaultMaxRewinds
+	}
+	return p
+}
+
+// backoff returns how long to wait after the given number of consecutive
+// failures (starting at one).
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < failures && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// StageStats contains diagnostics about one of the PicoNet initialization
+// stages.
+type StageStats struct {
+	// Attempts is the total number of times the stage was tried.
+	Attempts int
+
+	// Failures is how many of these attempts failed.
+	Failures int
+
+	// LastError is the error from the most recent failed attempt, or nil if
+	// the stage never failed.
+	LastError error
+
+	// LastFailure is when the most recent failed attempt happened.
+	LastFailure time.Time
+}
+
+// InitStats contains diagnostics about the PicoNet initialization.
+type InitStats struct {
+	// Stages has the stats of each stage, keyed by the status reported while
+	// the stage runs.
+	Stages map[PicoNetStatus]StageStats
+
+	// Rewinds is how many times earlier stages were re-run because some
+	// stage ran out of attempts.
+	Rewinds int
+
+	// Resets is how many times initialization gave up and asked for a reset.
+	// Unless the reset function is missing or returns, this will be zero: a
+	// real reset wipes the stats along with everything else.
+	Resets int
+
+	// LinkLosses is how many times the WiFi link went down after
+	// initialization, each time causing it to run again.
+	LinkLosses int
+}
+
+// InitStats returns diagnostics about the initialization process.
+func (pn *PicoNet) InitStats() InitStats {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	stats := pn.initStats
+	stats.Stages = make(map[PicoNetStatus]StageStats, len(pn.initStats.Stages))
+	for k, v := range pn.initStats.Stages {
+		stats.Stages[k] = v
+	}
+	return stats
+}
+
+// initStage is one of the stages of the PicoNet initialization.
+type initStage struct {
+	// status is the status reported while the stage runs.
+	status PicoNetStatus
+
+	// run makes one attempt at running the stage.
+	run func() error
+
+	// attempts is the default number of attempts before escalating.
+	attempts int
+
+	// rewindTo is the stage to re-run when this one runs out of attempts. Use
+	// StatusUninitialized if there is no earlier stage worth re-running.
+	rewindTo PicoNetStatus
+}
+
+// initStages returns the initialization stages, in the order they run.
+func (pn *PicoNet) initStages() []initStage {
+	// In access point mode there's nobody to ask for addresses or names: we
+	// are the ones answering. Failing to start the network we create is
+	// unlikely to be fixed by anything other than a reset.
+	if pn.AddrMode() == AddrModeAccessPoint {
+		return []initStage{
+			{StatusCreatingDevice, pn.createDevice, 3, StatusUninitialized},
+			{StatusStartingAP, pn.startAP, 3, StatusCreatingDevice},
+			{StatusCreatingStack, pn.createStack, 3, StatusUninitialized},
+			{StatusConfiguringStaticIP, pn.configureStaticIP, 1, StatusUninitialized},
+			{StatusStartingDHCPServer, pn.startDHCPServer, 3, StatusUninitialized},
+		}
+	}
+
+	// With DHCP, asking for an address again is the natural thing to do when
+	// later stages fail. With a static configuration, re-applying it would
+	// change nothing, so we join the network again instead.
+	addrStage := initStage{StatusObtainingIP, pn.obtainIPAddress, 4, StatusConnectingToWiFi}
+	rewindTo := StatusObtainingIP
+	if pn.AddrMode() == AddrModeStatic {
+		addrStage = initStage{StatusConfiguringStaticIP, pn.configureStaticIP, 1, StatusUninitialized}
+		rewindTo = StatusConnectingToWiFi
+	}
+
+	// Give every known WiFi network a fair chance before escalating.
+	wifiAttempts := max(5, len(pn.config.WiFiNetworks)*pn.config.JoinAttempts)
+
+	return []initStage{
+		{StatusCreatingDevice, pn.createDevice, 3, StatusUninitialized},
+		{StatusConnectingToWiFi, pn.connectToWifi, wifiAttempts, StatusCreatingDevice},
+		{StatusCreatingStack, pn.createStack, 3, StatusUninitialized},
+		addrStage,
+		{StatusConfiguringDNS, pn.configureDNS, 1, rewindTo},
+		{StatusObtainingRouterMAC, pn.obtainRouterMAC, 5, rewindTo},
+	}
+}
+
+// initialize runs the initialization stages, starting with the one reporting
+// status from, until all of them succeed, escalating as described by the retry
+// policy when they don't. The first status change is reported as caused by
+// reason.
+func (pn *PicoNet) initialize(from PicoNetStatus, reason error) {
+	stages := pn.initStages()
+	rewinds := 0
+
+	for i := stageIndex(stages, from); i < len(stages); {
+		stage := stages[i]
+		pn.setStatus(stage.status, reason)
+		reason = nil
+
+		err := pn.runStage(stage)
+		if err == nil {
+			i++
+			continue
+		}
+		reason = err
+
+		if stage.rewindTo != StatusUninitialized && rewinds < pn.config.Retry.MaxRewinds {
+			rewinds++
+			pn.mutex.Lock()
+			pn.initStats.Rewinds++
+			pn.mutex.Unlock()
+
+			pn.logger.Warn("Initialization stage ran out of attempts, re-running an earlier stage",
+				slog.String("stage", stage.status.String()),
+				slog.String("rewindTo", stage.rewindTo.String()),
+			)
+			i = stageIndex(stages, stage.rewindTo)
+			continue
+		}
+
+		pn.mutex.Lock()
+		pn.initStats.Resets++
+		pn.mutex.Unlock()
+
+		pn.logger.Error("Initialization keeps failing, resetting", slog.String("stage", stage.status.String()))
+		if pn.config.Reset != nil {
+			pn.config.Reset()
+		}
+
+		// If we are still alive, there was no way to reset. Best we can do is
+		// starting over.
+		rewinds = 0
+		i = 0
+		time.Sleep(pn.config.Retry.MaxBackoff)
+	}
+
+	pn.setStatus(StatusReadyToGo, nil)
+}
+
+// stageIndex returns the index of the stage reporting the given status.
+func stageIndex(stages []initStage, status PicoNetStatus) int {
+	for i := range stages {
+		if stages[i].status == status {
+			return i
+		}
+	}
+	return 0
+}
+
+// runStage tries running stage until it succeeds or runs out of attempts.
+// Returns the error from the last attempt, or nil if the stage succeeded.
+func (pn *PicoNet) runStage(stage initStage) error {
+	attempts := stage.attempts
+	if n, ok := pn.config.Retry.Attempts[stage.status]; ok && n != 0 {
+		attempts = n
+	}
+
+	var err error
+	for failures := 0; attempts < 0 || failures < attempts; {
+		err = stage.run()
+
+		pn.mutex.Lock()
+		stats := pn.initStats.Stages[stage.status]
+		stats.Attempts++
+		if err != nil {
+			stats.Failures++
+			stats.LastError = err
+			stats.LastFailure = time.Now()
+		}
+		pn.initStats.Stages[stage.status] = stats
+		pn.mutex.Unlock()
+
+		if err == nil {
+			return nil
+		}
+
+		failures++
+		backoff := pn.config.Retry.backoff(failures)
+		pn.logger.Error("Initialization stage failed",
+			slog.String("stage", stage.status.String()),
+			slog.Int("failures", failures),
+			slog.Duration("backoff", backoff),
+			slogError(err),
+		)
+		if attempts < 0 || failures < attempts {
+			time.Sleep(backoff)
+		}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+//
+// Routing, such as it is. We have a single interface and a single default
+// gateway, so the only decision to make is whether a destination is on our
+// own subnet (in which case we talk to it directly) or not (in which case the
+// packet goes to the gateway). Either way, we need the hardware address of
+// whoever receives the packet, which we get through ARP and cache for a while.
+//
+
+const (
+	// arpCacheTTL is how long we trust a resolved hardware address. Devices on
+	// a home network don't change addresses often, but they do now and then
+	// (a router gets replaced, DHCP hands an IP to some other box...).
+	arpCacheTTL = 5 * time.Minute
+
+	// arpCacheSize is the maximum number of entries in the ARP cache. We only
+	// talk to a handful of hosts, and the gateway is usually one of them.
+	arpCacheSize = 8
+
+	// arpTimeout is how long we wait for an ARP reply. ARP exchanges should be
+	// fast, so there's no point in waiting long for them.
+	arpTimeout = time.Second
+)
+
+// ErrNoRoute is returned when there's no way to reach some address: it is not
+// on our subnet, and we have no gateway to send it through.
+var ErrNoRoute = errors.New("no route to host")
+
+// nextHop returns the address to which packets for dst must be delivered: dst
+// itself if it is on our subnet, or the gateway otherwise.
+func (pn *PicoNet) nextHop(dst netip.Addr) (netip.Addr, error) {
+	subnet, gateway := pn.route()
+	if subnet.Contains(dst) {
+		return dst, nil
+	}
+	if !gateway.IsValid() {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrNoRoute, dst)
+	}
+	return gateway, nil
+}
+
+// hardwareAddrFor returns the hardware address to which packets for dst must
+// be sent. This is either dst's own address (if it is on our subnet) or the
+// gateway's. Cached addresses are used when available, otherwise we ask ARP.
+func (pn *PicoNet) hardwareAddrFor(ctx context.Context, dst netip.Addr) ([6]byte, error) {
+	hop, err := pn.nextHop(dst)
+	if err != nil {
+		return [6]byte{}, err
+	}
+	if mac, ok := pn.arpCache.lookup(hop, time.Now()); ok {
+		return mac, nil
+	}
+
+	pn.arpMutex.Lock()
+	defer pn.arpMutex.Unlock()
+
+	// Someone else may have resolved the same address while we waited for the
+	// mutex.
+	if mac, ok := pn.arpCache.lookup(hop, time.Now()); ok {
+		return mac, nil
+	}
+
+	startTime := time.Now()
+	mac, err := resolveHardwareAddr(ctx, pn.stack, hop)
+	if err != nil {
+		return [6]byte{}, fmt.Errorf("resolving hardware address of %s: %w", hop, err)
+	}
+	pn.arpCache.store(hop, mac, time.Now().Add(arpCacheTTL))
+	pn.logger.Info("Resolved hardware address",
+		slog.String("ip", hop.String()),
+		slogMAC(mac),
+		slogTook(startTime),
+	)
+	return mac, nil
+}
+
+// forgetRoute drops the cached hardware address used to reach dst, so that it
+// is resolved again next time. This is meant to be called when talking to dst
+// times out, because a stale address is one of the possible reasons for that.
+// If dst is off-link, this means forgetting the gateway's address.
+func (pn *PicoNet) forgetRoute(dst netip.Addr) {
+	hop, err := pn.nextHop(dst)
+	if err != nil {
+		return
+	}
+	pn.arpCache.forget(hop)
+}
+
+// resolveHardwareAddr obtains the hardware address of the given IP address.
+// The stack has a single ARP client, so calls must be serialized by the
+// caller.
+func resolveHardwareAddr(ctx context.Context, stack *stacks.PortStack, ip netip.Addr) ([6]byte, error) {
+	if !ip.IsValid() {
+		return [6]byte{}, errors.New("invalid ip")
+	}
+	arpClient := stack.ARP()
+	arpClient.Abort() // Remove any previous ARP requests.
+	err := arpClient.BeginResolve(ip)
+	if err != nil {
+		return [6]byte{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, arpTimeout)
+	defer cancel()
+
+	time.Sleep(4 * time.Millisecond)
+	for !arpClient.IsDone() {
+		err = sleepCtx(ctx, arpTimeout/20)
+		if err != nil {
+			arpClient.Abort()
+			return [6]byte{}, fmt.Errorf("arp: %w", err)
+		}
+	}
+	_, hw, err := arpClient.ResultAs6()
+	return hw, err
+}
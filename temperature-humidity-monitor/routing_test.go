@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestNextHop(t *testing.T) {
+	pn := &PicoNet{}
+	pn.setRoute(netip.MustParsePrefix("192.168.1.0/24"), netip.Addr{})
+	if _, err := pn.nextHop(netip.MustParseAddr("8.8.8.8")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("off-subnet without a gateway: got %v, want ErrNoRoute", err)
+	}
+
+	gateway := netip.MustParseAddr("192.168.1.1")
+	pn.setRoute(netip.MustParsePrefix("192.168.1.0/24"), gateway)
+	tests := []struct{ dst, want string }{
+		{"192.168.1.50", "192.168.1.50"},
+		{"192.168.1.1", "192.168.1.1"},
+		{"192.168.2.50", "192.168.1.1"},
+		{"8.8.8.8", "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		hop, err := pn.nextHop(netip.MustParseAddr(tt.dst))
+		if err != nil || hop.String() != tt.want {
+			t.Errorf("nextHop(%s) = %v, %v; want %s", tt.dst, hop, err, tt.want)
+		}
+	}
+}
+
+// Run with -race: the route is set again when the network is re-initialized
+// after losing the WiFi link, while packets are going out from other
+// goroutines.
+func TestRouteConcurrentUpdate(t *testing.T) {
+	pn := &PicoNet{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			pn.setRoute(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 0}), 24), netip.AddrFrom4([4]byte{10, 0, byte(i), 1}))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			pn.nextHop(netip.MustParseAddr("8.8.8.8"))
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+//
+// SenML (RFC 8428): a standard way of describing sensor measurements, in JSON
+// or CBOR, that plenty of tools understand without knowing anything about us.
+// A batch of readings looks like this in JSON:
+//
+//	[
+//	  {"bn":"smh-a1b2c3:","bt":1.7145648e+09,"n":"temperature","u":"Cel","v":21.3},
+//	  {"n":"humidity","u":"%RH","v":45.1},
+//	  {"n":"temperature","u":"Cel","t":30,"v":21.4},
+//	  {"n":"humidity","u":"%RH","t":30,"v":45}
+//	]
+//
+// The base name is the device ID, and the base time the time of the first
+// reading, with the others relative to it. Before the clock is synchronized,
+// times are relative to now instead, which SenML has a way to say: they are
+// negative.
+//
+// The encoders append to a buffer, and senmlPack reuses its records, so
+// encoding a batch allocates nothing once they've grown to size.
+//
+
+const (
+	// senmlJSONContentType and senmlCBORContentType are the media types of
+	// the SenML encodings.
+	senmlJSONContentType = "application/senml+json"
+	senmlCBORContentType = "application/senml+cbor"
+
+	// senmlCelsius and senmlRelativeHumidity are the SenML units of our
+	// measurements.
+	senmlCelsius          = "Cel"
+	senmlRelativeHumidity = "%RH"
+)
+
+// SenML labels for CBOR, from RFC 8428, section 6.
+const (
+	senmlLabelBaseName = -2
+	senmlLabelBaseTime = -3
+	senmlLabelName     = 0
+	senmlLabelUnit     = 1
+	senmlLabelValue    = 2
+	senmlLabelTime     = 6
+)
+
+// senmlRecord is a SenML record: a value, and what it is. Empty and zero fields
+// are left out, except for Value. This is just the part of SenML we need.
+type senmlRecord struct {
+	// BaseName is prepended to the names of this record and the following
+	// ones, and BaseTime added to their times, in seconds.
+	BaseName string
+	BaseTime float64
+
+	// Name and Unit tell what the value is.
+	Name string
+	Unit string
+
+	// Time is when the value was measured, in seconds since the Unix epoch,
+	// or relative to now if negative (both after adding the base time).
+	Time float64
+
+	// Value is the value.
+	Value float64
+}
+
+// senmlPack builds the SenML records for a batch of readings from a device.
+// The zero value is not usable: see newSenMLPack.
+//
+// Not safe for concurrent use.
+type senmlPack struct {
+	// Records are the records built so far.
+	Records []senmlRecord
+
+	// baseName is the base name of the first record.
+	baseName string
+
+	// baseTime is the base time of the first record, in milliseconds, or
+	// zero if it has none.
+	baseTime int64
+}
+
+// newSenMLPack returns a pack for the readings of the device with the given ID.
+func newSenMLPack(device string) *senmlPack {
+	return &senmlPack{baseName: device + ":"}
+}
+
+// reset empties the pack, keeping the memory of the records for reuse.
+func (p *senmlPack) reset() {
+	p.Records = p.Records[:0]
+	p.baseTime = 0
+}
+
+// add adds the records for reading r, with clock converting its time, and now
+// being the current local time. Readings from a failing sensor are left out,
+// as SenML has no way to say that values can't be trusted, and so are values
+// that aren't numbers.
+func (p *senmlPack) add(r Reading, clock wallClock, now time.Time) {
+	if r.Flags&(FlagNoReading|reportFaults) != 0 {
+		return
+	}
+
+	// Times go in milliseconds until the end: subtracting the base time in
+	// floating point would make 30.099999904 out of 30.1.
+	var t int64
+	if clock.synced {
+		t = clock.at(r.Time).UnixMilli()
+	} else {
+		t = -now.Sub(r.Time).Milliseconds()
+	}
+
+	for _, m := range []struct {
+		name  string
+		unit  string
+		value float32
+	}{
+		{"temperature", senmlCelsius, r.Temperature},
+		{"humidity", senmlRelativeHumidity, r.Humidity},
+	} {
+		if math.IsNaN(float64(m.value)) || math.IsInf(float64(m.value), 0) {
+			continue
+		}
+		rec := senmlRecord{Name: m.name, Unit: m.unit, Value: float64(m.value)}
+		if len(p.Records) == 0 {
+			rec.BaseName = p.baseName
+			if clock.synced {
+				rec.BaseTime = float64(t) / 1000
+				p.baseTime = t
+			}
+		}
+		rec.Time = float64(t-p.baseTime) / 1000
+		p.Records = append(p.Records, rec)
+	}
+}
+
+// appendSenMLJSON appends to dst the SenML JSON representation of records.
+func appendSenMLJSON(dst []byte, records []senmlRecord) []byte {
+	w := jsonWriter{buf: dst}
+	w.beginArray()
+	for i := range records {
+		rec := &records[i]
+		w.beginObject()
+		if rec.BaseName != "" {
+			w.key("bn")
+			w.string(rec.BaseName)
+		}
+		if rec.BaseTime != 0 {
+			w.key("bt")
+			w.number(rec.BaseTime)
+		}
+		if rec.Name != "" {
+			w.key("n")
+			w.string(rec.Name)
+		}
+		if rec.Unit != "" {
+			w.key("u")
+			w.string(rec.Unit)
+		}
+		if rec.Time != 0 {
+			w.key("t")
+			w.number(rec.Time)
+		}
+		w.key("v")
+		w.number(rec.Value)
+		w.endObject()
+	}
+	w.endArray()
+	return w.Bytes()
+}
+
+// appendSenMLCBOR appends to dst the SenML CBOR representation of records.
+func appendSenMLCBOR(dst []byte, records []senmlRecord) []byte {
+	w := cborWriter{buf: dst}
+	w.beginArray(len(records))
+	for i := range records {
+		rec := &records[i]
+		n := 1
+		for _, present := range []bool{rec.BaseName != "", rec.BaseTime != 0, rec.Name != "", rec.Unit != "", rec.Time != 0} {
+			if present {
+				n++
+			}
+		}
+
+		w.beginMap(n)
+		if rec.BaseName != "" {
+			w.int(senmlLabelBaseName)
+			w.string(rec.BaseName)
+		}
+		if rec.BaseTime != 0 {
+			w.int(senmlLabelBaseTime)
+			w.number(rec.BaseTime)
+		}
+		if rec.Name != "" {
+			w.int(senmlLabelName)
+			w.string(rec.Name)
+		}
+		if rec.Unit != "" {
+			w.int(senmlLabelUnit)
+			w.string(rec.Unit)
+		}
+		if rec.Time != 0 {
+			w.int(senmlLabelTime)
+			w.number(rec.Time)
+		}
+		w.int(senmlLabelValue)
+		w.number(rec.Value)
+	}
+	return w.Bytes()
+}
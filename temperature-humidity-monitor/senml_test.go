@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unhex decodes hex bytes, ignoring spaces, the way the RFCs show them.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad test data %q: %v", s, err)
+	}
+	return b
+}
+
+// hexString returns the hex bytes of s.
+func hexString(s string) string {
+	return hex.EncodeToString([]byte(s))
+}
+
+// rfc8428Voltage are the records of the example in RFC 8428, section 5.1.2.
+var rfc8428Voltage = []senmlRecord{
+	{BaseName: "urn:dev:ow:10e2073a01080063:", Name: "voltage", Unit: "V", Value: 120.1},
+	{Name: "current", Unit: "A", Value: 1.2},
+}
+
+func TestAppendSenMLJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []senmlRecord
+		want    string
+	}{
+		{
+			name:    "RFC 8428, 5.1.1",
+			records: []senmlRecord{{Name: "urn:dev:ow:10e2073a01080063", Unit: "Cel", Value: 23.1}},
+			want:    `[{"n":"urn:dev:ow:10e2073a01080063","u":"Cel","v":23.1}]`,
+		},
+		{
+			name:    "RFC 8428, 5.1.2",
+			records: rfc8428Voltage,
+			want: `[
+				{"bn":"urn:dev:ow:10e2073a01080063:","n":"voltage","u":"V","v":120.1},
+				{"n":"current","u":"A","v":1.2}
+			]`,
+		},
+		{
+			// Without the base unit and version, which we don't do.
+			name: "RFC 8428, 5.1.3",
+			records: []senmlRecord{
+				{BaseName: "urn:dev:ow:10e2073a0108006:", BaseTime: 1.276020076001e+09, Name: "voltage", Unit: "V", Value: 120.1},
+				{Name: "current", Time: -5, Value: 1.2},
+				{Name: "current", Time: -4, Value: 1.3},
+				{Name: "current", Time: -3, Value: 1.4},
+				{Name: "current", Time: -2, Value: 1.5},
+				{Name: "current", Time: -1, Value: 1.6},
+				{Name: "current", Value: 1.7},
+			},
+			want: `[
+				{"bn":"urn:dev:ow:10e2073a0108006:","bt":1.276020076001e+09,"n":"voltage","u":"V","v":120.1},
+				{"n":"current","t":-5,"v":1.2},
+				{"n":"current","t":-4,"v":1.3},
+				{"n":"current","t":-3,"v":1.4},
+				{"n":"current","t":-2,"v":1.5},
+				{"n":"current","t":-1,"v":1.6},
+				{"n":"current","v":1.7}
+			]`,
+		},
+		{
+			name:    "nothing",
+			records: nil,
+			want:    `[]`,
+		},
+		{
+			// A value of zero is still a value.
+			name:    "zero",
+			records: []senmlRecord{{Name: "temperature", Unit: "Cel"}},
+			want:    `[{"n":"temperature","u":"Cel","v":0}]`,
+		},
+		{
+			name:    "escaped",
+			records: []senmlRecord{{BaseName: `dev "1"\`, Name: "tab\there", Value: -0.5}},
+			want:    `[{"bn":"dev \"1\"\\","n":"tab\there","v":-0.5}]`,
+		},
+	}
+	for _, tt := range tests {
+		var want bytes.Buffer
+		if err := json.Compact(&want, []byte(tt.want)); err != nil {
+			t.Fatalf("%s: bad test data: %v", tt.name, err)
+		}
+		got := appendSenMLJSON([]byte("x"), tt.records)
+		if !bytes.Equal(got, append([]byte("x"), want.Bytes()...)) {
+			t.Errorf("%s:\n got %s\nwant x%s", tt.name, got, want.Bytes())
+		}
+	}
+}
+
+func TestAppendSenMLCBOR(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []senmlRecord
+		want    string
+	}{
+		{
+			// As in RFC 8428, section 6.
+			name:    "RFC 8428, 5.1.2",
+			records: rfc8428Voltage,
+			want: "82" +
+				"a4 21 781c" + hexString("urn:dev:ow:10e2073a01080063:") +
+				"00 67" + hexString("voltage") + "01 6156" + "02 fb405e066666666666" +
+				"a3 00 67" + hexString("current") + "01 6141" + "02 fb3ff3333333333333",
+		},
+		{
+			// Times too precise for a float32, negative times as integers.
+			name:    "RFC 8428, 5.1.3",
+			records: []senmlRecord{{BaseTime: 1.276020076001e+09, Name: "current", Time: -5, Value: 1.2}},
+			want:    "81 a4 22 fb41d303a15b001062" + "00 67" + hexString("current") + "06 24" + "02 fb3ff3333333333333",
+		},
+		{
+			name:    "nothing",
+			records: nil,
+			want:    "80",
+		},
+		{
+			// Numbers take the smallest form that holds them exactly.
+			name: "numbers",
+			records: []senmlRecord{
+				{Value: 0},
+				{Value: 45},
+				{Value: -1000},
+				{Value: 21.5},
+				{Value: float64(float32(21.3))},
+				{Value: 21.3},
+			},
+			want: "86" +
+				"a1 02 00" +
+				"a1 02 182d" +
+				"a1 02 3903e7" +
+				"a1 02 fa41ac0000" +
+				"a1 02 fa41aa6666" +
+				"a1 02 fb40354ccccccccccd",
+		},
+		{
+			// Strings of 24 bytes or more have their length apart.
+			name: "string lengths",
+			records: []senmlRecord{
+				{Name: strings.Repeat("n", 23), Value: 1},
+				{Name: strings.Repeat("n", 24), Value: 1},
+			},
+			want: "82" +
+				"a2 00 77" + hexString(strings.Repeat("n", 23)) + "02 01" +
+				"a2 00 7818" + hexString(strings.Repeat("n", 24)) + "02 01",
+		},
+	}
+	for _, tt := range tests {
+		want := append([]byte("x"), unhex(t, tt.want)...)
+		if got := appendSenMLCBOR([]byte("x"), tt.records); !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got %x\nwant %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestSenMLPack(t *testing.T) {
+	p := newSenMLPack("smh-a1b2c3")
+	now := time.Now()
+	clock := wallClock{local: now, wall: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), synced: true}
+	nan := float32(math.NaN())
+
+	// With the clock synchronized, times are relative to the first reading.
+	// Failing readings are left out, and so are values that aren't numbers.
+	p.add(Reading{Time: now, Temperature: 21.3, Humidity: 45.1}, clock, now)
+	p.add(Reading{Time: now.Add(10 * time.Second), Temperature: 99, Humidity: 45, Flags: FlagStale}, clock, now)
+	p.add(Reading{Time: now.Add(20 * time.Second), Temperature: 150, Humidity: 45, Flags: FlagOutOfRange}, clock, now)
+	p.add(Reading{Time: now.Add(30100 * time.Millisecond), Temperature: 21.4, Humidity: 45}, clock, now)
+	p.add(Reading{Time: now.Add(time.Minute), Temperature: nan, Humidity: 44.5}, clock, now)
+	p.add(Reading{Flags: FlagNoReading}, clock, now)
+	want := `[{"bn":"smh-a1b2c3:","bt":1.7145648e+09,"n":"temperature","u":"Cel","v":21.3},` +
+		`{"n":"humidity","u":"%RH","v":45.1},` +
+		`{"n":"temperature","u":"Cel","t":30.1,"v":21.4},` +
+		`{"n":"humidity","u":"%RH","t":30.1,"v":45},` +
+		`{"n":"humidity","u":"%RH","t":60,"v":44.5}]`
+	if got := string(appendSenMLJSON(nil, p.Records)); got != want {
+		t.Errorf("synced:\n got %s\nwant %s", got, want)
+	}
+
+	// Without, they are relative to now, and there's no base time.
+	p.reset()
+	clock.synced = false
+	p.add(Reading{Time: now.Add(-2500 * time.Millisecond), Temperature: 20, Humidity: 40}, clock, now)
+	p.add(Reading{Time: now, Temperature: 20.5, Humidity: 40}, clock, now)
+	want = `[{"bn":"smh-a1b2c3:","n":"temperature","u":"Cel","t":-2.5,"v":20},` +
+		`{"n":"humidity","u":"%RH","t":-2.5,"v":40},` +
+		`{"n":"temperature","u":"Cel","v":20.5},` +
+		`{"n":"humidity","u":"%RH","v":40}]`
+	if got := string(appendSenMLJSON(nil, p.Records)); got != want {
+		t.Errorf("not synced:\n got %s\nwant %s", got, want)
+	}
+
+	// The base name goes on the first record there is, even if the first
+	// reading had nothing.
+	p.reset()
+	p.add(Reading{Time: now, Temperature: nan, Humidity: 40}, clock, now)
+	if len(p.Records) != 1 || p.Records[0].BaseName != "smh-a1b2c3:" {
+		t.Errorf("got %+v", p.Records)
+	}
+}
+
+func TestSenMLPackAllocs(t *testing.T) {
+	p := newSenMLPack("smh-a1b2c3")
+	now := time.Now()
+	clock := wallClock{local: now, wall: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), synced: true}
+	buf := make([]byte, 0, 1024)
+	batch := func() {
+		p.reset()
+		for i := range 4 {
+			p.add(Reading{Time: now.Add(time.Duration(i) * time.Minute), Temperature: 21.3, Humidity: 45.1}, clock, now)
+		}
+		buf = appendSenMLJSON(buf[:0], p.Records)
+		buf = appendSenMLCBOR(buf[:0], p.Records)
+	}
+
+	// Once the records have grown to size, a batch allocates nothing.
+	batch()
+	if allocs := testing.AllocsPerRun(100, batch); allocs != 0 {
+		t.Errorf("%v allocations per batch", allocs)
+	}
+}
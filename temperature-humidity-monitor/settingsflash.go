@@ -0,0 +1,53 @@
+//go:build tinygo
+
+package main
+
+import (
+	"fmt"
+	"machine"
+)
+
+//
+// Storing settings in the flash memory. TinyGo gives us a "data area" in the
+// flash, starting right after the program itself, which is precisely for this
+// kind of thing. We use its first erase block for the settings.
+//
+
+// loadSettings reads the settings stored in the flash. Returns errNoSettings if
+// nothing was ever stored there.
+func loadSettings() (Settings, error) {
+	buf := make([]byte, settingsMaxSize)
+	_, err := machine.Flash.ReadAt(buf, 0)
+	if err != nil {
+		return Settings{}, fmt.Errorf("reading settings from flash: %w", err)
+	}
+	return unmarshalSettings(buf)
+}
+
+// saveSettings stores s in the flash, replacing whatever was there.
+func saveSettings(s Settings) error {
+	data := s.marshal()
+
+	// Writes must cover whole write blocks. Padding with 0xff leaves the rest
+	// of the block just like it was after the erase.
+	blockSize := int(machine.Flash.WriteBlockSize())
+	padded := make([]byte, (len(data)+blockSize-1)/blockSize*blockSize)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = 0xff
+	}
+
+	if int64(len(padded)) > machine.Flash.EraseBlockSize() {
+		return fmt.Errorf("settings too large for the flash: %d bytes", len(padded))
+	}
+
+	err := machine.Flash.EraseBlocks(0, 1)
+	if err != nil {
+		return fmt.Errorf("erasing flash: %w", err)
+	}
+	_, err = machine.Flash.WriteAt(padded, 0)
+	if err != nil {
+		return fmt.Errorf("writing settings to flash: %w", err)
+	}
+	return nil
+}
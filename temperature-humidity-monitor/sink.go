@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//
+// Telemetry: getting the readings wherever they should go. A single pipeline
+// takes the latest reading every sensorReadInterval and hands it to each sink,
+// like the env-server or an MQTT broker. Every sink has its own goroutine,
+// queue and retry state, so a slow or broken one holds up nobody but itself:
+// when it falls behind, it's its own readings that get dropped.
+//
+// Sinks are enabled and configured by the settings. Adding one takes a Sink
+// and a sinkFactory in sinkFactories; main doesn't need to know.
+//
+
+const (
+	// sinkInboxSize is how many readings can wait for a sink to take them.
+	// A sink busy delivering for longer than that many reading intervals
+	// misses readings.
+	sinkInboxSize = 4
+
+	// defaultSinkQueueSize is the default for sinkConfig.QueueSize.
+	defaultSinkQueueSize = 16
+
+	// defaultSinkTimeout is the default for sinkConfig.Timeout.
+	defaultSinkTimeout = 30 * time.Second
+)
+
+// telemetryReading is a reading as it goes through the pipeline.
+type telemetryReading struct {
+	Reading
+
+	// Now is when the pipeline took the reading, according to the local
+	// clock.
+	Now time.Time
+
+	// Clock converts local clock readings, like Now and Reading.Time, to
+	// actual times, if the clock is synchronized.
+	Clock wallClock
+}
+
+// Sink is somewhere readings go, like the env-server or an MQTT broker. Sinks
+// don't deal with goroutines, queues or retries: a sinkRunner does that for
+// them.
+//
+// T is what the sink queues for delivery: readings, aggregated values, or
+// whatever suits it.
+type Sink[T any] interface {
+	// Name identifies the sink in logs and in the health report.
+	Name() string
+
+	// Collect takes in a reading, appending to queue whatever of it is
+	// to be delivered, if anything, and returning the result. It's called
+	// for every reading, in order, so it can keep state, like what was last
+	// reported.
+	Collect(queue []T, r telemetryReading) []T
+
+	// Deliver sends items, oldest first. An error means they must be sent
+	// again later.
+	Deliver(ctx context.Context, items []T) error
+}
+
+// sinkConfig tells how a sinkRunner runs a sink. The zero value is a
+// reasonable config.
+type sinkConfig struct {
+	// QueueSize is how many items can wait for delivery. When more pile up,
+	// as when the sink is unreachable, the oldest are dropped.
+	QueueSize int
+
+	// MaxBatch is how many items are delivered at once. Zero means all of
+	// those waiting.
+	MaxBatch int
+
+	// Retry tells how long to wait after failed deliveries.
+	Retry RetryPolicy
+
+	// Timeout is how long each delivery can take.
+	Timeout time.Duration
+
+	// Local tells that the sink doesn't need the network, so deliveries
+	// don't wait for it.
+	Local bool
+}
+
+// withDefaults returns a copy of c with zero fields replaced by defaults.
+func (c sinkConfig) withDefaults() sinkConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultSinkQueueSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultSinkTimeout
+	}
+	c.Retry = c.Retry.withDefaults()
+	return c
+}
+
+// sinkHealth tells how a sink is doing.
+type sinkHealth struct {
+	// Name is the name of the sink.
+	Name string
+
+	// Queued is how many items are waiting for delivery.
+	Queued int
+
+	// Delivered is how many items were delivered, and Dropped how many
+	// readings and items were dropped because the sink fell behind.
+	Delivered int
+	Dropped   int
+
+	// Failures is how many deliveries failed in a row, and LastError the
+	// error from the most recent failed one, or nil if none ever failed.
+	Failures  int
+	LastError error
+
+	// LastDelivery is when the most recent successful delivery happened,
+	// according to the local clock.
+	LastDelivery time.Time
+}
+
+// Healthy tells if the sink is delivering.
+func (h sinkHealth) Healthy() bool {
+	return h.Failures == 0
+}
+
+// telemetrySink is what the pipeline sees of a sink: a sinkRunner, whatever
+// the type of its items.
+type telemetrySink interface {
+	// offer hands a reading to the sink, without blocking.
+	offer(r telemetryReading)
+
+	// run runs the sink. Meant to run in its own goroutine, for as long
+	// as the device runs.
+	run()
+
+	// health tells how the sink is doing.
+	health() sinkHealth
+}
+
+// sinkEnv is what sinkFactories get to work with.
+type sinkEnv struct {
+	logger   *slog.Logger
+	pn       *PicoNet
+	settings Settings
+}
+
+// sinkFactory returns the sink described by the settings in env, running in
+// a sinkRunner, or nil if the settings don't enable it.
+type sinkFactory func(env sinkEnv) (telemetrySink, error)
+
+// sinkFactories are the factories of all the sinks there are.
+var sinkFactories = []sinkFactory{
+	newEnvServerSink,
+	newCoAPSink,
+	newMQTTSink,
+	newWebhookSink,
+	newInfluxSink,
+	newLogSink,
+}
+
+// sinkRunner runs a sink in its own goroutine, feeding it readings, and
+// delivering what it collects, with retries. Safe for concurrent use.
+type sinkRunner[T any] struct {
+	// logger is used for all the logging.
+	logger *slog.Logger
+
+	// sink is the sink we run, and config how.
+	sink   Sink[T]
+	config sinkConfig
+
+	// ready tells if the network is ready for deliveries.
+	ready func() bool
+
+	// inbox has the readings offered to the sink.
+	inbox chan telemetryReading
+
+	// queue has the items waiting for delivery, and retryAt tells when we
+	// can try again after failed deliveries. Only touched by run.
+	queue   []T
+	retryAt time.Time
+
+	// mutex protects stats.
+	mutex sync.Mutex
+	stats sinkHealth
+}
+
+// newSinkRunner returns a runner for sink, delivering over pn.
+func newSinkRunner[T any](logger *slog.Logger, pn *PicoNet, sink Sink[T], config sinkConfig) *sinkRunner[T] {
+	s := &sinkRunner[T]{
+		logger: logger,
+		sink:   sink,
+		config: config.withDefaults(),
+		ready:  func() bool { return pn.Status() == StatusReadyToGo },
+		inbox:  make(chan telemetryReading, sinkInboxSize),
+		stats:  sinkHealth{Name: sink.Name()},
+	}
+	if s.config.Local {
+		s.ready = func() bool { return true }
+	}
+	return s
+}
+
+func (s *sinkRunner[T]) offer(r telemetryReading) {
+	select {
+	case s.inbox <- r:
+	default:
+		s.mutex.Lock()
+		s.stats.Dropped++
+		s.mutex.Unlock()
+	}
+}
+
+func (s *sinkRunner[T]) health() sinkHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *sinkRunner[T]) run() {
+	for r := range s.inbox {
+		s.collect(r)
+		if len(s.queue) > 0 && !r.Now.Before(s.retryAt) && s.ready() {
+			s.deliver()
+		}
+	}
+}
+
+// collect has the sink collect what it wants of r, dropping the oldest items
+// in the queue if it grows too long.
+func (s *sinkRunner[T]) collect(r telemetryReading) {
+	s.queue = s.sink.Collect(s.queue, r)
+	dropped := max(0, len(s.queue)-s.config.QueueSize)
+	if dropped > 0 {
+		s.queue = append(s.queue[:0], s.queue[dropped:]...)
+	}
+
+	s.mutex.Lock()
+	s.stats.Queued = len(s.queue)
+	s.stats.Dropped += dropped
+	s.mutex.Unlock()
+}
+
+// deliver delivers the queued items, a batch at a time, until they are all
+// gone or a delivery fails.
+func (s *sinkRunner[T]) deliver() {
+	for len(s.queue) > 0 {
+		n := len(s.queue)
+		if s.config.MaxBatch > 0 {
+			n = min(n, s.config.MaxBatch)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+		err := s.sink.Deliver(ctx, s.queue[:n])
+		cancel()
+
+		s.mutex.Lock()
+		failures := s.stats.Failures
+		if err != nil {
+			s.stats.Failures++
+			s.stats.LastError = err
+			s.retryAt = time.Now().Add(s.config.Retry.backoff(s.stats.Failures))
+		} else {
+			s.queue = append(s.queue[:0], s.queue[n:]...)
+			s.stats.Failures = 0
+			s.stats.Delivered += n
+			s.stats.LastDelivery = time.Now()
+		}
+		s.stats.Queued = len(s.queue)
+		s.mutex.Unlock()
+
+		if err != nil {
+			counters.uploadFailures.Add(1)
+			s.logger.Warn("Delivering readings",
+				slog.String("sink", s.sink.Name()),
+				slog.Int("queued", len(s.queue)),
+				slogError(err),
+			)
+			return
+		}
+		counters.uploadSuccesses.Add(1)
+		if failures > 0 {
+			s.logger.Info("Delivering readings again",
+				slog.String("sink", s.sink.Name()),
+				slog.Int("failures", failures),
+			)
+		}
+	}
+}
+
+// telemetry is the reading pipeline, feeding the sinks. Safe for concurrent
+// use.
+type telemetry struct {
+	// mutex protects sinks, which are set up only once the network is
+	// ready: sinks may need our MAC address, for one.
+	mutex sync.Mutex
+	sinks []telemetrySink
+}
+
+// Health tells how each sink is doing.
+func (t *telemetry) Health() []sinkHealth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	health := make([]sinkHealth, len(t.sinks))
+	for i, s := range t.sinks {
+		health[i] = s.health()
+	}
+	return health
+}
+
+// run sets up the sinks the settings enable, and feeds them readings. Meant to
+// run in its own goroutine, for as long as the device runs.
+func (t *telemetry) run(logger *slog.Logger, pn *PicoNet, settings Settings, readings *sensorReadings) {
+	for pn.Status() != StatusReadyToGo {
+		time.Sleep(time.Second)
+	}
+
+	env := sinkEnv{logger: logger, pn: pn, settings: settings}
+	var sinks []telemetrySink
+	for _, factory := range sinkFactories {
+		sink, err := factory(env)
+		if err != nil {
+			logger.Error("Setting up a telemetry sink", slogError(err))
+			continue
+		}
+		if sink == nil {
+			continue
+		}
+		logger.Info("Sending readings", slog.String("sink", sink.health().Name))
+		go sink.run()
+		sinks = append(sinks, sink)
+	}
+	t.mutex.Lock()
+	t.sinks = sinks
+	t.mutex.Unlock()
+
+	for range time.Tick(sensorReadInterval) {
+		now := time.Now()
+		wall, synced := pn.nowAt(now)
+		r := telemetryReading{
+			Reading: readings.Latest(now),
+			Now:     now,
+			Clock:   wallClock{local: now, wall: wall, synced: synced},
+		}
+		for _, sink := range sinks {
+			sink.offer(r)
+		}
+	}
+}
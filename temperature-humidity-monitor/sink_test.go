@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink queues the temperature of each reading, as an int, and records
+// what it delivers.
+type fakeSink struct {
+	mutex sync.Mutex
+
+	// perReading is how many items each reading queues. Zero means one.
+	perReading int
+
+	// block, when not nil, makes deliveries wait until it's closed.
+	block chan struct{}
+
+	// err, when not nil, is what deliveries fail with.
+	err error
+
+	// attempts and delivered are the batches tried and delivered.
+	attempts  [][]int
+	delivered [][]int
+}
+
+func (f *fakeSink) Name() string {
+	return "fake"
+}
+
+func (f *fakeSink) Collect(queue []int, r telemetryReading) []int {
+	for range max(1, f.perReading) {
+		queue = append(queue, int(r.Temperature))
+	}
+	return queue
+}
+
+func (f *fakeSink) Deliver(ctx context.Context, items []int) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("delivering without a deadline")
+	}
+	f.mutex.Lock()
+	f.attempts = append(f.attempts, append([]int(nil), items...))
+	block := f.block
+	f.mutex.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.delivered = append(f.delivered, append([]int(nil), items...))
+	return nil
+}
+
+func (f *fakeSink) setErr(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+func (f *fakeSink) tried() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.attempts)
+}
+
+// deliveredItems returns the items delivered, in order.
+func (f *fakeSink) deliveredItems() []int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var items []int
+	for _, batch := range f.delivered {
+		items = append(items, batch...)
+	}
+	return items
+}
+
+// newTestSinkRunner returns a runner for f, with the network always ready.
+func newTestSinkRunner(f *fakeSink, config sinkConfig) *sinkRunner[int] {
+	config.Local = true
+	return newSinkRunner[int](discardLogger, nil, f, config)
+}
+
+// testReading returns a reading with temperature i, taken at now.
+func testReading(i int, now time.Time) telemetryReading {
+	return telemetryReading{Reading: Reading{Temperature: float32(i)}, Now: now}
+}
+
+func TestSinkRunnerSlowSink(t *testing.T) {
+	healthy := &fakeSink{}
+	slow := &fakeSink{block: make(chan struct{})}
+	sinks := []*sinkRunner[int]{
+		newTestSinkRunner(healthy, sinkConfig{}),
+		newTestSinkRunner(slow, sinkConfig{QueueSize: 4}),
+	}
+	for _, s := range sinks {
+		go s.run()
+		t.Cleanup(func() { close(s.inbox) })
+	}
+
+	// The slow sink takes the first reading, and gets stuck delivering it.
+	now := time.Now()
+	for _, s := range sinks {
+		s.offer(testReading(0, now))
+	}
+	waitFor(t, "the slow sink to deliver", func() bool { return slow.tried() == 1 })
+
+	// Meanwhile, offering readings doesn't block, and the healthy sink
+	// delivers them all as they come.
+	start := time.Now()
+	for i := 1; i < 20; i++ {
+		for _, s := range sinks {
+			s.offer(testReading(i, now))
+		}
+		waitFor(t, "the healthy sink to deliver", func() bool { return len(healthy.deliveredItems()) == i+1 })
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("offering readings took %v", d)
+	}
+	want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	if got := healthy.deliveredItems(); !reflect.DeepEqual(got, want) {
+		t.Errorf("healthy sink delivered %v", got)
+	}
+	if h := sinks[0].health(); h.Delivered != 20 || h.Dropped != 0 || h.Queued != 0 || !h.Healthy() {
+		t.Errorf("healthy sink: %+v", h)
+	}
+
+	// The slow sink only has room for sinkInboxSize readings while it's
+	// stuck; it's those that get dropped.
+	if h := sinks[1].health(); h.Dropped != 19-sinkInboxSize || h.Delivered != 0 || h.Queued != 1 {
+		t.Errorf("slow sink: %+v", h)
+	}
+
+	// Once unstuck, it goes on with what it has.
+	close(slow.block)
+	waitFor(t, "the slow sink to catch up", func() bool { return sinks[1].health().Delivered == 1+sinkInboxSize })
+	if got := slow.deliveredItems(); !reflect.DeepEqual(got, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("slow sink delivered %v", got)
+	}
+	if h := sinks[1].health(); h.Dropped != 19-sinkInboxSize || h.Queued != 0 || !h.Healthy() {
+		t.Errorf("slow sink: %+v", h)
+	}
+}
+
+func TestSinkRunnerQueueOverflow(t *testing.T) {
+	f := &fakeSink{err: errors.New("unreachable")}
+	s := newTestSinkRunner(f, sinkConfig{QueueSize: 4, MaxBatch: 3})
+	now := time.Now()
+	for i := range 6 {
+		s.collect(testReading(i, now))
+	}
+	if h := s.health(); h.Queued != 4 || h.Dropped != 2 {
+		t.Errorf("got %+v", h)
+	}
+	if !reflect.DeepEqual(s.queue, []int{2, 3, 4, 5}) {
+		t.Errorf("queue %v, want the newest", s.queue)
+	}
+
+	// A failed delivery keeps them all, and a working one sends them all,
+	// a batch at a time, oldest first.
+	s.deliver()
+	if !reflect.DeepEqual(s.queue, []int{2, 3, 4, 5}) {
+		t.Errorf("queue %v after failing", s.queue)
+	}
+	f.setErr(nil)
+	s.deliver()
+	if !reflect.DeepEqual(f.delivered, [][]int{{2, 3, 4}, {5}}) {
+		t.Errorf("delivered %v", f.delivered)
+	}
+	if h := s.health(); h.Queued != 0 || h.Delivered != 4 || h.Dropped != 2 {
+		t.Errorf("got %+v", h)
+	}
+
+	// Sinks queueing several items per reading overflow the same way.
+	f = &fakeSink{perReading: 3, err: errors.New("unreachable")}
+	s = newTestSinkRunner(f, sinkConfig{QueueSize: 4})
+	s.collect(testReading(1, now))
+	s.collect(testReading(2, now))
+	if !reflect.DeepEqual(s.queue, []int{1, 2, 2, 2}) || s.health().Dropped != 2 {
+		t.Errorf("queue %v, health %+v", s.queue, s.health())
+	}
+}
+
+func TestSinkRunnerHealth(t *testing.T) {
+	f := &fakeSink{}
+	s := newTestSinkRunner(f, sinkConfig{Retry: RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: 4 * time.Minute, Jitter: -1}})
+	if h := s.health(); h.Name != "fake" || !h.Healthy() || h.LastError != nil || !h.LastDelivery.IsZero() {
+		t.Errorf("new: %+v", h)
+	}
+
+	now := time.Now()
+	s.collect(testReading(1, now))
+	s.deliver()
+	h := s.health()
+	if h.Delivered != 1 || h.Failures != 0 || h.LastDelivery.Before(now) {
+		t.Errorf("delivered: %+v", h)
+	}
+
+	// Failures count up, with the backoff doubling.
+	errs := []error{errors.New("one"), errors.New("two"), errors.New("three"), errors.New("four")}
+	for i, err := range errs {
+		f.setErr(err)
+		s.collect(testReading(i+2, now))
+		before := time.Now()
+		s.deliver()
+		h := s.health()
+		if h.Failures != i+1 || h.LastError != err || h.Healthy() || h.Queued != i+1 || h.Delivered != 1 {
+			t.Errorf("failure %d: %+v", i+1, h)
+		}
+		backoff := time.Minute << min(i, 2)
+		if wait := s.retryAt.Sub(before); wait < backoff || wait > backoff+time.Second {
+			t.Errorf("failure %d: retrying after %v, want %v", i+1, wait, backoff)
+		}
+	}
+
+	// Success resets the failures, but the last error stays for the
+	// record.
+	f.setErr(nil)
+	s.deliver()
+	h = s.health()
+	if h.Failures != 0 || !h.Healthy() || h.LastError != errs[3] || h.Delivered != 5 || h.Queued != 0 || h.Dropped != 0 {
+		t.Errorf("recovered: %+v", h)
+	}
+
+	// Readings the sink can't take because it's busy count as dropped.
+	for i := range sinkInboxSize + 3 {
+		s.offer(testReading(i, now))
+	}
+	if h := s.health(); h.Dropped != 3 {
+		t.Errorf("dropped %d, want 3", h.Dropped)
+	}
+}
+
+func TestSinkRunnerRun(t *testing.T) {
+	f := &fakeSink{err: errors.New("unreachable")}
+	s := newTestSinkRunner(f, sinkConfig{Retry: RetryPolicy{InitialBackoff: time.Hour, Jitter: -1}})
+	ready := true
+	var readyMutex sync.Mutex
+	s.ready = func() bool {
+		readyMutex.Lock()
+		defer readyMutex.Unlock()
+		return ready
+	}
+	go s.run()
+	t.Cleanup(func() { close(s.inbox) })
+
+	// After a failure, readings are only collected until it's time to try
+	// again.
+	now := time.Now()
+	s.offer(testReading(1, now))
+	waitFor(t, "the first attempt", func() bool { return s.health().Failures == 1 })
+	f.setErr(nil)
+	s.offer(testReading(2, now.Add(30*time.Minute)))
+	waitFor(t, "the reading to be queued", func() bool { return s.health().Queued == 2 })
+	if tried := f.tried(); tried != 1 {
+		t.Errorf("%d attempts before time", tried)
+	}
+
+	// Nor while the network isn't ready.
+	readyMutex.Lock()
+	ready = false
+	readyMutex.Unlock()
+	s.offer(testReading(3, now.Add(2*time.Hour)))
+	waitFor(t, "the reading to be queued", func() bool { return s.health().Queued == 3 })
+	if tried := f.tried(); tried != 1 {
+		t.Errorf("%d attempts without the network", tried)
+	}
+
+	readyMutex.Lock()
+	ready = true
+	readyMutex.Unlock()
+	s.offer(testReading(4, now.Add(2*time.Hour)))
+	waitFor(t, "the delivery", func() bool { return s.health().Delivered == 4 })
+	if got := f.deliveredItems(); !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("delivered %v", got)
+	}
+}
+
+func TestTelemetryHealth(t *testing.T) {
+	a := newTestSinkRunner(&fakeSink{}, sinkConfig{})
+	b := newTestSinkRunner(&fakeSink{err: errors.New("unreachable")}, sinkConfig{})
+	b.collect(testReading(1, time.Now()))
+	b.deliver()
+	tel := &telemetry{sinks: []telemetrySink{a, b}}
+	health := tel.Health()
+	if len(health) != 2 || !health[0].Healthy() || health[1].Healthy() || health[1].Queued != 1 {
+		t.Errorf("got %+v", health)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// Plain TCP connections, for protocols other than HTTP. They come from the same
+// pool as the connections used for HTTP requests, since they need the same
+// scarce TCP ports. A long-lived connection holds its port for as long as it is
+// open, so anyone keeping one around should bump PicoNetConfig.TCPPorts
+// accordingly.
+//
+
+// DialTCP opens a TCP connection to address, given as "host:port". The host can
+// be a name or an IPv4 address. Waits for a free TCP port if needed, and gives
+// up when ctx is done.
+//
+// Reads on the returned connection block until there's something to read; use
+// SetReadDeadline to bound them. Once the server closes its side of the
+// connection, reads return io.EOF.
+func (pn *PicoNet) DialTCP(ctx context.Context, address string) (net.Conn, error) {
+	if pn.Status() != StatusReadyToGo {
+		return nil, ErrNotReady
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	addr, err := pn.resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrPort := netip.AddrPortFrom(addr, uint16(port))
+
+	// Dialed connections are never reused by anyone else, so their pool key
+	// just needs to be something no HTTP request will ask for.
+	pc, err := pn.pool.get(ctx, "tcp:"+strings.ToLower(address), false)
+	if err != nil {
+		return nil, err
+	}
+	err = pn.connectAddr(ctx, pc, addrPort, address)
+	if err != nil {
+		pn.pool.discard(pc)
+		return nil, err
+	}
+
+	return &dialedConn{Conn: pc.conn, pool: pn.pool, pc: pc}, nil
+}
+
+// dialedConn is a connection returned by PicoNet.DialTCP. It holds a slot in
+// the connection pool until closed.
+type dialedConn struct {
+	net.Conn
+
+	// pool is where the connection came from, and pc its slot there.
+	pool *connPool
+	pc   *pooledConn
+
+	// closeOnce makes sure the slot is released only once.
+	closeOnce sync.Once
+}
+
+// Read reads from the connection, returning io.EOF once the server closed it.
+func (c *dialedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, net.ErrClosed) {
+		// Same deal as in timeoutReader: seqs refuses to read from a
+		// connection closed by the server.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// Close closes the connection and releases its slot in the pool. Only the
+// first call does anything.
+func (c *dialedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pool.discard(c.pc)
+	})
+	return nil
+}
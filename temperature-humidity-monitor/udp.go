@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+//
+// UDP sockets of our own. The stack handles UDP only for its built-in clients
+// (DHCP, DNS, NTP): the interface for anything else is unexported. So we go
+// around it: incoming frames for the ports we listen on are picked up before
+// they reach the stack, and the datagrams we send are queued straight into the
+// NIC loop. Everything else still goes through the stack as usual.
+//
+// UDP is simple enough that this is not much work. We don't do IP
+// fragmentation (nor does anyone sensible with UDP these days), and ARP is
+// borrowed from the stack, through the same route cache used for TCP.
+//
+
+const (
+	// maxUDPConns is the maximum number of UDP sockets open at once.
+	maxUDPConns = 4
+
+	// udpRxQueueSize is how many received datagrams each socket holds until
+	// read. Anything arriving while the queue is full is dropped, as UDP
+	// allows.
+	udpRxQueueSize = 4
+
+	// udpTxQueueSize is how many datagrams can wait for the NIC loop to send
+	// them.
+	udpTxQueueSize = 4
+
+	// udpHeadersSize is the size of the Ethernet, IPv4 and UDP headers in
+	// front of every datagram we send.
+	udpHeadersSize = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+
+	// maxUDPPayload is the largest datagram we can send without IP
+	// fragmentation. That's from the usual Ethernet MTU of 1500 bytes, not
+	// from the device's, which is the size of its buffers.
+	maxUDPPayload = 1500 - eth.SizeIPv4Header - eth.SizeUDPHeader
+
+	// firstEphemeralPort is where we start looking for free ports for sockets
+	// that don't care about their local port. This is the range IANA suggests
+	// for them.
+	firstEphemeralPort = 49152
+)
+
+var (
+	// errUDPPortInUse is returned when listening on a UDP port that is
+	// already taken, either by another socket or by the stack itself.
+	errUDPPortInUse = errors.New("UDP port in use")
+
+	// errTooManyUDPConns is returned when opening more than maxUDPConns
+	// sockets.
+	errTooManyUDPConns = errors.New("too many UDP sockets")
+
+	// errDatagramTooLarge is returned when sending a datagram larger than
+	// maxUDPPayload.
+	errDatagramTooLarge = errors.New("UDP datagram too large")
+)
+
+// stackUDPPorts are the local ports used by the stack's own clients, which we
+// must leave alone.
+var stackUDPPorts = map[uint16]bool{53: true, 67: true, 68: true, 123: true, 1023: true}
+
+// udpDatagram is a datagram received by one of our sockets.
+type udpDatagram struct {
+	from netip.AddrPort
+	data []byte
+}
+
+// UDPConn is a UDP socket, opened with PicoNet.ListenUDP. It implements
+// net.PacketConn.
+type UDPConn struct {
+	// pn is where the socket lives.
+	pn *PicoNet
+
+	// port is the local port.
+	port uint16
+
+	// rx gets the datagrams received by the socket.
+	rx chan udpDatagram
+
+	// closed is closed when the socket is closed; closeOnce makes sure this
+	// happens once.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// mutex protects the deadlines.
+	mutex         sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// deadlineChanged wakes up a blocked ReadFrom when the read deadline
+	// changes.
+	deadlineChanged chan struct{}
+
+	// group is the multicast group the socket joined with JoinGroup, if any.
+	// Protected by PicoNet.udpMutex, as recvUDP reads it.
+	group netip.Addr
+}
+
+// ListenUDP opens a UDP socket on the given local port. Port zero picks some
+// free ephemeral port. The socket survives the network going down and coming
+// back, though anything sent or received meanwhile is lost.
+func (pn *PicoNet) ListenUDP(port uint16) (*UDPConn, error) {
+	pn.udpMutex.Lock()
+	defer pn.udpMutex.Unlock()
+
+	if len(pn.udpConns) >= maxUDPConns {
+		return nil, errTooManyUDPConns
+	}
+	if port == 0 {
+		// Start somewhere random, so that a rebooted device doesn't reuse
+		// the same ports and get answers meant for its previous life.
+		start := rand.Intn(65536 - firstEphemeralPort)
+		for i := range 65536 - firstEphemeralPort {
+			p := uint16(firstEphemeralPort + (start+i)%(65536-firstEphemeralPort))
+			if pn.udpConns[p] == nil {
+				port = p
+				break
+			}
+		}
+	}
+	if pn.udpConns[port] != nil || stackUDPPorts[port] {
+		return nil, fmt.Errorf("%w: %d", errUDPPortInUse, port)
+	}
+
+	c := &UDPConn{
+		pn:              pn,
+		port:            port,
+		rx:              make(chan udpDatagram, udpRxQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}, 1),
+	}
+	pn.udpConns[port] = c
+	return c, nil
+}
+
+// JoinGroup makes the socket receive datagrams sent to the IPv4 multicast
+// address group, besides the ones sent to us or broadcast. One group per socket
+// is all we need.
+//
+// There's no IGMP, so this only works for groups on the local link, where
+// nobody asks for it. Whether the WiFi chip lets multicast frames through is up
+// to its firmware: the driver has no way to set its multicast filter.
+func (c *UDPConn) JoinGroup(group netip.Addr) error {
+	if !group.Is4() || !group.IsMulticast() {
+		return fmt.Errorf("%v is not an IPv4 multicast address", group)
+	}
+	c.pn.udpMutex.Lock()
+	defer c.pn.udpMutex.Unlock()
+	c.group = group
+	return nil
+}
+
+// ReadFrom reads a datagram into p, returning its size and where it came from.
+// Like with the standard library, a datagram larger than p is truncated.
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+
+		c.mutex.Lock()
+		deadline := c.readDeadline
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case dg := <-c.rx:
+			return copy(p, dg.data), net.UDPAddrFromAddrPort(dg.from), nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			// Loop to check the deadline again.
+		case <-c.deadlineChanged:
+			// Ditto.
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// WriteTo sends p as a datagram to addr, which must be a *net.UDPAddr with an
+// IPv4 address. Returns once the datagram is queued for sending.
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+	to := udpAddr.AddrPort()
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+	if !to.Addr().Is4() {
+		return 0, fmt.Errorf("unsupported address %v: only IPv4 is supported", to.Addr())
+	}
+
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	ctx := context.Background()
+	c.mutex.Lock()
+	deadline := c.writeDeadline
+	c.mutex.Unlock()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	err := c.pn.sendUDP(ctx, c.port, to, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the socket, releasing its port. Blocked reads return
+// net.ErrClosed.
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pn.udpMutex.Lock()
+		delete(c.pn.udpConns, c.port)
+		c.pn.udpMutex.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of the socket. The IP address is
+// unspecified if the network is not ready.
+func (c *UDPConn) LocalAddr() net.Addr {
+	addr := c.pn.Addr()
+	if !addr.IsValid() {
+		addr = netip.IPv4Unspecified()
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, c.port))
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom calls, including any currently
+// blocked. A zero t means no deadline.
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	select {
+	case c.deadlineChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for WriteTo calls. A zero t means no
+// deadline.
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// sendUDP builds a frame carrying payload from our local port lport to to, and
+// queues it for the NIC loop to send.
+func (pn *PicoNet) sendUDP(ctx context.Context, lport uint16, to netip.AddrPort, payload []byte) error {
+	if len(payload) > maxUDPPayload {
+		return fmt.Errorf("%w: %d bytes", errDatagramTooLarge, len(payload))
+	}
+	src := pn.Addr()
+	if !src.IsValid() {
+		return ErrNotReady
+	}
+
+	subnet, _ := pn.route()
+	var dstMAC [6]byte
+	ttl := uint8(64)
+	if to.Addr() == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || to.Addr() == subnetBroadcast(subnet) {
+		dstMAC = eth.BroadcastHW6()
+	} else if to.Addr().IsMulticast() {
+		dstMAC = multicastMAC(to.Addr())
+		// Multicast doesn't go past the local link unless asked to, and
+		// link-local groups (224.0.0.x) never do. For those mDNS insists on
+		// a TTL of 255, to tell its packets came from the link.
+		ttl = 1
+		if to.Addr().IsLinkLocalMulticast() {
+			ttl = 255
+		}
+	} else {
+		var err error
+		dstMAC, err = pn.hardwareAddrFor(ctx, to.Addr())
+		if err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, udpHeadersSize+len(payload))
+	ethHeader := eth.EthernetHeader{
+		Destination:     dstMAC,
+		Source:          pn.stack.HardwareAddr6(),
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ethHeader.Put(frame)
+
+	pn.udpMutex.Lock()
+	pn.udpIPID++
+	id := pn.udpIPID
+	pn.udpMutex.Unlock()
+
+	ipHeader := eth.IPv4Header{
+		VersionAndIHL: 5, // No options. Put sets the version.
+		TotalLength:   uint16(eth.SizeIPv4Header + eth.SizeUDPHeader + len(payload)),
+		ID:            id,
+		Flags:         0x4000, // Don't fragment.
+		TTL:           ttl,
+		Protocol:      17, // UDP.
+		Source:        src.As4(),
+		Destination:   to.Addr().As4(),
+	}
+	ipHeader.Checksum = ipHeader.CalculateChecksum()
+	ipHeader.Put(frame[eth.SizeEthernetHeader:])
+
+	udpHeader := eth.UDPHeader{
+		SourcePort:      lport,
+		DestinationPort: to.Port(),
+		Length:          uint16(eth.SizeUDPHeader + len(payload)),
+	}
+	udpHeader.Checksum = udpHeader.CalculateChecksumIPv4(&ipHeader, payload)
+	if udpHeader.Checksum == 0 {
+		// Zero means "no checksum", so a checksum that happens to be
+		// zero is sent as its other representation.
+		udpHeader.Checksum = 0xffff
+	}
+	udpHeader.Put(frame[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	copy(frame[udpHeadersSize:], payload)
+
+	select {
+	case pn.udpTx <- frame:
+		return nil
+	case <-ctx.Done():
+		return timeoutError(ctx, os.ErrDeadlineExceeded)
+	}
+}
+
+// recvEth handles a frame received by the WiFi device. Datagrams for our own
+// UDP sockets are delivered to them; everything else goes to the stack.
+func (pn *PicoNet) recvEth(frame []byte) error {
+	if pn.AddrMode() == AddrModeAccessPoint {
+		frame = fixDHCPRequest(frame, apAddr.Addr())
+	}
+	if pn.recvUDP(frame) {
+		return nil
+	}
+	return pn.stack.RecvEth(frame)
+}
+
+// recvUDP delivers frame to one of our UDP sockets, if it is a datagram for
+// one of them. Returns whether it was.
+func (pn *PicoNet) recvUDP(frame []byte) bool {
+	if len(frame) < udpHeadersSize || binary.BigEndian.Uint16(frame[12:]) != uint16(eth.EtherTypeIPv4) {
+		return false
+	}
+	ipHeader, ipHeaderLen := eth.DecodeIPv4Header(frame[eth.SizeEthernetHeader:])
+	if ipHeader.Protocol != 17 || ipHeader.Flags.MoreFragments() || ipHeader.Flags.FragmentOffset() != 0 {
+		return false
+	}
+	udpOffset := eth.SizeEthernetHeader + int(ipHeaderLen)
+	if ipHeaderLen < eth.SizeIPv4Header || len(frame) < udpOffset+eth.SizeUDPHeader {
+		return false
+	}
+	udpHeader := eth.DecodeUDPHeader(frame[udpOffset:])
+
+	pn.udpMutex.Lock()
+	c := pn.udpConns[udpHeader.DestinationPort]
+	var group netip.Addr
+	if c != nil {
+		group = c.group
+	}
+	pn.udpMutex.Unlock()
+	if c == nil {
+		return false
+	}
+
+	// From here on the datagram is ours, even if we end up dropping it.
+	dst := netip.AddrFrom4(ipHeader.Destination)
+	subnet, _ := pn.route()
+	if dst != pn.Addr() && dst != netip.AddrFrom4([4]byte{255, 255, 255, 255}) && dst != subnetBroadcast(subnet) && dst != group {
+		return true
+	}
+	end := udpOffset + int(udpHeader.Length)
+	if int(udpHeader.Length) < eth.SizeUDPHeader || end > len(frame) || end > eth.SizeEthernetHeader+int(ipHeader.TotalLength) {
+		return true
+	}
+	payload := frame[udpOffset+eth.SizeUDPHeader : end]
+	if udpHeader.Checksum != 0 {
+		sum := udpHeader.CalculateChecksumIPv4(&ipHeader, payload)
+		if sum != udpHeader.Checksum && !(sum == 0 && udpHeader.Checksum == 0xffff) {
+			return true
+		}
+	}
+
+	dg := udpDatagram{
+		from: netip.AddrPortFrom(netip.AddrFrom4(ipHeader.Source), udpHeader.SourcePort),
+		data: append([]byte(nil), payload...),
+	}
+	select {
+	case c.rx <- dg:
+	default:
+		// Queue full: drop it, as UDP allows.
+	}
+	return true
+}
+
+// nextUDPFrame copies the next frame queued by sendUDP into buf, returning its
+// length, or zero if there's nothing to send.
+func (pn *PicoNet) nextUDPFrame(buf []byte) int {
+	select {
+	case frame := <-pn.udpTx:
+		return copy(buf, frame)
+	default:
+		return 0
+	}
+}
+
+// subnetBroadcast returns the broadcast address of subnet, or an invalid
+// address if subnet is not a valid IPv4 prefix.
+func subnetBroadcast(subnet netip.Prefix) netip.Addr {
+	if !subnet.IsValid() || !subnet.Addr().Is4() {
+		return netip.Addr{}
+	}
+	a := subnet.Masked().Addr().As4()
+	host := ^uint32(0) >> subnet.Bits()
+	binary.BigEndian.PutUint32(a[:], binary.BigEndian.Uint32(a[:])|host)
+	return netip.AddrFrom4(a)
+}
+
+// multicastMAC returns the Ethernet address IPv4 multicast group is mapped to:
+// 01:00:5e followed by the lower 23 bits of the group address.
+func multicastMAC(group netip.Addr) [6]byte {
+	a := group.As4()
+	return [6]byte{0x01, 0x00, 0x5e, a[1] & 0x7f, a[2], a[3]}
+}
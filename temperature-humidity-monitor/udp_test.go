@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// datagram is a datagram written to a datagramRecorder.
+type datagram struct {
+	to   netip.AddrPort
+	data []byte
+}
+
+// datagramRecorder is a net.PacketConn that records what's written to it, and
+// never receives anything. The mDNS and CoAP servers' tests give it to them
+// instead of a UDPConn.
+type datagramRecorder struct {
+	net.PacketConn
+	mutex sync.Mutex
+	sent  []datagram
+}
+
+func (c *datagramRecorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = append(c.sent, datagram{addr.(*net.UDPAddr).AddrPort(), append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// take returns what was sent since the last call.
+func (c *datagramRecorder) take() []datagram {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sent := c.sent
+	c.sent = nil
+	return sent
+}
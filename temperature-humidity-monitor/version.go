@@ -0,0 +1,10 @@
+package main
+
+import "simple-minded-home/thm/internal/httpwire"
+
+// firmwareVersion is the version of this firmware.
+const firmwareVersion = "1.0"
+
+func init() {
+	httpwire.UserAgent = "simple-minded-home-thm/" + firmwareVersion
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//
+// Sending readings to a webhook: POSTing them as JSON to whatever URL the
+// settings say, like a Home Assistant webhook trigger or a script of our own.
+// The body looks like this:
+//
+//	{
+//	  "device": "smh-a1b2c3",
+//	  "location": "Living room",
+//	  "readings": [
+//	    {"time": "2024-05-01T12:00:00.000Z", "temperature_c": 21.3, "humidity_pct": 45.1, "flags": []}
+//	  ]
+//	}
+//
+// The time is null when the clock isn't synchronized yet. When the webhook is
+// unreachable for a while, the readings piling up meanwhile are sent together.
+//
+
+// webhookRetry tells how long to wait before trying again after failed
+// deliveries.
+var webhookRetry = RetryPolicy{InitialBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}
+
+// webhookTimeout is how long each request to the webhook can take.
+const webhookTimeout = 10 * time.Second
+
+// webhookSink POSTs readings to a webhook, when the report policy says they
+// are worth it.
+//
+// Not safe for concurrent use; it belongs to its sinkRunner.
+type webhookSink struct {
+	// pn is the network, and url where to POST the readings.
+	pn  *PicoNet
+	url string
+
+	// device and location identify the readings.
+	device   string
+	location string
+
+	// reporter decides which readings are worth sending.
+	reporter *readingReporter
+}
+
+// newWebhookSink returns the webhook sink, if the settings have a webhook URL.
+func newWebhookSink(env sinkEnv) (telemetrySink, error) {
+	if env.settings.WebhookURL == "" {
+		return nil, nil
+	}
+	mac := env.pn.HardwareAddr()
+	s := &webhookSink{
+		pn:       env.pn,
+		url:      env.settings.WebhookURL,
+		device:   deviceID(mac),
+		location: env.settings.locationName(mac),
+		reporter: newReadingReporter(env.settings.reportPolicies()),
+	}
+	config := sinkConfig{Retry: webhookRetry, Timeout: webhookTimeout}
+	return newSinkRunner(env.logger, env.pn, s, config), nil
+}
+
+func (s *webhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) Collect(queue []telemetryReading, r telemetryReading) []telemetryReading {
+	if !s.reporter.due(r.Now, r.Reading) {
+		return queue
+	}
+	s.reporter.markReported(r.Now, r.Reading)
+	return append(queue, r)
+}
+
+func (s *webhookSink) Deliver(ctx context.Context, readings []telemetryReading) error {
+	res, err := s.pn.Post(ctx, s.url, "application/json", s.appendBody(nil, readings))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: %d from %s", errUnexpectedStatus, res.StatusCode, s.url)
+	}
+	return nil
+}
+
+// appendBody appends to dst the JSON body for sending readings.
+func (s *webhookSink) appendBody(dst []byte, readings []telemetryReading) []byte {
+	w := jsonWriter{buf: dst}
+	w.beginObject()
+	w.key("device")
+	w.string(s.device)
+	w.key("location")
+	w.string(s.location)
+	w.key("readings")
+	w.beginArray()
+	for _, r := range readings {
+		w.beginObject()
+		w.key("time")
+		if r.Clock.synced {
+			w.time(r.Clock.at(r.Time))
+		} else {
+			w.null()
+		}
+		w.key("temperature_c")
+		w.float(float64(r.Temperature), -1)
+		w.key("humidity_pct")
+		w.float(float64(r.Humidity), -1)
+		w.key("flags")
+		w.beginArray()
+		for _, name := range r.Flags.Names() {
+			w.string(name)
+		}
+		w.endArray()
+		w.endObject()
+	}
+	w.endArray()
+	w.endObject()
+	return w.Bytes()
+}